@@ -2,12 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/xml"
 	"flag"
 	"log"
 	"net/http"
 
 	"github.com/pressly/saml"
-	"github.com/pkg/errors"
 	"github.com/pressly/chi"
 
 	"time"
@@ -33,6 +33,7 @@ var (
 const (
 	metadataPath = "/metadata.xml"
 	ssoPath      = "/idp/sso"
+	sloPath      = "/idp/slo"
 	initiatePath = "/idp/initiate"
 )
 
@@ -52,99 +53,45 @@ var (
 	identityProvider saml.IdentityProvider
 )
 
-func spInitiatedLogin(w http.ResponseWriter, r *http.Request) {
-	sess, err := authFn(w, r)
-	if err != nil {
-		http.Error(w, errors.Wrap(err, "failed to authenticate user").Error(), 500)
-		return
-	}
-
-	ctx := r.Context()
-	relayState := ctx.Value("relayState").(string)
-	samlRequest := ctx.Value("samlRequest").(string)
-
-	samlResponse, err := identityProvider.GenerateResponse(samlRequest, relayState, sess, r.RemoteAddr)
-	if err != nil {
-		http.Error(w, errors.Wrap(err, "failed to process saml request").Error(), 500)
-		return
-	}
-
-	w.Header().Set("Content-Type", "text/html")
-	w.Write(samlResponse)
-}
-
-func redirectBindingCtx(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		values := r.URL.Query()
-		ctx = context.WithValue(ctx, "relayState", values.Get("RelayState"))
-		ctx = context.WithValue(ctx, "samlRequest", values.Get("SAMLRequest"))
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
-
-func postBindingCtx(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, errors.Wrap(err, "failed to parse form").Error(), 400)
-			return
-		}
-		ctx = context.WithValue(ctx, "relayState", r.Form.Get("RelayState"))
-		ctx = context.WithValue(ctx, "samlRequest", r.Form.Get("SAMLRequest"))
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
-
 // authFn validates user credentials and creates a
 // saml.Session.
 func authFn(w http.ResponseWriter, r *http.Request) (*saml.Session, error) {
 	user, pass, ok := r.BasicAuth()
-	if ok {
-		for _, u := range validUsers {
-			if u.loginHandler == user && u.Password == pass {
-				sess := &saml.Session{
-					UserID:       "anakin",
-					UserEmail:    "anakin@example.org",
-					UserFullname: "Anakin Skywalker",
-					CreateTime:   time.Now(),
-				}
-				return sess, nil
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="IdP credentials"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+		return nil, nil
+	}
+
+	for _, u := range validUsers {
+		if u.loginHandler == user && u.Password == pass {
+			sess := &saml.Session{
+				UserID:       "anakin",
+				UserEmail:    "anakin@example.org",
+				UserFullname: "Anakin Skywalker",
+				CreateTime:   time.Now(),
 			}
+			return sess, nil
 		}
 	}
 
-	w.Header().Set("WWW-Authenticate", `Basic realm="IdP credentials"`)
-	w.WriteHeader(http.StatusUnauthorized)
-	w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
-
-	return nil, errors.New("Failed to authenticate user.")
+	return nil, saml.NewAuthnFailedError("invalid credentials")
 }
 
-// initiateLogin creates a message for the SP.
+// initiateLogin logs the user in to the SP chosen in the login form.
 func initiateLogin(idp *saml.IdentityProvider) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-
-		spMetadataURL := r.Form.Get("metadata_url")
-		if spMetadataURL == "" {
-			log.Printf("Missing metadata_url")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		ctx := r.Context()
-		if flagRelayState != nil {
-			ctx = context.WithValue(ctx, "saml.RelayState", *flagRelayState)
-		}
-
-		req, err := idp.NewLoginRequest(spMetadataURL, authFn)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		spEntityID := r.FormValue("sp")
+		if spEntityID == "" {
+			log.Printf("Missing sp")
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		req.PostForm(w, r.WithContext(ctx))
+		idp.InitiateSSO(w, r, spEntityID, saml.InitiateSSOOptions{
+			RelayState: *flagRelayState,
+		})
 	}
 }
 
@@ -158,7 +105,7 @@ func displayLoginForm(w http.ResponseWriter, r *http.Request) {
 		<body>
 			<h2>Select SP</h2>
 			<form action="` + *flagPublicURL + initiatePath + `">
-				<select name="metadata_url">
+				<select name="sp">
 					<option value="">(Choose one)</option>
 					<option value="` + *flagMetadataURL + `">` + *flagMetadataURL + `</option>
 				</select>
@@ -171,6 +118,30 @@ func displayLoginForm(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(loginForm))
 }
 
+// spRegistry trusts the test SP, whose metadata is fetched from url. Real
+// deployments should rather use a signed aggregate, see
+// saml.AggregateServiceProviderRegistry.
+type spRegistry struct {
+	url string
+}
+
+func (registry *spRegistry) GetServiceProvider(ctx context.Context, entityID string) (*saml.Metadata, error) {
+	if entityID != registry.url {
+		return nil, saml.ErrUnknownServiceProvider
+	}
+	res, err := http.Get(registry.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var metadata saml.Metadata
+	if err := xml.NewDecoder(res.Body).Decode(&metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
 func logHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("URL: %s", r.URL.String())
@@ -221,9 +192,13 @@ func main() {
 
 		MetadataURL: *flagPublicURL + metadataPath,
 		SSOURL:      *flagPublicURL + ssoPath,
+		SLOURL:      *flagPublicURL + sloPath,
+
+		ServiceProviders: &spRegistry{url: *flagMetadataURL},
+		EntityID:         *flagEntityID,
 
-		SPMetadataURL: *flagMetadataURL,
-		EntityID:      *flagEntityID,
+		Sessions:      &saml.MemorySessionStore{},
+		Authenticator: authFn,
 
 		SecurityOpts: saml.SecurityOpts{
 			AllowSelfSignedCert: true,
@@ -233,7 +208,10 @@ func main() {
 	r := chi.NewRouter()
 	r.Use(logHandler)
 
-	r.Get(metadataPath, identityProvider.MetadataHandler)
+	idpHandler := identityProvider.Handler()
+	r.Get(metadataPath, idpHandler.ServeHTTP)
+	r.Get(sloPath, idpHandler.ServeHTTP)
+	r.Post(sloPath, idpHandler.ServeHTTP)
 
 	log.Printf("Test IdP server listening at %s (%s)", *flagListenAddr, *flagPublicURL)
 	switch *flagInitiatedBy {
@@ -242,8 +220,8 @@ func main() {
 		r.Get(initiatePath, initiateLogin(&identityProvider))
 		log.Printf("Go to %s to begin the IdP initiated login.", *flagPublicURL)
 	case "sp":
-		r.With(redirectBindingCtx).Get(ssoPath, spInitiatedLogin)
-		r.With(postBindingCtx).Post(ssoPath, spInitiatedLogin)
+		r.Get(ssoPath, idpHandler.ServeHTTP)
+		r.Post(ssoPath, idpHandler.ServeHTTP)
 	}
 
 	log.Fatal(http.ListenAndServe(*flagListenAddr, r))
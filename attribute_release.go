@@ -0,0 +1,233 @@
+package saml
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Keys under which the fixed fields of a Session are available to an
+// AttributeReleasePolicy, unless Session.Attributes holds the same key.
+const (
+	SessionUserID         = "UserID"
+	SessionUserName       = "UserName"
+	SessionUserEmail      = "UserEmail"
+	SessionUserFullname   = "UserFullname"
+	SessionUserCommonName = "UserCommonName"
+	SessionUserSurname    = "UserSurname"
+	SessionUserGivenName  = "UserGivenName"
+	SessionGroups         = "Groups"
+)
+
+// Attribute name formats.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 8.2
+const (
+	AttributeNameFormatUnspecified = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+	AttributeNameFormatURI         = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	AttributeNameFormatBasic       = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+)
+
+// AttributeValues returns the values of the given session attribute, looking
+// at Attributes first and then at the fixed fields of the session.
+func (session *Session) AttributeValues(key string) []string {
+	if values, ok := session.Attributes[key]; ok {
+		return values
+	}
+
+	single := func(value string) []string {
+		if value == "" {
+			return nil
+		}
+		return []string{value}
+	}
+
+	switch key {
+	case SessionUserID:
+		return single(session.UserID)
+	case SessionUserName:
+		return single(session.UserName)
+	case SessionUserEmail:
+		return single(session.UserEmail)
+	case SessionUserFullname:
+		return single(session.UserFullname)
+	case SessionUserCommonName:
+		return single(session.UserCommonName)
+	case SessionUserSurname:
+		return single(session.UserSurname)
+	case SessionUserGivenName:
+		return single(session.UserGivenName)
+	case SessionGroups:
+		return session.Groups
+	}
+	return nil
+}
+
+// AttributeReleasePolicy decides which attributes of a session are released
+// to a SP, and how.
+type AttributeReleasePolicy interface {
+	// ReleaseAttributes returns the attributes of the session sent to the SP
+	// described by the given metadata.
+	ReleaseAttributes(session *Session, sp *Metadata) ([]Attribute, error)
+}
+
+// AttributeReleaseFunc is an adapter to use a function as an
+// AttributeReleasePolicy.
+type AttributeReleaseFunc func(session *Session, sp *Metadata) ([]Attribute, error)
+
+// ReleaseAttributes implements AttributeReleasePolicy.
+func (fn AttributeReleaseFunc) ReleaseAttributes(session *Session, sp *Metadata) ([]Attribute, error) {
+	return fn(session, sp)
+}
+
+// AttributeTransform rewrites the values of an attribute before it is
+// released. An attribute left without values is not released.
+type AttributeTransform func(values []string) ([]string, error)
+
+// AttributeMapping describes how a session attribute is released.
+type AttributeMapping struct {
+	// Key of the attribute in the session, see Session.AttributeValues
+	Source string
+
+	// Name, NameFormat and FriendlyName of the released attribute
+	Name         string
+	NameFormat   string
+	FriendlyName string
+
+	// Transforms applied, in order, to the values of the attribute
+	Transforms []AttributeTransform
+}
+
+// MappingAttributeReleasePolicy is an AttributeReleasePolicy that releases the
+// session attributes listed in Mappings, in that order, and nothing else.
+type MappingAttributeReleasePolicy struct {
+	Mappings []AttributeMapping
+}
+
+// ReleaseAttributes implements AttributeReleasePolicy.
+func (policy *MappingAttributeReleasePolicy) ReleaseAttributes(session *Session, sp *Metadata) ([]Attribute, error) {
+	attributes := []Attribute{}
+	for _, mapping := range policy.Mappings {
+		values := session.AttributeValues(mapping.Source)
+		for _, transform := range mapping.Transforms {
+			if len(values) == 0 {
+				break
+			}
+			var err error
+			if values, err = transform(values); err != nil {
+				return nil, err
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		attr := Attribute{
+			FriendlyName: mapping.FriendlyName,
+			Name:         mapping.Name,
+			NameFormat:   mapping.NameFormat,
+		}
+		for _, value := range values {
+			attr.Values = append(attr.Values, AttributeValue{
+				Type:  "xs:string",
+				Value: value,
+			})
+		}
+		attributes = append(attributes, attr)
+	}
+	return attributes, nil
+}
+
+// LowercaseTransform lowercases the values of an attribute.
+func LowercaseTransform(values []string) ([]string, error) {
+	out := make([]string, len(values))
+	for i, value := range values {
+		out[i] = strings.ToLower(value)
+	}
+	return out, nil
+}
+
+// ScopeTransform returns a transform that appends "@scope" to the values of
+// an attribute, as expected by scoped attributes like eduPersonPrincipalName.
+func ScopeTransform(scope string) AttributeTransform {
+	return func(values []string) ([]string, error) {
+		out := make([]string, len(values))
+		for i, value := range values {
+			out[i] = value + "@" + scope
+		}
+		return out, nil
+	}
+}
+
+// RegexpTransform returns a transform that replaces the matches of re in the
+// values of an attribute with repl, see regexp.Regexp.ReplaceAllString.
+// Values left empty are dropped.
+func RegexpTransform(re *regexp.Regexp, repl string) AttributeTransform {
+	return func(values []string) ([]string, error) {
+		var out []string
+		for _, value := range values {
+			if value = re.ReplaceAllString(value, repl); value != "" {
+				out = append(out, value)
+			}
+		}
+		return out, nil
+	}
+}
+
+// LegacyAttributeReleasePolicy releases the fixed fields of the session under
+// the names used by earlier versions of this package. It is used for SPs whose
+// policy does not set an AttributeReleasePolicy.
+var LegacyAttributeReleasePolicy AttributeReleasePolicy = &MappingAttributeReleasePolicy{
+	Mappings: []AttributeMapping{
+		{
+			Source:       SessionUserName,
+			FriendlyName: "uid",
+			Name:         "urn:oid:0.9.2342.19200300.100.1.1",
+			NameFormat:   AttributeNameFormatURI,
+		},
+		{
+			Source:       SessionUserEmail,
+			FriendlyName: "eduPersonPrincipalName",
+			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+			NameFormat:   AttributeNameFormatURI,
+		},
+		{
+			Source:       SessionUserSurname,
+			FriendlyName: "sn",
+			Name:         "urn:oid:2.5.4.4",
+			NameFormat:   AttributeNameFormatURI,
+		},
+		{
+			Source:       SessionUserGivenName,
+			FriendlyName: "givenName",
+			Name:         "urn:oid:2.5.4.42",
+			NameFormat:   AttributeNameFormatURI,
+		},
+		{
+			Source:       SessionUserCommonName,
+			FriendlyName: "cn",
+			Name:         "urn:oid:2.5.4.3",
+			NameFormat:   AttributeNameFormatURI,
+		},
+		{
+			Source:       SessionUserID,
+			FriendlyName: "MASTUsername",
+			Name:         "userid",
+		},
+		{
+			Source:       SessionUserEmail,
+			FriendlyName: "MASTEmail",
+			Name:         "email",
+		},
+		{
+			Source:       SessionUserFullname,
+			FriendlyName: "MASTName",
+			Name:         "fullname",
+		},
+		{
+			Source:       SessionGroups,
+			FriendlyName: "eduPersonAffiliation",
+			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
+			NameFormat:   AttributeNameFormatURI,
+		},
+	},
+}
@@ -0,0 +1,94 @@
+package saml
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLegacyAttributeReleasePolicy(t *testing.T) {
+	session := &Session{
+		UserID:       "anakin",
+		UserName:     "askywalker",
+		UserEmail:    "anakin@example.org",
+		UserFullname: "Anakin Skywalker",
+		Groups:       []string{"jedi", "sith"},
+	}
+
+	attributes, err := LegacyAttributeReleasePolicy.ReleaseAttributes(session, nil)
+	assert.NoError(t, err)
+
+	var names []string
+	for _, attr := range attributes {
+		names = append(names, attr.FriendlyName)
+	}
+	assert.Equal(t, []string{"uid", "eduPersonPrincipalName", "MASTUsername", "MASTEmail", "MASTName", "eduPersonAffiliation"}, names)
+	assert.Equal(t, []AttributeValue{{Type: "xs:string", Value: "jedi"}, {Type: "xs:string", Value: "sith"}}, attributes[5].Values)
+}
+
+func TestAttributeReleasePolicy(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.SPPolicies = map[string]*ServiceProviderPolicy{
+		testSP.MetadataURL: {
+			AttributeRelease: &MappingAttributeReleasePolicy{
+				Mappings: []AttributeMapping{
+					{
+						Source:       "login",
+						Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+						NameFormat:   AttributeNameFormatURI,
+						FriendlyName: "eduPersonPrincipalName",
+						Transforms:   []AttributeTransform{LowercaseTransform, ScopeTransform("example.org")},
+					},
+					{
+						Source:     SessionGroups,
+						Name:       "memberOf",
+						NameFormat: AttributeNameFormatBasic,
+						Transforms: []AttributeTransform{RegexpTransform(regexp.MustCompile(`^staff-`), "")},
+					},
+					{
+						Source: "missing",
+						Name:   "missing",
+					},
+				},
+			},
+		},
+	}
+
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	req := &IdpAuthnRequest{
+		IDP:                     idp,
+		Request:                 *authnRequest,
+		ServiceProviderMetadata: spMetadata,
+	}
+	err = req.MakeAssertion(&Session{
+		CreateTime: Now(),
+		UserEmail:  "anakin@example.org",
+		Groups:     []string{"staff-", "staff-pilots"},
+		Attributes: map[string][]string{
+			"login": {"ASkywalker"},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Attribute{
+		{
+			FriendlyName: "eduPersonPrincipalName",
+			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+			NameFormat:   AttributeNameFormatURI,
+			Values:       []AttributeValue{{Type: "xs:string", Value: "askywalker@example.org"}},
+		},
+		{
+			Name:       "memberOf",
+			NameFormat: AttributeNameFormatBasic,
+			Values:     []AttributeValue{{Type: "xs:string", Value: "pilots"}},
+		},
+	}, req.Assertion.AttributeStatement.Attributes)
+}
@@ -0,0 +1,159 @@
+package saml
+
+import (
+	"context"
+	"fmt"
+)
+
+// Authentication context classes.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-authn-context-2.0-os.pdf section 3.4
+const (
+	AuthnContextUnspecified                = "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified"
+	AuthnContextPassword                   = "urn:oasis:names:tc:SAML:2.0:ac:classes:Password"
+	AuthnContextPasswordProtectedTransport = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	AuthnContextKerberos                   = "urn:oasis:names:tc:SAML:2.0:ac:classes:Kerberos"
+	AuthnContextTLSClient                  = "urn:oasis:names:tc:SAML:2.0:ac:classes:TLSClient"
+	AuthnContextX509                       = "urn:oasis:names:tc:SAML:2.0:ac:classes:X509"
+	AuthnContextTimeSyncToken              = "urn:oasis:names:tc:SAML:2.0:ac:classes:TimeSyncToken"
+	AuthnContextSmartcardPKI               = "urn:oasis:names:tc:SAML:2.0:ac:classes:SmartcardPKI"
+
+	// Multi-factor authentication, as defined by REFEDS
+	AuthnContextREFEDSMFA = "https://refeds.org/profile/mfa"
+)
+
+// DefaultAuthnContextStrength ranks the authentication context classes, the
+// higher the stronger, when IdentityProvider.AuthnContextStrength is nil.
+var DefaultAuthnContextStrength = map[string]int{
+	AuthnContextUnspecified:                0,
+	AuthnContextPassword:                   1,
+	AuthnContextPasswordProtectedTransport: 2,
+	AuthnContextKerberos:                   3,
+	AuthnContextTLSClient:                  3,
+	AuthnContextX509:                       3,
+	AuthnContextTimeSyncToken:              4,
+	AuthnContextSmartcardPKI:               4,
+	AuthnContextREFEDSMFA:                  4,
+}
+
+// AuthnMethod describes how the user of a session authenticated, see
+// Session.AuthnMethods.
+type AuthnMethod struct {
+	// Authentication context class, such as AuthnContextX509
+	ClassRef string
+
+	// Optional URI of the authentication context declaration
+	DeclRef string
+}
+
+// defaultAuthnMethod is the method of the sessions that list none.
+var defaultAuthnMethod = AuthnMethod{ClassRef: AuthnContextPasswordProtectedTransport}
+
+// authnContextStrength returns the rank of the given authentication context
+// class, and whether the IdP knows it.
+func (idp *IdentityProvider) authnContextStrength(classRef string) (int, bool) {
+	strength := idp.AuthnContextStrength
+	if strength == nil {
+		strength = DefaultAuthnContextStrength
+	}
+	rank, ok := strength[classRef]
+	return rank, ok
+}
+
+// AuthnMethod returns the method of the session the assertion is issued for:
+// the strongest of those satisfying the RequestedAuthnContext of the request,
+// if any. Classes the IdP does not rank only satisfy exact comparisons, and
+// declarations are only compared for equality. A request the session cannot
+// satisfy yields a NoAuthnContext *StatusError.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.3.2.2.1
+func (req *IdpAuthnRequest) AuthnMethod(session *Session) (*AuthnMethod, error) {
+	methods := session.AuthnMethods
+	if len(methods) == 0 {
+		methods = []AuthnMethod{defaultAuthnMethod}
+	}
+
+	var best *AuthnMethod
+	bestRank := -1
+	for i := range methods {
+		ok, err := req.satisfiesAuthnContext(methods[i])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		// Later methods win ties, they are likely the result of a step-up.
+		rank, _ := req.IDP.authnContextStrength(methods[i].ClassRef)
+		if best == nil || rank >= bestRank {
+			best, bestRank = &methods[i], rank
+		}
+	}
+
+	if best == nil {
+		return nil, &StatusError{
+			Code:    StatusResponder,
+			SubCode: StatusNoAuthnContext,
+		}
+	}
+	return best, nil
+}
+
+// satisfiesAuthnContext reports whether the given method satisfies the
+// RequestedAuthnContext of the request.
+func (req *IdpAuthnRequest) satisfiesAuthnContext(method AuthnMethod) (bool, error) {
+	requested := req.Request.RequestedAuthnContext
+	if requested == nil || (len(requested.AuthnContextClassRef) == 0 && len(requested.AuthnContextDeclRef) == 0) {
+		return true, nil
+	}
+
+	comparison := requested.Comparison
+	if comparison == "" {
+		comparison = AuthnContextComparisonExact
+	}
+	switch comparison {
+	case AuthnContextComparisonExact, AuthnContextComparisonMinimum, AuthnContextComparisonBetter, AuthnContextComparisonMaximum:
+	default:
+		return false, &StatusError{
+			Code:    StatusRequester,
+			Message: fmt.Sprintf("unsupported authn context comparison %q", comparison),
+		}
+	}
+
+	if len(requested.AuthnContextDeclRef) > 0 {
+		return method.DeclRef != "" && contains(requested.AuthnContextDeclRef, method.DeclRef), nil
+	}
+
+	if comparison == AuthnContextComparisonExact {
+		return contains(requested.AuthnContextClassRef, method.ClassRef), nil
+	}
+
+	rank, ok := req.IDP.authnContextStrength(method.ClassRef)
+	if !ok {
+		return false, nil
+	}
+	for _, classRef := range requested.AuthnContextClassRef {
+		requestedRank, ok := req.IDP.authnContextStrength(classRef)
+		if !ok {
+			continue
+		}
+		switch {
+		case comparison == AuthnContextComparisonMinimum && rank >= requestedRank,
+			comparison == AuthnContextComparisonBetter && rank > requestedRank,
+			comparison == AuthnContextComparisonMaximum && rank <= requestedRank:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type authnRequestKey struct{}
+
+// AuthnRequestFromContext returns the AuthnRequest an Authenticator is called
+// for, found in the context of its HTTP request. It lets the Authenticator
+// look at the RequestedAuthnContext, for instance to step up the
+// authentication of a user who already has an SSO session.
+func AuthnRequestFromContext(ctx context.Context) *IdpAuthnRequest {
+	req, _ := ctx.Value(authnRequestKey{}).(*IdpAuthnRequest)
+	return req
+}
@@ -0,0 +1,181 @@
+package saml
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthnMethod(t *testing.T) {
+	tearUp()
+
+	password := AuthnMethod{ClassRef: AuthnContextPasswordProtectedTransport}
+	x509 := AuthnMethod{ClassRef: AuthnContextX509, DeclRef: "https://idp.example.com/decl/x509"}
+	mfa := AuthnMethod{ClassRef: AuthnContextREFEDSMFA}
+	custom := AuthnMethod{ClassRef: "https://idp.example.com/ac/custom"}
+
+	tests := []struct {
+		methods   []AuthnMethod
+		requested *RequestedAuthnContext
+		expected  *AuthnMethod
+	}{
+		{nil, nil, &defaultAuthnMethod},
+		{[]AuthnMethod{mfa, password}, nil, &mfa},
+		{[]AuthnMethod{password, x509}, &RequestedAuthnContext{
+			AuthnContextClassRef: []string{AuthnContextPasswordProtectedTransport},
+		}, &password},
+		{[]AuthnMethod{password}, &RequestedAuthnContext{
+			AuthnContextClassRef: []string{AuthnContextX509},
+		}, nil},
+		{[]AuthnMethod{custom}, &RequestedAuthnContext{
+			AuthnContextClassRef: []string{custom.ClassRef},
+		}, &custom},
+		{[]AuthnMethod{password, x509}, &RequestedAuthnContext{
+			Comparison:           AuthnContextComparisonMinimum,
+			AuthnContextClassRef: []string{AuthnContextPassword},
+		}, &x509},
+		{[]AuthnMethod{password}, &RequestedAuthnContext{
+			Comparison:           AuthnContextComparisonMinimum,
+			AuthnContextClassRef: []string{AuthnContextTLSClient},
+		}, nil},
+		{[]AuthnMethod{custom}, &RequestedAuthnContext{
+			Comparison:           AuthnContextComparisonMinimum,
+			AuthnContextClassRef: []string{AuthnContextPassword},
+		}, nil},
+		{[]AuthnMethod{password, x509}, &RequestedAuthnContext{
+			Comparison:           AuthnContextComparisonBetter,
+			AuthnContextClassRef: []string{AuthnContextKerberos},
+		}, nil},
+		{[]AuthnMethod{password, mfa}, &RequestedAuthnContext{
+			Comparison:           AuthnContextComparisonBetter,
+			AuthnContextClassRef: []string{AuthnContextKerberos},
+		}, &mfa},
+		{[]AuthnMethod{password, x509, mfa}, &RequestedAuthnContext{
+			Comparison:           AuthnContextComparisonMaximum,
+			AuthnContextClassRef: []string{AuthnContextKerberos},
+		}, &x509},
+		{[]AuthnMethod{password, x509}, &RequestedAuthnContext{
+			AuthnContextDeclRef: []string{x509.DeclRef},
+		}, &x509},
+	}
+
+	idp := &IdentityProvider{}
+	for i, test := range tests {
+		req := &IdpAuthnRequest{IDP: idp}
+		req.Request.RequestedAuthnContext = test.requested
+
+		method, err := req.AuthnMethod(&Session{AuthnMethods: test.methods})
+		if test.expected == nil {
+			assert.Equal(t, &StatusError{Code: StatusResponder, SubCode: StatusNoAuthnContext}, err, "test %d", i)
+			continue
+		}
+		assert.NoError(t, err, "test %d", i)
+		assert.Equal(t, test.expected, method, "test %d", i)
+	}
+
+	req := &IdpAuthnRequest{IDP: idp}
+	req.Request.RequestedAuthnContext = &RequestedAuthnContext{
+		Comparison:           "stronger",
+		AuthnContextClassRef: []string{AuthnContextPassword},
+	}
+	_, err := req.AuthnMethod(&Session{})
+	assert.EqualError(t, err, StatusRequester+`: unsupported authn context comparison "stronger"`)
+}
+
+func TestMakeAssertionAuthnContext(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+	req := &IdpAuthnRequest{
+		IDP:                     idp,
+		Request:                 *authnRequest,
+		ServiceProviderMetadata: spMetadata,
+	}
+
+	session := &Session{
+		CreateTime: Now(),
+		UserEmail:  "anakin@example.org",
+		AuthnMethods: []AuthnMethod{
+			{ClassRef: AuthnContextSmartcardPKI, DeclRef: "https://idp.example.com/decl/smartcard"},
+		},
+		SPSessionMaxAge: time.Hour,
+	}
+	assert.NoError(t, req.MakeAssertion(session))
+
+	statement := req.Assertion.AuthnStatement
+	assert.Equal(t, &AuthnContextClassRef{Value: AuthnContextSmartcardPKI}, statement.AuthnContext.AuthnContextClassRef)
+	assert.Equal(t, &AuthnContextDeclRef{Value: "https://idp.example.com/decl/smartcard"}, statement.AuthnContext.AuthnContextDeclRef)
+	if assert.NotNil(t, statement.SessionNotOnOrAfter) {
+		assert.Equal(t, Now().Add(time.Hour), *statement.SessionNotOnOrAfter)
+	}
+}
+
+func TestAuthenticateStepUp(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.Sessions = &MemorySessionStore{}
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	var stepUps []*IdpAuthnRequest
+	authFn := func(w http.ResponseWriter, r *http.Request) (*Session, error) {
+		req := AuthnRequestFromContext(r.Context())
+		stepUps = append(stepUps, req)
+		session := &Session{UserID: "anakin", AuthnMethods: []AuthnMethod{{ClassRef: AuthnContextPasswordProtectedTransport}}}
+		if req != nil && req.Request.RequestedAuthnContext != nil {
+			session.AuthnMethods = append(session.AuthnMethods, AuthnMethod{ClassRef: AuthnContextREFEDSMFA})
+		}
+		return session, nil
+	}
+
+	newRequest := func(cookies []*http.Cookie, requested *RequestedAuthnContext) *IdpAuthnRequest {
+		r := httptest.NewRequest("GET", "/sso", nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		req := &IdpAuthnRequest{
+			IDP:                     idp,
+			HTTPRequest:             r,
+			ServiceProviderMetadata: spMetadata,
+		}
+		req.Request.RequestedAuthnContext = requested
+		return req
+	}
+
+	w := httptest.NewRecorder()
+	session, err := newRequest(nil, nil).Authenticate(w, authFn)
+	assert.NoError(t, err)
+	assert.NotNil(t, session)
+	assert.Len(t, stepUps, 1)
+	cookies := w.Result().Cookies()
+
+	mfa := &RequestedAuthnContext{AuthnContextClassRef: []string{AuthnContextREFEDSMFA}}
+
+	// A passive request gets the session as is.
+	req := newRequest(cookies, mfa)
+	req.Request.IsPassive = true
+	session, err = req.Authenticate(httptest.NewRecorder(), authFn)
+	assert.NoError(t, err)
+	assert.NotNil(t, session)
+	assert.Len(t, stepUps, 1)
+
+	req = newRequest(cookies, mfa)
+	session, err = req.Authenticate(httptest.NewRecorder(), authFn)
+	assert.NoError(t, err)
+	if assert.Len(t, stepUps, 2) {
+		assert.Equal(t, req, stepUps[1])
+	}
+	method, err := req.AuthnMethod(session)
+	assert.NoError(t, err)
+	assert.Equal(t, AuthnContextREFEDSMFA, method.ClassRef)
+}
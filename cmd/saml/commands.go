@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/pkg/errors"
+	"github.com/pressly/saml"
+	"github.com/pressly/saml/xmlsec"
+)
+
+// output is the result of a command.
+type output interface {
+	// write writes the result in a human-readable form.
+	write(w io.Writer) error
+}
+
+// print writes the result of the command, as JSON if asked to, and returns
+// status as the exit status.
+func (cmd *command) print(asJSON bool, out output, status int) int {
+	var err error
+	if asJSON {
+		err = writeJSON(cmd.stdout, out)
+	} else {
+		err = out.write(cmd.stdout)
+	}
+	if err != nil {
+		return cmd.fail(err)
+	}
+	return status
+}
+
+func runDecode(cmd *command, flags *flag.FlagSet, args []string) int {
+	asJSON := flags.Bool("json", false, "Print JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	msg, err := cmd.readMessage(flags)
+	if err != nil {
+		return cmd.fail(err)
+	}
+	return cmd.print(*asJSON, summarize(msg), 0)
+}
+
+func runDecrypt(cmd *command, flags *flag.FlagSet, args []string) int {
+	keyFile := flags.String("key", "", "SP private key, PEM file")
+	asJSON := flags.Bool("json", false, "Print JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *keyFile == "" {
+		flags.Usage()
+		return 2
+	}
+	msg, err := cmd.readMessage(flags)
+	if err != nil {
+		return cmd.fail(err)
+	}
+	if err := msg.decryptAssertion(*keyFile); err != nil {
+		fmt.Fprintf(cmd.stderr, "saml %s: %v\n", cmd.name, err)
+		return 1
+	}
+	return cmd.print(*asJSON, summarize(msg), 0)
+}
+
+// decryptAssertion replaces the content of the EncryptedAssertion of the
+// message, a Response, by the decrypted Assertion.
+func (msg *message) decryptAssertion(keyFile string) error {
+	el := msg.Doc.Root().SelectElement("EncryptedAssertion")
+	if el == nil {
+		return errors.New("no encrypted assertion")
+	}
+	plainText, err := decryptedAssertion(msg.XML, keyFile)
+	if err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(plainText); err != nil {
+		return errors.Wrap(err, "failed to parse decrypted assertion")
+	}
+	for len(el.Child) > 0 {
+		el.RemoveChildAt(0)
+	}
+	el.AddChild(doc.Root())
+	return nil
+}
+
+// decryptedAssertion returns the XML of the encrypted assertion of the given
+// Response, decrypted like ServiceProvider.AssertResponse does.
+func decryptedAssertion(responseXML []byte, keyFile string) ([]byte, error) {
+	var res saml.Response
+	if err := xml.Unmarshal(responseXML, &res); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal response")
+	}
+	if res.EncryptedAssertion == nil {
+		return nil, errors.New("no encrypted assertion")
+	}
+	plainText, err := xmlsec.Decrypt(res.EncryptedAssertion.EncryptedData, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt assertion")
+	}
+	return plainText, nil
+}
+
+// spFlags are the flags configuring the SP that checks the messages.
+type spFlags struct {
+	metadata              string
+	cert                  string
+	key                   string
+	idpEntityID           string
+	allowSelfSigned       bool
+	trustUnknownAuthority bool
+}
+
+func (f *spFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.metadata, "metadata", "", "IdP metadata, file or URL")
+	flags.StringVar(&f.cert, "cert", "", "IdP certificate, PEM file, instead of -metadata")
+	flags.StringVar(&f.key, "key", "", "SP private key, PEM file, to decrypt assertions")
+	flags.StringVar(&f.idpEntityID, "idp-entity-id", "", "Expected assertion issuer, the entity ID of -metadata by default")
+	flags.BoolVar(&f.allowSelfSigned, "allow-self-signed", false, "Accept a self-signed IdP certificate")
+	flags.BoolVar(&f.trustUnknownAuthority, "trust-unknown-authority", false, "Accept an IdP certificate issued by an unknown authority")
+}
+
+// serviceProvider returns the SP configured by the flags, which trusts the
+// IdP of -metadata or -cert.
+func (f *spFlags) serviceProvider() (*saml.ServiceProvider, error) {
+	sp := &saml.ServiceProvider{
+		KeyFile:     f.key,
+		IdPEntityID: f.idpEntityID,
+		SecurityOpts: saml.SecurityOpts{
+			AllowSelfSignedCert:   f.allowSelfSigned,
+			TrustUnknownAuthority: f.trustUnknownAuthority,
+		},
+	}
+
+	switch {
+	case f.metadata != "":
+		if strings.HasPrefix(f.metadata, "http://") || strings.HasPrefix(f.metadata, "https://") {
+			sp.IdPMetadataURL = f.metadata
+		} else {
+			buf, err := ioutil.ReadFile(f.metadata)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read idp metadata")
+			}
+			sp.IdPMetadataXML = buf
+		}
+		metadata, err := sp.ParseIdPMetadata()
+		if err != nil {
+			return nil, err
+		}
+		sp.IdPMetadata = metadata
+		sp.IdPPubkeyPEM = metadata.Cert()
+		if sp.IdPPubkeyPEM == "" {
+			return nil, errors.New("idp metadata holds no signing certificate")
+		}
+		if sp.IdPEntityID == "" {
+			sp.IdPEntityID = metadata.EntityID
+		}
+
+	case f.cert != "":
+		buf, err := ioutil.ReadFile(f.cert)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read idp certificate")
+		}
+		block, _ := pem.Decode(buf)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.Errorf("no PEM certificate in %s", f.cert)
+		}
+		sp.IdPPubkeyPEM = base64.StdEncoding.EncodeToString(block.Bytes)
+
+	default:
+		return nil, errors.New("either -metadata or -cert is required")
+	}
+	return sp, nil
+}
+
+// signatureCheck is the outcome of the verification of the signature of an
+// element.
+type signatureCheck struct {
+	Element string `json:"element"`
+	Signed  bool   `json:"signed"`
+	Valid   bool   `json:"valid"`
+	Error   string `json:"error,omitempty"`
+}
+
+// verifyResult is the result of the verify command.
+type verifyResult struct {
+	// Whether a signature covers the assertion, or the message, and all the
+	// signatures are valid
+	Valid      bool             `json:"valid"`
+	Signatures []signatureCheck `json:"signatures"`
+}
+
+func (result *verifyResult) write(w io.Writer) error {
+	tw := newTabWriter(w)
+	for _, check := range result.Signatures {
+		outcome := "valid"
+		switch {
+		case check.Error != "":
+			outcome = "invalid: " + check.Error
+		case !check.Signed:
+			outcome = "not signed"
+		}
+		writeField(tw, "", check.Element+" signature", outcome)
+	}
+	outcome := "valid"
+	if !result.Valid {
+		outcome = "invalid"
+	}
+	writeField(tw, "", "Result", outcome)
+	return tw.Flush()
+}
+
+func runVerify(cmd *command, flags *flag.FlagSet, args []string) int {
+	var f spFlags
+	f.register(flags)
+	asJSON := flags.Bool("json", false, "Print JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	sp, err := f.serviceProvider()
+	if err != nil {
+		return cmd.fail(err)
+	}
+	msg, err := cmd.readMessage(flags)
+	if err != nil {
+		return cmd.fail(err)
+	}
+	certFile, err := sp.GetIdPCertFile()
+	if err != nil {
+		return cmd.fail(err)
+	}
+
+	// The signatures are checked as ServiceProvider.AssertResponse does, on
+	// the message as sent and on the decrypted assertion.
+	verify := func(element string, signed bool, buf []byte) signatureCheck {
+		check := signatureCheck{Element: element, Signed: signed}
+		if !signed {
+			return check
+		}
+		err := xmlsec.Verify(buf, certFile, &xmlsec.ValidationOptions{})
+		if err != nil && saml.IsSecurityException(err, &sp.SecurityOpts) {
+			check.Error = err.Error()
+		} else {
+			check.Valid = true
+		}
+		return check
+	}
+
+	root := msg.Doc.Root()
+	result := &verifyResult{}
+	result.Signatures = append(result.Signatures, verify(root.Tag, root.SelectElement("Signature") != nil, msg.XML))
+	if el := root.SelectElement("Assertion"); el != nil {
+		result.Signatures = append(result.Signatures, verify("Assertion", el.SelectElement("Signature") != nil, msg.XML))
+	}
+	if root.SelectElement("EncryptedAssertion") != nil {
+		check := signatureCheck{Element: "Assertion"}
+		if f.key == "" {
+			check.Error = "encrypted, -key is required"
+		} else if plainText, err := decryptedAssertion(msg.XML, f.key); err != nil {
+			check.Error = err.Error()
+		} else {
+			doc := etree.NewDocument()
+			signed := doc.ReadFromBytes(plainText) == nil && doc.Root().SelectElement("Signature") != nil
+			check = verify("Assertion", signed, plainText)
+		}
+		result.Signatures = append(result.Signatures, check)
+	}
+
+	for _, check := range result.Signatures {
+		if check.Error != "" {
+			result.Valid = false
+			break
+		}
+		result.Valid = result.Valid || check.Valid
+	}
+	if !result.Valid {
+		return cmd.print(*asJSON, result, 1)
+	}
+	return cmd.print(*asJSON, result, 0)
+}
+
+// assertResult is the result of the assert command.
+type assertResult struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+
+	// Time and ACS URL the response was checked with
+	Now    string `json:"now"`
+	ACSURL string `json:"acs_url"`
+
+	Assertion *assertionSummary `json:"assertion,omitempty"`
+}
+
+func (result *assertResult) write(w io.Writer) error {
+	tw := newTabWriter(w)
+	outcome := "valid"
+	if !result.Valid {
+		outcome = "invalid: " + result.Error
+	}
+	writeField(tw, "", "Result", outcome)
+	writeField(tw, "", "Now", result.Now)
+	writeField(tw, "", "ACS URL", result.ACSURL)
+	if result.Assertion != nil {
+		fmt.Fprintln(tw, "Assertion:")
+		result.Assertion.writeFields(tw, "  ")
+	}
+	return tw.Flush()
+}
+
+func runAssert(cmd *command, flags *flag.FlagSet, args []string) int {
+	var f spFlags
+	f.register(flags)
+	acsURL := flags.String("acs", "", "SP assertion consumer service URL, the destination of the response by default")
+	now := flags.String("now", "", "Time the response is checked at, RFC 3339, the current time by default")
+	asJSON := flags.Bool("json", false, "Print JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	sp, err := f.serviceProvider()
+	if err != nil {
+		return cmd.fail(err)
+	}
+	sp.Now = saml.Now
+	if *now != "" {
+		t, err := time.Parse(time.RFC3339, *now)
+		if err != nil {
+			return cmd.fail(errors.Wrap(err, "invalid -now"))
+		}
+		sp.Now = func() time.Time {
+			return t
+		}
+	}
+	msg, err := cmd.readMessage(flags)
+	if err != nil {
+		return cmd.fail(err)
+	}
+
+	sp.ACSURL = *acsURL
+	if sp.ACSURL == "" {
+		sp.ACSURL = msg.Doc.Root().SelectAttrValue("Destination", "")
+	}
+	result := &assertResult{
+		Now:    sp.Now().UTC().Format(time.RFC3339),
+		ACSURL: sp.ACSURL,
+	}
+	assertion, err := sp.AssertResponse(base64.StdEncoding.EncodeToString(msg.XML))
+	if err != nil {
+		result.Error = err.Error()
+		return cmd.print(*asJSON, result, 1)
+	}
+	result.Valid = true
+	if buf, err := xml.Marshal(assertion); err == nil {
+		doc := etree.NewDocument()
+		if doc.ReadFromBytes(buf) == nil {
+			summary := summarizeAssertion(doc.Root())
+			result.Assertion = &summary
+		}
+	}
+	return cmd.print(*asJSON, result, 0)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/pkg/errors"
+)
+
+// maxMessageSize is the largest inflated message accepted, to stop
+// decompression bombs.
+const maxMessageSize = 10 << 20
+
+// Encodings removed from the input of the commands.
+const (
+	encodingURL     = "url"
+	encodingBase64  = "base64"
+	encodingDeflate = "deflate"
+)
+
+// message is a SAML message decoded from the input of a command.
+type message struct {
+	// Parameter the message was sent as, SAMLRequest or SAMLResponse. Guessed
+	// from the root element if the input is not a query.
+	Param string
+
+	RelayState string
+
+	// Encodings removed from the input, outermost first
+	Encodings []string
+
+	// XML of the message, as sent
+	XML []byte
+
+	// Parsed XML of the message
+	Doc *etree.Document
+}
+
+// decodeMessage decodes a SAML message from its XML, its base64 encoding,
+// deflated or not, or a URL, a query or a form body holding it.
+func decodeMessage(input []byte) (*message, error) {
+	msg := &message{}
+	s := strings.TrimSpace(string(input))
+
+	if !strings.HasPrefix(s, "<") {
+		var err error
+		if s, err = msg.decodeQuery(s); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.HasPrefix(s, "<") {
+		var err error
+		if msg.XML, err = msg.decodeBase64(s); err != nil {
+			return nil, err
+		}
+		if !isXML(msg.XML) {
+			if msg.XML, err = inflate(msg.XML); err != nil {
+				return nil, err
+			}
+			msg.Encodings = append(msg.Encodings, encodingDeflate)
+		}
+	} else {
+		msg.XML = []byte(s)
+	}
+
+	msg.Doc = etree.NewDocument()
+	if err := msg.Doc.ReadFromBytes(msg.XML); err != nil {
+		return nil, errors.Wrap(err, "failed to parse XML")
+	}
+	root := msg.Doc.Root()
+	if root == nil {
+		return nil, errors.New("empty XML document")
+	}
+	if msg.Param == "" {
+		msg.Param = "SAMLRequest"
+		if strings.HasSuffix(root.Tag, "Response") {
+			msg.Param = "SAMLResponse"
+		}
+	}
+	return msg, nil
+}
+
+// decodeQuery returns the message held by s if it is a URL, a query or a
+// form body, and s URL-decoded if it is URL-encoded.
+func (msg *message) decodeQuery(s string) (string, error) {
+	if !strings.Contains(s, "SAMLRequest=") && !strings.Contains(s, "SAMLResponse=") {
+		if !strings.Contains(s, "%") {
+			return s, nil
+		}
+		unescaped, err := url.QueryUnescape(s)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to URL-decode message")
+		}
+		msg.Encodings = append(msg.Encodings, encodingURL)
+		return unescaped, nil
+	}
+
+	if i := strings.Index(s, "?"); i >= 0 {
+		s = s[i+1:]
+	}
+	if i := strings.Index(s, "#"); i >= 0 {
+		s = s[:i]
+	}
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse query")
+	}
+	msg.Encodings = append(msg.Encodings, encodingURL)
+	msg.RelayState = values.Get("RelayState")
+	for _, param := range []string{"SAMLRequest", "SAMLResponse"} {
+		if value := values.Get(param); value != "" {
+			msg.Param = param
+			return value, nil
+		}
+	}
+	return "", errors.New("empty SAMLRequest or SAMLResponse parameter")
+}
+
+// decodeBase64 decodes s, which may be wrapped, use the URL alphabet or have
+// its + turned into spaces by a careless URL decoding.
+func (msg *message) decodeBase64(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ':
+			return '+'
+		case '\n', '\r', '\t':
+			return -1
+		}
+		return r
+	}, s)
+
+	var err error
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.RawStdEncoding,
+		base64.URLEncoding,
+		base64.RawURLEncoding,
+	} {
+		var buf []byte
+		if buf, err = encoding.DecodeString(s); err == nil {
+			msg.Encodings = append(msg.Encodings, encodingBase64)
+			return buf, nil
+		}
+	}
+	return nil, errors.Wrap(err, "failed to base64-decode message")
+}
+
+// inflate decompresses a message deflated by the HTTP-Redirect binding.
+func inflate(compressed []byte) ([]byte, error) {
+	flateReader := flate.NewReader(bytes.NewReader(compressed))
+	defer flateReader.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(flateReader, maxMessageSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "message is neither XML nor deflated XML")
+	}
+	if len(buf) > maxMessageSize {
+		return nil, errors.New("message is too large")
+	}
+	if !isXML(buf) {
+		return nil, errors.New("message is not XML once inflated")
+	}
+	return buf, nil
+}
+
+func isXML(buf []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(buf), []byte("<"))
+}
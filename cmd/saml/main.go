@@ -0,0 +1,115 @@
+// Command saml decodes and inspects SAML messages, to troubleshoot failed
+// logins without pasting them into websites.
+//
+// Usage:
+//
+//	saml decode [-json] [file]
+//	saml decrypt -key sp.key [-json] [file]
+//	saml verify (-metadata idp.xml | -cert idp.crt) [-key sp.key] [-json] [file]
+//	saml assert (-metadata idp.xml | -cert idp.crt) [-key sp.key] [-acs url] [-now time] [-json] [file]
+//
+// The message is read from the file, or from the standard input if none is
+// given or it is "-". It may be the XML of the message, its base64 encoding
+// as posted by the HTTP-POST binding, or a URL, a query string or a form body
+// holding a SAMLRequest or SAMLResponse parameter, deflated as sent by the
+// HTTP-Redirect binding or not.
+//
+// decode prints the main fields of the message and its indented XML. decrypt
+// prints the response with its encrypted assertion decrypted with the SP's
+// private key. verify checks the signatures of the response and of its
+// assertion against the IdP's certificate, read from its metadata or from a
+// PEM file. assert runs all the checks of ServiceProvider.AssertResponse,
+// optionally at the time given by -now instead of the current time.
+//
+// The output is human-readable, or JSON with -json. The exit status is 1 if
+// the message is rejected and 2 if it cannot be read.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// command is a subcommand, it returns the exit status.
+type command struct {
+	name  string
+	usage string
+	run   func(cmd *command, flags *flag.FlagSet, args []string) int
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var commands = []command{
+	{name: "decode", usage: "[-json] [file]", run: runDecode},
+	{name: "decrypt", usage: "-key sp.key [-json] [file]", run: runDecrypt},
+	{name: "verify", usage: "(-metadata idp.xml | -cert idp.crt) [-key sp.key] [-json] [file]", run: runVerify},
+	{name: "assert", usage: "(-metadata idp.xml | -cert idp.crt) [-key sp.key] [-acs url] [-now time] [-json] [file]", run: runAssert},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the subcommand named by the first argument and returns the exit
+// status.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) > 0 {
+		for _, cmd := range commands {
+			if cmd.name != args[0] {
+				continue
+			}
+			cmd.stdin, cmd.stdout, cmd.stderr = stdin, stdout, stderr
+			flags := flag.NewFlagSet("saml "+cmd.name, flag.ContinueOnError)
+			flags.SetOutput(stderr)
+			flags.Usage = func() {
+				fmt.Fprintf(stderr, "usage: saml %s %s\n", cmd.name, cmd.usage)
+				flags.PrintDefaults()
+			}
+			return cmd.run(&cmd, flags, args[1:])
+		}
+	}
+
+	fmt.Fprintln(stderr, "usage:")
+	for _, cmd := range commands {
+		fmt.Fprintf(stderr, "\tsaml %s %s\n", cmd.name, cmd.usage)
+	}
+	return 2
+}
+
+// fail reports an error that prevented the command from running, and returns
+// the exit status.
+func (cmd *command) fail(err error) int {
+	fmt.Fprintf(cmd.stderr, "saml %s: %v\n", cmd.name, err)
+	return 2
+}
+
+// readMessage reads and decodes the message named by the remaining arguments
+// of the command line.
+func (cmd *command) readMessage(flags *flag.FlagSet) (*message, error) {
+	var input []byte
+	var err error
+	switch flags.NArg() {
+	case 0:
+		input, err = ioutil.ReadAll(cmd.stdin)
+	case 1:
+		if flags.Arg(0) == "-" {
+			input, err = ioutil.ReadAll(cmd.stdin)
+		} else {
+			input, err = ioutil.ReadFile(flags.Arg(0))
+		}
+	default:
+		flags.Usage()
+		return nil, errors.New("too many arguments")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read message")
+	}
+	return decodeMessage(input)
+}
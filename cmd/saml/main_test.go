@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pressly/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+const testResponse = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="id-response" Version="2.0" IssueInstant="2017-03-04T05:06:07Z" Destination="https://sp.example.org/saml/acs" InResponseTo="id-request">
+<saml:Issuer>https://idp.example.org/metadata.xml</saml:Issuer>
+<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Responder"><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"/></samlp:StatusCode><samlp:StatusMessage>locked out</samlp:StatusMessage></samlp:Status>
+</samlp:Response>`
+
+func deflate(t *testing.T, buf []byte) []byte {
+	var out bytes.Buffer
+	w, err := flate.NewWriter(&out, flate.DefaultCompression)
+	assert.NoError(t, err)
+	w.Write(buf)
+	assert.NoError(t, w.Close())
+	return out.Bytes()
+}
+
+func TestDecodeMessage(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(testResponse))
+	deflated := base64.StdEncoding.EncodeToString(deflate(t, []byte(testResponse)))
+	// The + of the base64 alphabet, turned into spaces by a careless decoding
+	// of a form body.
+	withPlus := base64.StdEncoding.EncodeToString([]byte(testResponse + "\n<!-- >>>>>> -->"))
+	if !assert.Contains(t, withPlus, "+") {
+		return
+	}
+
+	tests := []struct {
+		Input      string
+		Encodings  []string
+		RelayState string
+		XML        string
+	}{
+		{Input: testResponse, XML: testResponse},
+		{Input: encoded, Encodings: []string{"base64"}, XML: testResponse},
+		{Input: encoded[:40] + "\n" + encoded[40:] + "\n", Encodings: []string{"base64"}, XML: testResponse},
+		{Input: url.QueryEscape(encoded), Encodings: []string{"url", "base64"}, XML: testResponse},
+		{Input: url.QueryEscape(testResponse), Encodings: []string{"url"}, XML: testResponse},
+		{
+			Input:      "https://sp.example.org/saml/slo?SAMLResponse=" + url.QueryEscape(deflated) + "&RelayState=%2Fhome",
+			Encodings:  []string{"url", "base64", "deflate"},
+			RelayState: "/home",
+			XML:        testResponse,
+		},
+		{
+			Input:     "RelayState=&SAMLResponse=" + withPlus,
+			Encodings: []string{"url", "base64"},
+			XML:       testResponse + "\n<!-- >>>>>> -->",
+		},
+	}
+	for _, test := range tests {
+		msg, err := decodeMessage([]byte(test.Input))
+		if !assert.NoError(t, err, test.Input) {
+			continue
+		}
+		assert.Equal(t, "SAMLResponse", msg.Param)
+		assert.Equal(t, test.Encodings, msg.Encodings)
+		assert.Equal(t, test.RelayState, msg.RelayState)
+		assert.Equal(t, test.XML, string(msg.XML))
+	}
+
+	for _, input := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("plain text")), "SAMLRequest=&RelayState=x"} {
+		_, err := decodeMessage([]byte(input))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestDecodeCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	status := run([]string{"decode", "-json"}, strings.NewReader(base64.StdEncoding.EncodeToString([]byte(testResponse))), &stdout, &stderr)
+	assert.Equal(t, 0, status, stderr.String())
+
+	var s summary
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &s))
+	assert.Equal(t, "Response", s.Message)
+	assert.Equal(t, "id-response", s.ID)
+	assert.Equal(t, "https://idp.example.org/metadata.xml", s.Issuer)
+	assert.Equal(t, []string{
+		"urn:oasis:names:tc:SAML:2.0:status:Responder",
+		"urn:oasis:names:tc:SAML:2.0:status:AuthnFailed",
+	}, s.Status)
+	assert.Equal(t, "locked out", s.StatusMessage)
+	assert.False(t, s.Signed)
+	assert.Contains(t, s.XML, "\n  <saml:Issuer>")
+
+	stdout.Reset()
+	status = run([]string{"decode"}, strings.NewReader(testResponse), &stdout, &stderr)
+	assert.Equal(t, 0, status)
+	assert.Contains(t, stdout.String(), "Message:       Response (SAMLResponse)\n")
+	assert.Contains(t, stdout.String(), "StatusMessage: locked out\n")
+
+	stderr.Reset()
+	assert.Equal(t, 2, run([]string{"decode"}, strings.NewReader("%%%"), &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "saml decode: ")
+	assert.Equal(t, 2, run([]string{"unknown"}, nil, &stdout, &stderr))
+	assert.Equal(t, 2, run([]string{"decrypt"}, nil, &stdout, &stderr))
+}
+
+func TestAssertCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	status := run([]string{"assert", "-json", "-cert", "../../_example/idp.crt", "-now", "2017-03-04T05:06:08Z"},
+		strings.NewReader(testResponse), &stdout, &stderr)
+	assert.Equal(t, 1, status, stderr.String())
+
+	var result assertResult
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &result))
+	assert.Equal(t, assertResult{
+		Error:  "Unexpected status code: urn:oasis:names:tc:SAML:2.0:status:Responder",
+		Now:    "2017-03-04T05:06:08Z",
+		ACSURL: "https://sp.example.org/saml/acs",
+	}, result)
+	assert.NotEqual(t, "2017-03-04T05:06:08Z", saml.Now().UTC().Format(time.RFC3339), "-now must not change saml.Now")
+
+	// The ACS URL is checked before the status.
+	stdout.Reset()
+	status = run([]string{"assert", "-cert", "../../_example/idp.crt", "-acs", "https://other.example.org/acs"},
+		strings.NewReader(testResponse), &stdout, &stderr)
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stdout.String(), "Result:  invalid: Wrong ACS destination")
+
+	assert.Equal(t, 2, run([]string{"assert"}, strings.NewReader(testResponse), &stdout, &stderr))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/beevik/etree"
+)
+
+// summary holds the main fields of a SAML message, as printed by the
+// commands.
+type summary struct {
+	Message       string             `json:"message"`
+	Param         string             `json:"param"`
+	Encodings     []string           `json:"encodings,omitempty"`
+	RelayState    string             `json:"relay_state,omitempty"`
+	ID            string             `json:"id,omitempty"`
+	IssueInstant  string             `json:"issue_instant,omitempty"`
+	Destination   string             `json:"destination,omitempty"`
+	InResponseTo  string             `json:"in_response_to,omitempty"`
+	Issuer        string             `json:"issuer,omitempty"`
+	ACSURL        string             `json:"acs_url,omitempty"`
+	NameID        string             `json:"name_id,omitempty"`
+	SessionIndex  string             `json:"session_index,omitempty"`
+	Status        []string           `json:"status,omitempty"`
+	StatusMessage string             `json:"status_message,omitempty"`
+	Signed        bool               `json:"signed"`
+	Assertions    []assertionSummary `json:"assertions,omitempty"`
+
+	// Indented XML of the message
+	XML string `json:"xml"`
+}
+
+// assertionSummary holds the main fields of an assertion. Only Encrypted is
+// set for the assertions that are still encrypted.
+type assertionSummary struct {
+	Encrypted    bool                `json:"encrypted"`
+	ID           string              `json:"id,omitempty"`
+	IssueInstant string              `json:"issue_instant,omitempty"`
+	Issuer       string              `json:"issuer,omitempty"`
+	Signed       bool                `json:"signed"`
+	NameID       string              `json:"name_id,omitempty"`
+	NameIDFormat string              `json:"name_id_format,omitempty"`
+	Recipient    string              `json:"recipient,omitempty"`
+	NotBefore    string              `json:"not_before,omitempty"`
+	NotOnOrAfter string              `json:"not_on_or_after,omitempty"`
+	Audiences    []string            `json:"audiences,omitempty"`
+	SessionIndex string              `json:"session_index,omitempty"`
+	Attributes   map[string][]string `json:"attributes,omitempty"`
+}
+
+// summarize returns the summary of the given message.
+func summarize(msg *message) *summary {
+	root := msg.Doc.Root()
+	s := &summary{
+		Message:      root.Tag,
+		Param:        msg.Param,
+		Encodings:    msg.Encodings,
+		RelayState:   msg.RelayState,
+		ID:           root.SelectAttrValue("ID", ""),
+		IssueInstant: root.SelectAttrValue("IssueInstant", ""),
+		Destination:  root.SelectAttrValue("Destination", ""),
+		InResponseTo: root.SelectAttrValue("InResponseTo", ""),
+		Issuer:       childText(root, "Issuer"),
+		ACSURL:       root.SelectAttrValue("AssertionConsumerServiceURL", ""),
+		NameID:       childText(root, "NameID"),
+		SessionIndex: childText(root, "SessionIndex"),
+		Signed:       root.SelectElement("Signature") != nil,
+	}
+	if status := root.SelectElement("Status"); status != nil {
+		for code := status.SelectElement("StatusCode"); code != nil; code = code.SelectElement("StatusCode") {
+			s.Status = append(s.Status, code.SelectAttrValue("Value", ""))
+		}
+		s.StatusMessage = childText(status, "StatusMessage")
+	}
+	for _, el := range root.ChildElements() {
+		switch el.Tag {
+		case "Assertion":
+			s.Assertions = append(s.Assertions, summarizeAssertion(el))
+		case "EncryptedAssertion":
+			assertion := assertionSummary{}
+			if el := el.SelectElement("Assertion"); el != nil {
+				assertion = summarizeAssertion(el)
+			}
+			assertion.Encrypted = true
+			s.Assertions = append(s.Assertions, assertion)
+		}
+	}
+
+	doc := msg.Doc.Copy()
+	doc.Indent(2)
+	s.XML, _ = doc.WriteToString()
+	return s
+}
+
+func summarizeAssertion(el *etree.Element) assertionSummary {
+	assertion := assertionSummary{
+		ID:           el.SelectAttrValue("ID", ""),
+		IssueInstant: el.SelectAttrValue("IssueInstant", ""),
+		Issuer:       childText(el, "Issuer"),
+		Signed:       el.SelectElement("Signature") != nil,
+	}
+	if subject := el.SelectElement("Subject"); subject != nil {
+		if nameID := subject.SelectElement("NameID"); nameID != nil {
+			assertion.NameID = strings.TrimSpace(nameID.Text())
+			assertion.NameIDFormat = nameID.SelectAttrValue("Format", "")
+		}
+		if confirmation := subject.SelectElement("SubjectConfirmation"); confirmation != nil {
+			if data := confirmation.SelectElement("SubjectConfirmationData"); data != nil {
+				assertion.Recipient = data.SelectAttrValue("Recipient", "")
+			}
+		}
+	}
+	if conditions := el.SelectElement("Conditions"); conditions != nil {
+		assertion.NotBefore = conditions.SelectAttrValue("NotBefore", "")
+		assertion.NotOnOrAfter = conditions.SelectAttrValue("NotOnOrAfter", "")
+		for _, restriction := range conditions.SelectElements("AudienceRestriction") {
+			for _, audience := range restriction.SelectElements("Audience") {
+				assertion.Audiences = append(assertion.Audiences, strings.TrimSpace(audience.Text()))
+			}
+		}
+	}
+	if statement := el.SelectElement("AuthnStatement"); statement != nil {
+		assertion.SessionIndex = statement.SelectAttrValue("SessionIndex", "")
+	}
+	if statement := el.SelectElement("AttributeStatement"); statement != nil {
+		assertion.Attributes = map[string][]string{}
+		for _, attr := range statement.SelectElements("Attribute") {
+			name := attr.SelectAttrValue("FriendlyName", "")
+			if name == "" {
+				name = attr.SelectAttrValue("Name", "")
+			}
+			values := []string{}
+			for _, value := range attr.SelectElements("AttributeValue") {
+				values = append(values, strings.TrimSpace(value.Text()))
+			}
+			assertion.Attributes[name] = append(assertion.Attributes[name], values...)
+		}
+	}
+	return assertion
+}
+
+// childText returns the text of the first child element with the given tag,
+// if any.
+func childText(el *etree.Element, tag string) string {
+	if child := el.SelectElement(tag); child != nil {
+		return strings.TrimSpace(child.Text())
+	}
+	return ""
+}
+
+// writeJSON writes v as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeField writes a line of the human-readable output of the commands to a
+// tabwriter, unless value is empty.
+func writeField(w io.Writer, indent string, name string, value string) {
+	if value != "" {
+		fmt.Fprintf(w, "%s%s:\t%s\n", indent, name, value)
+	}
+}
+
+// newTabWriter returns the tabwriter aligning the fields of the human-readable
+// output.
+func newTabWriter(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+}
+
+// write writes the summary in a human-readable form, followed by the XML of
+// the message.
+func (s *summary) write(w io.Writer) error {
+	tw := newTabWriter(w)
+	writeField(tw, "", "Message", s.Message+" ("+s.Param+")")
+	writeField(tw, "", "Encodings", strings.Join(s.Encodings, ", "))
+	writeField(tw, "", "RelayState", s.RelayState)
+	writeField(tw, "", "ID", s.ID)
+	writeField(tw, "", "IssueInstant", s.IssueInstant)
+	writeField(tw, "", "Destination", s.Destination)
+	writeField(tw, "", "InResponseTo", s.InResponseTo)
+	writeField(tw, "", "Issuer", s.Issuer)
+	writeField(tw, "", "ACS URL", s.ACSURL)
+	writeField(tw, "", "NameID", s.NameID)
+	writeField(tw, "", "SessionIndex", s.SessionIndex)
+	writeField(tw, "", "Status", strings.Join(s.Status, " > "))
+	writeField(tw, "", "StatusMessage", s.StatusMessage)
+	writeField(tw, "", "Signed", fmt.Sprint(s.Signed))
+	for _, assertion := range s.Assertions {
+		fmt.Fprintln(tw, "Assertion:")
+		assertion.writeFields(tw, "  ")
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%s", s.XML)
+	return err
+}
+
+// writeFields writes the fields of the assertion to a tabwriter, with the
+// given indentation.
+func (assertion *assertionSummary) writeFields(w io.Writer, indent string) {
+	if assertion.Encrypted {
+		writeField(w, indent, "Encrypted", "true")
+		if assertion.ID == "" {
+			return
+		}
+	}
+	writeField(w, indent, "ID", assertion.ID)
+	writeField(w, indent, "IssueInstant", assertion.IssueInstant)
+	writeField(w, indent, "Issuer", assertion.Issuer)
+	writeField(w, indent, "Signed", fmt.Sprint(assertion.Signed))
+	writeField(w, indent, "NameID", assertion.NameID)
+	writeField(w, indent, "NameID format", assertion.NameIDFormat)
+	writeField(w, indent, "Recipient", assertion.Recipient)
+	writeField(w, indent, "NotBefore", assertion.NotBefore)
+	writeField(w, indent, "NotOnOrAfter", assertion.NotOnOrAfter)
+	writeField(w, indent, "Audiences", strings.Join(assertion.Audiences, ", "))
+	writeField(w, indent, "SessionIndex", assertion.SessionIndex)
+	names := make([]string, 0, len(assertion.Attributes))
+	for name := range assertion.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeField(w, indent, "Attribute "+name, strings.Join(assertion.Attributes[name], ", "))
+	}
+}
@@ -0,0 +1,88 @@
+package saml
+
+import (
+	"encoding/xml"
+)
+
+// Enhanced Client or Proxy (ECP) profile: a client that is not a browser, such
+// as a command line tool, logs in to a SP by relaying the AuthnRequest the SP
+// sends it with the PAOS binding to the IdP, using the SOAP binding, and the
+// IdP's Response back to the SP.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 4.2
+const (
+	// ECPNamespace is the namespace of the header blocks of the ECP profile.
+	ECPNamespace = "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"
+
+	// PAOSNamespace is the namespace of the header blocks of the PAOS binding.
+	PAOSNamespace = "urn:liberty:paos:2003-08"
+
+	// PAOSContentType is the HTTP content type of the messages exchanged
+	// between a SP and an ECP, and of the Accept header by which an ECP
+	// advertises itself.
+	PAOSContentType = "application/vnd.paos+xml"
+
+	// PAOSHeader is the PAOS HTTP header by which an ECP advertises it
+	// supports the ECP profile.
+	PAOSHeader = `ver="` + PAOSNamespace + `";"` + ECPNamespace + `"`
+)
+
+// PAOSRequest is the PAOS header block of the envelope holding the
+// AuthnRequest a SP sends to an ECP, it tells where to send the Response.
+type PAOSRequest struct {
+	XMLName        xml.Name `xml:"urn:liberty:paos:2003-08 Request"`
+	MustUnderstand string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+	Actor          string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr"`
+
+	// Location the ECP sends the Response to, the PAOS assertion consumer
+	// service of the SP
+	ResponseConsumerURL string `xml:"responseConsumerURL,attr"`
+
+	// Always ECPNamespace
+	Service string `xml:"service,attr"`
+
+	MessageID string `xml:"messageID,attr,omitempty"`
+}
+
+// ECPRequest is the ECP header block of the envelope holding the
+// AuthnRequest a SP sends to an ECP.
+type ECPRequest struct {
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp Request"`
+	MustUnderstand string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+	Actor          string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr"`
+
+	// Human readable name of the SP
+	ProviderName string `xml:",attr,omitempty"`
+
+	IsPassive bool `xml:",attr,omitempty"`
+
+	// The SP
+	Issuer *Issuer
+}
+
+// ECPRelayState is the ECP header block carrying the RelayState of the SP,
+// which the ECP sends back along with the Response.
+type ECPRelayState struct {
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp RelayState"`
+	MustUnderstand string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+	Actor          string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr"`
+	Value          string   `xml:",chardata"`
+}
+
+// ECPResponse is the ECP header block of the envelope holding the Response an
+// IdP sends to an ECP, it tells where the IdP expects the Response to be
+// delivered.
+type ECPResponse struct {
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp Response"`
+	MustUnderstand string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+	Actor          string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr"`
+
+	AssertionConsumerServiceURL string `xml:",attr"`
+}
+
+// Names of the header blocks the SP and the ECP look up.
+var (
+	paosRequestName   = xml.Name{Space: PAOSNamespace, Local: "Request"}
+	ecpRelayStateName = xml.Name{Space: ECPNamespace, Local: "RelayState"}
+	ecpResponseName   = xml.Name{Space: ECPNamespace, Local: "Response"}
+)
@@ -0,0 +1,161 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"mime"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/soap"
+)
+
+// ECPClient logs users in to SPs without a browser, as an enhanced client of
+// the ECP profile: it relays the AuthnRequest of the SP to the IdP, with the
+// HTTP Basic credentials of the user, and the Response of the IdP back to the
+// SP.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 4.2
+type ECPClient struct {
+	// Client of the requests to the SPs and the IdP, http.DefaultClient if
+	// nil. It needs a cookie jar for the SPs to remember the user once logged
+	// in.
+	HTTPClient *http.Client
+
+	// Location of the SSO service of the IdP for ECPs, see
+	// IdentityProvider.ECPURL
+	IdPURL string
+
+	// Credentials of the user, sent to the IdP only
+	Username string
+	Password string
+}
+
+// Get fetches the resource at the given URL of a SP. If the SP asks the user
+// to log in, by answering with an AuthnRequest, the user is authenticated by
+// the IdP and the Response is delivered to the SP, whose answer is returned:
+// usually the resource, or a redirection to it that the HTTP client follows.
+func (c *ECPClient) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/html, "+PAOSContentType)
+	req.Header.Set("PAOS", PAOSHeader)
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != PAOSContentType {
+		// The user is already logged in, or the SP does not support ECPs.
+		return resp, nil
+	}
+
+	envelope, err := soap.ReadEnvelope(resp.Body, 0)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read authn request")
+	}
+	return c.Login(ctx, envelope)
+}
+
+// Login logs the user in to a SP, given the envelope holding the AuthnRequest
+// the SP sent with the PAOS binding, and returns the answer of the SP to the
+// Response delivered. If the IdP asks the Response to be delivered elsewhere
+// than the SP asked, a SOAP fault is sent to the SP instead and an error is
+// returned.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 4.2.4
+func (c *ECPClient) Login(ctx context.Context, envelope *soap.Envelope) (*http.Response, error) {
+	if envelope.Body.Name != soap.ProtocolMessage("AuthnRequest") {
+		return nil, errors.Errorf("unexpected message %s", envelope.Body.Name.Local)
+	}
+	header := envelope.Header(paosRequestName)
+	if header == nil {
+		return nil, errors.New("missing paos request header")
+	}
+	var paosRequest PAOSRequest
+	if err := xml.Unmarshal(header, &paosRequest); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal paos request header")
+	}
+	if paosRequest.ResponseConsumerURL == "" {
+		return nil, errors.New("missing response consumer url")
+	}
+
+	idpEnvelope, err := c.authenticate(ctx, envelope.Body.XML)
+	if err != nil {
+		return nil, err
+	}
+	if idpEnvelope.Body.Name != soap.ProtocolMessage("Response") {
+		return nil, errors.Errorf("unexpected idp message %s", idpEnvelope.Body.Name.Local)
+	}
+	header = idpEnvelope.Header(ecpResponseName)
+	if header == nil {
+		return nil, errors.New("missing ecp response header")
+	}
+	var ecpResponse ECPResponse
+	if err := xml.Unmarshal(header, &ecpResponse); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal ecp response header")
+	}
+
+	// The Response must not be delivered to a location the SP did not ask
+	// for, as one SP could otherwise obtain the assertions meant for another.
+	if ecpResponse.AssertionConsumerServiceURL != paosRequest.ResponseConsumerURL {
+		message := soap.MarshalFault(&soap.Fault{
+			Code:   soap.FaultServer,
+			String: "assertion consumer service does not match the response consumer url",
+		})
+		if resp, err := c.post(ctx, paosRequest.ResponseConsumerURL, message); err == nil {
+			resp.Body.Close()
+		}
+		return nil, errors.Errorf("idp asks the response to be delivered to %q instead of %q", ecpResponse.AssertionConsumerServiceURL, paosRequest.ResponseConsumerURL)
+	}
+
+	// The RelayState is sent back as is.
+	var headers [][]byte
+	if relayState := envelope.Header(ecpRelayStateName); relayState != nil {
+		headers = append(headers, relayState)
+	}
+	return c.post(ctx, paosRequest.ResponseConsumerURL, soap.Marshal(idpEnvelope.Body.XML, headers...))
+}
+
+// authenticate sends the given AuthnRequest to the IdP, with the credentials
+// of the user, and returns the envelope answered.
+func (c *ECPClient) authenticate(ctx context.Context, authnRequest []byte) (*soap.Envelope, error) {
+	if c.IdPURL == "" {
+		return nil, errors.New("missing idp url")
+	}
+	req, err := soap.NewRequest(ctx, c.IdPURL, soap.Marshal(authnRequest))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+
+	client := &soap.Client{HTTPClient: c.httpClient()}
+	envelope, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to authenticate with the idp")
+	}
+	return envelope, nil
+}
+
+// post sends the given envelope to the SP with the PAOS binding.
+func (c *ECPClient) post(ctx context.Context, location string, envelope []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, location, bytes.NewReader(envelope))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", PAOSContentType)
+	return c.httpClient().Do(req)
+}
+
+func (c *ECPClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
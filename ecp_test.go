@@ -0,0 +1,193 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/soap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestECPAuthnRequest(t *testing.T) {
+	tearUp()
+
+	sp := *testSP
+	_, err := sp.ECPAuthnRequest("")
+	assert.EqualError(t, err, "missing PAOS assertion consumer service")
+
+	sp.AssertionConsumerServices = []IndexedEndpoint{
+		{Binding: HTTPPostBinding, Location: "http://localhost:1235/saml/acs", Index: 1},
+		{Binding: PAOSBinding, Location: "http://localhost:1235/saml/ecp", Index: 2},
+	}
+	buf, err := sp.ECPAuthnRequest("xyz")
+	assert.NoError(t, err)
+
+	envelope, err := soap.Unmarshal(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, soap.ProtocolMessage("AuthnRequest"), envelope.Body.Name)
+
+	var authnRequest AuthnRequest
+	assert.NoError(t, xml.Unmarshal(envelope.Body.XML, &authnRequest))
+	assert.Equal(t, "http://localhost:1235/saml/ecp", authnRequest.AssertionConsumerServiceURL)
+	assert.Equal(t, PAOSBinding, authnRequest.ProtocolBinding)
+	assert.Equal(t, testSP.MetadataURL, authnRequest.Issuer.Value)
+
+	var paosRequest PAOSRequest
+	assert.NoError(t, xml.Unmarshal(envelope.Header(paosRequestName), &paosRequest))
+	assert.Equal(t, "http://localhost:1235/saml/ecp", paosRequest.ResponseConsumerURL)
+	assert.Equal(t, ECPNamespace, paosRequest.Service)
+	assert.Equal(t, "1", paosRequest.MustUnderstand)
+	assert.Equal(t, soap.ActorNext, paosRequest.Actor)
+
+	var ecpRequest ECPRequest
+	assert.NoError(t, xml.Unmarshal(envelope.Header(xml.Name{Space: ECPNamespace, Local: "Request"}), &ecpRequest))
+	if assert.NotNil(t, ecpRequest.Issuer) {
+		assert.Equal(t, testSP.MetadataURL, ecpRequest.Issuer.Value)
+	}
+
+	var relayState ECPRelayState
+	assert.NoError(t, xml.Unmarshal(envelope.Header(ecpRelayStateName), &relayState))
+	assert.Equal(t, "xyz", relayState.Value)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.False(t, IsECPRequest(r))
+	r.Header.Set("Accept", "text/html; "+PAOSContentType)
+	r.Header.Set("PAOS", PAOSHeader)
+	assert.True(t, IsECPRequest(r))
+}
+
+func TestECPLogin(t *testing.T) {
+	tearUp()
+
+	// The IdP cannot sign without xmlsec1, so it denies the logins to only
+	// answer with status responses.
+	var assertErrs []error
+	var relayStates []string
+	sp := *testSP
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resource", func(w http.ResponseWriter, r *http.Request) {
+		if !IsECPRequest(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		envelope, err := sp.ECPAuthnRequest("resource")
+		assert.NoError(t, err)
+		w.Header().Set("Content-Type", PAOSContentType)
+		w.Write(envelope)
+	})
+	mux.HandleFunc("/saml/ecp", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, PAOSContentType, r.Header.Get("Content-Type"))
+		buf, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		envelope, err := soap.Unmarshal(buf)
+		if assert.NoError(t, err) {
+			var relayState ECPRelayState
+			assert.NoError(t, xml.Unmarshal(envelope.Header(ecpRelayStateName), &relayState))
+			relayStates = append(relayStates, relayState.Value)
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		_, _, err = sp.AssertECPResponse(r)
+		assertErrs = append(assertErrs, err)
+		w.Write([]byte("done"))
+	})
+	spServer := httptest.NewServer(mux)
+	defer spServer.Close()
+	sp.AssertionConsumerServices = []IndexedEndpoint{
+		{Binding: HTTPPostBinding, Location: spServer.URL + "/saml/acs", Index: 1},
+		{Binding: PAOSBinding, Location: spServer.URL + "/saml/ecp", Index: 2},
+	}
+
+	idp := newTestIdPForSP(t, &sp)
+	idp.ECPAuthenticator = func(r *http.Request, username, password string) (*Session, error) {
+		if username != "anakin" || password != "skywalker" {
+			return nil, nil
+		}
+		return nil, NewRequestDeniedError("no ecp for sith")
+	}
+	idpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idp.Handler().ServeHTTP(w, r)
+	}))
+	defer idpServer.Close()
+	idp.ECPURL = idpServer.URL + "/saml/ecp"
+
+	metadata, err := idp.Metadata()
+	assert.NoError(t, err)
+	assert.Contains(t, metadata.IDPSSODescriptor.SingleSignOnService, Endpoint{Binding: SOAPBinding, Location: idp.ECPURL})
+
+	client := &ECPClient{IdPURL: idp.ECPURL, Username: "anakin", Password: "darth"}
+	_, err = client.Get(context.Background(), spServer.URL+"/resource")
+	assert.EqualError(t, err, "failed to authenticate with the idp: soap request failed with status 401")
+	assert.Empty(t, assertErrs)
+
+	client.Password = "skywalker"
+	resp, err := client.Get(context.Background(), spServer.URL+"/resource")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	if assert.Len(t, assertErrs, 1) {
+		assert.EqualError(t, assertErrs[0], "Unexpected status code: "+StatusResponder)
+		assert.Equal(t, []string{"resource"}, relayStates)
+	}
+
+	// Requests that are not from an ECP are left to the caller.
+	resp, err = http.Get(spServer.URL + "/resource")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestECPLoginWrongConsumer(t *testing.T) {
+	tearUp()
+
+	var assertErrs []error
+	sp := *testSP
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resource", func(w http.ResponseWriter, r *http.Request) {
+		envelope, err := sp.ECPAuthnRequest("")
+		assert.NoError(t, err)
+		w.Header().Set("Content-Type", PAOSContentType)
+		w.Write(envelope)
+	})
+	mux.HandleFunc("/saml/ecp", func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := sp.AssertECPResponse(r)
+		assertErrs = append(assertErrs, err)
+	})
+	spServer := httptest.NewServer(mux)
+	defer spServer.Close()
+	sp.AssertionConsumerServices = []IndexedEndpoint{
+		{Binding: PAOSBinding, Location: spServer.URL + "/saml/ecp", Index: 1},
+	}
+
+	// An IdP that would have the Response delivered to another SP.
+	idpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "anakin", username)
+		assert.Equal(t, "skywalker", password)
+
+		header, err := xml.Marshal(&ECPResponse{
+			MustUnderstand:              "1",
+			Actor:                       soap.ActorNext,
+			AssertionConsumerServiceURL: "http://evil.example.org/saml/ecp",
+		})
+		assert.NoError(t, err)
+		soap.WriteMessage(w, []byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"></samlp:Response>`), header)
+	}))
+	defer idpServer.Close()
+
+	client := &ECPClient{IdPURL: idpServer.URL, Username: "anakin", Password: "skywalker"}
+	_, err := client.Get(context.Background(), spServer.URL+"/resource")
+	assert.EqualError(t, err, `idp asks the response to be delivered to "http://evil.example.org/saml/ecp" instead of "`+spServer.URL+`/saml/ecp"`)
+	if assert.Len(t, assertErrs, 1) {
+		_, ok := errors.Cause(assertErrs[0]).(*soap.Fault)
+		assert.True(t, ok)
+	}
+}
@@ -0,0 +1,192 @@
+package saml
+
+import (
+	"encoding/xml"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/xmlsec"
+)
+
+// dataEncryptionAlgorithms are the block encryption algorithms supported for
+// encrypted assertions, by order of preference.
+var dataEncryptionAlgorithms = []string{
+	xmlsec.AES256GCM,
+	xmlsec.AES128GCM,
+	xmlsec.AES256CBC,
+	xmlsec.AES192CBC,
+	xmlsec.AES128CBC,
+}
+
+// keyTransportAlgorithms are the key transport algorithms supported for
+// encrypted assertions, by order of preference. rsa-oaep-mgf1p comes first
+// since RSAOAEP needs xmlsec1 1.3 or later, on the SP as well.
+var keyTransportAlgorithms = []string{
+	xmlsec.RSAOAEPMGF1P,
+	xmlsec.RSAOAEP,
+}
+
+// oaepDigestAlgorithms are the digest algorithms supported for RSA-OAEP.
+var oaepDigestAlgorithms = []string{
+	xmlsec.DigestSHA1,
+	xmlsec.DigestSHA256,
+	xmlsec.DigestSHA512,
+}
+
+// oaepMGFAlgorithms are the mask generation functions supported for the
+// RSA-OAEP of XML Encryption 1.1.
+var oaepMGFAlgorithms = []string{
+	xmlsec.MGF1SHA1,
+	xmlsec.MGF1SHA256,
+	xmlsec.MGF1SHA512,
+}
+
+// supportedEncryptionMethods returns the encryption methods advertised in
+// metadata.
+func supportedEncryptionMethods() []EncryptionMethod {
+	return []EncryptionMethod{
+		{Algorithm: xmlsec.AES128CBC},
+		{Algorithm: xmlsec.AES192CBC},
+		{Algorithm: xmlsec.AES256CBC},
+		{Algorithm: xmlsec.AES128GCM},
+		{Algorithm: xmlsec.AES256GCM},
+		{Algorithm: xmlsec.RSAOAEPMGF1P},
+		{
+			Algorithm:    xmlsec.RSAOAEP,
+			DigestMethod: &xmlsec.Method{Algorithm: xmlsec.DigestSHA256},
+			MGF:          &xmlsec.Method{Algorithm: xmlsec.MGF1SHA256},
+		},
+	}
+}
+
+// negotiateEncryptionMethods picks the block encryption algorithm and the key
+// transport method used to encrypt an assertion for a SP whose key descriptor
+// lists the given encryption methods. RSA-OAEP methods are only picked if the
+// digest and mask generation function they advertise are supported, and use
+// them. When the SP lists no algorithm of a kind aes128-cbc and
+// rsa-oaep-mgf1p are used, as before metadata was taken into account.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.1.1
+func negotiateEncryptionMethods(methods []EncryptionMethod) (dataAlgorithm string, keyMethod *xmlsec.KeyEncryptionMethod, err error) {
+	advertised := map[string]bool{}
+	hasData, hasKey := false, false
+	for _, method := range methods {
+		advertised[method.Algorithm] = true
+		if isDataEncryptionAlgorithm(method.Algorithm) {
+			hasData = true
+		}
+		if isKeyTransportAlgorithm(method.Algorithm) {
+			hasKey = true
+		}
+	}
+
+	dataAlgorithm = xmlsec.AES128CBC
+	if hasData {
+		dataAlgorithm = ""
+		for _, algorithm := range dataEncryptionAlgorithms {
+			if advertised[algorithm] {
+				dataAlgorithm = algorithm
+				break
+			}
+		}
+	}
+
+	keyMethod = &xmlsec.KeyEncryptionMethod{Algorithm: xmlsec.RSAOAEPMGF1P}
+	if hasKey {
+		keyMethod = nil
+	search:
+		for _, algorithm := range keyTransportAlgorithms {
+			for _, method := range methods {
+				if method.Algorithm == algorithm && isSupportedKeyTransportMethod(method) {
+					keyMethod = &xmlsec.KeyEncryptionMethod{
+						Algorithm:    method.Algorithm,
+						DigestMethod: method.DigestMethod,
+						MGF:          method.MGF,
+					}
+					break search
+				}
+			}
+		}
+	}
+
+	if dataAlgorithm == "" || keyMethod == nil {
+		return "", nil, errors.New("sp supports no known encryption algorithm")
+	}
+	return dataAlgorithm, keyMethod, nil
+}
+
+// isSupportedKeyTransportMethod reports whether the digest and the mask
+// generation function of a RSA-OAEP key transport method are supported. The
+// mask generation function of rsa-oaep-mgf1p is always MGF1 with SHA-1.
+func isSupportedKeyTransportMethod(method EncryptionMethod) bool {
+	if method.DigestMethod != nil && !contains(oaepDigestAlgorithms, method.DigestMethod.Algorithm) {
+		return false
+	}
+	if method.MGF != nil {
+		return method.Algorithm == xmlsec.RSAOAEP && contains(oaepMGFAlgorithms, method.MGF.Algorithm)
+	}
+	return true
+}
+
+// isDataEncryptionAlgorithm reports whether algorithm identifies a block
+// encryption algorithm, supported or not.
+func isDataEncryptionAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case xmlsec.AES128CBC, xmlsec.AES192CBC, xmlsec.AES256CBC,
+		xmlsec.AES128GCM, xmlsec.AES256GCM,
+		"http://www.w3.org/2009/xmlenc11#aes192-gcm",
+		"http://www.w3.org/2001/04/xmlenc#tripledes-cbc":
+		return true
+	}
+	return false
+}
+
+// isKeyTransportAlgorithm reports whether algorithm identifies a key transport
+// algorithm, supported or not.
+func isKeyTransportAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case xmlsec.RSAOAEPMGF1P, xmlsec.RSAOAEP,
+		"http://www.w3.org/2001/04/xmlenc#rsa-1_5":
+		return true
+	}
+	return false
+}
+
+// checkEncryptionMethods makes sure an encrypted assertion only uses the
+// algorithms advertised in the SP metadata before it is decrypted.
+func checkEncryptionMethods(encryptedData []byte) error {
+	type encryptedKey struct {
+		EncryptionMethod xmlsec.Method `xml:"EncryptionMethod"`
+	}
+	var doc struct {
+		EncryptedData struct {
+			EncryptionMethod xmlsec.Method `xml:"EncryptionMethod"`
+			KeyInfo          struct {
+				EncryptedKey []encryptedKey `xml:"EncryptedKey"`
+			} `xml:"KeyInfo"`
+		} `xml:"EncryptedData"`
+		EncryptedKey []encryptedKey `xml:"EncryptedKey"`
+	}
+	buf := append(append([]byte("<EncryptedAssertion>"), encryptedData...), []byte("</EncryptedAssertion>")...)
+	if err := xml.Unmarshal(buf, &doc); err != nil {
+		return errors.Wrap(err, "failed to parse encrypted assertion")
+	}
+
+	if !contains(dataEncryptionAlgorithms, doc.EncryptedData.EncryptionMethod.Algorithm) {
+		return errors.Errorf("unsupported data encryption algorithm %q", doc.EncryptedData.EncryptionMethod.Algorithm)
+	}
+	for _, key := range append(doc.EncryptedData.KeyInfo.EncryptedKey, doc.EncryptedKey...) {
+		if !contains(keyTransportAlgorithms, key.EncryptionMethod.Algorithm) {
+			return errors.Errorf("unsupported key transport algorithm %q", key.EncryptionMethod.Algorithm)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
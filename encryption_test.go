@@ -0,0 +1,90 @@
+package saml
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/pressly/saml/xmlsec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncryptionMethods(t *testing.T) {
+	methods := func(algorithms ...string) []EncryptionMethod {
+		var methods []EncryptionMethod
+		for _, algorithm := range algorithms {
+			methods = append(methods, EncryptionMethod{Algorithm: algorithm})
+		}
+		return methods
+	}
+
+	dataAlgorithm, keyMethod, err := negotiateEncryptionMethods(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, xmlsec.AES128CBC, dataAlgorithm)
+	assert.Equal(t, &xmlsec.KeyEncryptionMethod{Algorithm: xmlsec.RSAOAEPMGF1P}, keyMethod)
+
+	dataAlgorithm, keyMethod, err = negotiateEncryptionMethods(supportedEncryptionMethods())
+	assert.NoError(t, err)
+	assert.Equal(t, xmlsec.AES256GCM, dataAlgorithm)
+	assert.Equal(t, &xmlsec.KeyEncryptionMethod{Algorithm: xmlsec.RSAOAEPMGF1P}, keyMethod)
+
+	dataAlgorithm, keyMethod, err = negotiateEncryptionMethods(methods(xmlsec.AES192CBC, xmlsec.AES128GCM))
+	assert.NoError(t, err)
+	assert.Equal(t, xmlsec.AES128GCM, dataAlgorithm)
+	assert.Equal(t, &xmlsec.KeyEncryptionMethod{Algorithm: xmlsec.RSAOAEPMGF1P}, keyMethod)
+
+	_, _, err = negotiateEncryptionMethods(methods("http://www.w3.org/2001/04/xmlenc#tripledes-cbc"))
+	assert.Error(t, err)
+
+	_, _, err = negotiateEncryptionMethods(methods("http://www.w3.org/2001/04/xmlenc#rsa-1_5"))
+	assert.Error(t, err)
+
+	// The digest and mask generation function advertised for RSA-OAEP are
+	// carried through, and an unsupported one falls back to rsa-oaep-mgf1p,
+	// which is preferred anyway.
+	oaep := EncryptionMethod{
+		Algorithm:    xmlsec.RSAOAEP,
+		DigestMethod: &xmlsec.Method{Algorithm: xmlsec.DigestSHA256},
+		MGF:          &xmlsec.Method{Algorithm: xmlsec.MGF1SHA1},
+	}
+	_, keyMethod, err = negotiateEncryptionMethods([]EncryptionMethod{oaep})
+	assert.NoError(t, err)
+	assert.Equal(t, &xmlsec.KeyEncryptionMethod{
+		Algorithm:    xmlsec.RSAOAEP,
+		DigestMethod: &xmlsec.Method{Algorithm: xmlsec.DigestSHA256},
+		MGF:          &xmlsec.Method{Algorithm: xmlsec.MGF1SHA1},
+	}, keyMethod)
+
+	oaep.MGF = &xmlsec.Method{Algorithm: "http://www.w3.org/2009/xmlenc11#mgf1sha224"}
+	_, keyMethod, err = negotiateEncryptionMethods([]EncryptionMethod{oaep, {Algorithm: xmlsec.RSAOAEPMGF1P}})
+	assert.NoError(t, err)
+	assert.Equal(t, &xmlsec.KeyEncryptionMethod{Algorithm: xmlsec.RSAOAEPMGF1P}, keyMethod)
+
+	_, _, err = negotiateEncryptionMethods([]EncryptionMethod{oaep})
+	assert.Error(t, err)
+
+	// Metadata lists the parameters as child elements.
+	var parsed EncryptionMethod
+	assert.NoError(t, xml.Unmarshal([]byte(`<EncryptionMethod Algorithm="http://www.w3.org/2009/xmlenc11#rsa-oaep">`+
+		`<DigestMethod xmlns="http://www.w3.org/2000/09/xmldsig#" Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>`+
+		`<MGF xmlns="http://www.w3.org/2009/xmlenc11#" Algorithm="http://www.w3.org/2009/xmlenc11#mgf1sha256"/>`+
+		`</EncryptionMethod>`), &parsed))
+	assert.Equal(t, xmlsec.DigestSHA256, parsed.DigestMethod.Algorithm)
+	assert.Equal(t, xmlsec.MGF1SHA256, parsed.MGF.Algorithm)
+}
+
+func TestCheckEncryptionMethods(t *testing.T) {
+	tpl := xmlsec.NewEncryptedDataTemplate(xmlsec.AES256GCM, xmlsec.RSAOAEP)
+	buf, err := xml.Marshal(tpl)
+	assert.NoError(t, err)
+	assert.NoError(t, checkEncryptionMethods(buf))
+
+	tpl = xmlsec.NewEncryptedDataTemplate("http://www.w3.org/2001/04/xmlenc#tripledes-cbc", xmlsec.RSAOAEP)
+	buf, err = xml.Marshal(tpl)
+	assert.NoError(t, err)
+	assert.Error(t, checkEncryptionMethods(buf))
+
+	tpl = xmlsec.NewEncryptedDataTemplate(xmlsec.AES128CBC, "http://www.w3.org/2001/04/xmlenc#rsa-1_5")
+	buf, err = xml.Marshal(tpl)
+	assert.NoError(t, err)
+	assert.Error(t, checkEncryptionMethods(buf))
+}
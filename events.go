@@ -0,0 +1,201 @@
+package saml
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EventType identifies the point of a SAML flow an Event is reported at.
+type EventType string
+
+// Types of the events reported to an EventSink.
+const (
+	// A SP validated, or rejected, a Response, see
+	// ServiceProvider.AssertResponse
+	EventSPLogin EventType = "sp.login"
+
+	// The IdP made, or failed to make, an assertion for a SP, see
+	// IdpAuthnRequest.MakeAssertion
+	EventAssertionIssued EventType = "idp.assertion_issued"
+
+	// The IdP answered an AuthnRequest, with an assertion or an error status,
+	// see IdpAuthnRequest.GenerateResponse
+	EventIdPLogin EventType = "idp.login"
+
+	// The IdP received a LogoutRequest from a SP, see
+	// IdentityProvider.SingleLogoutHandler
+	EventLogoutRequest EventType = "idp.logout_request"
+
+	// The IdP logged the user out of one of the other participants of the
+	// SSO session, or failed to
+	EventLogoutPropagation EventType = "idp.logout_propagation"
+
+	// The IdP ended the SSO session and answered the SP that asked for the
+	// logout
+	EventLogout EventType = "idp.logout"
+)
+
+// Event is the audit record of a step of a SAML login or logout. Fields that
+// do not apply to the step, or are unknown because the step failed early, are
+// left empty.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Whether the step succeeded, and why not
+	Success bool   `json:"success"`
+	Reason  string `json:"reason,omitempty"`
+
+	// Entity ID of the party that issued the message the step is about, such
+	// as the IdP for a Response or the SP for a LogoutRequest
+	Issuer string `json:"issuer,omitempty"`
+
+	// Entity ID of the party the message is meant for
+	Audience string `json:"audience,omitempty"`
+
+	// ID of the request the step answers
+	RequestID string `json:"request_id,omitempty"`
+
+	AssertionID string `json:"assertion_id,omitempty"`
+
+	// Subject of the assertion or of the logout
+	NameID       string `json:"name_id,omitempty"`
+	NameIDFormat string `json:"name_id_format,omitempty"`
+
+	SessionIndex string `json:"session_index,omitempty"`
+
+	// Address of the user's client
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+// setNameID copies the given NameID, if any, to the event.
+func (e *Event) setNameID(nameID *NameID) {
+	if nameID != nil {
+		e.NameID = nameID.Value
+		e.NameIDFormat = nameID.Format
+	}
+}
+
+// setParticipant copies the subject of the last assertion the participant of
+// the session with the given entity ID was issued to the event.
+func (e *Event) setParticipant(session *Session, entityID string) {
+	for _, participant := range session.Participants {
+		if participant.EntityID == entityID {
+			e.setNameID(participant.NameID)
+			e.SessionIndex = participant.SessionIndex
+		}
+	}
+}
+
+// setAssertion copies the identifiers and the subject of the given assertion,
+// if any, to the event.
+func (e *Event) setAssertion(assertion *Assertion) {
+	if assertion == nil {
+		return
+	}
+	e.AssertionID = assertion.ID
+	if assertion.Subject != nil {
+		e.setNameID(assertion.Subject.NameID)
+	}
+	if assertion.AuthnStatement != nil {
+		e.SessionIndex = assertion.AuthnStatement.SessionIndex
+	}
+}
+
+// setError marks the event as failed by the given error, if any. Only the
+// cause of the error is kept as the reason: the messages wrapping it may
+// embed whole XML documents.
+func (e *Event) setError(err error) {
+	e.Success = err == nil
+	if err != nil {
+		e.Reason = errors.Cause(err).Error()
+	}
+}
+
+// EventSink receives the audit events of SPs and IdPs. Event is called
+// synchronously, by the goroutine serving the request, so it should not block
+// for long. The event must not be retained after Event returns.
+type EventSink interface {
+	Event(ctx context.Context, event *Event)
+}
+
+// EventSinkFunc adapts a function to the EventSink interface.
+type EventSinkFunc func(ctx context.Context, event *Event)
+
+// Event calls f(ctx, event).
+func (f EventSinkFunc) Event(ctx context.Context, event *Event) {
+	f(ctx, event)
+}
+
+// JSONEventSink writes the events as JSON lines, one object per event, to a
+// writer. It is safe for concurrent use.
+type JSONEventSink struct {
+	// Called with the errors writing an event, which are otherwise dropped
+	OnError func(err error)
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONEventSink returns a sink writing the events to w.
+func NewJSONEventSink(w io.Writer) *JSONEventSink {
+	return &JSONEventSink{w: w}
+}
+
+// NewJSONFileEventSink returns a sink appending the events to the file at the
+// given path, which is created if need be. The file should be closed with
+// Close once the sink is no longer used.
+func NewJSONFileEventSink(path string) (*JSONEventSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open event file")
+	}
+	return NewJSONEventSink(f), nil
+}
+
+// Event writes the event as a single line.
+func (s *JSONEventSink) Event(ctx context.Context, event *Event) {
+	buf, err := json.Marshal(event)
+	if err == nil {
+		s.mu.Lock()
+		_, err = s.w.Write(append(buf, '\n'))
+		s.mu.Unlock()
+	}
+	if err != nil && s.OnError != nil {
+		s.OnError(errors.Wrap(err, "failed to write event"))
+	}
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (s *JSONEventSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// emit reports the given event, stamped with the current time, to the IdP's
+// EventSink, if any.
+func (idp *IdentityProvider) emit(ctx context.Context, event *Event) {
+	if idp.Events == nil {
+		return
+	}
+	event.Time = idp.now()
+	idp.Events.Event(ctx, event)
+}
+
+// emit reports the given event, stamped with the current time, to the SP's
+// EventSink, if any.
+func (sp *ServiceProvider) emit(ctx context.Context, event *Event) {
+	if sp.Events == nil {
+		return
+	}
+	event.Time = sp.now()
+	sp.Events.Event(ctx, event)
+}
@@ -0,0 +1,262 @@
+package saml
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordEvents returns a sink appending the events it receives to the given
+// slice.
+func recordEvents(events *[]Event) EventSink {
+	return EventSinkFunc(func(ctx context.Context, event *Event) {
+		*events = append(*events, *event)
+	})
+}
+
+func TestJSONEventSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saml-events")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+
+	now := time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, event := range []*Event{
+		{Type: EventSPLogin, Time: now, Success: true, AssertionID: "id-1", NameID: "anakin"},
+		{Type: EventSPLogin, Time: now, Reason: "expired"},
+	} {
+		// The file is appended to, not truncated.
+		sink, err := NewJSONFileEventSink(path)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		sink.Event(context.Background(), event)
+		assert.NoError(t, sink.Close())
+	}
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	assert.Equal(t, []string{
+		`{"type":"sp.login","time":"2017-03-04T05:06:07Z","success":true,"assertion_id":"id-1","name_id":"anakin"}`,
+		`{"type":"sp.login","time":"2017-03-04T05:06:07Z","success":false,"reason":"expired"}`,
+	}, lines)
+
+	var event Event
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, Event{Type: EventSPLogin, Time: now, Success: true, AssertionID: "id-1", NameID: "anakin"}, event)
+
+	var errs []error
+	sink := NewJSONEventSink(failingWriter{})
+	sink.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+	sink.Event(context.Background(), &event)
+	if assert.Len(t, errs, 1) {
+		assert.EqualError(t, errs[0], "failed to write event: disk full")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestLoginEvents(t *testing.T) {
+	tearUp()
+
+	var events []Event
+	idp := newTestIdPForSP(t, testSP)
+	idp.Events = recordEvents(&events)
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+	req := &IdpAuthnRequest{
+		IDP:                     idp,
+		Address:                 "10.0.0.1",
+		Request:                 *authnRequest,
+		ServiceProviderMetadata: spMetadata,
+	}
+
+	// The IdP cannot sign without xmlsec1, the assertion is only made.
+	session := &Session{CreateTime: Now(), Index: "index", UserEmail: "anakin@example.org"}
+	assert.NoError(t, req.MakeAssertion(session))
+	if assert.Len(t, events, 1) {
+		event := events[0]
+		assert.False(t, event.Time.IsZero())
+		event.Time = time.Time{}
+		assert.Equal(t, Event{
+			Type:         EventAssertionIssued,
+			Success:      true,
+			Issuer:       idp.MetadataURL,
+			Audience:     testSP.MetadataURL,
+			RequestID:    authnRequest.ID,
+			AssertionID:  req.Assertion.ID,
+			NameID:       req.Assertion.Subject.NameID.Value,
+			NameIDFormat: req.Assertion.Subject.NameID.Format,
+			SessionIndex: "index",
+			ClientIP:     "10.0.0.1",
+		}, event)
+	}
+
+	unknownIndex := 7
+	req.Request.AttributeConsumingServiceIndex = &unknownIndex
+	assert.Error(t, req.MakeAssertion(session))
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, EventAssertionIssued, events[1].Type)
+		assert.False(t, events[1].Success)
+		assert.NotEmpty(t, events[1].Reason)
+		assert.Empty(t, events[1].AssertionID)
+	}
+
+	// The failed login is reported once, with the status sent to the SP.
+	events = nil
+	_, err = req.GenerateResponse(nil)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, EventIdPLogin, events[0].Type)
+		assert.False(t, events[0].Success)
+		assert.Equal(t, StatusResponder+" "+StatusAuthnFailed, events[0].Reason)
+		assert.Equal(t, authnRequest.ID, events[0].RequestID)
+		assert.Equal(t, testSP.MetadataURL, events[0].Audience)
+	}
+
+	// The SP rejects the response.
+	assert.NoError(t, req.MarshalResponse())
+	sp := *testSP
+	var spEvents []Event
+	sp.Events = recordEvents(&spEvents)
+	spNow := time.Date(2015, 12, 1, 1, 57, 30, 0, time.UTC)
+	sp.Now = func() time.Time { return spNow }
+	_, err = sp.AssertResponse(base64.StdEncoding.EncodeToString(req.ResponseBuffer))
+	assert.Error(t, err)
+	_, err = sp.AssertResponse("%%%")
+	assert.Error(t, err)
+	if assert.Len(t, spEvents, 2) {
+		assert.Equal(t, EventSPLogin, spEvents[0].Type)
+		assert.False(t, spEvents[0].Success)
+		assert.Equal(t, "Unexpected status code: "+StatusResponder, spEvents[0].Reason)
+		assert.Equal(t, idp.MetadataURL, spEvents[0].Issuer)
+		assert.Equal(t, testSP.MetadataURL, spEvents[0].Audience)
+		assert.Equal(t, authnRequest.ID, spEvents[0].RequestID)
+		assert.Equal(t, spNow, spEvents[0].Time)
+
+		assert.False(t, spEvents[1].Success)
+		assert.Equal(t, "illegal base64 data at input byte 0", spEvents[1].Reason)
+		assert.Empty(t, spEvents[1].Issuer)
+	}
+}
+
+func TestLogoutEvents(t *testing.T) {
+	tearUp()
+
+	soapSP := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer soapSP.Close()
+
+	spA := newTestLogoutSP(t, "https://a.example.org", Endpoint{
+		Binding:  HTTPRedirectBinding,
+		Location: "https://a.example.org/slo",
+	})
+	spC := newTestLogoutSP(t, "https://c.example.org", Endpoint{
+		Binding:  SOAPBinding,
+		Location: soapSP.URL,
+	})
+
+	var events []Event
+	idp := newTestIdPForSP(t, testSP)
+	idp.SLOURL = testSLOURL
+	idp.Sessions = &MemorySessionStore{}
+	idp.ServiceProviders = NewMemoryServiceProviderRegistry(spA, spC)
+	idp.Events = recordEvents(&events)
+
+	session := &Session{
+		ID:         "session-" + NewID(),
+		ExpireTime: Now().Add(time.Hour),
+		Index:      "index",
+	}
+	for _, entityID := range []string{spA.EntityID, spC.EntityID} {
+		session.Participants = append(session.Participants, SessionParticipant{
+			EntityID:     entityID,
+			SessionIndex: session.Index,
+			NameID:       &NameID{Format: NameIDTransientFormat, Value: "id-" + entityID},
+		})
+	}
+	assert.NoError(t, idp.Sessions.SaveSession(context.Background(), session))
+	cookies := []*http.Cookie{{Name: DefaultSessionCookieName, Value: session.ID}}
+
+	w := httptest.NewRecorder()
+	idp.SingleLogoutHandler(w, signedRedirect(t, testSLOURL, "SAMLRequest", &LogoutRequest{
+		ID:           "logout-request",
+		Version:      "2.0",
+		IssueInstant: Now(),
+		Destination:  testSLOURL,
+		Issuer:       &Issuer{Value: spA.EntityID},
+		NameID:       &NameID{Format: NameIDTransientFormat, Value: "id-" + spA.EntityID},
+		SessionIndex: []string{"index"},
+	}, "", cookies))
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	// C could not be logged out, the reason depends on the environment.
+	for i := range events {
+		events[i].Time = time.Time{}
+	}
+	if assert.Len(t, events, 3) {
+		assert.NotEmpty(t, events[1].Reason)
+		events[1].Reason = ""
+	}
+	assert.Equal(t, []Event{
+		{
+			Type:         EventLogoutRequest,
+			Success:      true,
+			Issuer:       spA.EntityID,
+			Audience:     idp.MetadataURL,
+			RequestID:    "logout-request",
+			NameID:       "id-" + spA.EntityID,
+			NameIDFormat: NameIDTransientFormat,
+			SessionIndex: "index",
+			ClientIP:     "192.0.2.1",
+		},
+		{
+			Type:         EventLogoutPropagation,
+			Issuer:       idp.MetadataURL,
+			Audience:     spC.EntityID,
+			RequestID:    "logout-request",
+			NameID:       "id-" + spC.EntityID,
+			NameIDFormat: NameIDTransientFormat,
+			SessionIndex: "index",
+			ClientIP:     "192.0.2.1",
+		},
+		{
+			Type:         EventLogout,
+			Reason:       "partial logout, failed for " + spC.EntityID,
+			Issuer:       spA.EntityID,
+			Audience:     idp.MetadataURL,
+			RequestID:    "logout-request",
+			NameID:       "id-" + spA.EntityID,
+			NameIDFormat: NameIDTransientFormat,
+			SessionIndex: "index",
+			ClientIP:     "192.0.2.1",
+		},
+	}, events)
+}
@@ -3,22 +3,25 @@ package saml
 import (
 	"crypto/sha1"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 // WorkDir is a temporary directory for files. We need to write keys to disk in
 // order for xmlsec1 to pick them and use them.
 var WorkDir = "/tmp"
 
-func writeFile(buf []byte) (string, error) {
-	destDir := WorkDir
-
+// writeFile writes buf to a file of destDir named after its hash and returns
+// its path. The file is written under a temporary name and renamed, so
+// concurrent callers never see it partially written.
+func writeFile(destDir string, buf []byte) (string, error) {
 	if err := os.MkdirAll(destDir, 0700); err != nil {
 		return "", err
 	}
 
 	hash := sha1.Sum(buf)
-	fileName := destDir + "/" + fmt.Sprintf("%x.tmp", hash)
+	fileName := filepath.Join(destDir, fmt.Sprintf("%x.tmp", hash))
 
 	if stat, err := os.Stat(fileName); err == nil {
 		if !stat.IsDir() {
@@ -27,13 +30,21 @@ func writeFile(buf []byte) (string, error) {
 		}
 	}
 
-	fp, err := os.Create(fileName)
+	fp, err := ioutil.TempFile(destDir, ".saml-")
 	if err != nil {
 		return "", err
 	}
-	defer fp.Close()
+	defer os.Remove(fp.Name())
 
 	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return "", err
+	}
+	if err := fp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(fp.Name(), fileName); err != nil {
 		return "", err
 	}
 
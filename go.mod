@@ -0,0 +1,19 @@
+module github.com/pressly/saml
+
+go 1.21
+
+require (
+	github.com/beevik/etree v1.1.0
+	github.com/gofrs/uuid v4.4.0+incompatible
+	github.com/pkg/errors v0.9.1
+	github.com/russellhaering/goxmldsig v1.1.1
+	github.com/sergi/go-diff v1.3.1
+	github.com/stretchr/testify v1.8.4
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/jonboulle/clockwork v0.2.2 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
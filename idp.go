@@ -2,15 +2,21 @@ package saml
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/pem"
 	"encoding/xml"
+	"fmt"
+	"html/template"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/pressly/saml/instrument"
 	"github.com/pressly/saml/xmlsec"
 	"github.com/pkg/errors"
 )
@@ -24,6 +30,11 @@ type Session struct {
 	ExpireTime time.Time
 	Index      string
 
+	// Stable identifier of the user, persistent NameIDs are derived from it.
+	// UserID is used if empty.
+	SubjectID string
+
+	// Value of the NameID when the unspecified format is used
 	NameID         string
 	Groups         []string
 	UserID         string
@@ -33,6 +44,28 @@ type Session struct {
 	UserCommonName string
 	UserSurname    string
 	UserGivenName  string
+
+	// Arbitrary attributes of the user, keyed by a name of the IdP's choosing.
+	// Which of them are sent to a SP, and how, is decided by its
+	// AttributeReleasePolicy.
+	Attributes map[string][]string
+
+	// SPs that were issued an assertion under this SSO session, see
+	// SessionStore
+	Participants []SessionParticipant
+
+	// Single logout in progress, see IdentityProvider.SingleLogoutHandler
+	Logout *LogoutProgress
+
+	// How the user authenticated, in order, an AuthnContextClassRef is picked
+	// among them for each assertion. PasswordProtectedTransport is assumed if
+	// empty.
+	AuthnMethods []AuthnMethod
+
+	// How long SPs may keep the sessions they establish from the assertions,
+	// counted from CreateTime and sent as SessionNotOnOrAfter. Unlimited if
+	// zero.
+	SPSessionMaxAge time.Duration
 }
 
 // IdpAuthnRequest is used by IdentityProvider to handle a single authentication request.
@@ -42,14 +75,29 @@ type IdpAuthnRequest struct {
 	// Address set in the SubjectConfirmation element of the Assertion
 	Address string
 
-	RelayState              string
-	RequestBuffer           []byte
+	// HTTP request the AuthnRequest was received with, if any
+	HTTPRequest *http.Request
+
+	// SAML binding the AuthnRequest was received with
+	Binding string
+
+	RelayState string
+
+	// Decoded XML of the AuthnRequest, as sent by the SP
+	RequestBuffer []byte
+
 	Request                 AuthnRequest
 	ServiceProviderMetadata *Metadata
 	ACSEndpoint             *IndexedEndpoint
 	Assertion               *Assertion
 	AssertionBuffer         []byte
 	Response                *Response
+
+	// Whether AssertionBuffer holds an EncryptedData rather than an Assertion
+	AssertionEncrypted bool
+
+	// XML of the Response, as sent to the SP
+	ResponseBuffer []byte
 }
 
 // IdentityProvider represents an identity provider.
@@ -62,6 +110,18 @@ type IdentityProvider struct {
 
 	SSOURL string
 
+	// Location of the single logout service, see SingleLogoutHandler. Single
+	// logout is not advertised in the metadata if empty.
+	SLOURL string
+
+	// Location of the attribute service, see AttributeQueryHandler. No
+	// attribute authority is advertised in the metadata if empty.
+	AttributeServiceURL string
+
+	// Location of the SSO service for ECPs, using the SOAP binding, see
+	// ECPHandler. It must differ from SSOURL. ECPs are not supported if empty.
+	ECPURL string
+
 	SecurityOpts
 
 	// File system location of the private key file
@@ -80,11 +140,113 @@ type IdentityProvider struct {
 
 	pemCert atomic.Value
 
-	// Service provide settings
-	SPMetadataURL string
-	SPMetadata    *Metadata
+	// Service providers the IdP trusts, looked up by the Issuer of their
+	// requests
+	ServiceProviders ServiceProviderRegistry
+
+	// Policies applied to specific SPs, keyed by entity ID
+	SPPolicies map[string]*ServiceProviderPolicy
+
+	// Policy applied to SPs without an entry in SPPolicies
+	DefaultSPPolicy ServiceProviderPolicy
+
+	// Source of persistent NameIDs, the persistent format is not supported
+	// if nil
+	PersistentNameIDs PersistentNameIDSource
+
+	// Looks up the principals of the AttributeQuery messages received by
+	// AttributeQueryHandler
+	AttributeSource AttributeSource
+
+	// Returns the current time, the package level Now is used if nil
+	Now func() time.Time
+
+	// Returns unique identifiers for the messages the IdP issues, the package
+	// level NewID is used if nil
+	NewID func() string
+
+	// Directory where keys and certificates are written for xmlsec1, the
+	// package level WorkDir is used if empty
+	WorkDir string
+
+	// SSO sessions of the users, see IdpAuthnRequest.Authenticate. Users
+	// authenticate for every login if nil.
+	Sessions SessionStore
+
+	// Name of the cookie holding the SSO session ID,
+	// DefaultSessionCookieName if empty
+	SessionCookieName string
+
+	// Lifetime of the SSO sessions whose ExpireTime the Authenticator leaves
+	// unset, DefaultSessionMaxAge if zero
+	SessionMaxAge time.Duration
+
+	// Authenticates the users of the SSO service served by Handler and of
+	// InitiateSSO, unless its options name another Authenticator
+	Authenticator Authenticator
+
+	// Authenticates the users of the ECP SSO service with their HTTP Basic
+	// credentials, see ECPHandler
+	ECPAuthenticator PasswordAuthenticator
+
+	// Hooks of the pages Handler shows users
+	LoginUI LoginUI
+
+	// Template of the pages posting messages to SPs with the HTTP-POST
+	// binding, DefaultPostBindingTemplate if nil
+	PostBindingTemplate *template.Template
+
+	// Returns the nonce allowing the script of the HTTP-POST binding pages to
+	// run under the Content-Security-Policy of the given request, see
+	// PostBindingForm. The script has no nonce if nil.
+	PostBindingNonce func(r *http.Request) string
+
+	// Ranks the authentication context classes for the comparisons of
+	// RequestedAuthnContext, DefaultAuthnContextStrength if nil
+	AuthnContextStrength map[string]int
+
+	// Client of the requests the IdP sends to SPs directly, such as SOAP
+	// LogoutRequests, http.DefaultClient if nil. The unsigned LogoutResponses
+	// of SPs are trusted only if its transport presents a TLS client
+	// certificate to an https endpoint.
+	HTTPClient *http.Client
+
+	// Receives the audit events of the logins and logouts, see EventSink
+	Events EventSink
+
+	// Receives the debug logs of the SAML flows and of the xmlsec1
+	// invocations, slog.Default() if nil
+	Logger *slog.Logger
+
+	// Whether the logs include the subjects, the attributes, the client
+	// addresses and the XML of the messages. It must not be set in
+	// production.
+	LogSensitive bool
+
+	// Receives the metrics and traces of the responses the IdP makes and the
+	// metrics of its xmlsec1 invocations, nothing is reported if nil
+	Instrumentation instrument.Instrumentation
+}
 
-	SPAcsURL string
+func (idp *IdentityProvider) now() time.Time {
+	if idp.Now != nil {
+		return idp.Now()
+	}
+	return Now()
+}
+
+func (idp *IdentityProvider) newID() string {
+	if idp.NewID != nil {
+		return idp.NewID()
+	}
+	return NewID()
+}
+
+func (idp *IdentityProvider) workDir() string {
+	if idp.WorkDir != "" {
+		return idp.WorkDir
+	}
+	return WorkDir
 }
 
 // PrivkeyFile returns a physical path where the IdP's key can be accessed.
@@ -93,7 +255,7 @@ func (idp *IdentityProvider) PrivkeyFile() (string, error) {
 		return idp.KeyFile, nil
 	}
 	if idp.PrivkeyPEM != "" {
-		return writeFile([]byte(idp.PrivkeyPEM))
+		return writeFile(idp.workDir(), []byte(idp.PrivkeyPEM))
 	}
 	return "", errors.New("missing idp private key")
 }
@@ -105,7 +267,7 @@ func (idp *IdentityProvider) PubkeyFile() (string, error) {
 		return validateKeyFile(idp.CertFile, nil)
 	}
 	if idp.PubkeyPEM != "" {
-		return validateKeyFile(writeFile([]byte(idp.PubkeyPEM)))
+		return validateKeyFile(writeFile(idp.workDir(), []byte(idp.PubkeyPEM)))
 	}
 	return "", errors.New("missing idp public key")
 }
@@ -151,8 +313,9 @@ func (idp *IdentityProvider) Metadata() (*Metadata, error) {
 
 	metadata := &Metadata{
 		EntityID:   idp.MetadataURL,
-		ValidUntil: Now().Add(defaultValidDuration),
+		ValidUntil: idp.now().Add(defaultValidDuration),
 		IDPSSODescriptor: &IDPSSODescriptor{
+			WantAuthnRequestsSigned:    idp.DefaultSPPolicy.RequireSignedAuthnRequests,
 			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
 			KeyDescriptor: []KeyDescriptor{
 				KeyDescriptor{
@@ -166,17 +329,10 @@ func (idp *IdentityProvider) Metadata() (*Metadata, error) {
 					KeyInfo: KeyInfo{
 						Certificate: certStr,
 					},
-					EncryptionMethods: []EncryptionMethod{
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
-					},
+					EncryptionMethods: supportedEncryptionMethods(),
 				},
 			},
-			NameIDFormat: []string{
-				"urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
-			},
+			NameIDFormat: idp.nameIDFormats(),
 			SingleSignOnService: []Endpoint{
 				{
 					Binding:  HTTPRedirectBinding,
@@ -190,124 +346,301 @@ func (idp *IdentityProvider) Metadata() (*Metadata, error) {
 		},
 	}
 
+	if idp.ECPURL != "" {
+		metadata.IDPSSODescriptor.SingleSignOnService = append(metadata.IDPSSODescriptor.SingleSignOnService, Endpoint{
+			Binding:  SOAPBinding,
+			Location: idp.ECPURL,
+		})
+	}
+
+	if idp.SLOURL != "" {
+		metadata.IDPSSODescriptor.SingleLogoutService = []Endpoint{
+			{
+				Binding:  HTTPRedirectBinding,
+				Location: idp.SLOURL,
+			},
+			{
+				Binding:  HTTPPostBinding,
+				Location: idp.SLOURL,
+			},
+		}
+	}
+
+	if idp.AttributeServiceURL != "" {
+		metadata.AttributeAuthorityDescriptor = &AttributeAuthorityDescriptor{
+			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+			KeyDescriptor: []KeyDescriptor{
+				{
+					Use: "signing",
+					KeyInfo: KeyInfo{
+						Certificate: certStr,
+					},
+				},
+			},
+			AttributeService: []Endpoint{
+				{
+					Binding:  SOAPBinding,
+					Location: idp.AttributeServiceURL,
+				},
+			},
+			NameIDFormat: idp.nameIDFormats(),
+		}
+	}
+
 	return metadata, nil
 }
 
-// MakeAssertion produces a SAML assertion for the given request and assigns it
-// to req.Assertion.
-func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
-	cert, err := req.IDP.Cert()
-	if err != nil {
-		return err
+// Validate checks the AuthnRequest comes from a known SP and verifies its
+// signature, either the one embedded in the XML (HTTP-POST binding) or the one
+// carried by the query (HTTP-Redirect binding), against the signing
+// certificates listed in the SP's metadata. Unsigned requests are rejected
+// when the SP's metadata sets AuthnRequestsSigned or when its policy requires
+// signed requests.
+func (req *IdpAuthnRequest) Validate() error {
+	if req.ServiceProviderMetadata == nil {
+		metadata, err := req.IDP.GetServiceProvider(req.context(), req.Request.Issuer.Value)
+		if err != nil {
+			return err
+		}
+		req.ServiceProviderMetadata = metadata
 	}
 
-	signatureTemplate := xmlsec.DefaultSignature(pem.EncodeToMemory(cert))
-	attributes := []Attribute{}
-	if session.UserName != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "uid",
-			Name:         "urn:oid:0.9.2342.19200300.100.1.1",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserName,
-			}},
-		})
+	spSSODescriptor := req.ServiceProviderMetadata.SPSSODescriptor
+	if spSSODescriptor == nil {
+		return errors.New("missing sp sso descriptor")
 	}
+	certs := signingCertificates(spSSODescriptor.KeyDescriptor)
 
-	if session.UserEmail != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "eduPersonPrincipalName",
-			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserEmail,
-			}},
-		})
+	signed := false
+	if req.Binding == HTTPRedirectBinding && req.HTTPRequest != nil && isRedirectSigned(req.HTTPRequest.URL.RawQuery) {
+		if err := verifyRedirectSignature(req.HTTPRequest.URL.RawQuery, "SAMLRequest", certs); err != nil {
+			return errors.Wrap(err, "failed to verify authn request signature")
+		}
+		signed = true
+	} else if req.Request.Signature != nil {
+		if err := req.verifySignature(certs); err != nil {
+			return errors.Wrap(err, "failed to verify authn request signature")
+		}
+		signed = true
 	}
-	if session.UserSurname != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "sn",
-			Name:         "urn:oid:2.5.4.4",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserSurname,
-			}},
-		})
+
+	if !signed {
+		if spSSODescriptor.AuthnRequestsSigned {
+			return errors.New("authn request must be signed, as stated by the sp metadata")
+		}
+		if req.IDP.SPPolicy(req.ServiceProviderMetadata.EntityID).RequireSignedAuthnRequests {
+			return errors.New("authn request must be signed")
+		}
 	}
-	if session.UserGivenName != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "givenName",
-			Name:         "urn:oid:2.5.4.42",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserGivenName,
-			}},
-		})
+
+	if req.ACSEndpoint == nil {
+		endpoint, err := req.resolveACSEndpoint()
+		if err != nil {
+			return err
+		}
+		req.ACSEndpoint = endpoint
 	}
 
-	if session.UserCommonName != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "cn",
-			Name:         "urn:oid:2.5.4.3",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserCommonName,
-			}},
-		})
+	return nil
+}
+
+// resolveACSEndpoint picks the endpoint the response is sent to among those
+// listed in the SP's metadata, as requested by the AuthnRequest through its
+// AssertionConsumerServiceIndex, AssertionConsumerServiceURL or
+// ProtocolBinding. Requests that cannot be honored yield a *StatusError. Only
+// the HTTP-POST binding is supported, and the PAOS binding for requests
+// received from an ECP, see acsBinding.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 4.1.4.1
+func (req *IdpAuthnRequest) resolveACSEndpoint() (*IndexedEndpoint, error) {
+	if req.ServiceProviderMetadata == nil || req.ServiceProviderMetadata.SPSSODescriptor == nil {
+		return nil, errors.New("missing sp sso descriptor")
+	}
+	endpoints := req.ServiceProviderMetadata.SPSSODescriptor.AssertionConsumerService
+	acsBinding := req.acsBinding()
+
+	if binding := req.Request.ProtocolBinding; binding != "" && binding != acsBinding {
+		return nil, &StatusError{
+			Code:    StatusResponder,
+			SubCode: StatusUnsupportedBinding,
+			Message: fmt.Sprintf("unsupported protocol binding %q", binding),
+		}
 	}
 
-	if session.UserID != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "MASTUsername",
-			Name:         "userid",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserID,
-			}},
-		})
+	index, location := req.Request.AssertionConsumerServiceIndex, req.Request.AssertionConsumerServiceURL
+
+	var endpoint *IndexedEndpoint
+	switch {
+	case index != nil && location != "":
+		return nil, &StatusError{
+			Code:    StatusRequester,
+			Message: "AssertionConsumerServiceIndex and AssertionConsumerServiceURL are mutually exclusive",
+		}
+	case index != nil:
+		for i := range endpoints {
+			if endpoints[i].Index == *index {
+				endpoint = &endpoints[i]
+				break
+			}
+		}
+		if endpoint == nil {
+			return nil, &StatusError{
+				Code:    StatusRequester,
+				Message: fmt.Sprintf("unknown assertion consumer service index %d", *index),
+			}
+		}
+	case location != "":
+		for i := range endpoints {
+			if endpoints[i].Location == location && endpoints[i].Binding == acsBinding {
+				endpoint = &endpoints[i]
+				break
+			}
+		}
+		if endpoint == nil {
+			return nil, &StatusError{
+				Code:    StatusRequester,
+				Message: fmt.Sprintf("assertion consumer service %q is not listed in the sp metadata", location),
+			}
+		}
+	default:
+		endpoint = defaultIndexedEndpoint(endpoints, acsBinding)
+		if endpoint == nil {
+			return nil, errors.Errorf("sp metadata lists no %s assertion consumer service", bindingName(acsBinding))
+		}
 	}
 
-	if session.UserEmail != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "MASTEmail",
-			Name:         "email",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserEmail,
-			}},
-		})
+	if endpoint.Binding != acsBinding {
+		return nil, &StatusError{
+			Code:    StatusResponder,
+			SubCode: StatusUnsupportedBinding,
+			Message: fmt.Sprintf("unsupported assertion consumer service binding %q", endpoint.Binding),
+		}
 	}
 
-	if session.UserFullname != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "MASTName",
-			Name:         "fullname",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserFullname,
-			}},
-		})
+	return endpoint, nil
+}
+
+// acsBinding returns the binding of the assertion consumer services the
+// Response may be sent to: PAOS for requests received from an ECP with the
+// SOAP binding, HTTP-POST otherwise.
+func (req *IdpAuthnRequest) acsBinding() string {
+	if req.Binding == SOAPBinding {
+		return PAOSBinding
+	}
+	return HTTPPostBinding
+}
+
+// bindingName returns the short name of the given binding, such as HTTP-POST.
+func bindingName(binding string) string {
+	return binding[strings.LastIndex(binding, ":")+1:]
+}
+
+// context returns the context of the HTTP request the AuthnRequest was
+// received with, if any.
+func (req *IdpAuthnRequest) context() context.Context {
+	if req.HTTPRequest != nil {
+		return req.HTTPRequest.Context()
+	}
+	return context.Background()
+}
+
+// verifySignature checks the XML signature embedded in the AuthnRequest.
+func (req *IdpAuthnRequest) verifySignature(certs []string) error {
+	return req.IDP.verifySignature(req.RequestBuffer, req.Request.Signature, req.Request.ID, certs)
+}
+
+// verifySignature checks the XML signature of the message in buf, whose root
+// element has the given ID and carries the given signature, against any of
+// the given base64 encoded certificates.
+func (idp *IdentityProvider) verifySignature(buf []byte, signature *xmlsec.Signature, id string, certs []string) error {
+	// The signature must cover the message itself and not some other element
+	// of the document.
+	if signature.Reference.URI != "#"+id {
+		return errors.Errorf("signature references %q instead of the message", signature.Reference.URI)
 	}
 
-	if len(session.Groups) != 0 {
-		groupMemberAttributeValues := []AttributeValue{}
-		for _, group := range session.Groups {
-			groupMemberAttributeValues = append(groupMemberAttributeValues, AttributeValue{
-				Type:  "xs:string",
-				Value: group,
-			})
+	if len(certs) == 0 {
+		return errors.New("missing signing certificate")
+	}
+
+	var err error
+	for _, cert := range certs {
+		certBytes, decodeErr := base64.StdEncoding.DecodeString(cert)
+		if decodeErr != nil {
+			return errors.Wrap(decodeErr, "failed to base64-decode certificate")
 		}
-		attributes = append(attributes, Attribute{
-			FriendlyName: "eduPersonAffiliation",
-			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values:       groupMemberAttributeValues,
+		certFile, writeErr := writeFile(idp.workDir(), pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: certBytes,
+		}))
+		if writeErr != nil {
+			return writeErr
+		}
+
+		err = idp.xmlsecCommand().Verify(buf, certFile, &xmlsec.ValidationOptions{
+			EnableIDAttrHack: true,
 		})
+		if err == nil || !IsSecurityException(err, &idp.SecurityOpts) {
+			return nil
+		}
+	}
+	return err
+}
+
+// MakeAssertion produces a SAML assertion for the given request and assigns it
+// to req.Assertion. The outcome is reported to the IdP's EventSink as an
+// EventAssertionIssued event.
+func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
+	err := req.makeAssertion(session)
+
+	event := req.event(EventAssertionIssued, session)
+	if err == nil {
+		event.setAssertion(req.Assertion)
+	}
+	event.setError(err)
+	req.IDP.emit(req.context(), event)
+	return err
+}
+
+// event returns an event of the given type about the request and the given
+// session, if any.
+func (req *IdpAuthnRequest) event(eventType EventType, session *Session) *Event {
+	event := &Event{
+		Type:      eventType,
+		Issuer:    req.IDP.MetadataURL,
+		Audience:  req.spEntityID(),
+		RequestID: req.Request.ID,
+		ClientIP:  req.Address,
+	}
+	if session != nil {
+		event.SessionIndex = session.Index
+	}
+	return event
+}
+
+// spEntityID returns the entity ID of the SP the request comes from.
+func (req *IdpAuthnRequest) spEntityID() string {
+	if req.ServiceProviderMetadata != nil {
+		return req.ServiceProviderMetadata.EntityID
+	}
+	return req.Request.Issuer.Value
+}
+
+func (req *IdpAuthnRequest) makeAssertion(session *Session) error {
+	attributes, err := req.releaseAttributes(session)
+	if err != nil {
+		return err
+	}
+
+	attributes, err = req.filterRequestedAttributes(attributes)
+	if err != nil {
+		return err
+	}
+
+	if req.ACSEndpoint == nil {
+		if req.ACSEndpoint, err = req.resolveACSEndpoint(); err != nil {
+			return err
+		}
 	}
 
 	idpMetadata, err := req.IDP.Metadata()
@@ -315,56 +648,63 @@ func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
 		return err
 	}
 
-	spNameQualifier := func() string {
-		if meta := req.ServiceProviderMetadata; meta != nil {
-			return meta.EntityID
+	nameID, err := req.makeNameID(session)
+	if err != nil {
+		return err
+	}
+
+	authnMethod, err := req.AuthnMethod(session)
+	if err != nil {
+		return err
+	}
+	authnContext := AuthnContext{
+		AuthnContextClassRef: &AuthnContextClassRef{Value: authnMethod.ClassRef},
+	}
+	if authnMethod.DeclRef != "" {
+		authnContext.AuthnContextDeclRef = &AuthnContextDeclRef{Value: authnMethod.DeclRef}
+	}
+
+	var sessionNotOnOrAfter *time.Time
+	if session.SPSessionMaxAge > 0 {
+		t := session.CreateTime.Add(session.SPSessionMaxAge)
+		sessionNotOnOrAfter = &t
+	}
+
+	var signature *xmlsec.Signature
+	id := req.IDP.newID()
+	if policy := req.spPolicy(); policy.Signing.signAssertion() {
+		cert, err := req.IDP.Cert()
+		if err != nil {
+			return err
 		}
-		return ""
+		signature = policy.signatureTemplate(pem.EncodeToMemory(cert), id)
 	}
 
+	now := req.IDP.now()
 	req.Assertion = &Assertion{
-		ID:           NewID(),
-		IssueInstant: Now(),
+		ID:           id,
+		IssueInstant: now,
 		Version:      "2.0",
 		Issuer: &Issuer{
 			Format: "XXX",
 			Value:  idpMetadata.EntityID,
 		},
-		Signature: &signatureTemplate,
+		Signature: signature,
 		Subject: &Subject{
-			NameID: &NameID{
-				Format:          "urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
-				NameQualifier:   idpMetadata.EntityID,
-				SPNameQualifier: spNameQualifier(),
-				Value:           session.NameID,
-			},
+			NameID: nameID,
 			SubjectConfirmation: &SubjectConfirmation{
 				Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
 				SubjectConfirmationData: SubjectConfirmationData{
 					Address:      req.Address,
 					InResponseTo: req.Request.ID,
-					NotOnOrAfter: Now().Add(IssueLifetime),
-					Recipient: func() string {
-						switch {
-						case req.ACSEndpoint != nil:
-							return req.ACSEndpoint.Location
-						case req.ServiceProviderMetadata != nil && req.ServiceProviderMetadata.SPSSODescriptor != nil:
-							for _, acs := range req.ServiceProviderMetadata.SPSSODescriptor.AssertionConsumerService {
-								if acs.Binding == "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" {
-									return acs.Location
-								}
-							}
-						default:
-							return req.Request.AssertionConsumerServiceURL
-						}
-						return ""
-					}(),
+					NotOnOrAfter: now.Add(IssueLifetime),
+					Recipient:    req.ACSEndpoint.Location,
 				},
 			},
 		},
 		Conditions: &Conditions{
-			NotBefore:    Now(),
-			NotOnOrAfter: Now().Add(IssueLifetime),
+			NotBefore:    now,
+			NotOnOrAfter: now.Add(IssueLifetime),
 			AudienceRestriction: func() *AudienceRestriction {
 				if req.ServiceProviderMetadata != nil {
 					return &AudienceRestriction{
@@ -375,16 +715,13 @@ func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
 			}(),
 		},
 		AuthnStatement: &AuthnStatement{
-			AuthnInstant: session.CreateTime,
-			SessionIndex: session.Index,
+			AuthnInstant:        session.CreateTime,
+			SessionIndex:        session.Index,
+			SessionNotOnOrAfter: sessionNotOnOrAfter,
 			SubjectLocality: SubjectLocality{
 				Address: req.Address,
 			},
-			AuthnContext: AuthnContext{
-				AuthnContextClassRef: &AuthnContextClassRef{
-					Value: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
-				},
-			},
+			AuthnContext: authnContext,
 		},
 		AttributeStatement: &AttributeStatement{
 			Attributes: attributes,
@@ -394,59 +731,157 @@ func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
 	return nil
 }
 
-// MarshalAssertion produces a valid and signed XML assertion.
+// releaseAttributes returns the attributes of the session the SP's
+// AttributeReleasePolicy lets out.
+func (req *IdpAuthnRequest) releaseAttributes(session *Session) ([]Attribute, error) {
+	policy := req.spPolicy().AttributeRelease
+	if policy == nil {
+		policy = LegacyAttributeReleasePolicy
+	}
+
+	attributes, err := policy.ReleaseAttributes(session, req.ServiceProviderMetadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to release attributes")
+	}
+	return attributes, nil
+}
+
+// filterRequestedAttributes drops the attributes the SP did not ask for in
+// the AttributeConsumingService selected by the request. Attributes are
+// released unfiltered if the SP's metadata does not list any such service.
+func (req *IdpAuthnRequest) filterRequestedAttributes(attributes []Attribute) ([]Attribute, error) {
+	if req.ServiceProviderMetadata == nil {
+		return attributes, nil
+	}
+
+	index := req.Request.AttributeConsumingServiceIndex
+	service := req.ServiceProviderMetadata.AttributeConsumingService(index)
+	if service == nil {
+		if index != nil {
+			return nil, errors.Errorf("unknown AttributeConsumingServiceIndex %d", *index)
+		}
+		return attributes, nil
+	}
+
+	released := []Attribute{}
+	for _, attr := range attributes {
+		for _, requested := range service.RequestedAttribute {
+			if attr, ok := releaseRequestedAttribute(attr, requested); ok {
+				released = append(released, attr)
+				break
+			}
+		}
+	}
+	return released, nil
+}
+
+// releaseRequestedAttribute reports whether attr matches the requested
+// attribute. If the SP asked for specific values, only those are kept.
+func releaseRequestedAttribute(attr Attribute, requested RequestedAttribute) (Attribute, bool) {
+	if attr.Name != requested.Name {
+		return attr, false
+	}
+	if requested.NameFormat != "" && attr.NameFormat != "" && requested.NameFormat != attr.NameFormat {
+		return attr, false
+	}
+	if len(requested.Values) == 0 {
+		return attr, true
+	}
+
+	values := []AttributeValue{}
+	for _, value := range attr.Values {
+		for _, requestedValue := range requested.Values {
+			if value.Value == requestedValue.Value {
+				values = append(values, value)
+				break
+			}
+		}
+	}
+	if len(values) == 0 {
+		return attr, false
+	}
+	attr.Values = values
+	return attr, true
+}
+
+// MarshalAssertion produces the XML assertion sent to the SP, signed and
+// encrypted as the SP's policy asks.
 func (req *IdpAuthnRequest) MarshalAssertion() error {
 	buf, err := xml.Marshal(req.Assertion)
 	if err != nil {
 		return err
 	}
 
-	keyFile, err := req.IDP.PrivkeyFile()
+	policy := req.spPolicy()
+	if policy.Signing.signAssertion() {
+		if buf, err = req.IDP.sign(buf); err != nil {
+			return err
+		}
+	}
+
+	req.AssertionEncrypted = false
+	if policy.Encryption != EncryptNever {
+		keyDescriptor, err := req.spEncryptionKey()
+		if err != nil && policy.Encryption == EncryptAlways {
+			return err
+		}
+		if err == nil {
+			if buf, err = req.encrypt(buf, keyDescriptor); err != nil {
+				return err
+			}
+			req.AssertionEncrypted = true
+		}
+	}
+
+	req.AssertionBuffer = bytes.TrimSpace(bytes.TrimPrefix(buf, []byte(`<?xml version="1.0"?>`)))
+
+	return nil
+}
+
+// sign signs the XML document in buf with the IdP's key.
+func (idp *IdentityProvider) sign(buf []byte) ([]byte, error) {
+	keyFile, err := idp.PrivkeyFile()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	buf, err = xmlsec.Sign(buf, keyFile, &xmlsec.ValidationOptions{
+	signed, err := idp.xmlsecCommand().Sign(buf, keyFile, &xmlsec.ValidationOptions{
 		EnableIDAttrHack: true,
 	})
 	if err != nil {
-		if IsSecurityException(err, &req.IDP.SecurityOpts) {
-			return err
+		if IsSecurityException(err, &idp.SecurityOpts) {
+			return nil, err
 		}
 	}
+	return signed, nil
+}
 
-	req.IDP.SPMetadataURL = (func() string {
-		if req.Request.Issuer.Value != "" {
-			return req.Request.Issuer.Value
-		}
-		if req.ServiceProviderMetadata != nil {
-			return req.ServiceProviderMetadata.EntityID
-		}
-		return ""
-	})()
+// encrypt encrypts the XML document in buf for the given key of the SP.
+func (req *IdpAuthnRequest) encrypt(buf []byte, keyDescriptor *KeyDescriptor) ([]byte, error) {
+	dataAlgorithm, keyMethod, err := negotiateEncryptionMethods(keyDescriptor.EncryptionMethods)
+	if err != nil {
+		return nil, err
+	}
 
-	spCertFile, err := req.IDP.GetSPCertFile()
+	sessionKey, err := xmlsec.SessionKey(dataAlgorithm)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// EncryptedDataTemplate
-	tpl := xmlsec.NewEncryptedDataTemplate(
-		"http://www.w3.org/2001/04/xmlenc#aes128-cbc",
-		"http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p",
-	)
+	spCertFile, err := req.spCertFile(keyDescriptor)
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO: pick an encryption algorithm from the actual metadata.
-	buf, err = xmlsec.Encrypt(tpl, buf, spCertFile, "aes-128-cbc")
+	tpl := xmlsec.NewEncryptedDataTemplate(dataAlgorithm, keyMethod.Algorithm)
+	tpl.KeyInfo.EncryptedKey.EncryptionMethod = *keyMethod
+	encrypted, err := req.IDP.xmlsecCommand().Encrypt(tpl, buf, spCertFile, sessionKey)
 	if err != nil {
 		if IsSecurityException(err, &req.IDP.SecurityOpts) {
-			return err
+			return nil, err
 		}
 	}
-
-	req.AssertionBuffer = bytes.TrimSpace(bytes.TrimPrefix(buf, []byte(`<?xml version="1.0"?>`)))
-
-	return nil
+	return encrypted, nil
 }
 
 // MakeResponse computes the Response field of the IdpAuthnRequest
@@ -459,9 +894,9 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 
 	req.Response = &Response{
 		Destination:  req.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient,
-		ID:           NewID(),
+		ID:           req.IDP.newID(),
 		InResponseTo: req.Request.ID,
-		IssueInstant: Now(),
+		IssueInstant: req.IDP.now(),
 		Version:      "2.0",
 		Issuer: &Issuer{
 			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
@@ -472,9 +907,13 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 				Value: StatusSuccess,
 			},
 		},
-		EncryptedAssertion: &EncryptedAssertion{
+	}
+	if req.AssertionEncrypted {
+		req.Response.EncryptedAssertion = &EncryptedAssertion{
 			EncryptedData: req.AssertionBuffer,
-		},
+		}
+	} else {
+		req.Response.Assertion = req.Assertion
 	}
 	if req.Response.Destination == "" {
 		return errors.New("missing response destination")
@@ -482,77 +921,143 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 	return nil
 }
 
-// GetSPCertFile returns a physical path where the SP's certificate can be
-// accessed.
-func (idp *IdentityProvider) GetSPCertFile() (string, error) {
-	meta, err := idp.GetSPMetadata()
-	if err != nil {
-		return "", err
+// MarshalResponse produces the XML of req.Response in req.ResponseBuffer,
+// signed if the SP's policy asks for it. A plain text assertion is included
+// as found in req.AssertionBuffer so its signature stays valid.
+func (req *IdpAuthnRequest) MarshalResponse() error {
+	response := *req.Response
+	plainAssertion := response.Assertion != nil && req.AssertionBuffer != nil
+	if plainAssertion {
+		response.Assertion = nil
 	}
 
-	if meta.SPSSODescriptor == nil {
-		return "", errors.New("missing sp sso descriptor")
+	policy := req.spPolicy()
+	if policy.Signing.signResponse() {
+		cert, err := req.IDP.Cert()
+		if err != nil {
+			return err
+		}
+		response.Signature = policy.signatureTemplate(pem.EncodeToMemory(cert), response.ID)
 	}
 
-	cert := ""
-	for _, keyDescriptor := range meta.SPSSODescriptor.KeyDescriptor {
-		if keyDescriptor.Use == "encryption" {
-			cert = keyDescriptor.KeyInfo.Certificate
-			break
-		}
+	buf, err := xml.MarshalIndent(response, "", "\t")
+	if err != nil {
+		return err
 	}
 
-	if cert == "" {
-		for _, keyDescriptor := range meta.SPSSODescriptor.KeyDescriptor {
-			if keyDescriptor.KeyInfo.Certificate != "" {
-				cert = keyDescriptor.KeyInfo.Certificate
-				break
-			}
+	if plainAssertion {
+		if buf, err = insertAssertion(buf, req.AssertionBuffer); err != nil {
+			return err
 		}
 	}
 
-	if cert == "" {
-		return "", errors.New("missing sp cert")
+	if response.Signature != nil {
+		if buf, err = req.IDP.sign(buf); err != nil {
+			return err
+		}
+		buf = bytes.TrimSpace(bytes.TrimPrefix(buf, []byte(`<?xml version="1.0"?>`)))
 	}
 
-	certBytes, _ := base64.StdEncoding.DecodeString(cert)
-
-	certBytes = pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certBytes,
-	})
+	req.ResponseBuffer = buf
+	return nil
+}
 
-	return writeFile(certBytes)
+// insertAssertion adds the XML of an assertion as the last child of the XML
+// of a Response.
+func insertAssertion(response []byte, assertion []byte) ([]byte, error) {
+	end := bytes.LastIndex(response, []byte("</Response>"))
+	if end < 0 {
+		return nil, errors.New("failed to find the end of the response")
+	}
+	return append(response[:end:end], append(append(assertion, '\n'), response[end:]...)...), nil
 }
 
-// GetSPMetadata returns a the SP's metadata value
-func (idp *IdentityProvider) GetSPMetadata() (*Metadata, error) {
-	if idp.SPMetadata != nil {
-		m := *(idp.SPMetadata)
-		return &m, nil
+// MakeStatusResponse sets req.Response to a Response carrying the status of
+// the given error instead of an assertion. It is sent to req.ACSEndpoint if it
+// was resolved, and to the SP's default assertion consumer service otherwise,
+// as the one requested may be the cause of the error.
+func (req *IdpAuthnRequest) MakeStatusResponse(statusErr *StatusError) error {
+	if req.ServiceProviderMetadata == nil || req.ServiceProviderMetadata.SPSSODescriptor == nil {
+		return errors.New("missing sp sso descriptor")
+	}
+	endpoint := req.ACSEndpoint
+	if endpoint == nil {
+		endpoint = defaultIndexedEndpoint(req.ServiceProviderMetadata.SPSSODescriptor.AssertionConsumerService, req.acsBinding())
+	}
+	if endpoint == nil {
+		return errors.Errorf("sp metadata lists no %s assertion consumer service", bindingName(req.acsBinding()))
 	}
 
-	if idp.SPMetadataURL == "" {
-		return nil, errors.New("missing sp metadata url")
+	req.Response = &Response{
+		Destination:  endpoint.Location,
+		ID:           req.IDP.newID(),
+		InResponseTo: req.Request.ID,
+		IssueInstant: req.IDP.now(),
+		Version:      "2.0",
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  req.IDP.MetadataURL,
+		},
+		Status: statusErr.Status(),
 	}
+	return nil
+}
 
-	res, err := http.Get(idp.SPMetadataURL)
+// GetServiceProvider returns the metadata of the SP with the given entity ID,
+// as found in the IdP's ServiceProviders registry.
+func (idp *IdentityProvider) GetServiceProvider(ctx context.Context, entityID string) (*Metadata, error) {
+	if idp.ServiceProviders == nil {
+		return nil, errors.New("missing service provider registry")
+	}
+	if entityID == "" {
+		return nil, errors.New("missing issuer")
+	}
+	start := time.Now()
+	metadata, err := idp.ServiceProviders.GetServiceProvider(ctx, entityID)
+	idp.logger().DebugContext(ctx, "looked up service provider",
+		"entity_id", entityID,
+		"duration", time.Since(start),
+		errorAttr(err))
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "failed to get service provider %q", entityID)
 	}
-	defer res.Body.Close()
+	if metadata.SPSSODescriptor == nil {
+		return nil, errors.Errorf("service provider %q has no sp sso descriptor", entityID)
+	}
+	return metadata, nil
+}
 
-	buf, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+// spEncryptionKey returns the key descriptor of the SP the assertion is
+// encrypted for.
+func (req *IdpAuthnRequest) spEncryptionKey() (*KeyDescriptor, error) {
+	if req.ServiceProviderMetadata == nil || req.ServiceProviderMetadata.SPSSODescriptor == nil {
+		return nil, errors.New("missing sp sso descriptor")
 	}
 
-	var metadata Metadata
-	err = xml.Unmarshal(buf, &metadata)
-	if err != nil {
-		return nil, err
+	keyDescriptors := req.ServiceProviderMetadata.SPSSODescriptor.KeyDescriptor
+	for i := range keyDescriptors {
+		if keyDescriptors[i].Use == "encryption" && keyDescriptors[i].KeyInfo.Certificate != "" {
+			return &keyDescriptors[i], nil
+		}
+	}
+	for i := range keyDescriptors {
+		if keyDescriptors[i].KeyInfo.Certificate != "" {
+			return &keyDescriptors[i], nil
+		}
 	}
+	return nil, errors.New("missing sp cert")
+}
+
+// spCertFile returns a physical path where the certificate of the given key
+// descriptor can be accessed.
+func (req *IdpAuthnRequest) spCertFile(keyDescriptor *KeyDescriptor) (string, error) {
+	cert := keyDescriptor.KeyInfo.Certificate
+	certBytes, _ := base64.StdEncoding.DecodeString(cert)
+
+	certBytes = pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certBytes,
+	})
 
-	idp.SPMetadata = &metadata
-	return &metadata, nil
+	return writeFile(req.IDP.workDir(), certBytes)
 }
@@ -0,0 +1,302 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/soap"
+)
+
+// ErrUnknownPrincipal is returned by an AttributeSource when it knows no
+// principal with the given NameID.
+var ErrUnknownPrincipal = errors.New("unknown principal")
+
+// AttributeSource looks up the principals whose attributes SPs query from the
+// IdP's attribute authority, see IdentityProvider.AttributeQueryHandler.
+type AttributeSource interface {
+	// GetPrincipal returns a session describing the principal the given NameID
+	// was issued to for the SP with the given metadata, or
+	// ErrUnknownPrincipal. Only the attributes of the session are used: they
+	// are released to the SP through its AttributeReleasePolicy, as in
+	// assertions.
+	GetPrincipal(ctx context.Context, nameID *NameID, sp *Metadata) (*Session, error)
+}
+
+// AttributeSourceFunc is an adapter to use a function as an AttributeSource.
+type AttributeSourceFunc func(ctx context.Context, nameID *NameID, sp *Metadata) (*Session, error)
+
+// GetPrincipal implements AttributeSource.
+func (fn AttributeSourceFunc) GetPrincipal(ctx context.Context, nameID *NameID, sp *Metadata) (*Session, error) {
+	return fn(ctx, nameID, sp)
+}
+
+// IdpAttributeQuery is used by IdentityProvider to handle an attribute query.
+type IdpAttributeQuery struct {
+	IDP *IdentityProvider
+
+	// HTTP request the AttributeQuery was received with
+	HTTPRequest *http.Request
+
+	// XML of the AttributeQuery, as sent by the SP
+	RequestBuffer []byte
+
+	Request                 AttributeQuery
+	ServiceProviderMetadata *Metadata
+
+	Response       *Response
+	ResponseBuffer []byte
+}
+
+// AttributeQueryHandler serves the IdP's attribute service,
+// AttributeServiceURL, using the SOAP binding. The AttributeQuery must come
+// from a known SP and be signed with one of the signing certificates of its
+// metadata, otherwise it is answered with a SOAP fault. The attributes of the
+// principal, found with the AttributeSource, are released as for assertions
+// and filtered by the query. The assertion is signed as the SP's policy asks
+// but never encrypted, the SOAP binding being protected by TLS.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 6
+func (idp *IdentityProvider) AttributeQueryHandler(w http.ResponseWriter, r *http.Request) {
+	handler := soap.Handler{MaxMessageSize: maxRequestSize}
+	handler.HandleFunc(soap.ProtocolMessage("AttributeQuery"), idp.answerAttributeQuery)
+	handler.ServeHTTP(w, r)
+}
+
+// answerAttributeQuery returns the XML of the Response answering the
+// AttributeQuery of the given envelope.
+func (idp *IdentityProvider) answerAttributeQuery(r *http.Request, envelope *soap.Envelope) ([]byte, error) {
+	start := time.Now()
+	req, err := idp.attributeQuery(r, envelope.Body.XML)
+	if err != nil {
+		idp.logger().DebugContext(r.Context(), "rejected attribute query", errorAttr(err))
+		return nil, &soap.Fault{Code: soap.FaultClient, String: err.Error()}
+	}
+	if err := req.MakeResponse(); err != nil {
+		return nil, err
+	}
+	if err := req.MarshalResponse(); err != nil {
+		return nil, err
+	}
+
+	var nameID *NameID
+	if req.Request.Subject != nil {
+		nameID = req.Request.Subject.NameID
+	}
+	idp.logger().DebugContext(r.Context(), "answered attribute query",
+		"query_id", req.Request.ID,
+		"issuer", req.Request.Issuer.Value,
+		"response_id", req.Response.ID,
+		"duration", time.Since(start),
+		idp.sensitive("name_id", nameIDValue(nameID)))
+	return req.ResponseBuffer, nil
+}
+
+// ParseAttributeQuery reads the AttributeQuery a SP sent to the IdP's
+// attribute service, using the SOAP binding. The query must come from a known
+// SP and be signed with one of the signing certificates of its metadata.
+func (idp *IdentityProvider) ParseAttributeQuery(r *http.Request) (*IdpAttributeQuery, error) {
+	if r.Method != http.MethodPost {
+		return nil, errors.Errorf("unsupported method %s", r.Method)
+	}
+	envelope, err := soap.ReadEnvelope(r.Body, maxRequestSize)
+	if err != nil {
+		return nil, err
+	}
+	return idp.attributeQuery(r, envelope.Body.XML)
+}
+
+// attributeQuery checks the AttributeQuery in buf, received with the given
+// HTTP request.
+func (idp *IdentityProvider) attributeQuery(r *http.Request, buf []byte) (*IdpAttributeQuery, error) {
+	req := &IdpAttributeQuery{
+		IDP:           idp,
+		HTTPRequest:   r,
+		RequestBuffer: buf,
+	}
+
+	if err := xml.Unmarshal(req.RequestBuffer, &req.Request); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal attribute query")
+	}
+
+	if req.Request.Destination != "" && idp.AttributeServiceURL != "" && req.Request.Destination != idp.AttributeServiceURL {
+		return nil, errors.Errorf("wrong destination, expected %q, got %q", idp.AttributeServiceURL, req.Request.Destination)
+	}
+	if req.Request.Issuer == nil {
+		return nil, errors.New("missing issuer")
+	}
+
+	var err error
+	req.ServiceProviderMetadata, err = idp.GetServiceProvider(r.Context(), req.Request.Issuer.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Request.Signature == nil {
+		return nil, errors.New("failed to verify attribute query signature: message is not signed")
+	}
+	certs := signingCertificates(req.ServiceProviderMetadata.SPSSODescriptor.KeyDescriptor)
+	if err := idp.verifySignature(req.RequestBuffer, req.Request.Signature, req.Request.ID, certs); err != nil {
+		return nil, errors.Wrap(err, "failed to verify attribute query signature")
+	}
+
+	return req, nil
+}
+
+// MakeResponse sets req.Response to the Response answering the query: an
+// assertion holding the attributes of the principal or, if the query cannot
+// be answered, the status of the *StatusError that prevents it.
+func (req *IdpAttributeQuery) MakeResponse() error {
+	idp := req.IDP
+
+	req.Response = &Response{
+		ID:           idp.newID(),
+		InResponseTo: req.Request.ID,
+		IssueInstant: idp.now(),
+		Version:      "2.0",
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL,
+		},
+	}
+
+	attributes, err := req.queryAttributes()
+	if statusErr, ok := errors.Cause(err).(*StatusError); ok {
+		req.Response.Status = statusErr.Status()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entityID := req.ServiceProviderMetadata.EntityID
+	id := idp.newID()
+	policy := idp.SPPolicy(entityID)
+	assertion := &Assertion{
+		ID:           id,
+		IssueInstant: idp.now(),
+		Version:      "2.0",
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL,
+		},
+		Subject: &Subject{
+			NameID: req.Request.Subject.NameID,
+		},
+		Conditions: &Conditions{
+			NotBefore:    idp.now(),
+			NotOnOrAfter: idp.now().Add(IssueLifetime),
+			AudienceRestriction: &AudienceRestriction{
+				Audience: &Audience{Value: entityID},
+			},
+		},
+		AttributeStatement: &AttributeStatement{
+			Attributes: attributes,
+		},
+	}
+	if policy.Signing.signAssertion() {
+		if assertion.Signature, err = idp.signatureTemplate(policy, id); err != nil {
+			return err
+		}
+	}
+
+	req.Response.Status = &Status{
+		StatusCode: StatusCode{
+			Value: StatusSuccess,
+		},
+	}
+	req.Response.Assertion = assertion
+	return nil
+}
+
+// queryAttributes returns the attributes of the principal the query is about
+// that are released to the SP and requested by the query.
+func (req *IdpAttributeQuery) queryAttributes() ([]Attribute, error) {
+	idp := req.IDP
+	if idp.AttributeSource == nil {
+		return nil, NewRequestUnsupportedError("attribute queries are not supported")
+	}
+	if req.Request.Subject == nil || req.Request.Subject.NameID == nil {
+		return nil, &StatusError{Code: StatusRequester, Message: "missing subject"}
+	}
+
+	session, err := idp.AttributeSource.GetPrincipal(req.HTTPRequest.Context(), req.Request.Subject.NameID, req.ServiceProviderMetadata)
+	if err == ErrUnknownPrincipal {
+		return nil, &StatusError{Code: StatusRequester, SubCode: StatusUnknownPrincipal}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get principal")
+	}
+
+	policy := idp.SPPolicy(req.ServiceProviderMetadata.EntityID).AttributeRelease
+	if policy == nil {
+		policy = LegacyAttributeReleasePolicy
+	}
+	attributes, err := policy.ReleaseAttributes(session, req.ServiceProviderMetadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to release attributes")
+	}
+
+	if len(req.Request.Attributes) == 0 {
+		return attributes, nil
+	}
+	released := []Attribute{}
+	for _, attr := range attributes {
+		for _, queried := range req.Request.Attributes {
+			requested := RequestedAttribute{
+				Name:       queried.Name,
+				NameFormat: queried.NameFormat,
+				Values:     queried.Values,
+			}
+			if attr, ok := releaseRequestedAttribute(attr, requested); ok {
+				released = append(released, attr)
+				break
+			}
+		}
+	}
+	return released, nil
+}
+
+// MarshalResponse produces the XML of req.Response in req.ResponseBuffer,
+// signed as the SP's policy asks.
+func (req *IdpAttributeQuery) MarshalResponse() error {
+	idp := req.IDP
+	policy := idp.SPPolicy(req.ServiceProviderMetadata.EntityID)
+
+	response := *req.Response
+	response.Assertion = nil
+	if policy.Signing.signResponse() {
+		var err error
+		if response.Signature, err = idp.signatureTemplate(policy, response.ID); err != nil {
+			return err
+		}
+	}
+
+	buf, err := xml.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	if assertion := req.Response.Assertion; assertion != nil {
+		assertionBuf, err := idp.marshalMessage(assertion, assertion.Signature != nil)
+		if err != nil {
+			return err
+		}
+		if buf, err = insertAssertion(buf, assertionBuf); err != nil {
+			return err
+		}
+	}
+
+	if response.Signature != nil {
+		if buf, err = idp.sign(buf); err != nil {
+			return err
+		}
+		buf = bytes.TrimSpace(bytes.TrimPrefix(buf, []byte(`<?xml version="1.0"?>`)))
+	}
+
+	req.ResponseBuffer = buf
+	return nil
+}
@@ -0,0 +1,193 @@
+package saml
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pressly/saml/soap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttributeQuery(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.AttributeSource = AttributeSourceFunc(func(ctx context.Context, nameID *NameID, sp *Metadata) (*Session, error) {
+		if nameID.Value != "anakin" {
+			return nil, ErrUnknownPrincipal
+		}
+		return &Session{
+			UserName:  "anakin",
+			UserEmail: "anakin@example.org",
+			Groups:    []string{"jedi", "sith"},
+		}, nil
+	})
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	// The IdP cannot sign without xmlsec1, so the server only answers with
+	// status responses.
+	var queries []AttributeQuery
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, soap.Action, r.Header.Get("SOAPAction"))
+		envelope, err := soap.ReadEnvelope(r.Body, 0)
+		assert.NoError(t, err)
+		buf := envelope.Body.XML
+
+		req := &IdpAttributeQuery{
+			IDP:                     idp,
+			HTTPRequest:             r,
+			RequestBuffer:           buf,
+			ServiceProviderMetadata: spMetadata,
+		}
+		assert.NoError(t, xml.Unmarshal(buf, &req.Request))
+		queries = append(queries, req.Request)
+
+		assert.NoError(t, req.MakeResponse())
+		assert.NoError(t, req.MarshalResponse())
+		soap.WriteMessage(w, req.ResponseBuffer)
+	}))
+	defer server.Close()
+	idp.AttributeServiceURL = server.URL
+
+	idpMetadata, err := idp.Metadata()
+	assert.NoError(t, err)
+	if assert.NotNil(t, idpMetadata.AttributeAuthorityDescriptor) {
+		assert.Equal(t, []Endpoint{{Binding: SOAPBinding, Location: server.URL}}, idpMetadata.AttributeAuthorityDescriptor.AttributeService)
+	}
+
+	issueInstant := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	sp := &ServiceProvider{
+		MetadataURL: testSP.MetadataURL,
+		PrivkeyPEM:  testSP.PrivkeyPEM,
+		PubkeyPEM:   testSP.PubkeyPEM,
+		IdPMetadata: idpMetadata,
+		Now:         func() time.Time { return issueInstant },
+		NewID:       func() string { return "query-id" },
+	}
+	nameID := &NameID{Format: NameIDPersistentFormat, Value: "obiwan"}
+	_, err = sp.QueryAttributes(context.Background(), nameID, []Attribute{{Name: "email"}})
+	assert.Equal(t, &StatusError{Code: StatusRequester, SubCode: StatusUnknownPrincipal}, err)
+
+	if assert.Len(t, queries, 1) {
+		query := queries[0]
+		assert.Equal(t, "query-id", query.ID)
+		assert.True(t, issueInstant.Equal(query.IssueInstant))
+		assert.Equal(t, server.URL, query.Destination)
+		assert.Equal(t, testSP.MetadataURL, query.Issuer.Value)
+		assert.Equal(t, "obiwan", query.Subject.NameID.Value)
+		if assert.Len(t, query.Attributes, 1) {
+			assert.Equal(t, "email", query.Attributes[0].Name)
+		}
+		if assert.NotNil(t, query.Signature) {
+			assert.Equal(t, "#"+query.ID, query.Signature.Reference.URI)
+		}
+	}
+
+	// The attributes released to the SP are filtered by the query.
+	req := &IdpAttributeQuery{
+		IDP:                     idp,
+		HTTPRequest:             httptest.NewRequest("POST", server.URL, nil),
+		ServiceProviderMetadata: spMetadata,
+		Request: AttributeQuery{
+			ID:      "query",
+			Subject: &Subject{NameID: &NameID{Value: "anakin"}},
+			Attributes: []Attribute{
+				{Name: "urn:oid:1.3.6.1.4.1.5923.1.1.1.1", Values: []AttributeValue{{Value: "jedi"}}},
+				{Name: "email"},
+			},
+		},
+	}
+	assert.NoError(t, req.MakeResponse())
+	assert.Equal(t, "query", req.Response.InResponseTo)
+	assert.Equal(t, StatusSuccess, req.Response.Status.StatusCode.Value)
+	if assertion := req.Response.Assertion; assert.NotNil(t, assertion) {
+		assert.Equal(t, "anakin", assertion.Subject.NameID.Value)
+		assert.Equal(t, testSP.MetadataURL, assertion.Conditions.AudienceRestriction.Audience.Value)
+
+		released := map[string][]string{}
+		for _, attr := range assertion.AttributeStatement.Attributes {
+			for _, value := range attr.Values {
+				released[attr.Name] = append(released[attr.Name], value.Value)
+			}
+		}
+		assert.Equal(t, map[string][]string{
+			"email":                            {"anakin@example.org"},
+			"urn:oid:1.3.6.1.4.1.5923.1.1.1.1": {"jedi"},
+		}, released)
+	}
+}
+
+func TestQueryAttributesResponseOrigin(t *testing.T) {
+	tearUp()
+
+	var response Response
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, err := xml.Marshal(&response)
+		assert.NoError(t, err)
+		soap.WriteMessage(w, buf)
+	}))
+	defer server.Close()
+
+	sp := &ServiceProvider{
+		MetadataURL:            testSP.MetadataURL,
+		PrivkeyPEM:             testSP.PrivkeyPEM,
+		PubkeyPEM:              testSP.PubkeyPEM,
+		IdPEntityID:            "https://idp.example.org",
+		IdPAttributeServiceURL: server.URL,
+		NewID:                  func() string { return "query-id" },
+	}
+	nameID := &NameID{Format: NameIDPersistentFormat, Value: "obiwan"}
+	denied := &Status{StatusCode: StatusCode{Value: StatusRequester}}
+
+	response = Response{InResponseTo: "query-id", Issuer: &Issuer{Value: "https://idp.example.org"}, Status: denied}
+	_, err := sp.QueryAttributes(context.Background(), nameID, nil)
+	assert.Equal(t, &StatusError{Code: StatusRequester}, err)
+
+	// Responses to other queries, or from other entities, are rejected
+	// before their status is considered.
+	response = Response{InResponseTo: "another-id", Issuer: &Issuer{Value: "https://idp.example.org"}, Status: denied}
+	_, err = sp.QueryAttributes(context.Background(), nameID, nil)
+	assert.EqualError(t, err, `response answers "another-id" instead of "query-id"`)
+
+	response = Response{InResponseTo: "query-id", Issuer: &Issuer{Value: "https://evil.example.org"}, Status: denied}
+	_, err = sp.QueryAttributes(context.Background(), nameID, nil)
+	assert.EqualError(t, err, "response issued by another entity")
+
+	response = Response{InResponseTo: "query-id", Status: denied}
+	_, err = sp.QueryAttributes(context.Background(), nameID, nil)
+	assert.EqualError(t, err, "response issued by another entity")
+
+	sp.IdPEntityID = ""
+	_, err = sp.QueryAttributes(context.Background(), nameID, nil)
+	assert.EqualError(t, err, "missing idp entity id")
+}
+
+func TestAttributeQueryHandler(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	server := httptest.NewServer(http.HandlerFunc(idp.AttributeQueryHandler))
+	defer server.Close()
+
+	buf, err := xml.Marshal(&AttributeQuery{
+		ID:           "query",
+		Version:      "2.0",
+		IssueInstant: Now(),
+		Issuer:       &Issuer{Value: testSP.MetadataURL},
+		Subject:      &Subject{NameID: &NameID{Value: "anakin"}},
+	})
+	assert.NoError(t, err)
+
+	_, err = (&soap.Client{}).Send(context.Background(), server.URL, buf)
+	assert.EqualError(t, err, "soap fault Client: failed to verify attribute query signature: message is not signed")
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,165 @@
+package saml
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/soap"
+)
+
+// PasswordAuthenticator authenticates a user with a username and a password,
+// such as the HTTP Basic credentials an ECP sends. It returns a nil session
+// and no error if the credentials are wrong. As with Authenticator, a
+// *StatusError is reported to the SP and any other error as AuthnFailed.
+type PasswordAuthenticator func(r *http.Request, username, password string) (*Session, error)
+
+// ECPHandler serves the SSO service of the IdP for ECPs, ECPURL. It reads the
+// AuthnRequest an ECP relays from a SP with the SOAP binding, authenticates
+// the user with the HTTP Basic credentials of the request and the IdP's
+// ECPAuthenticator, and answers with the Response for the SP, which the ECP
+// delivers to the SP's PAOS assertion consumer service. Requests without
+// valid credentials are answered with the 401 status code, requests that come
+// from a known SP but cannot be honored, and failed authentications, with a
+// Response carrying the error status, and other requests with a SOAP fault.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 4.2.4.3
+func (idp *IdentityProvider) ECPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if idp.ECPAuthenticator == nil {
+		soap.WriteFault(w, &soap.Fault{Code: soap.FaultServer, String: "missing ecp authenticator"})
+		return
+	}
+
+	req, err := idp.ParseECPAuthnRequest(r)
+	if _, ok := err.(*StatusError); ok {
+		// The SP is known but its request cannot be honored, let it know.
+		idp.writeECPResponse(w)(req.GenerateECPErrorResponse(err))
+		return
+	}
+	if err != nil {
+		soap.WriteFault(w, &soap.Fault{Code: soap.FaultClient, String: err.Error()})
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		idp.requireBasicAuth(w)
+		return
+	}
+	sess, err := idp.ECPAuthenticator(r, username, password)
+	switch {
+	case err != nil:
+		idp.writeECPResponse(w)(req.GenerateECPErrorResponse(authnStatusError(err)))
+	case sess == nil:
+		idp.requireBasicAuth(w)
+	default:
+		envelope, err := req.GenerateECPResponse(sess)
+		if _, ok := errors.Cause(err).(*StatusError); ok {
+			envelope, err = req.GenerateECPErrorResponse(err)
+		}
+		idp.writeECPResponse(w)(envelope, err)
+	}
+}
+
+// requireBasicAuth answers a request without valid HTTP Basic credentials.
+func (idp *IdentityProvider) requireBasicAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+idp.MetadataURL+`", charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// writeECPResponse returns a function writing the SOAP envelope returned by
+// one of the GenerateECP methods of IdpAuthnRequest, or a fault if an error
+// prevented building it.
+func (idp *IdentityProvider) writeECPResponse(w http.ResponseWriter) func(envelope []byte, err error) {
+	return func(envelope []byte, err error) {
+		if err != nil {
+			soap.WriteFault(w, &soap.Fault{Code: soap.FaultServer, String: "failed to process saml request"})
+			return
+		}
+		w.Header().Set("Content-Type", soap.ContentType)
+		w.Write(envelope)
+	}
+}
+
+// ParseECPAuthnRequest reads the AuthnRequest an ECP sent to the IdP's ECP
+// SSO service, using the SOAP binding. As with ParseAuthnRequest, the request
+// is validated and a request that comes from a known SP but cannot be honored
+// is returned along with a *StatusError, to be answered with
+// IdpAuthnRequest.GenerateECPErrorResponse. The Response is sent to a PAOS
+// assertion consumer service of the SP.
+func (idp *IdentityProvider) ParseECPAuthnRequest(r *http.Request) (*IdpAuthnRequest, error) {
+	if r.Method != http.MethodPost {
+		return nil, errors.Errorf("unsupported method %s", r.Method)
+	}
+	envelope, err := soap.ReadEnvelope(r.Body, maxRequestSize)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.Body.Name != soap.ProtocolMessage("AuthnRequest") {
+		return nil, errors.Errorf("unexpected message %s", envelope.Body.Name.Local)
+	}
+
+	req := &IdpAuthnRequest{
+		IDP:           idp,
+		HTTPRequest:   r,
+		Address:       remoteAddr(r),
+		Binding:       SOAPBinding,
+		RequestBuffer: envelope.Body.XML,
+	}
+	if err := req.load(idp.ECPURL); err != nil {
+		if _, ok := err.(*StatusError); ok {
+			return req, err
+		}
+		return nil, err
+	}
+	return req, nil
+}
+
+// GenerateECPResponse builds the response to the request for the given
+// session and returns the SOAP envelope answering the ECP, see
+// GenerateResponse.
+func (req *IdpAuthnRequest) GenerateECPResponse(sess *Session) ([]byte, error) {
+	if sess == nil {
+		if req.Request.IsPassive {
+			return req.GenerateECPErrorResponse(NewNoPassiveError(""))
+		}
+		return req.GenerateECPErrorResponse(NewAuthnFailedError(""))
+	}
+
+	if err := req.makeSessionResponse(sess); err != nil {
+		return nil, err
+	}
+	return req.responseEnvelope()
+}
+
+// GenerateECPErrorResponse returns the SOAP envelope answering the ECP with a
+// response carrying the status of the given error, see GenerateErrorResponse.
+func (req *IdpAuthnRequest) GenerateECPErrorResponse(err error) ([]byte, error) {
+	if err := req.makeErrorResponse(err); err != nil {
+		return nil, err
+	}
+	return req.responseEnvelope()
+}
+
+// responseEnvelope returns the SOAP envelope holding req.Response, with the
+// ECP header block telling the ECP where to deliver it.
+func (req *IdpAuthnRequest) responseEnvelope() ([]byte, error) {
+	if err := req.MarshalResponse(); err != nil {
+		return nil, errors.Wrap(err, "failed to format response")
+	}
+
+	header, err := xml.Marshal(&ECPResponse{
+		MustUnderstand:              "1",
+		Actor:                       soap.ActorNext,
+		AssertionConsumerServiceURL: req.Response.Destination,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal header block")
+	}
+	return soap.Marshal(req.ResponseBuffer, header), nil
+}
@@ -1,13 +1,16 @@
 package saml
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/xml"
+	"log/slog"
+	"net"
 	"net/http"
-	"text/template"
+	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/pressly/saml/instrument"
 )
 
 // MetadataHandler generates and serves the IdP's metadata.xml file.
@@ -27,7 +30,142 @@ func (idp *IdentityProvider) MetadataHandler(w http.ResponseWriter, r *http.Requ
 	w.Write(out)
 }
 
-// NewLoginRequest creates a login request against an SP.
+// LoginUI holds the hooks of the pages Handler shows users. Any of them may be
+// nil, a default behavior is used then. The login page itself is served by
+// the Authenticator.
+type LoginUI struct {
+	// Called with a valid AuthnRequest before the user is authenticated. It
+	// may answer the HTTP request itself, for instance to let the user pick an
+	// account, and return false to stop there.
+	BeforeLogin func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest) bool
+
+	// Writes the page shown when a request cannot be answered with a SAML
+	// message, such as one coming from an unknown SP. A plain text error is
+	// written if nil.
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// renderError shows the user an error, see LoginUI.RenderError.
+func (idp *IdentityProvider) renderError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if idp.LoginUI.RenderError != nil {
+		idp.LoginUI.RenderError(w, r, status, err)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// Handler returns a handler serving the endpoints of the IdP at the paths of
+// MetadataURL, SSOURL and, if set, SLOURL, AttributeServiceURL and ECPURL: the
+// metadata (MetadataHandler), the SSO service (SSOHandler), the single logout
+// service (SingleLogoutHandler), the attribute service
+// (AttributeQueryHandler) and the SSO service for ECPs (ECPHandler). Other
+// paths are not found. The artifact binding is not supported.
+func (idp *IdentityProvider) Handler() http.Handler {
+	metadataPath, ssoPath := urlPath(idp.MetadataURL), urlPath(idp.SSOURL)
+	sloPath, attributePath, ecpPath := "", "", ""
+	if idp.SLOURL != "" {
+		sloPath = urlPath(idp.SLOURL)
+	}
+	if idp.AttributeServiceURL != "" {
+		attributePath = urlPath(idp.AttributeServiceURL)
+	}
+	if idp.ECPURL != "" {
+		ecpPath = urlPath(idp.ECPURL)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case metadataPath:
+			idp.MetadataHandler(w, r)
+		case ssoPath:
+			idp.SSOHandler(w, r)
+		case sloPath:
+			idp.SingleLogoutHandler(w, r)
+		case attributePath:
+			idp.AttributeQueryHandler(w, r)
+		case ecpPath:
+			idp.ECPHandler(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// urlPath returns the path of the given URL, "/" if it has none.
+func urlPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// SSOHandler serves the SSO service of the IdP, SSOURL. It reads the
+// AuthnRequest of the SP, using either the HTTP-Redirect or the HTTP-POST
+// binding, authenticates the user with the IdP's Authenticator, reusing the
+// SSO session if possible, and serves a form that posts the Response to the
+// SP. Requests that come from a known SP but cannot be honored, and failed
+// authentications, are answered with a Response carrying the error status.
+func (idp *IdentityProvider) SSOHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		idp.renderError(w, r, http.StatusMethodNotAllowed, errors.Errorf("unsupported method %s", r.Method))
+		return
+	}
+	if idp.Authenticator == nil {
+		idp.renderError(w, r, http.StatusInternalServerError, errors.New("missing authenticator"))
+		return
+	}
+
+	req, err := idp.ParseAuthnRequest(r)
+	if _, ok := err.(*StatusError); ok {
+		// The SP is known but its request cannot be honored, let it know.
+		idp.writeForm(w, r)(req.GenerateErrorResponse(err))
+		return
+	}
+	if err != nil {
+		idp.renderError(w, r, http.StatusBadRequest, errors.Wrap(err, "failed to parse saml request"))
+		return
+	}
+
+	if idp.LoginUI.BeforeLogin != nil && !idp.LoginUI.BeforeLogin(w, r, req) {
+		return
+	}
+
+	sess, err := req.Authenticate(w, idp.Authenticator)
+	switch {
+	case err != nil:
+		idp.writeForm(w, r)(req.GenerateErrorResponse(authnStatusError(err)))
+	case sess == nil && !req.Request.IsPassive:
+		// The Authenticator answered the request itself, with a login page.
+	default:
+		// A passive request without session gets a NoPassive status.
+		form, err := req.GenerateResponse(sess)
+		if _, ok := errors.Cause(err).(*StatusError); ok {
+			form, err = req.GenerateErrorResponse(err)
+		}
+		idp.writeForm(w, r)(form, err)
+	}
+}
+
+// writeForm returns a function writing the HTML form returned by one of the
+// Generate methods of IdpAuthnRequest, or the error that prevented building
+// it.
+func (idp *IdentityProvider) writeForm(w http.ResponseWriter, r *http.Request) func(form []byte, err error) {
+	return func(form []byte, err error) {
+		if err != nil {
+			idp.renderError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to process saml request"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(form)
+	}
+}
+
+// NewLoginRequest creates a login request against an SP, downloading its
+// metadata from spMetadataURL.
+//
+// Deprecated: use InitiateSSO, which finds the SP in the ServiceProviders
+// registry.
 func (idp *IdentityProvider) NewLoginRequest(spMetadataURL string, authFn Authenticator) (*LoginRequest, error) {
 	metadata, err := GetMetadata(spMetadataURL)
 	if err != nil {
@@ -42,6 +180,98 @@ func (idp *IdentityProvider) NewLoginRequest(spMetadataURL string, authFn Authen
 	return lr, nil
 }
 
+// maxRequestSize is the maximum size of a decoded SAML message.
+const maxRequestSize = 1 << 20
+
+// ParseAuthnRequest reads the AuthnRequest a SP sent to the IdP's SSO
+// endpoint, using either the HTTP-Redirect binding (base64 encoded and DEFLATE
+// compressed SAMLRequest query parameter) or the HTTP-POST binding (base64
+// encoded SAMLRequest form value). The returned request keeps the RelayState
+// and the decoded XML, as received. The request is validated before being
+// returned, see IdpAuthnRequest.Validate. A request that comes from a known SP
+// but cannot be honored is returned along with a *StatusError, and should be
+// answered with IdpAuthnRequest.GenerateErrorResponse.
+func (idp *IdentityProvider) ParseAuthnRequest(r *http.Request) (*IdpAuthnRequest, error) {
+	req := &IdpAuthnRequest{
+		IDP:         idp,
+		HTTPRequest: r,
+		Address:     remoteAddr(r),
+	}
+
+	var err error
+	req.Binding, req.RequestBuffer, req.RelayState, err = decodeSAMLMessage(r, "SAMLRequest")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.load(idp.SSOURL); err != nil {
+		if _, ok := err.(*StatusError); ok {
+			return req, err
+		}
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// load unmarshals and validates the AuthnRequest in req.RequestBuffer, which
+// was received at the given location.
+func (req *IdpAuthnRequest) load(location string) error {
+	if err := xml.Unmarshal(req.RequestBuffer, &req.Request); err != nil {
+		return errors.Wrap(err, "failed to unmarshal saml request")
+	}
+	req.IDP.logger().DebugContext(req.context(), "received authn request",
+		"request_id", req.Request.ID,
+		"issuer", req.Request.Issuer.Value,
+		"binding", req.Binding)
+
+	// If Destination is present the IdP must check it identifies the location
+	// the request was received at.
+	if req.Request.Destination != "" && location != "" && req.Request.Destination != location {
+		return errors.Errorf("wrong destination, expected %q, got %q", location, req.Request.Destination)
+	}
+
+	return req.Validate()
+}
+
+// decodeSAMLMessage reads the SAML message carried by the messageParam
+// parameter (SAMLRequest or SAMLResponse) of a request using either the
+// HTTP-Redirect binding (GET) or the HTTP-POST binding (POST), along with the
+// binding and the RelayState.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf sections 3.4 and 3.5
+func decodeSAMLMessage(r *http.Request, messageParam string) (binding string, buf []byte, relayState string, err error) {
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		if buf, err = decodeRedirectMessage(query.Get(messageParam)); err != nil {
+			return "", nil, "", err
+		}
+		binding = HTTPRedirectBinding
+		relayState = query.Get("RelayState")
+	case http.MethodPost:
+		if err = r.ParseForm(); err != nil {
+			return "", nil, "", errors.Wrap(err, "failed to parse form")
+		}
+		if buf, err = base64.StdEncoding.DecodeString(r.PostForm.Get(messageParam)); err != nil {
+			return "", nil, "", errors.Wrap(err, "failed to base64-decode saml message")
+		}
+		binding = HTTPPostBinding
+		relayState = r.PostForm.Get("RelayState")
+	default:
+		return "", nil, "", errors.Errorf("unsupported method %s", r.Method)
+	}
+
+	if len(buf) == 0 {
+		return "", nil, "", errors.Errorf("missing %s", messageParam)
+	}
+	return binding, buf, relayState, nil
+}
+
+// GenerateResponse takes the XML of an AuthnRequest and returns an HTML form
+// that posts the response for the given session to the SP. Use
+// ParseAuthnRequest and IdpAuthnRequest.GenerateResponse when dealing with an
+// encoded SAMLRequest.
 func (idp *IdentityProvider) GenerateResponse(samlRequest, relayState string, sess *Session, address string) ([]byte, error) {
 	var authnRequest AuthnRequest
 	if err := xml.Unmarshal([]byte(samlRequest), &authnRequest); err != nil {
@@ -49,45 +279,197 @@ func (idp *IdentityProvider) GenerateResponse(samlRequest, relayState string, se
 	}
 
 	idpAuthnRequest := &IdpAuthnRequest{
-		IDP:     idp,
-		Address: address,
-		Request: authnRequest,
+		IDP:           idp,
+		Address:       address,
+		RelayState:    relayState,
+		RequestBuffer: []byte(samlRequest),
+		Request:       authnRequest,
 	}
 
-	if err := idpAuthnRequest.MakeAssertion(sess); err != nil {
-		return nil, errors.Wrap(err, "failed to make assertion")
+	if err := idpAuthnRequest.Validate(); err != nil {
+		if _, ok := err.(*StatusError); ok {
+			return idpAuthnRequest.GenerateErrorResponse(err)
+		}
+		return nil, err
 	}
 
-	if err := idpAuthnRequest.MarshalAssertion(); err != nil {
-		return nil, errors.Wrap(err, "failed to marshal assertion")
+	form, err := idpAuthnRequest.GenerateResponse(sess)
+	if _, ok := errors.Cause(err).(*StatusError); ok {
+		return idpAuthnRequest.GenerateErrorResponse(err)
 	}
+	return form, err
+}
 
-	if err := idpAuthnRequest.MakeResponse(); err != nil {
-		return nil, errors.Wrap(err, "failed to build response")
+// GenerateResponse builds the response to the request for the given session
+// and returns an HTML form that posts it to the SP. A nil session means the
+// principal could not be authenticated: the SP is then sent a NoPassive status
+// if the request is passive and an AuthnFailed status otherwise.
+func (req *IdpAuthnRequest) GenerateResponse(sess *Session) ([]byte, error) {
+	if sess == nil {
+		if req.Request.IsPassive {
+			return req.GenerateErrorResponse(NewNoPassiveError(""))
+		}
+		return req.GenerateErrorResponse(NewAuthnFailedError(""))
 	}
 
-	buf, err := xml.MarshalIndent(idpAuthnRequest.Response, "", "\t")
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to format response")
+	if err := req.makeSessionResponse(sess); err != nil {
+		return nil, err
+	}
+	return req.responseForm()
+}
+
+// makeSessionResponse sets req.Response to a Response holding an assertion
+// for the given session, and records the SP as a participant of the session.
+// The outcome is reported as an EventIdPLogin event, unless a *StatusError
+// prevents it: the error response is reported instead.
+func (req *IdpAuthnRequest) makeSessionResponse(sess *Session) error {
+	start := time.Now()
+	_, span := req.IDP.instrumentation().StartSpan(req.context(), "saml.GenerateResponse")
+	err := req.buildSessionResponse(sess)
+	if _, ok := errors.Cause(err).(*StatusError); ok {
+		span.End(err)
+		return err
+	}
+	req.reportResponse(start, span, err)
+
+	event := req.event(EventIdPLogin, sess)
+	if err == nil {
+		event.setAssertion(req.Assertion)
+	}
+	event.setError(err)
+	req.IDP.emit(req.context(), event)
+	return err
+}
+
+func (req *IdpAuthnRequest) buildSessionResponse(sess *Session) error {
+	if err := req.MakeAssertion(sess); err != nil {
+		return errors.Wrap(err, "failed to make assertion")
+	}
+
+	if err := req.MarshalAssertion(); err != nil {
+		return errors.Wrap(err, "failed to marshal assertion")
+	}
+
+	if err := req.MakeResponse(); err != nil {
+		return errors.Wrap(err, "failed to build response")
+	}
+
+	return req.recordParticipant(sess)
+}
+
+// GenerateErrorResponse returns an HTML form that posts a response carrying
+// the status of the given error to the SP. Errors not caused by a *StatusError
+// are reported as a generic responder failure, without details.
+func (req *IdpAuthnRequest) GenerateErrorResponse(err error) ([]byte, error) {
+	if err := req.makeErrorResponse(err); err != nil {
+		return nil, err
 	}
+	return req.responseForm()
+}
 
-	form := redirectForm{
-		FormAction:   idpAuthnRequest.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient,
-		RelayState:   relayState, // RelayState is passed as is.
-		SAMLResponse: base64.StdEncoding.EncodeToString(buf),
+// makeErrorResponse sets req.Response to a Response carrying the status of the
+// given error, see GenerateErrorResponse. The failed login is reported as an
+// EventIdPLogin event.
+func (req *IdpAuthnRequest) makeErrorResponse(err error) error {
+	statusErr, ok := errors.Cause(err).(*StatusError)
+	if !ok {
+		statusErr = &StatusError{Code: StatusResponder}
 	}
 
-	formTpl, err := template.New("").Parse(redirectFormTemplate)
+	event := req.event(EventIdPLogin, nil)
+	event.setError(err)
+	req.IDP.emit(req.context(), event)
+
+	start := time.Now()
+	_, span := req.IDP.instrumentation().StartSpan(req.context(), "saml.GenerateResponse")
+	if err := req.MakeStatusResponse(statusErr); err != nil {
+		err = errors.Wrap(err, "failed to build response")
+		req.reportResponse(start, span, err)
+		return err
+	}
+	req.reportResponse(start, span, nil)
+	return nil
+}
+
+// reportResponse ends the span of the making of req.Response, started at the
+// given time, and reports its duration to the IdP's Instrumentation by status.
+// The response is logged, see logResponse.
+func (req *IdpAuthnRequest) reportResponse(start time.Time, span instrument.Span, err error) {
+	duration := time.Since(start)
+	span.End(err)
+	status := "error"
+	if err == nil && req.Response != nil {
+		status = statusName(req.Response.Status)
+	}
+	req.IDP.instrumentation().Observe(instrument.IdPResponseDuration, duration.Seconds(), instrument.L(instrument.LabelStatus, status))
+	req.logResponse(duration, err)
+}
+
+// logResponse logs req.Response, made in the given duration, or the error
+// that prevented making it.
+func (req *IdpAuthnRequest) logResponse(duration time.Duration, err error) {
+	ctx, logger := req.context(), req.IDP.logger()
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", req.Request.ID),
+		slog.String("sp", req.spEntityID()),
+		slog.Duration("duration", duration),
+		req.IDP.sensitive("client_ip", req.Address),
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create form")
+		logger.LogAttrs(ctx, slog.LevelDebug, "failed to make response", append(attrs, errorAttr(err))...)
+		return
+	}
+	var status string
+	if req.Response.Status != nil {
+		status = req.Response.Status.StatusCode.Value
 	}
+	attrs = append(attrs, slog.String("response_id", req.Response.ID), slog.String("status", status))
+	if req.Assertion != nil && status == StatusSuccess {
+		attrs = append(attrs, slog.String("assertion_id", req.Assertion.ID))
+		if req.Assertion.Subject != nil {
+			attrs = append(attrs, req.IDP.sensitive("name_id", nameIDValue(req.Assertion.Subject.NameID)))
+		}
+	}
+	logger.LogAttrs(ctx, slog.LevelDebug, "made response", attrs...)
+}
+
+// responseForm returns an HTML form that posts req.Response to its
+// destination.
+func (req *IdpAuthnRequest) responseForm() ([]byte, error) {
+	if err := req.MarshalResponse(); err != nil {
+		return nil, errors.Wrap(err, "failed to format response")
+	}
+
+	form := PostBindingForm{
+		Action:       req.Response.Destination,
+		RelayState:   req.RelayState, // RelayState is passed as is.
+		SAMLResponse: base64.StdEncoding.EncodeToString(req.ResponseBuffer),
+	}
+	if req.HTTPRequest != nil {
+		form.Nonce = req.IDP.postBindingNonce(req.HTTPRequest)
+	}
+	return form.Render(req.IDP.PostBindingTemplate)
+}
 
-	formBuf := bytes.NewBuffer(nil)
-	if err := formTpl.Execute(formBuf, form); err != nil {
-		return nil, errors.Wrap(err, "failed to build form")
+// postBindingNonce returns the nonce of the script of the HTTP-POST binding
+// pages answering r, see PostBindingNonce.
+func (idp *IdentityProvider) postBindingNonce(r *http.Request) string {
+	if idp.PostBindingNonce == nil {
+		return ""
 	}
-	return formBuf.Bytes(), nil
+	return idp.PostBindingNonce(r)
+}
 
+// remoteAddr returns the IP address of the client that sent the request.
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func writeErr(w http.ResponseWriter, err error) {
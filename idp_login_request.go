@@ -1,121 +1,139 @@
 package saml
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/xml"
-	"log"
 	"net/http"
-	"text/template"
-)
 
-var redirectFormTemplate = `<!DOCTYPE html>
-<html>
-	<head></head>
-	<body>
-		<form id="redirect" method="POST" action="{{.FormAction}}">
-			<input type="hidden" name="RelayState" value="{{.RelayState}}" />
-			<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}" />
-		</form>
-		<script type="text/javascript">
-			document.getElementById("redirect").submit();
-		</script>
-	</body>
-</html>`
+	"github.com/pkg/errors"
+)
 
 // Authenticator defines an authentication function that returns a
-// *saml.Session value.
+// *saml.Session value. If it writes a response, for instance a login page or
+// a 401, it has answered the HTTP request itself and the IdP writes nothing
+// more, whatever it returns; it then returns a nil session, along with the
+// error, if any, which is logged. Otherwise an error is reported to the SP: a
+// *StatusError, such as the one of NewRequestDeniedError, tells the SP why the
+// principal was not authenticated, and any other error is reported as
+// AuthnFailed, without details.
 type Authenticator func(w http.ResponseWriter, r *http.Request) (*Session, error)
 
-type redirectForm struct {
-	FormAction   string
-	RelayState   string
-	SAMLResponse string
-}
+// InitiateSSOOptions are the options of an IdP-initiated login, see
+// IdentityProvider.InitiateSSO.
+type InitiateSSOOptions struct {
+	// Authenticates the user, see IdpAuthnRequest.Authenticate. The IdP's
+	// Authenticator is used if nil.
+	Authenticator Authenticator
 
-// LoginRequest represents a login request that the IdP creates in order to try
-// autenticating against a SP.
-type LoginRequest struct {
-	spMetadataURL string
-	metadata      *Metadata
-	authFn        Authenticator
-	idp           *IdentityProvider
-}
+	// Opaque value sent to the SP along with the Response, usually the URL
+	// the user should land on
+	RelayState string
 
-// PostForm creates and serves a form that is used to authenticate to the SP.
-func (lr *LoginRequest) PostForm(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	// Index of the assertion consumer service the Response is sent to, the
+	// SP's default one if nil
+	ACSIndex *int
+}
 
-	sess, err := lr.authFn(w, r)
+// InitiateSSO logs the user in to the SP with the given entity ID, which is
+// looked up in the ServiceProviders registry, without a prior AuthnRequest:
+// the user is authenticated with opts.Authenticator and served a form that
+// posts an unsolicited Response to the SP. If authentication fails the form
+// posts a Response carrying the error status instead. An unknown SP is
+// answered with the 404 status, and an assertion consumer service that cannot
+// be found with the 400 status, through LoginUI.RenderError if set.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 4.1.5
+func (idp *IdentityProvider) InitiateSSO(w http.ResponseWriter, r *http.Request, spEntityID string, opts InitiateSSOOptions) {
+	metadata, err := idp.GetServiceProvider(r.Context(), spEntityID)
+	if errors.Cause(err) == ErrUnknownServiceProvider {
+		idp.renderError(w, r, http.StatusNotFound, err)
+		return
+	}
 	if err != nil {
-		log.Printf("authFn: %v", err)
+		idp.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	idp.initiateSSO(w, r, metadata, opts)
+}
 
-	authnRequest := &AuthnRequest{}
-
-	idpAuthnRequest := &IdpAuthnRequest{
-		IDP:                     lr.idp,
-		Address:                 r.RemoteAddr,
-		Request:                 *authnRequest,
-		ServiceProviderMetadata: lr.metadata,
+func (idp *IdentityProvider) initiateSSO(w http.ResponseWriter, r *http.Request, metadata *Metadata, opts InitiateSSOOptions) {
+	if opts.Authenticator == nil {
+		opts.Authenticator = idp.Authenticator
 	}
-
-	if err = idpAuthnRequest.MakeAssertion(sess); err != nil {
-		log.Printf("Failed to build assertion %v", err)
-		writeErr(w, err)
+	if opts.Authenticator == nil {
+		idp.renderError(w, r, http.StatusInternalServerError, errors.New("missing authenticator"))
 		return
 	}
 
-	err = idpAuthnRequest.MarshalAssertion()
-	if err != nil {
-		log.Printf("Failed to marshal assertion %v", err)
-		writeErr(w, err)
-		return
+	// The Request is left empty, but for the assertion consumer service, so
+	// the Response is not bound to any AuthnRequest.
+	idpAuthnRequest := &IdpAuthnRequest{
+		IDP:                     idp,
+		Address:                 remoteAddr(r),
+		HTTPRequest:             r,
+		RelayState:              opts.RelayState,
+		ServiceProviderMetadata: metadata,
 	}
+	idpAuthnRequest.Request.AssertionConsumerServiceIndex = opts.ACSIndex
 
-	err = idpAuthnRequest.MakeResponse()
+	// A wrong ACSIndex is the IdP's mistake, it is not reported to the SP.
+	endpoint, err := idpAuthnRequest.resolveACSEndpoint()
 	if err != nil {
-		log.Printf("Failed to build response %v", err)
-		writeErr(w, err)
+		idp.renderError(w, r, http.StatusBadRequest, err)
 		return
 	}
-
-	buf, err := xml.MarshalIndent(idpAuthnRequest.Response, "", "\t")
-	if err != nil {
-		log.Printf("Failed to format response %v", err)
-		writeErr(w, err)
+	idpAuthnRequest.ACSEndpoint = endpoint
+
+	var form []byte
+	sess, err := idpAuthnRequest.Authenticate(w, opts.Authenticator)
+	switch {
+	case err != nil:
+		idp.logger().DebugContext(r.Context(), "authentication failed",
+			"sp", metadata.EntityID,
+			errorAttr(err))
+		form, err = idpAuthnRequest.GenerateErrorResponse(authnStatusError(err))
+	case sess == nil:
 		return
+	default:
+		form, err = idpAuthnRequest.GenerateResponse(sess)
+		if _, ok := errors.Cause(err).(*StatusError); ok {
+			form, err = idpAuthnRequest.GenerateErrorResponse(err)
+		}
 	}
-
-	// RelayState is an opaque string that can be used to keep track of this
-	// session on our side.
-	var relayState string
-	token := ctx.Value("saml.RelayState")
-	if token != nil {
-		relayState, _ = token.(string)
-	}
-
-	form := redirectForm{
-		FormAction:   lr.metadata.SPSSODescriptor.AssertionConsumerService[0].Location,
-		RelayState:   relayState,
-		SAMLResponse: base64.StdEncoding.EncodeToString(buf),
-	}
-
-	formTpl, err := template.New("").Parse(redirectFormTemplate)
 	if err != nil {
-		log.Printf("Failed to create form %v", err)
-		writeErr(w, err)
-		return
-	}
-
-	formBuf := bytes.NewBuffer(nil)
-	if err := formTpl.Execute(formBuf, form); err != nil {
-		log.Printf("Failed to build form %v", err)
-		writeErr(w, err)
+		idp.logger().ErrorContext(r.Context(), "failed to build response",
+			"sp", metadata.EntityID,
+			errorAttr(err))
+		idp.renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/html")
-	w.Write(formBuf.Bytes())
+	w.Write(form)
+}
+
+// LoginRequest represents a login request that the IdP creates in order to try
+// autenticating against a SP.
+//
+// Deprecated: use IdentityProvider.InitiateSSO.
+type LoginRequest struct {
+	spMetadataURL string
+	metadata      *Metadata
+	authFn        Authenticator
+	idp           *IdentityProvider
+}
+
+// PostForm creates and serves a form that is used to authenticate to the SP.
+// If authentication fails the form posts a Response carrying the error status
+// instead. The RelayState is read from the "saml.RelayState" value of the
+// request context.
+//
+// Deprecated: use IdentityProvider.InitiateSSO.
+func (lr *LoginRequest) PostForm(w http.ResponseWriter, r *http.Request) {
+	// RelayState is an opaque string that can be used to keep track of this
+	// session on our side.
+	relayState, _ := r.Context().Value("saml.RelayState").(string)
+
+	lr.idp.initiateSSO(w, r, lr.metadata, InitiateSSOOptions{
+		Authenticator: lr.authFn,
+		RelayState:    relayState,
+	})
 }
@@ -0,0 +1,641 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/soap"
+	"github.com/pressly/saml/xmlsec"
+)
+
+// LogoutProgress tracks the propagation of a single logout to the
+// participants of an SSO session. It is kept in the session while the browser
+// goes from one SP to the next.
+type LogoutProgress struct {
+	// ID, issuer and RelayState of the LogoutRequest that started the logout
+	RequestID  string
+	Issuer     string
+	RelayState string
+
+	// Participants that were not sent a LogoutRequest yet
+	Pending []SessionParticipant
+
+	// ID of the LogoutRequest sent through the browser, and entity ID of the
+	// SP it was sent to, while the IdP waits for the LogoutResponse
+	AwaitingID string
+	Awaiting   string
+
+	// Entity IDs of the participants that could not be logged out
+	Failed []string
+}
+
+// IdpLogoutRequest is used by IdentityProvider to handle a single logout
+// request.
+type IdpLogoutRequest struct {
+	IDP *IdentityProvider
+
+	// HTTP request the LogoutRequest was received with
+	HTTPRequest *http.Request
+
+	// SAML binding the LogoutRequest was received with
+	Binding string
+
+	RelayState string
+
+	// Decoded XML of the LogoutRequest, as sent by the SP
+	RequestBuffer []byte
+
+	Request                 LogoutRequest
+	ServiceProviderMetadata *Metadata
+}
+
+// SingleLogoutHandler serves the IdP's single logout endpoint, SLOURL. A
+// LogoutRequest from a SP ends the SSO session of the browser: the other SPs
+// that were issued assertions under it are sent LogoutRequests in turn, either
+// through the browser (HTTP-Redirect and HTTP-POST bindings) or directly (SOAP
+// binding), then the SP that initiated the logout is sent a LogoutResponse.
+// Its status is Success, with a PartialLogout second-level code if some SPs
+// could not be logged out. The LogoutResponses the SPs send through the
+// browser are received by this handler too.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 4.4
+func (idp *IdentityProvider) SingleLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.FormValue("SAMLResponse") != "" {
+		err = idp.handleLogoutResponse(w, r)
+	} else {
+		var req *IdpLogoutRequest
+		if req, err = idp.ParseLogoutRequest(r); err == nil {
+			err = req.Logout(w)
+		}
+	}
+	if err != nil {
+		idp.renderError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// ParseLogoutRequest reads the LogoutRequest a SP sent to the IdP's single
+// logout endpoint, using either the HTTP-Redirect or the HTTP-POST binding.
+// The request must come from a known SP and be signed with one of the signing
+// certificates of its metadata.
+func (idp *IdentityProvider) ParseLogoutRequest(r *http.Request) (*IdpLogoutRequest, error) {
+	req := &IdpLogoutRequest{
+		IDP:         idp,
+		HTTPRequest: r,
+	}
+
+	var err error
+	req.Binding, req.RequestBuffer, req.RelayState, err = decodeSAMLMessage(r, "SAMLRequest")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := xml.Unmarshal(req.RequestBuffer, &req.Request); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal logout request")
+	}
+
+	if req.Request.Destination != "" && idp.SLOURL != "" && req.Request.Destination != idp.SLOURL {
+		return nil, errors.Errorf("wrong destination, expected %q, got %q", idp.SLOURL, req.Request.Destination)
+	}
+	if req.Request.NotOnOrAfter != nil && !idp.now().Before(*req.Request.NotOnOrAfter) {
+		return nil, errors.New("logout request expired")
+	}
+	if req.Request.Issuer == nil {
+		return nil, errors.New("missing issuer")
+	}
+
+	req.ServiceProviderMetadata, err = idp.GetServiceProvider(r.Context(), req.Request.Issuer.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = idp.verifyMessageSignature(r, req.Binding, "SAMLRequest", req.RequestBuffer, req.Request.Signature, req.Request.ID, req.ServiceProviderMetadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to verify logout request signature")
+	}
+
+	return req, nil
+}
+
+// Logout ends the SSO session of the browser that sent the request, see
+// IdentityProvider.SingleLogoutHandler. Without SSO session the SP is answered
+// right away.
+func (req *IdpLogoutRequest) Logout(w http.ResponseWriter) error {
+	idp, r := req.IDP, req.HTTPRequest
+	entityID := req.ServiceProviderMetadata.EntityID
+
+	session, err := idp.currentSession(r)
+	if err != nil {
+		return err
+	}
+	req.emitRequest(session)
+	idp.logger().DebugContext(r.Context(), "received logout request",
+		"request_id", req.Request.ID,
+		"issuer", entityID,
+		"binding", req.Binding,
+		"session", session != nil,
+		idp.sensitive("name_id", nameIDValue(req.Request.NameID)))
+	if session == nil {
+		// There is nothing left to log out.
+		return idp.sendLogoutResponse(w, r, req.ServiceProviderMetadata, req.Request.ID, req.RelayState, &StatusError{Code: StatusSuccess})
+	}
+	if !req.matches(session) {
+		return idp.sendLogoutResponse(w, r, req.ServiceProviderMetadata, req.Request.ID, req.RelayState, &StatusError{
+			Code:    StatusRequester,
+			SubCode: StatusUnknownPrincipal,
+		})
+	}
+
+	progress := &LogoutProgress{
+		RequestID:  req.Request.ID,
+		Issuer:     entityID,
+		RelayState: req.RelayState,
+	}
+	// Each SP is sent a single LogoutRequest, for the last assertion it was
+	// issued.
+	pending := make(map[string]int)
+	for _, participant := range session.Participants {
+		if participant.EntityID == entityID {
+			continue
+		}
+		if i, ok := pending[participant.EntityID]; ok {
+			progress.Pending[i] = participant
+			continue
+		}
+		pending[participant.EntityID] = len(progress.Pending)
+		progress.Pending = append(progress.Pending, participant)
+	}
+	session.Logout = progress
+
+	return idp.continueLogout(w, r, session)
+}
+
+// emitRequest reports the request as an EventLogoutRequest event. It fails if
+// the request is not about the given SSO session, if any.
+func (req *IdpLogoutRequest) emitRequest(session *Session) {
+	event := &Event{
+		Type:      EventLogoutRequest,
+		Issuer:    req.ServiceProviderMetadata.EntityID,
+		Audience:  req.IDP.MetadataURL,
+		RequestID: req.Request.ID,
+		ClientIP:  remoteAddr(req.HTTPRequest),
+		Success:   true,
+	}
+	event.setNameID(req.Request.NameID)
+	if len(req.Request.SessionIndex) > 0 {
+		event.SessionIndex = req.Request.SessionIndex[0]
+	}
+	if session != nil && !req.matches(session) {
+		event.Success, event.Reason = false, "unknown principal"
+	}
+	req.IDP.emit(req.HTTPRequest.Context(), event)
+}
+
+// matches reports whether the request is about the given session: the SP
+// must have been issued an assertion for the same NameID under it.
+func (req *IdpLogoutRequest) matches(session *Session) bool {
+	nameID := req.Request.NameID
+	if nameID == nil {
+		return false
+	}
+	if len(req.Request.SessionIndex) > 0 && !contains(req.Request.SessionIndex, session.Index) {
+		return false
+	}
+	for _, participant := range session.Participants {
+		if participant.EntityID != req.ServiceProviderMetadata.EntityID || participant.NameID == nil {
+			continue
+		}
+		if participant.NameID.Value == nameID.Value && (nameID.Format == "" || participant.NameID.Format == nameID.Format) {
+			return true
+		}
+	}
+	return false
+}
+
+// continueLogout sends LogoutRequests to the pending participants of the
+// session until one of them must be reached through the browser, and ends the
+// logout once there are none left.
+func (idp *IdentityProvider) continueLogout(w http.ResponseWriter, r *http.Request, session *Session) error {
+	progress := session.Logout
+	for len(progress.Pending) > 0 {
+		participant := progress.Pending[0]
+		progress.Pending = progress.Pending[1:]
+
+		start := time.Now()
+		redirected, err := idp.propagateLogout(w, r, session, participant)
+		idp.logger().DebugContext(r.Context(), "propagated logout",
+			"request_id", progress.RequestID,
+			"sp", participant.EntityID,
+			"redirected", redirected,
+			"duration", time.Since(start),
+			errorAttr(err))
+		if redirected {
+			return nil
+		}
+		// The participant was logged out directly, or could not be.
+		idp.emitLogoutPropagation(r, session, participant.EntityID, err)
+		if err != nil {
+			progress.Failed = append(progress.Failed, participant.EntityID)
+		}
+	}
+	return idp.finishLogout(w, r, session)
+}
+
+// emitLogoutPropagation reports the logout of the participant of the session
+// with the given entity ID, which failed with err if not nil, as an
+// EventLogoutPropagation event. Its RequestID is the ID of the LogoutRequest
+// that started the logout.
+func (idp *IdentityProvider) emitLogoutPropagation(r *http.Request, session *Session, entityID string, err error) {
+	event := &Event{
+		Type:      EventLogoutPropagation,
+		Issuer:    idp.MetadataURL,
+		Audience:  entityID,
+		RequestID: session.Logout.RequestID,
+		ClientIP:  remoteAddr(r),
+	}
+	event.setParticipant(session, entityID)
+	event.setError(err)
+	idp.emit(r.Context(), event)
+}
+
+// propagateLogout sends a LogoutRequest to the given participant. It reports
+// whether the browser was sent to the SP, in which case the logout continues
+// once it comes back with the LogoutResponse.
+func (idp *IdentityProvider) propagateLogout(w http.ResponseWriter, r *http.Request, session *Session, participant SessionParticipant) (bool, error) {
+	metadata, err := idp.GetServiceProvider(r.Context(), participant.EntityID)
+	if err != nil {
+		return false, err
+	}
+
+	policy := idp.SPPolicy(metadata.EntityID)
+	bindings := []string{HTTPRedirectBinding, HTTPPostBinding, SOAPBinding}
+	if policy.LogoutBinding != "" {
+		bindings = []string{policy.LogoutBinding}
+	}
+	endpoint := logoutEndpoint(metadata, bindings...)
+	if endpoint == nil {
+		return false, errors.Errorf("service provider %q has no usable single logout service", metadata.EntityID)
+	}
+
+	now := idp.now()
+	notOnOrAfter := now.Add(IssueLifetime)
+	logoutRequest := &LogoutRequest{
+		ID:           idp.newID(),
+		Version:      "2.0",
+		IssueInstant: now,
+		Destination:  endpoint.Location,
+		NotOnOrAfter: &notOnOrAfter,
+		Reason:       LogoutReasonUser,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL,
+		},
+		NameID: participant.NameID,
+	}
+	if participant.SessionIndex != "" {
+		logoutRequest.SessionIndex = []string{participant.SessionIndex}
+	}
+	if endpoint.Binding != HTTPRedirectBinding {
+		if logoutRequest.Signature, err = idp.signatureTemplate(policy, logoutRequest.ID); err != nil {
+			return false, err
+		}
+	}
+	buf, err := idp.marshalMessage(logoutRequest, logoutRequest.Signature != nil)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to marshal logout request")
+	}
+
+	if endpoint.Binding == SOAPBinding {
+		return false, idp.sendSOAPLogoutRequest(r.Context(), endpoint.Location, buf, logoutRequest.ID, metadata)
+	}
+
+	session.Logout.AwaitingID = logoutRequest.ID
+	session.Logout.Awaiting = metadata.EntityID
+	if err := idp.Sessions.SaveSession(r.Context(), session); err != nil {
+		return false, errors.Wrap(err, "failed to save session")
+	}
+	if err := idp.sendMessage(w, r, endpoint.Binding, endpoint.Location, "SAMLRequest", buf, ""); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// handleLogoutResponse receives the LogoutResponse of the participant the
+// browser was sent to, and carries on with the logout.
+func (idp *IdentityProvider) handleLogoutResponse(w http.ResponseWriter, r *http.Request) error {
+	binding, buf, _, err := decodeSAMLMessage(r, "SAMLResponse")
+	if err != nil {
+		return err
+	}
+	var response LogoutResponse
+	if err := xml.Unmarshal(buf, &response); err != nil {
+		return errors.Wrap(err, "failed to unmarshal logout response")
+	}
+
+	session, err := idp.currentSession(r)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.Logout == nil || session.Logout.AwaitingID == "" {
+		return errors.New("no logout in progress")
+	}
+
+	progress := session.Logout
+	err = idp.checkFrontChannelLogoutResponse(r, binding, buf, &response, progress)
+	idp.logger().DebugContext(r.Context(), "received logout response",
+		"response_id", response.ID,
+		"in_response_to", response.InResponseTo,
+		"sp", progress.Awaiting,
+		errorAttr(err))
+	idp.emitLogoutPropagation(r, session, progress.Awaiting, err)
+	if err != nil {
+		progress.Failed = append(progress.Failed, progress.Awaiting)
+	}
+	progress.AwaitingID, progress.Awaiting = "", ""
+
+	return idp.continueLogout(w, r, session)
+}
+
+// checkFrontChannelLogoutResponse checks a LogoutResponse received through
+// the browser answers the LogoutRequest the IdP waits for, is signed by its
+// recipient and reports a success.
+func (idp *IdentityProvider) checkFrontChannelLogoutResponse(r *http.Request, binding string, buf []byte, response *LogoutResponse, progress *LogoutProgress) error {
+	if response.Destination != "" && idp.SLOURL != "" && response.Destination != idp.SLOURL {
+		return errors.Errorf("wrong destination, expected %q, got %q", idp.SLOURL, response.Destination)
+	}
+
+	metadata, err := idp.GetServiceProvider(r.Context(), progress.Awaiting)
+	if err != nil {
+		return err
+	}
+	if err := idp.verifyMessageSignature(r, binding, "SAMLResponse", buf, response.Signature, response.ID, metadata); err != nil {
+		return errors.Wrap(err, "failed to verify logout response signature")
+	}
+	return checkLogoutResponse(response, progress.AwaitingID, metadata.EntityID)
+}
+
+// checkLogoutResponse checks the LogoutResponse answers the LogoutRequest with
+// the given ID, comes from the SP it was sent to and reports a success.
+func checkLogoutResponse(response *LogoutResponse, requestID string, entityID string) error {
+	if response.InResponseTo != requestID {
+		return errors.Errorf("logout response answers %q instead of %q", response.InResponseTo, requestID)
+	}
+	if response.Issuer == nil || response.Issuer.Value != entityID {
+		return errors.New("logout response issued by another entity")
+	}
+	if response.Status == nil || response.Status.StatusCode.Value != StatusSuccess {
+		return errors.New("logout failed")
+	}
+	return nil
+}
+
+// finishLogout deletes the session and sends the LogoutResponse to the SP
+// that initiated the logout. The logout is reported as an EventLogout event,
+// which fails if some participants could not be logged out.
+func (idp *IdentityProvider) finishLogout(w http.ResponseWriter, r *http.Request, session *Session) error {
+	progress := session.Logout
+
+	if err := idp.Sessions.DeleteSession(r.Context(), session.ID); err != nil {
+		return errors.Wrap(err, "failed to delete session")
+	}
+
+	event := &Event{
+		Type:         EventLogout,
+		Issuer:       progress.Issuer,
+		Audience:     idp.MetadataURL,
+		RequestID:    progress.RequestID,
+		SessionIndex: session.Index,
+		ClientIP:     remoteAddr(r),
+		Success:      len(progress.Failed) == 0,
+	}
+	event.setParticipant(session, progress.Issuer)
+	if !event.Success {
+		event.Reason = "partial logout, failed for " + strings.Join(progress.Failed, ", ")
+	}
+	idp.emit(r.Context(), event)
+	idp.logger().DebugContext(r.Context(), "finished logout",
+		"request_id", progress.RequestID,
+		"issuer", progress.Issuer,
+		"failed", progress.Failed)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     idp.sessionCookieName(),
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	metadata, err := idp.GetServiceProvider(r.Context(), progress.Issuer)
+	if err != nil {
+		return err
+	}
+	status := &StatusError{Code: StatusSuccess}
+	if len(progress.Failed) > 0 {
+		status.SubCode = StatusPartialLogout
+	}
+	return idp.sendLogoutResponse(w, r, metadata, progress.RequestID, progress.RelayState, status)
+}
+
+// sendLogoutResponse sends the SP a LogoutResponse to the LogoutRequest with
+// the given ID, through the browser.
+func (idp *IdentityProvider) sendLogoutResponse(w http.ResponseWriter, r *http.Request, metadata *Metadata, inResponseTo string, relayState string, status *StatusError) error {
+	endpoint := logoutEndpoint(metadata, HTTPRedirectBinding, HTTPPostBinding)
+	if endpoint == nil {
+		return errors.Errorf("service provider %q has no usable single logout service", metadata.EntityID)
+	}
+	location := endpoint.ResponseLocation
+	if location == "" {
+		location = endpoint.Location
+	}
+
+	response := &LogoutResponse{
+		ID:           idp.newID(),
+		Version:      "2.0",
+		IssueInstant: idp.now(),
+		Destination:  location,
+		InResponseTo: inResponseTo,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL,
+		},
+		Status: status.Status(),
+	}
+	if endpoint.Binding != HTTPRedirectBinding {
+		var err error
+		if response.Signature, err = idp.signatureTemplate(idp.SPPolicy(metadata.EntityID), response.ID); err != nil {
+			return err
+		}
+	}
+	buf, err := idp.marshalMessage(response, response.Signature != nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal logout response")
+	}
+
+	return idp.sendMessage(w, r, endpoint.Binding, location, "SAMLResponse", buf, relayState)
+}
+
+// logoutEndpoint returns the first single logout service of the SP using one
+// of the given bindings, in order of preference.
+func logoutEndpoint(metadata *Metadata, bindings ...string) *Endpoint {
+	if metadata.SPSSODescriptor == nil {
+		return nil
+	}
+	endpoints := metadata.SPSSODescriptor.SingleLogoutService
+	for _, binding := range bindings {
+		for i := range endpoints {
+			if endpoints[i].Binding == binding {
+				return &endpoints[i]
+			}
+		}
+	}
+	return nil
+}
+
+// verifyMessageSignature checks the signature of a message received from the
+// SP with the given metadata, either the one carried by the query
+// (HTTP-Redirect binding) or the one embedded in the XML. Unsigned messages are
+// rejected.
+func (idp *IdentityProvider) verifyMessageSignature(r *http.Request, binding string, messageParam string, buf []byte, signature *xmlsec.Signature, id string, metadata *Metadata) error {
+	certs := signingCertificates(metadata.SPSSODescriptor.KeyDescriptor)
+	if binding == HTTPRedirectBinding && isRedirectSigned(r.URL.RawQuery) {
+		return verifyRedirectSignature(r.URL.RawQuery, messageParam, certs)
+	}
+	if signature != nil {
+		return idp.verifySignature(buf, signature, id, certs)
+	}
+	return errors.New("message is not signed")
+}
+
+// signatureTemplate returns the template of the XML signature of the message
+// with the given ID, as the policy asks for.
+func (idp *IdentityProvider) signatureTemplate(policy *ServiceProviderPolicy, id string) (*xmlsec.Signature, error) {
+	cert, err := idp.Cert()
+	if err != nil {
+		return nil, err
+	}
+	return policy.signatureTemplate(pem.EncodeToMemory(cert), id), nil
+}
+
+// marshalMessage returns the XML of a SAML message, signed with the IdP's key
+// if sign is set. The message must then hold a signature template.
+func (idp *IdentityProvider) marshalMessage(message interface{}, sign bool) ([]byte, error) {
+	buf, err := xml.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	if !sign {
+		return buf, nil
+	}
+	if buf, err = idp.sign(buf); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(bytes.TrimPrefix(buf, []byte(`<?xml version="1.0"?>`))), nil
+}
+
+// sendMessage sends the SAML message in buf to the given location through the
+// browser, using the HTTP-Redirect binding, whose query is signed with the
+// IdP's key, or the HTTP-POST binding. messageParam is either SAMLRequest or
+// SAMLResponse.
+func (idp *IdentityProvider) sendMessage(w http.ResponseWriter, r *http.Request, binding string, location string, messageParam string, buf []byte, relayState string) error {
+	switch binding {
+	case HTTPRedirectBinding:
+		query, err := encodeRedirectQuery(messageParam, buf, relayState)
+		if err != nil {
+			return err
+		}
+		keyFile, err := idp.PrivkeyFile()
+		if err != nil {
+			return err
+		}
+		if query, err = signRedirectQuery(query, messageParam, keyFile); err != nil {
+			return err
+		}
+
+		separator := "?"
+		if strings.Contains(location, "?") {
+			separator = "&"
+		}
+		http.Redirect(w, r, location+separator+query, http.StatusFound)
+		return nil
+
+	case HTTPPostBinding:
+		form := PostBindingForm{
+			Action:     location,
+			RelayState: relayState,
+			Nonce:      idp.postBindingNonce(r),
+		}
+		if messageParam == "SAMLRequest" {
+			form.SAMLRequest = base64.StdEncoding.EncodeToString(buf)
+		} else {
+			form.SAMLResponse = base64.StdEncoding.EncodeToString(buf)
+		}
+		out, err := form.Render(idp.PostBindingTemplate)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(out)
+		return nil
+	}
+	return errors.Errorf("unsupported binding %q", binding)
+}
+
+func (idp *IdentityProvider) httpClient() *http.Client {
+	if idp.HTTPClient != nil {
+		return idp.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// mutualTLS reports whether the requests sent to the given location by the
+// HTTP client of the IdP use TLS with a client certificate, so that the SP
+// authenticates the IdP and answers it over the same connection.
+func (idp *IdentityProvider) mutualTLS(location string) bool {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	transport, ok := idp.httpClient().Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil {
+		return false
+	}
+	config := transport.TLSClientConfig
+	return len(config.Certificates) > 0 || config.GetClientCertificate != nil
+}
+
+// sendSOAPLogoutRequest sends a LogoutRequest to the SP with the given
+// metadata through the SOAP binding, and checks the LogoutResponse it answers
+// with. The status of the response is trusted only if its signature is
+// verified, or if it is answered over mutually authenticated TLS; otherwise
+// the SP is not known to be logged out and an error is returned.
+func (idp *IdentityProvider) sendSOAPLogoutRequest(ctx context.Context, location string, buf []byte, requestID string, metadata *Metadata) error {
+	client := &soap.Client{HTTPClient: idp.httpClient()}
+	envelope, err := client.Send(ctx, location, buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to send logout request")
+	}
+	buf = envelope.Body.XML
+
+	var response LogoutResponse
+	if err := xml.Unmarshal(buf, &response); err != nil {
+		return errors.Wrap(err, "failed to unmarshal logout response")
+	}
+	if response.Signature != nil {
+		certs := signingCertificates(metadata.SPSSODescriptor.KeyDescriptor)
+		if err := idp.verifySignature(buf, response.Signature, response.ID, certs); err != nil {
+			return errors.Wrap(err, "failed to verify logout response signature")
+		}
+	} else if !idp.mutualTLS(location) {
+		return errors.New("logout response is not signed and not sent over mutual TLS")
+	}
+	return checkLogoutResponse(&response, requestID, metadata.EntityID)
+}
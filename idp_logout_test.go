@@ -0,0 +1,383 @@
+package saml
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pressly/saml/soap"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSLOURL = "https://idp.example.com/saml/slo"
+
+// newTestLogoutSP returns the metadata of a SP with the given entity ID and
+// single logout services, using the keys of testSP.
+func newTestLogoutSP(t *testing.T, entityID string, endpoints ...Endpoint) *Metadata {
+	metadata, err := testSP.Metadata()
+	assert.NoError(t, err)
+	metadata.EntityID = entityID
+	metadata.SPSSODescriptor.SingleLogoutService = endpoints
+	return metadata
+}
+
+// signedRedirect returns the request sent by the browser to the given
+// location with a SAML message signed by testSP, using the HTTP-Redirect
+// binding.
+func signedRedirect(t *testing.T, location string, messageParam string, message interface{}, relayState string, cookies []*http.Cookie) *http.Request {
+	buf, err := xml.Marshal(message)
+	assert.NoError(t, err)
+	query, err := encodeRedirectQuery(messageParam, buf, relayState)
+	assert.NoError(t, err)
+	keyFile, err := testSP.PrivkeyFile()
+	assert.NoError(t, err)
+	query, err = signRedirectQuery(query, messageParam, keyFile)
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest("GET", location+"?"+query, nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+// followRedirect decodes the SAML message the IdP sent through the browser
+// with the HTTP-Redirect binding, after checking its signature.
+func followRedirect(t *testing.T, idp *IdentityProvider, w *httptest.ResponseRecorder, messageParam string, message interface{}) *url.URL {
+	if !assert.Equal(t, http.StatusFound, w.Code, w.Body.String()) {
+		t.FailNow()
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+
+	cert, err := idp.Cert()
+	assert.NoError(t, err)
+	err = verifyRedirectSignature(location.RawQuery, messageParam, []string{base64.StdEncoding.EncodeToString(cert.Bytes)})
+	assert.NoError(t, err)
+
+	buf, err := decodeRedirectMessage(location.Query().Get(messageParam))
+	assert.NoError(t, err)
+	assert.NoError(t, xml.Unmarshal(buf, message))
+	return location
+}
+
+func TestSingleLogout(t *testing.T) {
+	tearUp()
+
+	soapSP := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "http://www.oasis-open.org/committees/security", r.Header.Get("SOAPAction"))
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer soapSP.Close()
+
+	spA := newTestLogoutSP(t, "https://a.example.org", Endpoint{
+		Binding:          HTTPRedirectBinding,
+		Location:         "https://a.example.org/slo",
+		ResponseLocation: "https://a.example.org/slo/response",
+	})
+	spB := newTestLogoutSP(t, "https://b.example.org", Endpoint{
+		Binding:  HTTPRedirectBinding,
+		Location: "https://b.example.org/slo",
+	})
+	spC := newTestLogoutSP(t, "https://c.example.org", Endpoint{
+		Binding:  SOAPBinding,
+		Location: soapSP.URL,
+	})
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.SLOURL = testSLOURL
+	idp.Sessions = &MemorySessionStore{}
+	idp.ServiceProviders = NewMemoryServiceProviderRegistry(spA, spB, spC)
+
+	metadata, err := idp.Metadata()
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{
+		{Binding: HTTPRedirectBinding, Location: testSLOURL},
+		{Binding: HTTPPostBinding, Location: testSLOURL},
+	}, metadata.IDPSSODescriptor.SingleLogoutService)
+
+	newSession := func(participants ...string) []*http.Cookie {
+		session := &Session{
+			ID:         "session-" + NewID(),
+			ExpireTime: Now().Add(time.Hour),
+			Index:      "index",
+		}
+		for _, entityID := range participants {
+			session.Participants = append(session.Participants, SessionParticipant{
+				EntityID:     entityID,
+				SessionIndex: session.Index,
+				NameID:       &NameID{Format: NameIDTransientFormat, Value: "id-" + entityID},
+			})
+		}
+		assert.NoError(t, idp.Sessions.SaveSession(context.Background(), session))
+		return []*http.Cookie{{Name: DefaultSessionCookieName, Value: session.ID}}
+	}
+
+	newLogoutRequest := func() *LogoutRequest {
+		return &LogoutRequest{
+			ID:           "logout-request",
+			Version:      "2.0",
+			IssueInstant: Now(),
+			Destination:  testSLOURL,
+			Issuer:       &Issuer{Value: spA.EntityID},
+			NameID:       &NameID{Format: NameIDTransientFormat, Value: "id-" + spA.EntityID},
+			SessionIndex: []string{"index"},
+		}
+	}
+
+	checkResponse := func(w *httptest.ResponseRecorder, subCode string) {
+		var response LogoutResponse
+		location := followRedirect(t, idp, w, "SAMLResponse", &response)
+		assert.Equal(t, "https://a.example.org/slo/response", location.Scheme+"://"+location.Host+location.Path)
+		assert.Equal(t, "state", location.Query().Get("RelayState"))
+		assert.Equal(t, "logout-request", response.InResponseTo)
+		assert.Equal(t, idp.MetadataURL, response.Issuer.Value)
+		if assert.NotNil(t, response.Status) {
+			assert.Equal(t, StatusSuccess, response.Status.StatusCode.Value)
+			if subCode == "" {
+				assert.Nil(t, response.Status.StatusCode.StatusCode)
+			} else if assert.NotNil(t, response.Status.StatusCode.StatusCode) {
+				assert.Equal(t, subCode, response.Status.StatusCode.StatusCode.Value)
+			}
+		}
+	}
+
+	// B is logged out through the browser, C cannot be reached.
+	cookies := newSession(spA.EntityID, spB.EntityID, spC.EntityID)
+	w := httptest.NewRecorder()
+	idp.SingleLogoutHandler(w, signedRedirect(t, testSLOURL, "SAMLRequest", newLogoutRequest(), "state", cookies))
+
+	var request LogoutRequest
+	followRedirect(t, idp, w, "SAMLRequest", &request)
+	assert.Equal(t, "https://b.example.org/slo", request.Destination)
+	assert.Equal(t, idp.MetadataURL, request.Issuer.Value)
+	assert.Equal(t, &NameID{Format: NameIDTransientFormat, Value: "id-" + spB.EntityID}, request.NameID)
+	assert.Equal(t, []string{"index"}, request.SessionIndex)
+
+	// The progress of the logout is kept in the session.
+	session, err := idp.Sessions.GetSession(context.Background(), cookies[0].Value)
+	assert.NoError(t, err)
+	if assert.NotNil(t, session.Logout) {
+		assert.Equal(t, request.ID, session.Logout.AwaitingID)
+	}
+
+	w = httptest.NewRecorder()
+	idp.SingleLogoutHandler(w, signedRedirect(t, testSLOURL, "SAMLResponse", &LogoutResponse{
+		ID:           "logout-response",
+		Version:      "2.0",
+		IssueInstant: Now(),
+		InResponseTo: request.ID,
+		Issuer:       &Issuer{Value: spB.EntityID},
+		Status:       &Status{StatusCode: StatusCode{Value: StatusSuccess}},
+	}, "", cookies))
+	checkResponse(w, StatusPartialLogout)
+
+	_, err = idp.Sessions.GetSession(context.Background(), cookies[0].Value)
+	assert.Equal(t, ErrSessionNotFound, err)
+	if cleared := w.Result().Cookies(); assert.Len(t, cleared, 1) {
+		assert.Equal(t, DefaultSessionCookieName, cleared[0].Name)
+		assert.Equal(t, -1, cleared[0].MaxAge)
+	}
+
+	// B answers a LogoutRequest the IdP did not send.
+	cookies = newSession(spA.EntityID, spB.EntityID)
+	w = httptest.NewRecorder()
+	idp.SingleLogoutHandler(w, signedRedirect(t, testSLOURL, "SAMLRequest", newLogoutRequest(), "state", cookies))
+	followRedirect(t, idp, w, "SAMLRequest", &request)
+
+	w = httptest.NewRecorder()
+	idp.SingleLogoutHandler(w, signedRedirect(t, testSLOURL, "SAMLResponse", &LogoutResponse{
+		ID:           "logout-response",
+		Version:      "2.0",
+		IssueInstant: Now(),
+		InResponseTo: "another-request",
+		Issuer:       &Issuer{Value: spB.EntityID},
+		Status:       &Status{StatusCode: StatusCode{Value: StatusSuccess}},
+	}, "", cookies))
+	checkResponse(w, StatusPartialLogout)
+
+	// A is the only participant.
+	cookies = newSession(spA.EntityID)
+	w = httptest.NewRecorder()
+	idp.SingleLogoutHandler(w, signedRedirect(t, testSLOURL, "SAMLRequest", newLogoutRequest(), "state", cookies))
+	checkResponse(w, "")
+
+	// Without SSO session there is nothing to log out.
+	w = httptest.NewRecorder()
+	idp.SingleLogoutHandler(w, signedRedirect(t, testSLOURL, "SAMLRequest", newLogoutRequest(), "state", nil))
+	checkResponse(w, "")
+}
+
+func TestParseLogoutRequest(t *testing.T) {
+	tearUp()
+
+	spA := newTestLogoutSP(t, "https://a.example.org", Endpoint{
+		Binding:  HTTPRedirectBinding,
+		Location: "https://a.example.org/slo",
+	})
+	idp := newTestIdPForSP(t, testSP)
+	idp.SLOURL = testSLOURL
+	idp.ServiceProviders = NewMemoryServiceProviderRegistry(spA)
+
+	logoutRequest := &LogoutRequest{
+		ID:           "logout-request",
+		Version:      "2.0",
+		IssueInstant: Now(),
+		Destination:  testSLOURL,
+		Issuer:       &Issuer{Value: spA.EntityID},
+		NameID:       &NameID{Value: "anakin"},
+	}
+
+	req, err := idp.ParseLogoutRequest(signedRedirect(t, testSLOURL, "SAMLRequest", logoutRequest, "state", nil))
+	assert.NoError(t, err)
+	if assert.NotNil(t, req) {
+		assert.Equal(t, HTTPRedirectBinding, req.Binding)
+		assert.Equal(t, "state", req.RelayState)
+		assert.Equal(t, "logout-request", req.Request.ID)
+		assert.Equal(t, spA, req.ServiceProviderMetadata)
+	}
+
+	// Unsigned requests are rejected.
+	buf, err := xml.Marshal(logoutRequest)
+	assert.NoError(t, err)
+	query, err := encodeRedirectQuery("SAMLRequest", buf, "")
+	assert.NoError(t, err)
+	_, err = idp.ParseLogoutRequest(httptest.NewRequest("GET", testSLOURL+"?"+query, nil))
+	assert.EqualError(t, err, "failed to verify logout request signature: message is not signed")
+
+	notOnOrAfter := Now()
+	logoutRequest.NotOnOrAfter = &notOnOrAfter
+	_, err = idp.ParseLogoutRequest(signedRedirect(t, testSLOURL, "SAMLRequest", logoutRequest, "", nil))
+	assert.EqualError(t, err, "logout request expired")
+}
+
+func TestSOAPLogoutResponseTrust(t *testing.T) {
+	tearUp()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		envelope, err := soap.ReadEnvelope(r.Body, 0)
+		assert.NoError(t, err)
+		var request LogoutRequest
+		assert.NoError(t, xml.Unmarshal(envelope.Body.XML, &request))
+		buf, err := xml.Marshal(&LogoutResponse{
+			ID:           "logout-response",
+			Version:      "2.0",
+			IssueInstant: Now(),
+			InResponseTo: request.ID,
+			Issuer:       &Issuer{Value: "https://sp.example.org"},
+			Status:       &Status{StatusCode: StatusCode{Value: StatusSuccess}},
+		})
+		assert.NoError(t, err)
+		soap.WriteMessage(w, buf)
+	})
+	plainSP := httptest.NewServer(handler)
+	defer plainSP.Close()
+	tlsSP := httptest.NewUnstartedServer(handler)
+	tlsSP.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	tlsSP.StartTLS()
+	defer tlsSP.Close()
+
+	idp := newTestIdPForSP(t, testSP)
+	metadata := newTestLogoutSP(t, "https://sp.example.org")
+	buf, err := xml.Marshal(&LogoutRequest{ID: "logout-request", Version: "2.0", IssueInstant: Now()})
+	assert.NoError(t, err)
+	send := func(location string) error {
+		return idp.sendSOAPLogoutRequest(context.Background(), location, buf, "logout-request", metadata)
+	}
+
+	// An unsigned response is not trusted over plain HTTP, nor over TLS
+	// without client certificate.
+	assert.Error(t, send(plainSP.URL))
+	idp.HTTPClient = tlsSP.Client()
+	assert.Error(t, send(tlsSP.URL))
+
+	// It is trusted over mutual TLS.
+	certFile, err := idp.PubkeyFile()
+	assert.NoError(t, err)
+	keyFile, err := idp.PrivkeyFile()
+	assert.NoError(t, err)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+	idp.HTTPClient.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+	assert.NoError(t, send(tlsSP.URL))
+}
+
+func TestSingleLogoutAfterForceAuthn(t *testing.T) {
+	tearUp()
+
+	spA := newTestLogoutSP(t, "https://a.example.org", Endpoint{
+		Binding:          HTTPRedirectBinding,
+		Location:         "https://a.example.org/slo",
+		ResponseLocation: "https://a.example.org/slo/response",
+	})
+	spB := newTestLogoutSP(t, "https://b.example.org", Endpoint{
+		Binding:  HTTPRedirectBinding,
+		Location: "https://b.example.org/slo",
+	})
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.SLOURL = testSLOURL
+	idp.Sessions = &MemorySessionStore{}
+	idp.ServiceProviders = NewMemoryServiceProviderRegistry(spA, spB)
+
+	// B was issued an assertion under the first session.
+	old := &Session{
+		ID:         "old-session",
+		ExpireTime: Now().Add(time.Hour),
+		Index:      "old-index",
+		Participants: []SessionParticipant{{
+			EntityID:     spB.EntityID,
+			SessionIndex: "old-index",
+			NameID:       &NameID{Format: NameIDTransientFormat, Value: "id-b"},
+		}},
+	}
+	assert.NoError(t, idp.Sessions.SaveSession(context.Background(), old))
+
+	// A forces the user to authenticate again.
+	r := httptest.NewRequest("GET", "/sso", nil)
+	r.AddCookie(&http.Cookie{Name: DefaultSessionCookieName, Value: old.ID})
+	req := &IdpAuthnRequest{
+		IDP:                     idp,
+		HTTPRequest:             r,
+		Request:                 AuthnRequest{ForceAuthn: true},
+		ServiceProviderMetadata: spA,
+	}
+	w := httptest.NewRecorder()
+	session, err := req.Authenticate(w, func(w http.ResponseWriter, r *http.Request) (*Session, error) {
+		return &Session{UserID: "anakin"}, nil
+	})
+	assert.NoError(t, err)
+	if !assert.NotNil(t, session) {
+		return
+	}
+	assert.NoError(t, idp.Sessions.AddSessionParticipant(context.Background(), session.ID, SessionParticipant{
+		EntityID:     spA.EntityID,
+		SessionIndex: session.Index,
+		NameID:       &NameID{Format: NameIDTransientFormat, Value: "id-a"},
+	}))
+
+	// The logout initiated by A reaches B, with the index of its assertion.
+	cookies := w.Result().Cookies()
+	w = httptest.NewRecorder()
+	idp.SingleLogoutHandler(w, signedRedirect(t, testSLOURL, "SAMLRequest", &LogoutRequest{
+		ID:           "logout-request",
+		Version:      "2.0",
+		IssueInstant: Now(),
+		Destination:  testSLOURL,
+		Issuer:       &Issuer{Value: spA.EntityID},
+		NameID:       &NameID{Format: NameIDTransientFormat, Value: "id-a"},
+		SessionIndex: []string{session.Index},
+	}, "state", cookies))
+
+	var request LogoutRequest
+	followRedirect(t, idp, w, "SAMLRequest", &request)
+	assert.Equal(t, "https://b.example.org/slo", request.Destination)
+	assert.Equal(t, &NameID{Format: NameIDTransientFormat, Value: "id-b"}, request.NameID)
+	assert.Equal(t, []string{"old-index"}, request.SessionIndex)
+}
@@ -0,0 +1,112 @@
+package saml
+
+import (
+	"github.com/pressly/saml/xmlsec"
+)
+
+// ServiceProviderPolicy holds the settings the IdP applies when dealing with a
+// given SP.
+type ServiceProviderPolicy struct {
+	// Reject AuthnRequests that are not signed, even if the SP's metadata does
+	// not set AuthnRequestsSigned.
+	RequireSignedAuthnRequests bool
+
+	// Decides which attributes are released to the SP,
+	// LegacyAttributeReleasePolicy is used if nil.
+	AttributeRelease AttributeReleasePolicy
+
+	// NameID format used when the SP lets the IdP pick one, transient if
+	// empty
+	NameIDFormat string
+
+	// SPNameQualifier values the SP may request besides its own entity ID,
+	// such as the affiliations it belongs to
+	SPNameQualifiers []string
+
+	// Which of the Response and the Assertion are signed, the assertion only
+	// by default
+	Signing SigningPolicy
+
+	// Whether assertions are encrypted, EncryptWhenPossible by default
+	Encryption EncryptionPolicy
+
+	// Algorithms of the XML signatures, xmlsec.SignatureRSASHA256 and
+	// xmlsec.DigestSHA256 if empty
+	SignatureAlgorithm string
+	DigestAlgorithm    string
+
+	// Binding of the LogoutRequests sent to the SP during single logout, the
+	// first of HTTP-Redirect, HTTP-POST and SOAP listed in its metadata if
+	// empty
+	LogoutBinding string
+}
+
+// SigningPolicy tells which elements of a response the IdP signs.
+type SigningPolicy int
+
+// Signing policies.
+const (
+	SignAssertion SigningPolicy = iota
+	SignResponse
+	SignResponseAndAssertion
+)
+
+func (p SigningPolicy) signAssertion() bool {
+	return p == SignAssertion || p == SignResponseAndAssertion
+}
+
+func (p SigningPolicy) signResponse() bool {
+	return p == SignResponse || p == SignResponseAndAssertion
+}
+
+// EncryptionPolicy tells whether the IdP encrypts the assertions it sends.
+type EncryptionPolicy int
+
+// Encryption policies.
+const (
+	// Encrypt assertions if the SP metadata lists a certificate, send them
+	// in the clear otherwise
+	EncryptWhenPossible EncryptionPolicy = iota
+
+	// Always encrypt assertions, failing if the SP metadata lists no
+	// certificate
+	EncryptAlways
+
+	// Never encrypt assertions
+	EncryptNever
+)
+
+// signatureTemplate returns the template of the XML signatures the policy
+// asks for, referencing the element with the given ID.
+func (policy *ServiceProviderPolicy) signatureTemplate(cert []byte, id string) *xmlsec.Signature {
+	signatureAlgorithm := policy.SignatureAlgorithm
+	if signatureAlgorithm == "" {
+		signatureAlgorithm = xmlsec.SignatureRSASHA256
+	}
+	digestAlgorithm := policy.DigestAlgorithm
+	if digestAlgorithm == "" {
+		digestAlgorithm = xmlsec.DigestSHA256
+	}
+
+	signature := xmlsec.NewSignature(cert, signatureAlgorithm, digestAlgorithm)
+	signature.Reference.URI = "#" + id
+	return &signature
+}
+
+// SPPolicy returns the policy the IdP applies to the SP with the given entity
+// ID.
+func (idp *IdentityProvider) SPPolicy(entityID string) *ServiceProviderPolicy {
+	if policy := idp.SPPolicies[entityID]; policy != nil {
+		return policy
+	}
+	return &idp.DefaultSPPolicy
+}
+
+// spPolicy returns the policy applied to the SP that sent the request.
+func (req *IdpAuthnRequest) spPolicy() *ServiceProviderPolicy {
+	var entityID string
+	if req.ServiceProviderMetadata != nil {
+		entityID = req.ServiceProviderMetadata.EntityID
+	}
+	return req.IDP.SPPolicy(entityID)
+}
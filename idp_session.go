@@ -0,0 +1,483 @@
+package saml
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSessionNotFound is returned by a SessionStore when it holds no session
+// with the requested ID, or only an expired one.
+var ErrSessionNotFound = errors.New("session not found")
+
+// DefaultSessionCookieName is the name of the cookie holding the IdP's SSO
+// session ID when IdentityProvider.SessionCookieName is empty.
+const DefaultSessionCookieName = "saml_idp_session"
+
+// DefaultSessionMaxAge is how long an SSO session lasts when neither the
+// Authenticator nor IdentityProvider.SessionMaxAge set it.
+const DefaultSessionMaxAge = 8 * time.Hour
+
+// SessionParticipant records that a SP was issued an assertion under an SSO
+// session.
+type SessionParticipant struct {
+	// Entity ID of the SP
+	EntityID string
+
+	// SessionIndex of the assertion
+	SessionIndex string
+
+	// Subject of the assertion
+	NameID *NameID
+
+	// When the assertion was issued
+	IssueInstant time.Time
+}
+
+// SessionStore keeps the SSO sessions of the IdP, so users who already
+// authenticated are not asked to do so again when they log in to another SP.
+type SessionStore interface {
+	// GetSession returns the session with the given ID, or ErrSessionNotFound
+	// if there is none or it has expired. The returned value belongs to the
+	// caller.
+	GetSession(ctx context.Context, id string) (*Session, error)
+
+	// SaveSession creates or replaces the session with the same ID.
+	SaveSession(ctx context.Context, session *Session) error
+
+	// DeleteSession removes the session with the given ID, if any.
+	DeleteSession(ctx context.Context, id string) error
+
+	// AddSessionParticipant records that a SP was issued an assertion under
+	// the session with the given ID.
+	AddSessionParticipant(ctx context.Context, id string, participant SessionParticipant) error
+}
+
+// copySession returns a copy of session that shares no slice with it.
+func copySession(session *Session) *Session {
+	c := *session
+	c.Participants = append([]SessionParticipant(nil), session.Participants...)
+	c.AuthnMethods = append([]AuthnMethod(nil), session.AuthnMethods...)
+	if session.Logout != nil {
+		logout := *session.Logout
+		logout.Pending = append([]SessionParticipant(nil), logout.Pending...)
+		logout.Failed = append([]string(nil), logout.Failed...)
+		c.Logout = &logout
+	}
+	return &c
+}
+
+// expired reports whether the session has expired at the given time.
+func (session *Session) expired(now time.Time) bool {
+	return !session.ExpireTime.IsZero() && !now.Before(session.ExpireTime)
+}
+
+// memorySessionPruneInterval is the number of saves between two sweeps of
+// the expired sessions of a MemorySessionStore.
+const memorySessionPruneInterval = 100
+
+// MemorySessionStore is a SessionStore that keeps sessions in memory. Sessions
+// are lost when the process exits and are not shared between processes.
+// Expired sessions are removed when they are read, and swept every hundred
+// saves so abandoned ones do not pile up. It is safe for concurrent use.
+type MemorySessionStore struct {
+	// Returns the current time, the package level Now is used if nil. It
+	// should be the Now of the IdP, which sets the expiry of the sessions.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	saves    int
+}
+
+func (store *MemorySessionStore) now() time.Time {
+	if store.Now != nil {
+		return store.Now()
+	}
+	return Now()
+}
+
+// GetSession implements SessionStore.
+func (store *MemorySessionStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	session, ok := store.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if session.expired(store.now()) {
+		delete(store.sessions, id)
+		return nil, ErrSessionNotFound
+	}
+	return copySession(session), nil
+}
+
+// SaveSession implements SessionStore.
+func (store *MemorySessionStore) SaveSession(ctx context.Context, session *Session) error {
+	if session.ID == "" {
+		return errors.New("missing session id")
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.sessions == nil {
+		store.sessions = make(map[string]*Session)
+	}
+	store.sessions[session.ID] = copySession(session)
+
+	store.saves++
+	if store.saves%memorySessionPruneInterval == 0 {
+		now := store.now()
+		for id, s := range store.sessions {
+			if s.expired(now) {
+				delete(store.sessions, id)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteSession implements SessionStore.
+func (store *MemorySessionStore) DeleteSession(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.sessions, id)
+	return nil
+}
+
+// AddSessionParticipant implements SessionStore.
+func (store *MemorySessionStore) AddSessionParticipant(ctx context.Context, id string, participant SessionParticipant) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	session, ok := store.sessions[id]
+	if !ok || session.expired(store.now()) {
+		return ErrSessionNotFound
+	}
+	session.Participants = append(session.Participants, participant)
+	return nil
+}
+
+// FileSessionStore is a SessionStore that keeps each session in a JSON file of
+// Dir, so sessions survive restarts. It is safe for concurrent use within a
+// process; processes sharing Dir may lose participants recorded at the same
+// time. Expired sessions are removed when they are read.
+type FileSessionStore struct {
+	// Directory holding the session files
+	Dir string
+
+	// Returns the current time, the package level Now is used if nil. It
+	// should be the Now of the IdP, which sets the expiry of the sessions.
+	Now func() time.Time
+
+	mu sync.Mutex
+}
+
+func (store *FileSessionStore) now() time.Time {
+	if store.Now != nil {
+		return store.Now()
+	}
+	return Now()
+}
+
+// path returns the file of the session with the given ID. Session IDs come
+// from cookies, so they are hashed rather than used as file names.
+func (store *FileSessionStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(store.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (store *FileSessionStore) read(id string) (*Session, error) {
+	buf, err := ioutil.ReadFile(store.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read session")
+	}
+
+	var session Session
+	if err := json.Unmarshal(buf, &session); err != nil {
+		return nil, errors.Wrap(err, "failed to parse session")
+	}
+	if session.ID != id {
+		return nil, ErrSessionNotFound
+	}
+	if session.expired(store.now()) {
+		os.Remove(store.path(id))
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (store *FileSessionStore) write(session *Session) error {
+	buf, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode session")
+	}
+
+	f, err := ioutil.TempFile(store.Dir, ".session")
+	if err != nil {
+		return errors.Wrap(err, "failed to write session")
+	}
+	_, err = f.Write(buf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), store.path(session.ID))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "failed to write session")
+	}
+	return nil
+}
+
+// GetSession implements SessionStore.
+func (store *FileSessionStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.read(id)
+}
+
+// SaveSession implements SessionStore.
+func (store *FileSessionStore) SaveSession(ctx context.Context, session *Session) error {
+	if session.ID == "" {
+		return errors.New("missing session id")
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.write(session)
+}
+
+// DeleteSession implements SessionStore.
+func (store *FileSessionStore) DeleteSession(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	err := os.Remove(store.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to delete session")
+	}
+	return nil
+}
+
+// AddSessionParticipant implements SessionStore.
+func (store *FileSessionStore) AddSessionParticipant(ctx context.Context, id string, participant SessionParticipant) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	session, err := store.read(id)
+	if err != nil {
+		return err
+	}
+	session.Participants = append(session.Participants, participant)
+	return store.write(session)
+}
+
+// newSessionID returns a random, unguessable SSO session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate session id")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (idp *IdentityProvider) sessionCookieName() string {
+	if idp.SessionCookieName != "" {
+		return idp.SessionCookieName
+	}
+	return DefaultSessionCookieName
+}
+
+// currentSession returns the valid SSO session of the browser that sent r, or
+// nil.
+func (idp *IdentityProvider) currentSession(r *http.Request) (*Session, error) {
+	if idp.Sessions == nil || r == nil {
+		return nil, nil
+	}
+	cookie, err := r.Cookie(idp.sessionCookieName())
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+
+	session, err := idp.Sessions.GetSession(r.Context(), cookie.Value)
+	if err == ErrSessionNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get session")
+	}
+	return session, nil
+}
+
+// startSession saves a session returned by an Authenticator and sets the
+// cookie of the SSO session on w. The session always gets a new ID, whatever
+// the Authenticator set, so a session ID is never chosen by a client nor
+// reused after the user authenticated again.
+func (idp *IdentityProvider) startSession(w http.ResponseWriter, r *http.Request, session *Session) error {
+	var err error
+	if session.ID, err = newSessionID(); err != nil {
+		return err
+	}
+	now := idp.now()
+	if session.CreateTime.IsZero() {
+		session.CreateTime = now
+	}
+	if session.ExpireTime.IsZero() {
+		maxAge := idp.SessionMaxAge
+		if maxAge == 0 {
+			maxAge = DefaultSessionMaxAge
+		}
+		session.ExpireTime = now.Add(maxAge)
+	}
+	if session.Index == "" {
+		session.Index = idp.newID()
+	}
+
+	if err := idp.Sessions.SaveSession(r.Context(), session); err != nil {
+		return errors.Wrap(err, "failed to save session")
+	}
+
+	// Requests of the HTTP-POST binding are cross-site, the cookie must be
+	// sent along with them.
+	secure := r.TLS != nil || strings.HasPrefix(idp.SSOURL, "https://")
+	cookie := &http.Cookie{
+		Name:     idp.sessionCookieName(),
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpireTime,
+		HttpOnly: true,
+		Secure:   secure,
+	}
+	if secure {
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// Authenticate returns the session of the user who sent the request. The SSO
+// session of the browser is reused if there is a valid one, the request does
+// not set ForceAuthn and one of the AuthnMethods of the session satisfies its
+// RequestedAuthnContext; otherwise authFn is called and the session it returns
+// becomes the browser's SSO session, replacing the one it had, if any, which
+// is deleted from the SessionStore after its participants are moved to the
+// new session. authFn can find the request with
+// AuthnRequestFromContext, to step up the authentication of the user. A
+// passive request never calls authFn: the SSO session is returned even if it
+// does not satisfy the RequestedAuthnContext, or nil if there is none, which
+// GenerateResponse answers with a NoAuthnContext or NoPassive status. Without
+// a SessionStore authFn is always called. If authFn fails after writing a
+// response, such as a 401, the error is only logged and neither a session nor
+// an error is returned, as authFn answered the request itself.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.4.1
+func (req *IdpAuthnRequest) Authenticate(w http.ResponseWriter, authFn Authenticator) (*Session, error) {
+	r := req.HTTPRequest
+	if r == nil {
+		return nil, errors.New("missing http request")
+	}
+
+	session, err := req.IDP.currentSession(r)
+	if err != nil {
+		return nil, err
+	}
+	if session != nil && session.Logout != nil {
+		// The session is being logged out.
+		session = nil
+	}
+	if session != nil && !req.Request.ForceAuthn {
+		if _, err := req.AuthnMethod(session); err == nil || req.Request.IsPassive {
+			return session, nil
+		}
+	}
+	if req.Request.IsPassive {
+		return nil, nil
+	}
+	replaced := session
+
+	tw := &trackingResponseWriter{ResponseWriter: w}
+	session, err = authFn(tw, r.WithContext(context.WithValue(r.Context(), authnRequestKey{}, req)))
+	if err != nil && tw.written {
+		req.IDP.logger().DebugContext(r.Context(), "authentication failed",
+			"sp", req.spEntityID(),
+			errorAttr(err))
+		return nil, nil
+	}
+	if err != nil || session == nil || req.IDP.Sessions == nil {
+		return session, err
+	}
+	if replaced != nil {
+		// The SPs the user logged in to under the replaced session are
+		// logged out along with the new one.
+		session.Participants = append(append([]SessionParticipant(nil), replaced.Participants...), session.Participants...)
+	}
+	if err := req.IDP.startSession(w, r, session); err != nil {
+		return nil, err
+	}
+	if replaced != nil {
+		// The user authenticated again because of ForceAuthn or to step up
+		// the authentication.
+		if err := req.IDP.Sessions.DeleteSession(r.Context(), replaced.ID); err != nil {
+			return nil, errors.Wrap(err, "failed to delete replaced session")
+		}
+	}
+	return session, nil
+}
+
+// trackingResponseWriter tells whether a response was written to the
+// underlying http.ResponseWriter.
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *trackingResponseWriter) WriteHeader(statusCode int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *trackingResponseWriter) Write(buf []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(buf)
+}
+
+// recordParticipant records in the SSO session that the SP was issued the
+// assertion of the request.
+func (req *IdpAuthnRequest) recordParticipant(session *Session) error {
+	if req.IDP.Sessions == nil || session.ID == "" || req.ServiceProviderMetadata == nil || req.Assertion == nil {
+		return nil
+	}
+
+	participant := SessionParticipant{
+		EntityID:     req.ServiceProviderMetadata.EntityID,
+		SessionIndex: session.Index,
+		IssueInstant: req.Assertion.IssueInstant,
+	}
+	if req.Assertion.Subject != nil {
+		participant.NameID = req.Assertion.Subject.NameID
+	}
+
+	err := req.IDP.Sessions.AddSessionParticipant(req.context(), session.ID, participant)
+	if err != nil && err != ErrSessionNotFound {
+		return errors.Wrap(err, "failed to record session participant")
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package saml
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	ctx := context.Background()
+
+	_, err := store.GetSession(ctx, "missing")
+	assert.Equal(t, ErrSessionNotFound, err)
+	assert.Equal(t, ErrSessionNotFound, store.AddSessionParticipant(ctx, "missing", SessionParticipant{}))
+
+	session := &Session{
+		ID:         "../../etc/passwd",
+		CreateTime: Now(),
+		ExpireTime: Now().Add(time.Hour),
+		Index:      "index",
+		UserID:     "anakin",
+	}
+	assert.NoError(t, store.SaveSession(ctx, session))
+
+	participant := SessionParticipant{
+		EntityID:     "https://sp.example.org",
+		SessionIndex: "index",
+		NameID:       &NameID{Format: NameIDTransientFormat, Value: "id-1"},
+	}
+	assert.NoError(t, store.AddSessionParticipant(ctx, session.ID, participant))
+
+	got, err := store.GetSession(ctx, session.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "anakin", got.UserID)
+		assert.Equal(t, []SessionParticipant{participant}, got.Participants)
+	}
+	assert.Empty(t, session.Participants)
+
+	assert.NoError(t, store.DeleteSession(ctx, session.ID))
+	_, err = store.GetSession(ctx, session.ID)
+	assert.Equal(t, ErrSessionNotFound, err)
+	assert.NoError(t, store.DeleteSession(ctx, session.ID))
+
+	session.ExpireTime = Now().Add(-time.Second)
+	assert.NoError(t, store.SaveSession(ctx, session))
+	_, err = store.GetSession(ctx, session.ID)
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	tearUp()
+
+	testSessionStore(t, &MemorySessionStore{})
+}
+
+func TestMemorySessionStorePrunesExpired(t *testing.T) {
+	tearUp()
+
+	now := Now()
+	store := &MemorySessionStore{Now: func() time.Time { return now }}
+	ctx := context.Background()
+	assert.NoError(t, store.SaveSession(ctx, &Session{ID: "abandoned", ExpireTime: now.Add(time.Minute)}))
+
+	// Expired sessions are swept by the saves even if never read again.
+	now = now.Add(time.Hour)
+	for i := 1; i < memorySessionPruneInterval; i++ {
+		assert.NoError(t, store.SaveSession(ctx, &Session{ID: fmt.Sprintf("session-%d", i), ExpireTime: now.Add(time.Hour)}))
+	}
+	assert.Len(t, store.sessions, memorySessionPruneInterval-1)
+	assert.NotContains(t, store.sessions, "abandoned")
+}
+
+func TestFileSessionStore(t *testing.T) {
+	tearUp()
+
+	dir, err := ioutil.TempDir("", "saml-sessions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testSessionStore(t, &FileSessionStore{Dir: dir})
+}
+
+func TestSessionStoreClock(t *testing.T) {
+	tearUp()
+
+	dir, err := ioutil.TempDir("", "saml-sessions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The stores tell expired sessions with their own clock, that of the
+	// IdP, rather than the package level Now.
+	later := func() time.Time { return Now().Add(2 * time.Hour) }
+	for _, store := range []SessionStore{&MemorySessionStore{Now: later}, &FileSessionStore{Dir: dir, Now: later}} {
+		session := &Session{ID: "session", ExpireTime: Now().Add(time.Hour)}
+		assert.NoError(t, store.SaveSession(context.Background(), session))
+		_, err := store.GetSession(context.Background(), session.ID)
+		assert.Equal(t, ErrSessionNotFound, err)
+	}
+}
+
+func TestAuthenticateReusesSession(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.Sessions = &MemorySessionStore{}
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	logins := 0
+	authFn := func(w http.ResponseWriter, r *http.Request) (*Session, error) {
+		logins++
+		return &Session{UserID: "anakin", UserEmail: "anakin@example.org"}, nil
+	}
+
+	newRequest := func(cookies []*http.Cookie, update func(*AuthnRequest)) *IdpAuthnRequest {
+		authnRequest, err := testSP.NewAuthnRequest()
+		assert.NoError(t, err)
+		if update != nil {
+			update(authnRequest)
+		}
+		r := httptest.NewRequest("GET", "/sso", nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		return &IdpAuthnRequest{
+			IDP:                     idp,
+			HTTPRequest:             r,
+			Request:                 *authnRequest,
+			ServiceProviderMetadata: spMetadata,
+		}
+	}
+
+	// A passive request without SSO session yields no session.
+	session, err := newRequest(nil, func(r *AuthnRequest) { r.IsPassive = true }).Authenticate(httptest.NewRecorder(), authFn)
+	assert.NoError(t, err)
+	assert.Nil(t, session)
+	assert.Equal(t, 0, logins)
+
+	w := httptest.NewRecorder()
+	req := newRequest(nil, nil)
+	session, err = req.Authenticate(w, authFn)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, logins)
+	if !assert.NotNil(t, session) {
+		return
+	}
+	assert.NotEmpty(t, session.ID)
+	assert.NotEmpty(t, session.Index)
+	assert.Equal(t, Now().Add(DefaultSessionMaxAge), session.ExpireTime)
+
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, DefaultSessionCookieName, cookies[0].Name)
+		assert.Equal(t, session.ID, cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+	}
+
+	assert.NoError(t, req.MakeAssertion(session))
+	assert.NoError(t, req.recordParticipant(session))
+
+	// The SSO session is reused, even by passive requests.
+	reused, err := newRequest(cookies, nil).Authenticate(httptest.NewRecorder(), authFn)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, logins)
+	if assert.NotNil(t, reused) {
+		assert.Equal(t, session.ID, reused.ID)
+		if assert.Len(t, reused.Participants, 1) {
+			assert.Equal(t, testSP.MetadataURL, reused.Participants[0].EntityID)
+			assert.Equal(t, session.Index, reused.Participants[0].SessionIndex)
+			assert.Equal(t, req.Assertion.Subject.NameID, reused.Participants[0].NameID)
+		}
+	}
+
+	reused, err = newRequest(cookies, func(r *AuthnRequest) { r.IsPassive = true }).Authenticate(httptest.NewRecorder(), authFn)
+	assert.NoError(t, err)
+	assert.NotNil(t, reused)
+	assert.Equal(t, 1, logins)
+
+	// ForceAuthn makes the user authenticate again, the new session replaces
+	// the old one.
+	w = httptest.NewRecorder()
+	forced, err := newRequest(cookies, func(r *AuthnRequest) { r.ForceAuthn = true }).Authenticate(w, authFn)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, logins)
+	if assert.NotNil(t, forced) {
+		assert.NotEqual(t, session.ID, forced.ID)
+	}
+	assert.Len(t, w.Result().Cookies(), 1)
+	_, err = idp.Sessions.GetSession(context.Background(), session.ID)
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	// The session ID set by the Authenticator is not kept.
+	fixed := func(w http.ResponseWriter, r *http.Request) (*Session, error) {
+		return &Session{ID: forced.ID, UserID: "vader"}, nil
+	}
+	other, err := newRequest(nil, nil).Authenticate(httptest.NewRecorder(), fixed)
+	assert.NoError(t, err)
+	if assert.NotNil(t, other) {
+		assert.NotEqual(t, forced.ID, other.ID)
+	}
+	kept, err := idp.Sessions.GetSession(context.Background(), forced.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "anakin", kept.UserID)
+	}
+}
@@ -1,10 +1,24 @@
 package saml
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/xmlsec"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -126,9 +140,17 @@ func TestGenerateIdPMetadata(t *testing.T) {
 			<EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes128-cbc"></EncryptionMethod>
 			<EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes192-cbc"></EncryptionMethod>
 			<EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes256-cbc"></EncryptionMethod>
+			<EncryptionMethod Algorithm="http://www.w3.org/2009/xmlenc11#aes128-gcm"></EncryptionMethod>
+			<EncryptionMethod Algorithm="http://www.w3.org/2009/xmlenc11#aes256-gcm"></EncryptionMethod>
 			<EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"></EncryptionMethod>
+			<EncryptionMethod Algorithm="http://www.w3.org/2009/xmlenc11#rsa-oaep">
+				<DigestMethod xmlns="http://www.w3.org/2000/09/xmldsig#" Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></DigestMethod>
+				<MGF xmlns="http://www.w3.org/2009/xmlenc11#" Algorithm="http://www.w3.org/2009/xmlenc11#mgf1sha256"></MGF>
+			</EncryptionMethod>
 		</KeyDescriptor>
 		<NameIDFormat>urn:oasis:names:tc:SAML:2.0:nameid-format:transient</NameIDFormat>
+		<NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress</NameIDFormat>
+		<NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified</NameIDFormat>
 		<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="http://localhost:1233/saml/sso"></SingleSignOnService>
 		<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="http://localhost:1233/saml/sso"></SingleSignOnService>
 	</IDPSSODescriptor>
@@ -142,6 +164,7 @@ func TestParseAuthenticationRequest(t *testing.T) {
 
 	authnRequest, err := testSP.NewAuthnRequest()
 	assert.NoError(t, err)
+	authnRequest.NameIDPolicy.Format = NameIDTransientFormat
 
 	sdpMetadata, err := testSP.Metadata()
 	assert.NoError(t, err)
@@ -157,6 +180,7 @@ func TestParseAuthenticationRequest(t *testing.T) {
 	}
 
 	err = idpAuthnRequest.MakeAssertion(&Session{CreateTime: Now()})
+	assert.NoError(t, err)
 
 	out, err := xml.MarshalIndent(idpAuthnRequest.Assertion, "", "\t")
 	assert.NoError(t, err)
@@ -169,12 +193,12 @@ func TestParseAuthenticationRequest(t *testing.T) {
 	<Signature xmlns="http://www.w3.org/2000/09/xmldsig#">
 		<SignedInfo>
 			<CanonicalizationMethod Algorithm="http://www.w3.org/TR/2001/REC-xml-c14n-20010315"></CanonicalizationMethod>
-			<SignatureMethod Algorithm="http://www.w3.org/2000/09/xmldsig#rsa-sha1"></SignatureMethod>
-			<Reference>
+			<SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></SignatureMethod>
+			<Reference URI="#id-MOCKID">
 				<Transforms>
 					<Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></Transform>
 				</Transforms>
-				<DigestMethod Algorithm="http://www.w3.org/2000/09/xmldsig#sha1"></DigestMethod>
+				<DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></DigestMethod>
 				<DigestValue></DigestValue>
 			</Reference>
 		</SignedInfo>
@@ -186,7 +210,7 @@ func TestParseAuthenticationRequest(t *testing.T) {
 		</KeyInfo>
 	</Signature>
 	<Subject xmlns="urn:oasis:names:tc:SAML:2.0:assertion">
-		<NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:transient" NameQualifier="http://localhost:1233/saml/service.xml" SPNameQualifier="http://localhost:1235/saml/service.xml"></NameID>
+		<NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:transient" NameQualifier="http://localhost:1233/saml/service.xml" SPNameQualifier="http://localhost:1235/saml/service.xml">id-MOCKID</NameID>
 		<SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
 			<SubjectConfirmationData Address="127.0.0.1" InResponseTo="id-MOCKID" NotOnOrAfter="` + after + `" Recipient="http://localhost:1235/saml/acs"></SubjectConfirmationData>
 		</SubjectConfirmation>
@@ -207,3 +231,913 @@ func TestParseAuthenticationRequest(t *testing.T) {
 
 	assert.Equal(t, expectedOutput, string(out))
 }
+
+func TestMakeAssertionRequestedAttributes(t *testing.T) {
+	tearUp()
+
+	sp := *testSP
+	sp.RequestedAttributes = []RequestedAttribute{
+		{Name: "urn:oid:2.5.4.42", FriendlyName: "givenName"},
+	}
+
+	authnRequest, err := sp.NewAuthnRequest()
+	assert.NoError(t, err)
+
+	spMetadata, err := sp.Metadata()
+	assert.NoError(t, err)
+
+	idpAuthnRequest := &IdpAuthnRequest{
+		IDP:                     testIdP,
+		ServiceProviderMetadata: spMetadata,
+		Request:                 *authnRequest,
+	}
+
+	err = idpAuthnRequest.MakeAssertion(&Session{
+		CreateTime:    Now(),
+		UserEmail:     "anakin@example.org",
+		UserGivenName: "Anakin",
+		UserSurname:   "Skywalker",
+	})
+	assert.NoError(t, err)
+
+	attributes := idpAuthnRequest.Assertion.AttributeStatement.Attributes
+	if assert.Len(t, attributes, 1) {
+		assert.Equal(t, "urn:oid:2.5.4.42", attributes[0].Name)
+	}
+
+	unknownIndex := 7
+	idpAuthnRequest.Request.AttributeConsumingServiceIndex = &unknownIndex
+	err = idpAuthnRequest.MakeAssertion(&Session{CreateTime: Now()})
+	assert.Error(t, err)
+}
+
+// newTestIdPForSP returns a copy of testIdP that knows about the given SP.
+func newTestIdPForSP(t *testing.T, sp *ServiceProvider) *IdentityProvider {
+	spMetadata, err := sp.Metadata()
+	assert.NoError(t, err)
+
+	return &IdentityProvider{
+		PrivkeyPEM:  testIdP.PrivkeyPEM,
+		PubkeyPEM:   testIdP.PubkeyPEM,
+		MetadataURL: testIdP.MetadataURL,
+		SSOURL:      testIdP.SSOURL,
+
+		ServiceProviders: NewMemoryServiceProviderRegistry(spMetadata),
+	}
+}
+
+// newTestSPForIdP returns a copy of testSP that trusts the given IdP.
+func newTestSPForIdP(t *testing.T, idp *IdentityProvider) *ServiceProvider {
+	cert, err := idp.Cert()
+	assert.NoError(t, err)
+
+	sp := *testSP
+	sp.IdPEntityID = idp.MetadataURL
+	sp.IdPPubkeyPEM = base64.StdEncoding.EncodeToString(cert.Bytes)
+	return &sp
+}
+
+// sequentialIDs returns a NewID function whose IDs differ, unlike the one of
+// tearUp, so the signatures of a Response and of its Assertion can be told
+// apart.
+func sequentialIDs() func() string {
+	var lastID uint64
+	return func() string {
+		return fmt.Sprintf("id-%d", atomic.AddUint64(&lastID, 1))
+	}
+}
+
+// loginResponse has idp answer an AuthnRequest of sp for the given session,
+// and returns the request with the XML of the response in ResponseBuffer.
+func loginResponse(t *testing.T, idp *IdentityProvider, sp *ServiceProvider, session *Session) *IdpAuthnRequest {
+	authnRequest, err := sp.NewAuthnRequest()
+	assert.NoError(t, err)
+	buf, err := xml.Marshal(authnRequest)
+	assert.NoError(t, err)
+	redirectURL, err := sp.SAMLRequestURL(buf, "")
+	assert.NoError(t, err)
+
+	req, err := idp.ParseAuthnRequest(httptest.NewRequest("GET", redirectURL, nil))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if err := req.MakeAssertion(session); err == nil {
+		if err = req.MakeResponse(); err == nil {
+			err = req.MarshalResponse()
+		}
+	}
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return req
+}
+
+func TestParseAuthnRequestBindings(t *testing.T) {
+	tearUp()
+
+	testIdP := newTestIdPForSP(t, testSP)
+
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+
+	buf, err := xml.Marshal(authnRequest)
+	assert.NoError(t, err)
+
+	redirectURL, err := testSP.SAMLRequestURL(buf, "/foo?bar=baz")
+	assert.NoError(t, err)
+
+	req, err := testIdP.ParseAuthnRequest(httptest.NewRequest("GET", redirectURL, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, HTTPRedirectBinding, req.Binding)
+	assert.Equal(t, "/foo?bar=baz", req.RelayState)
+	assert.Equal(t, string(buf), string(req.RequestBuffer))
+	assert.Equal(t, authnRequest.ID, req.Request.ID)
+	assert.Equal(t, testSP.MetadataURL, req.Request.Issuer.Value)
+
+	form := url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(buf)},
+		"RelayState":  {"xyz"},
+	}
+	r := httptest.NewRequest("POST", testIdP.SSOURL, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	req, err = testIdP.ParseAuthnRequest(r)
+	assert.NoError(t, err)
+	assert.Equal(t, HTTPPostBinding, req.Binding)
+	assert.Equal(t, "xyz", req.RelayState)
+	assert.Equal(t, string(buf), string(req.RequestBuffer))
+	assert.Equal(t, testSP.ACSURL, req.Request.AssertionConsumerServiceURL)
+
+	_, err = testIdP.ParseAuthnRequest(httptest.NewRequest("GET", testIdP.SSOURL, nil))
+	assert.Error(t, err)
+
+	authnRequest.Destination = "http://evil.example.org/saml/sso"
+	buf, err = xml.Marshal(authnRequest)
+	assert.NoError(t, err)
+	redirectURL, err = testSP.SAMLRequestURL(buf, "")
+	assert.NoError(t, err)
+	_, err = testIdP.ParseAuthnRequest(httptest.NewRequest("GET", redirectURL, nil))
+	assert.Error(t, err)
+}
+
+func TestAuthnRequestRedirectSignature(t *testing.T) {
+	tearUp()
+
+	sp := *testSP
+	sp.IdPSignSAMLRequest = true
+	idp := newTestIdPForSP(t, &sp)
+
+	authnRequest, err := sp.NewAuthnRequest()
+	assert.NoError(t, err)
+	buf, err := xml.Marshal(authnRequest)
+	assert.NoError(t, err)
+
+	redirectURL, err := sp.SAMLRequestURL(buf, "/foo?bar=baz")
+	assert.NoError(t, err)
+	assert.Contains(t, redirectURL, "&SigAlg="+url.QueryEscape(SigAlgRSASHA256)+"&Signature=")
+
+	req, err := idp.ParseAuthnRequest(httptest.NewRequest("GET", redirectURL, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "/foo?bar=baz", req.RelayState)
+
+	// Tampering with any signed parameter must be detected.
+	tampered := strings.Replace(redirectURL, "RelayState=%2Ffoo", "RelayState=%2Fevil", 1)
+	_, err = idp.ParseAuthnRequest(httptest.NewRequest("GET", tampered, nil))
+	assert.Error(t, err)
+
+	// The SP's metadata requires signed requests.
+	unsignedURL := redirectURL[:strings.Index(redirectURL, "&SigAlg=")]
+	_, err = idp.ParseAuthnRequest(httptest.NewRequest("GET", unsignedURL, nil))
+	assert.Error(t, err)
+
+	// The IdP's policy requires signed requests.
+	idp = newTestIdPForSP(t, testSP)
+	_, err = idp.ParseAuthnRequest(httptest.NewRequest("GET", unsignedURL, nil))
+	assert.NoError(t, err)
+
+	idp.SPPolicies = map[string]*ServiceProviderPolicy{
+		testSP.MetadataURL: {RequireSignedAuthnRequests: true},
+	}
+	_, err = idp.ParseAuthnRequest(httptest.NewRequest("GET", unsignedURL, nil))
+	assert.Error(t, err)
+
+	_, err = idp.ParseAuthnRequest(httptest.NewRequest("GET", redirectURL, nil))
+	assert.NoError(t, err)
+}
+
+func TestResolveACSEndpoint(t *testing.T) {
+	tearUp()
+
+	sp := *testSP
+	sp.AssertionConsumerServices = []IndexedEndpoint{
+		{Binding: HTTPPostBinding, Location: "http://localhost:1235/saml/acs", Index: 1},
+		{Binding: HTTPPostBinding, Location: "http://sp.example.org/saml/acs", Index: 2, IsDefault: true},
+		{Binding: HTTPRedirectBinding, Location: "http://sp.example.org/saml/acs-redirect", Index: 3},
+	}
+	spMetadata, err := sp.Metadata()
+	assert.NoError(t, err)
+
+	one, three := 1, 3
+	tests := []struct {
+		Request  AuthnRequest
+		Location string
+		Status   string
+	}{
+		{Request: AuthnRequest{}, Location: "http://sp.example.org/saml/acs"},
+		{Request: AuthnRequest{AssertionConsumerServiceIndex: &one}, Location: "http://localhost:1235/saml/acs"},
+		{Request: AuthnRequest{AssertionConsumerServiceURL: "http://localhost:1235/saml/acs"}, Location: "http://localhost:1235/saml/acs"},
+		{Request: AuthnRequest{AssertionConsumerServiceURL: "http://evil.example.org/acs"}, Status: StatusRequester},
+		{Request: AuthnRequest{AssertionConsumerServiceURL: "http://localhost:1235/saml/acs", AssertionConsumerServiceIndex: &one}, Status: StatusRequester},
+		{Request: AuthnRequest{AssertionConsumerServiceIndex: &three}, Status: StatusResponder},
+		{Request: AuthnRequest{ProtocolBinding: HTTPRedirectBinding}, Status: StatusResponder},
+	}
+
+	for _, test := range tests {
+		req := &IdpAuthnRequest{
+			IDP:                     testIdP,
+			Request:                 test.Request,
+			ServiceProviderMetadata: spMetadata,
+		}
+		err := req.Validate()
+		if test.Status == "" {
+			assert.NoError(t, err)
+			assert.Equal(t, test.Location, req.ACSEndpoint.Location)
+			continue
+		}
+		statusErr, ok := err.(*StatusError)
+		if assert.True(t, ok, "expected a status error, got %v", err) {
+			assert.Equal(t, test.Status, statusErr.Code)
+		}
+		assert.Nil(t, req.ACSEndpoint)
+	}
+}
+
+func TestGenerateErrorResponse(t *testing.T) {
+	tearUp()
+
+	testIdP := newTestIdPForSP(t, testSP)
+
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+	authnRequest.AssertionConsumerServiceURL = "http://evil.example.org/acs"
+	buf, err := xml.Marshal(authnRequest)
+	assert.NoError(t, err)
+
+	redirectURL, err := testSP.SAMLRequestURL(buf, "xyz")
+	assert.NoError(t, err)
+
+	req, err := testIdP.ParseAuthnRequest(httptest.NewRequest("GET", redirectURL, nil))
+	assert.IsType(t, &StatusError{}, err)
+	assert.NotNil(t, req)
+
+	form, err := req.GenerateErrorResponse(err)
+	assert.NoError(t, err)
+	assert.Contains(t, string(form), `action="`+testSP.ACSURL+`"`)
+	assert.NotContains(t, string(form), "evil.example.org")
+
+	out, err := xml.MarshalIndent(req.Response, "", "\t")
+	assert.NoError(t, err)
+	assert.Equal(t, `<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-MOCKID" Version="2.0" IssueInstant="`+Now().Format(time.RFC3339Nano)+`" Destination="http://localhost:1235/saml/acs" InResponseTo="id-MOCKID">
+	<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion" Format="urn:oasis:names:tc:SAML:2.0:nameid-format:entity">http://localhost:1233/saml/service.xml</Issuer>
+	<Status xmlns="urn:oasis:names:tc:SAML:2.0:protocol">
+		<StatusCode xmlns="urn:oasis:names:tc:SAML:2.0:protocol" Value="urn:oasis:names:tc:SAML:2.0:status:Requester"></StatusCode>
+		<StatusMessage xmlns="urn:oasis:names:tc:SAML:2.0:protocol">assertion consumer service &#34;http://evil.example.org/acs&#34; is not listed in the sp metadata</StatusMessage>
+	</Status>
+</Response>`, string(out))
+}
+
+func TestIdentityProviderConcurrentLogins(t *testing.T) {
+	tearUp()
+
+	const numSPs, numLogins = 16, 400
+
+	// When xmlsec1 is installed, one assertion in ten is also signed,
+	// encrypted and asserted by the SP, which is slow.
+	_, err := exec.LookPath("xmlsec1")
+	withXMLSec1 := err == nil
+
+	registry := NewMemoryServiceProviderRegistry()
+	idp := &IdentityProvider{
+		PrivkeyPEM:       testIdP.PrivkeyPEM,
+		PubkeyPEM:        testIdP.PubkeyPEM,
+		MetadataURL:      testIdP.MetadataURL,
+		SSOURL:           testIdP.SSOURL,
+		ServiceProviders: registry,
+		Now:              Now,
+		NewID:            sequentialIDs(),
+	}
+
+	sps := make([]*ServiceProvider, numSPs)
+	for i := range sps {
+		sps[i] = &ServiceProvider{
+			PrivkeyPEM:         testSP.PrivkeyPEM,
+			PubkeyPEM:          testSP.PubkeyPEM,
+			MetadataURL:        fmt.Sprintf("http://sp%d.example.org/saml/metadata", i),
+			ACSURL:             fmt.Sprintf("http://sp%d.example.org/saml/acs", i),
+			IdPSSOServiceURL:   idp.SSOURL,
+			IdPSignSAMLRequest: i%2 == 0,
+			IdPEntityID:        idp.MetadataURL,
+			IdPPubkeyPEM:       newTestSPForIdP(t, idp).IdPPubkeyPEM,
+		}
+		metadata, err := sps[i].Metadata()
+		assert.NoError(t, err)
+		registry.Add(metadata)
+	}
+
+	var wg sync.WaitGroup
+	var assertionIDs sync.Map
+	for i := 0; i < numLogins; i++ {
+		wg.Add(1)
+		go func(sp *ServiceProvider, marshal bool) {
+			defer wg.Done()
+
+			authnRequest, err := sp.NewAuthnRequest()
+			if !assert.NoError(t, err) {
+				return
+			}
+			buf, err := xml.Marshal(authnRequest)
+			if !assert.NoError(t, err) {
+				return
+			}
+			redirectURL, err := sp.SAMLRequestURL(buf, sp.MetadataURL)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			req, err := idp.ParseAuthnRequest(httptest.NewRequest("GET", redirectURL, nil))
+			if !assert.NoError(t, err) {
+				return
+			}
+			if !assert.NoError(t, req.MakeAssertion(&Session{CreateTime: Now(), UserEmail: sp.MetadataURL})) {
+				return
+			}
+
+			assert.Equal(t, sp.MetadataURL, req.RelayState)
+			assert.Equal(t, sp.MetadataURL, req.Assertion.Conditions.AudienceRestriction.Audience.Value)
+			assert.Equal(t, sp.ACSURL, req.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient)
+			assert.Equal(t, sp.MetadataURL, req.Assertion.Subject.NameID.Value)
+
+			_, duplicate := assertionIDs.LoadOrStore(req.Assertion.ID, true)
+			assert.False(t, duplicate, "duplicate assertion ID %s", req.Assertion.ID)
+
+			if !marshal {
+				return
+			}
+			if !assert.NoError(t, req.MarshalAssertion()) {
+				return
+			}
+			assert.True(t, req.AssertionEncrypted)
+			if !assert.NoError(t, req.MakeResponse()) || !assert.NoError(t, req.MarshalResponse()) {
+				return
+			}
+			assertion, err := sp.AssertResponse(base64.StdEncoding.EncodeToString(req.ResponseBuffer))
+			if assert.NoError(t, err) {
+				assert.Equal(t, req.Assertion.ID, assertion.ID)
+				assert.Equal(t, sp.MetadataURL, assertion.Subject.NameID.Value)
+			}
+		}(sps[i%numSPs], withXMLSec1 && i%10 == 0)
+	}
+	wg.Wait()
+}
+
+func TestMakeNameID(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.PersistentNameIDs = &MemoryPersistentNameIDs{}
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	session := &Session{
+		UserID:    "anakin",
+		UserEmail: "anakin@example.org",
+	}
+
+	tests := []struct {
+		Policy NameIDPolicy
+		Format string
+		Value  string
+		Status string
+	}{
+		{Policy: NameIDPolicy{}, Format: NameIDTransientFormat, Value: "id-MOCKID"},
+		{Policy: NameIDPolicy{Format: NameIDEmailAddressFormat}, Format: NameIDEmailAddressFormat, Value: "anakin@example.org"},
+		{Policy: NameIDPolicy{Format: NameIDUnspecifiedFormat}, Format: NameIDUnspecifiedFormat, Value: "anakin"},
+		{Policy: NameIDPolicy{Format: NameIDPersistentFormat}, Status: StatusInvalidNameIDPolicy},
+		{Policy: NameIDPolicy{Format: NameIDPersistentFormat, AllowCreate: true}, Format: NameIDPersistentFormat, Value: "id-MOCKID"},
+		{Policy: NameIDPolicy{Format: NameIDPersistentFormat}, Format: NameIDPersistentFormat, Value: "id-MOCKID"},
+		{Policy: NameIDPolicy{Format: NameIDEncryptedFormat}, Status: StatusInvalidNameIDPolicy},
+		{Policy: NameIDPolicy{SPNameQualifier: "urn:example:affiliation"}, Status: StatusInvalidNameIDPolicy},
+	}
+
+	for _, test := range tests {
+		req := &IdpAuthnRequest{
+			IDP:                     idp,
+			ServiceProviderMetadata: spMetadata,
+			Request:                 AuthnRequest{NameIDPolicy: test.Policy},
+		}
+		nameID, err := req.makeNameID(session)
+		if test.Status != "" {
+			if statusErr, ok := err.(*StatusError); assert.True(t, ok, "expected a status error, got %v", err) {
+				assert.Equal(t, test.Status, statusErr.SubCode)
+			}
+			continue
+		}
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.Format, nameID.Format)
+			assert.Equal(t, test.Value, nameID.Value)
+			assert.Equal(t, testSP.MetadataURL, nameID.SPNameQualifier)
+		}
+	}
+
+	// Without an email address the emailAddress format cannot be satisfied.
+	req := &IdpAuthnRequest{
+		IDP:                     idp,
+		ServiceProviderMetadata: spMetadata,
+		Request:                 AuthnRequest{NameIDPolicy: NameIDPolicy{Format: NameIDEmailAddressFormat}},
+	}
+	_, err = req.makeNameID(&Session{UserID: "anakin"})
+	assert.IsType(t, &StatusError{}, err)
+
+	// Affiliations listed in the SP's policy may be requested.
+	idp.SPPolicies = map[string]*ServiceProviderPolicy{
+		testSP.MetadataURL: {SPNameQualifiers: []string{"urn:example:affiliation"}},
+	}
+	req.Request.NameIDPolicy = NameIDPolicy{Format: NameIDPersistentFormat, SPNameQualifier: "urn:example:affiliation", AllowCreate: true}
+	nameID, err := req.makeNameID(session)
+	assert.NoError(t, err)
+	assert.Equal(t, "urn:example:affiliation", nameID.SPNameQualifier)
+}
+
+func TestMakeNameIDSessionNameID(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	// Sessions only setting NameID get it for the default request of the SP,
+	// which asks for an email address.
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+	req := &IdpAuthnRequest{
+		IDP:                     idp,
+		ServiceProviderMetadata: spMetadata,
+		Request:                 *authnRequest,
+	}
+	session := &Session{
+		NameID:     "anakin-name-id",
+		UserID:     "anakin",
+		CreateTime: Now(),
+	}
+	assert.NoError(t, req.MakeAssertion(session))
+	if assert.NotNil(t, req.Assertion) {
+		nameID := req.Assertion.Subject.NameID
+		assert.Equal(t, NameIDUnspecifiedFormat, nameID.Format)
+		assert.Equal(t, "anakin-name-id", nameID.Value)
+	}
+
+	for _, format := range []string{"", NameIDUnspecifiedFormat} {
+		req.Request.NameIDPolicy = NameIDPolicy{Format: format}
+		nameID, err := req.makeNameID(session)
+		if assert.NoError(t, err) {
+			assert.Equal(t, NameIDUnspecifiedFormat, nameID.Format)
+			assert.Equal(t, "anakin-name-id", nameID.Value)
+		}
+	}
+
+	// The email address is still preferred when the SP asks for it.
+	req.Request.NameIDPolicy = NameIDPolicy{Format: NameIDEmailAddressFormat}
+	session.UserEmail = "anakin@example.org"
+	nameID, err := req.makeNameID(session)
+	if assert.NoError(t, err) {
+		assert.Equal(t, NameIDEmailAddressFormat, nameID.Format)
+		assert.Equal(t, "anakin@example.org", nameID.Value)
+	}
+}
+
+func TestHMACPersistentNameIDs(t *testing.T) {
+	ctx := context.Background()
+	source := &HMACPersistentNameIDs{Secret: []byte("secret")}
+
+	id1, err := source.PersistentNameID(ctx, "anakin", "https://sp1.example.org", false)
+	assert.NoError(t, err)
+	id2, err := source.PersistentNameID(ctx, "anakin", "https://sp2.example.org", false)
+	assert.NoError(t, err)
+	again, err := source.PersistentNameID(ctx, "anakin", "https://sp1.example.org", false)
+	assert.NoError(t, err)
+
+	assert.Equal(t, id1, again)
+	assert.NotEqual(t, id1, id2)
+	assert.NotContains(t, id1, "anakin")
+}
+
+func TestAssertionEncryptionPolicy(t *testing.T) {
+	tearUp()
+
+	// An SP whose metadata lists no certificate.
+	spMetadata, err := testSP.Metadata()
+	assert.NoError(t, err)
+	spMetadata.SPSSODescriptor.KeyDescriptor = nil
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.ServiceProviders = NewMemoryServiceProviderRegistry(spMetadata)
+	idp.DefaultSPPolicy.Signing = SignResponse
+
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+	req := &IdpAuthnRequest{
+		IDP:                     idp,
+		Request:                 *authnRequest,
+		ServiceProviderMetadata: spMetadata,
+	}
+	assert.NoError(t, req.MakeAssertion(&Session{CreateTime: Now(), UserEmail: "anakin@example.org"}))
+	assert.Nil(t, req.Assertion.Signature)
+
+	idp.DefaultSPPolicy.Encryption = EncryptAlways
+	assert.Error(t, req.MarshalAssertion())
+
+	idp.DefaultSPPolicy.Encryption = EncryptWhenPossible
+	assert.NoError(t, req.MarshalAssertion())
+	assert.False(t, req.AssertionEncrypted)
+
+	assert.NoError(t, req.MakeResponse())
+	assert.Nil(t, req.Response.EncryptedAssertion)
+	assert.Equal(t, req.Assertion, req.Response.Assertion)
+
+	// Signing the response needs xmlsec1, check how the assertion is
+	// included without it.
+	idp.DefaultSPPolicy.Signing = SignAssertion
+	assert.NoError(t, req.MarshalResponse())
+
+	var response Response
+	assert.NoError(t, xml.Unmarshal(req.ResponseBuffer, &response))
+	if assert.NotNil(t, response.Assertion) {
+		assert.Equal(t, req.Assertion.ID, response.Assertion.ID)
+	}
+	assert.Contains(t, string(req.ResponseBuffer), string(req.AssertionBuffer))
+}
+
+func TestGenerateResponseWithoutSession(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	for _, isPassive := range []bool{false, true} {
+		authnRequest, err := testSP.NewAuthnRequest()
+		assert.NoError(t, err)
+		authnRequest.IsPassive = isPassive
+
+		req := &IdpAuthnRequest{
+			IDP:                     idp,
+			Request:                 *authnRequest,
+			ServiceProviderMetadata: spMetadata,
+		}
+		_, err = req.GenerateResponse(nil)
+		assert.NoError(t, err)
+
+		expected := StatusAuthnFailed
+		if isPassive {
+			expected = StatusNoPassive
+		}
+		assert.Equal(t, StatusResponder, req.Response.Status.StatusCode.Value)
+		if assert.NotNil(t, req.Response.Status.StatusCode.StatusCode) {
+			assert.Equal(t, expected, req.Response.Status.StatusCode.StatusCode.Value)
+		}
+		assert.Nil(t, req.Response.Assertion)
+		assert.Nil(t, req.Response.EncryptedAssertion)
+	}
+}
+
+func TestLoginRequestAuthenticationFailure(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		Err     error
+		SubCode string
+		Message string
+	}{
+		{Err: NewRequestDeniedError("not for you"), SubCode: StatusRequestDenied, Message: "not for you"},
+		{Err: errors.Wrap(NewRequestUnsupportedError(""), "authenticator"), SubCode: StatusRequestUnsupported},
+		{Err: errors.New("database is down"), SubCode: StatusAuthnFailed},
+	}
+	for _, test := range tests {
+		lr := &LoginRequest{
+			idp:      idp,
+			metadata: spMetadata,
+			authFn: func(w http.ResponseWriter, r *http.Request) (*Session, error) {
+				return nil, test.Err
+			},
+		}
+
+		w := httptest.NewRecorder()
+		lr.PostForm(w, httptest.NewRequest("GET", "/login", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		body := w.Body.String()
+		assert.Contains(t, body, `action="`+testSP.ACSURL+`"`)
+
+		m := regexp.MustCompile(`name="SAMLResponse" value="([^"]*)"`).FindStringSubmatch(body)
+		if !assert.Len(t, m, 2) {
+			continue
+		}
+		buf, err := base64.StdEncoding.DecodeString(html.UnescapeString(m[1]))
+		assert.NoError(t, err)
+
+		var response Response
+		assert.NoError(t, xml.Unmarshal(buf, &response))
+		assert.Equal(t, StatusResponder, response.Status.StatusCode.Value)
+		if assert.NotNil(t, response.Status.StatusCode.StatusCode) {
+			assert.Equal(t, test.SubCode, response.Status.StatusCode.StatusCode.Value)
+		}
+		assert.Equal(t, test.Message, response.Status.StatusMessage)
+	}
+
+	// An Authenticator that answered the request itself is left alone, even
+	// if it returns an error.
+	lr := &LoginRequest{
+		idp:      idp,
+		metadata: spMetadata,
+		authFn: func(w http.ResponseWriter, r *http.Request) (*Session, error) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return nil, errors.New("invalid credentials")
+		},
+	}
+	w := httptest.NewRecorder()
+	lr.PostForm(w, httptest.NewRequest("GET", "/login", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotContains(t, w.Body.String(), "SAMLResponse")
+}
+
+func TestInitiateSSO(t *testing.T) {
+	tearUp()
+
+	sp := *testSP
+	sp.AssertionConsumerServices = []IndexedEndpoint{
+		{Binding: HTTPPostBinding, Location: "http://localhost:1235/saml/acs", Index: 1, IsDefault: true},
+		{Binding: HTTPPostBinding, Location: "http://sp.example.org/saml/acs", Index: 2},
+	}
+	idp := newTestIdPForSP(t, &sp)
+
+	logins := 0
+	authFn := func(w http.ResponseWriter, r *http.Request) (*Session, error) {
+		logins++
+		return nil, NewRequestDeniedError("not for you")
+	}
+
+	// Unknown SPs and assertion consumer services are not reported to the SP.
+	w := httptest.NewRecorder()
+	idp.InitiateSSO(w, httptest.NewRequest("GET", "/login", nil), "https://unknown.example.org", InitiateSSOOptions{Authenticator: authFn})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	index := 3
+	w = httptest.NewRecorder()
+	idp.InitiateSSO(w, httptest.NewRequest("GET", "/login", nil), sp.MetadataURL, InitiateSSOOptions{Authenticator: authFn, ACSIndex: &index})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	noACS, err := sp.Metadata()
+	assert.NoError(t, err)
+	noACS.EntityID = "https://no-acs.example.org"
+	noACS.SPSSODescriptor.AssertionConsumerService = nil
+	idp.ServiceProviders.(*MemoryServiceProviderRegistry).Add(noACS)
+	w = httptest.NewRecorder()
+	idp.InitiateSSO(w, httptest.NewRequest("GET", "/login", nil), noACS.EntityID, InitiateSSOOptions{Authenticator: authFn})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, logins)
+
+	index = 2
+	w = httptest.NewRecorder()
+	idp.InitiateSSO(w, httptest.NewRequest("GET", "/login", nil), sp.MetadataURL, InitiateSSOOptions{
+		Authenticator: authFn,
+		RelayState:    "/dashboard",
+		ACSIndex:      &index,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, logins)
+
+	body := w.Body.String()
+	assert.Contains(t, body, `action="http://sp.example.org/saml/acs"`)
+	assert.Contains(t, body, `name="RelayState" value="/dashboard"`)
+
+	m := regexp.MustCompile(`name="SAMLResponse" value="([^"]*)"`).FindStringSubmatch(body)
+	if !assert.Len(t, m, 2) {
+		return
+	}
+	buf, err := base64.StdEncoding.DecodeString(html.UnescapeString(m[1]))
+	assert.NoError(t, err)
+
+	// The response is unsolicited.
+	assert.NotContains(t, string(buf), "InResponseTo")
+	var response Response
+	assert.NoError(t, xml.Unmarshal(buf, &response))
+	assert.Equal(t, "http://sp.example.org/saml/acs", response.Destination)
+	if assert.NotNil(t, response.Status.StatusCode.StatusCode) {
+		assert.Equal(t, StatusRequestDenied, response.Status.StatusCode.StatusCode.Value)
+	}
+}
+
+func TestIdentityProviderHandler(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.SLOURL = "http://localhost:1233/saml/slo"
+
+	var errs []int
+	idp.LoginUI.RenderError = func(w http.ResponseWriter, r *http.Request, status int, err error) {
+		errs = append(errs, status)
+		w.WriteHeader(status)
+	}
+	handler := idp.Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/saml/service.xml", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "IDPSSODescriptor")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/elsewhere", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// The SSO service needs an Authenticator.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/saml/sso", nil))
+	assert.Equal(t, []int{http.StatusInternalServerError}, errs)
+
+	logins := 0
+	idp.Authenticator = func(w http.ResponseWriter, r *http.Request) (*Session, error) {
+		logins++
+		w.Write([]byte("login page"))
+		return nil, nil
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/saml/sso?SAMLRequest=garbage", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+	buf, err := xml.Marshal(authnRequest)
+	assert.NoError(t, err)
+	redirectURL, err := testSP.SAMLRequestURL(buf, "")
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", redirectURL, nil))
+	assert.Equal(t, "login page", w.Body.String())
+	assert.Equal(t, 1, logins)
+
+	idp.LoginUI.BeforeLogin = func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest) bool {
+		assert.Equal(t, authnRequest.ID, req.Request.ID)
+		w.Write([]byte("pick an account"))
+		return false
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", redirectURL, nil))
+	assert.Equal(t, "pick an account", w.Body.String())
+	assert.Equal(t, 1, logins)
+}
+
+func TestEncryptedAssertionRoundTrip(t *testing.T) {
+	requireXMLSec1(t)
+	tearUp()
+
+	oaep := func(digest string, mgf string) EncryptionMethod {
+		return EncryptionMethod{
+			Algorithm:    xmlsec.RSAOAEP,
+			DigestMethod: &xmlsec.Method{Algorithm: digest},
+			MGF:          &xmlsec.Method{Algorithm: mgf},
+		}
+	}
+
+	// Algorithms lists the data encryption and key transport algorithms
+	// first, then the RSA-OAEP parameters.
+	tests := []struct {
+		Methods    []EncryptionMethod
+		Algorithms []string
+	}{
+		{
+			Methods:    nil,
+			Algorithms: []string{xmlsec.AES128CBC, xmlsec.RSAOAEPMGF1P},
+		},
+		{
+			Methods:    supportedEncryptionMethods(),
+			Algorithms: []string{xmlsec.AES256GCM, xmlsec.RSAOAEPMGF1P},
+		},
+		{
+			Methods:    []EncryptionMethod{{Algorithm: xmlsec.AES256GCM}, oaep(xmlsec.DigestSHA256, xmlsec.MGF1SHA256)},
+			Algorithms: []string{xmlsec.AES256GCM, xmlsec.RSAOAEP, xmlsec.DigestSHA256, xmlsec.MGF1SHA256},
+		},
+		{
+			Methods:    []EncryptionMethod{{Algorithm: xmlsec.AES256GCM}, {Algorithm: xmlsec.RSAOAEPMGF1P}},
+			Algorithms: []string{xmlsec.AES256GCM, xmlsec.RSAOAEPMGF1P},
+		},
+		{
+			Methods: []EncryptionMethod{{Algorithm: xmlsec.AES128GCM}, {
+				Algorithm:    xmlsec.RSAOAEPMGF1P,
+				DigestMethod: &xmlsec.Method{Algorithm: xmlsec.DigestSHA256},
+			}},
+			Algorithms: []string{xmlsec.AES128GCM, xmlsec.RSAOAEPMGF1P, xmlsec.DigestSHA256},
+		},
+		{
+			Methods:    []EncryptionMethod{{Algorithm: xmlsec.AES128GCM}, oaep(xmlsec.DigestSHA256, xmlsec.MGF1SHA256)},
+			Algorithms: []string{xmlsec.AES128GCM, xmlsec.RSAOAEP, xmlsec.DigestSHA256, xmlsec.MGF1SHA256},
+		},
+		{
+			Methods:    []EncryptionMethod{{Algorithm: xmlsec.AES256GCM}, oaep(xmlsec.DigestSHA256, xmlsec.MGF1SHA1)},
+			Algorithms: []string{xmlsec.AES256GCM, xmlsec.RSAOAEP, xmlsec.DigestSHA256, xmlsec.MGF1SHA1},
+		},
+	}
+
+	for _, test := range tests {
+		// xmlsec1 1.2 only knows rsa-oaep-mgf1p with the SHA-1 digest.
+		if (test.Algorithms[1] == xmlsec.RSAOAEP || len(test.Algorithms) > 2) && !xmlsec1AtLeast(1, 3) {
+			continue
+		}
+
+		spMetadata, err := testSP.Metadata()
+		assert.NoError(t, err)
+		spMetadata.SPSSODescriptor.KeyDescriptor[1].EncryptionMethods = test.Methods
+
+		idp := newTestIdPForSP(t, testSP)
+		idp.ServiceProviders = NewMemoryServiceProviderRegistry(spMetadata)
+		idp.NewID = sequentialIDs()
+		sp := newTestSPForIdP(t, idp)
+
+		req := loginResponse(t, idp, sp, &Session{CreateTime: Now(), UserEmail: "anakin@example.org"})
+		assert.True(t, req.AssertionEncrypted)
+		for _, algorithm := range test.Algorithms {
+			assert.Contains(t, string(req.AssertionBuffer), `Algorithm="`+algorithm+`"`)
+		}
+
+		assertion, err := sp.AssertResponse(base64.StdEncoding.EncodeToString(req.ResponseBuffer))
+		if assert.NoError(t, err, "%q", test.Algorithms) {
+			assert.Equal(t, req.Assertion.ID, assertion.ID)
+			assert.Equal(t, "anakin@example.org", assertion.Subject.NameID.Value)
+		}
+	}
+}
+
+func TestEncryptedAssertionDefaultMetadata(t *testing.T) {
+	requireXMLSec1(t)
+	tearUp()
+
+	// The metadata of an SP built on this package is encrypted for with
+	// algorithms any xmlsec1 version supports.
+	idp := newTestIdPForSP(t, testSP)
+	idp.NewID = sequentialIDs()
+	sp := newTestSPForIdP(t, idp)
+
+	req := loginResponse(t, idp, sp, &Session{CreateTime: Now(), UserEmail: "anakin@example.org"})
+	assert.True(t, req.AssertionEncrypted)
+	assert.Contains(t, string(req.AssertionBuffer), `Algorithm="`+xmlsec.RSAOAEPMGF1P+`"`)
+
+	assertion, err := sp.AssertResponse(base64.StdEncoding.EncodeToString(req.ResponseBuffer))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "anakin@example.org", assertion.Subject.NameID.Value)
+	}
+}
+
+func TestSignedResponseRoundTrip(t *testing.T) {
+	requireXMLSec1(t)
+	tearUp()
+
+	spMetadata, err := testSP.Metadata()
+	assert.NoError(t, err)
+
+	for _, signing := range []SigningPolicy{SignAssertion, SignResponse, SignResponseAndAssertion} {
+		for _, encryption := range []EncryptionPolicy{EncryptNever, EncryptAlways} {
+			idp := newTestIdPForSP(t, testSP)
+			idp.ServiceProviders = NewMemoryServiceProviderRegistry(spMetadata)
+			idp.DefaultSPPolicy = ServiceProviderPolicy{Signing: signing, Encryption: encryption}
+			idp.NewID = sequentialIDs()
+			sp := newTestSPForIdP(t, idp)
+
+			req := loginResponse(t, idp, sp, &Session{CreateTime: Now(), UserEmail: "anakin@example.org"})
+			assert.Equal(t, signing.signResponse(), strings.Contains(string(req.ResponseBuffer), `URI="#`+req.Response.ID+`"`))
+			assert.Equal(t, encryption == EncryptAlways, req.AssertionEncrypted)
+
+			assertion, err := sp.AssertResponse(base64.StdEncoding.EncodeToString(req.ResponseBuffer))
+			if assert.NoError(t, err, "signing %d, encryption %d", signing, encryption) {
+				assert.Equal(t, req.Assertion.ID, assertion.ID)
+				assert.Equal(t, "anakin@example.org", assertion.Subject.NameID.Value)
+			}
+
+			// Changing what the signature covers must break it.
+			if signing.signResponse() {
+				tampered := strings.Replace(string(req.ResponseBuffer), `InResponseTo="`, `InResponseTo="x`, 1)
+				_, err = sp.AssertResponse(base64.StdEncoding.EncodeToString([]byte(tampered)))
+				assert.Error(t, err, "signing %d, encryption %d", signing, encryption)
+			}
+			if signing == SignAssertion && encryption == EncryptNever {
+				tampered := strings.Replace(string(req.ResponseBuffer), "anakin@example.org", "vader@example.org", 1)
+				_, err = sp.AssertResponse(base64.StdEncoding.EncodeToString([]byte(tampered)))
+				assert.Error(t, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Package instrument defines the hooks through which the saml and xmlsec
+// packages report metrics and traces. The adapters in its subpackages feed
+// them to Prometheus and OpenTelemetry; any other system can be plugged in by
+// implementing Instrumentation.
+package instrument
+
+import (
+	"context"
+)
+
+// Metrics reported by the saml and xmlsec packages. Durations are in seconds.
+// A metric is always reported with the same label keys.
+const (
+	// Histogram of the xmlsec1 invocations, by operation (sign, verify,
+	// encrypt, decrypt) and result (success, failure)
+	XMLSecDuration = "saml_xmlsec_duration_seconds"
+
+	// Counter of the failed xmlsec1 invocations, by operation and reason
+	// (signature, validity, self_signed_certificate, unknown_issuer, exec,
+	// other)
+	XMLSecFailures = "saml_xmlsec_failures_total"
+
+	// Histogram of the stages of ServiceProvider.AssertResponse, by stage
+	// (parse, verify, validate) and result
+	AssertResponseDuration = "saml_sp_assert_response_duration_seconds"
+
+	// Counter of the responses validated by ServiceProvider.AssertResponse,
+	// by result: success or the stage that rejected the response
+	AssertResponseTotal = "saml_sp_responses_total"
+
+	// Histogram of the metadata fetches, by source (idp for the metadata a SP
+	// fetches, sp_aggregate for AggregateServiceProviderRegistry) and result
+	MetadataFetchDuration = "saml_metadata_fetch_duration_seconds"
+
+	// Histogram of the responses the IdP generates for AuthnRequests, by
+	// status: the last part of the most specific status code, such as Success
+	// or AuthnFailed, or error if no response could be made
+	IdPResponseDuration = "saml_idp_response_duration_seconds"
+)
+
+// Label keys of the metrics.
+const (
+	LabelOperation = "operation"
+	LabelResult    = "result"
+	LabelReason    = "reason"
+	LabelStage     = "stage"
+	LabelSource    = "source"
+	LabelStatus    = "status"
+)
+
+// Values of LabelResult.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Label is a key/value pair qualifying a measurement or a span.
+type Label struct {
+	Key   string
+	Value string
+}
+
+// L returns a label.
+func L(key, value string) Label {
+	return Label{Key: key, Value: value}
+}
+
+// Result returns the LabelResult label of an operation that failed with err,
+// if not nil.
+func Result(err error) Label {
+	if err != nil {
+		return L(LabelResult, ResultFailure)
+	}
+	return L(LabelResult, ResultSuccess)
+}
+
+// Instrumentation receives the measurements of the saml and xmlsec packages.
+// Its methods are called by the goroutines serving the requests, concurrently,
+// and must not block.
+type Instrumentation interface {
+	// Count adds delta to the counter with the given name and labels.
+	Count(name string, delta float64, labels ...Label)
+
+	// Observe adds a value to the histogram with the given name and labels.
+	Observe(name string, value float64, labels ...Label)
+
+	// StartSpan starts a span with the given name, child of the span of ctx
+	// if any, and returns a context holding it.
+	StartSpan(ctx context.Context, name string, labels ...Label) (context.Context, Span)
+}
+
+// Span is a traced operation, started by Instrumentation.StartSpan.
+type Span interface {
+	// End ends the span, which failed with err if not nil.
+	End(err error)
+}
+
+// Nop is an Instrumentation that discards everything.
+type Nop struct{}
+
+// Count implements Instrumentation.
+func (Nop) Count(name string, delta float64, labels ...Label) {}
+
+// Observe implements Instrumentation.
+func (Nop) Observe(name string, value float64, labels ...Label) {}
+
+// StartSpan implements Instrumentation.
+func (Nop) StartSpan(ctx context.Context, name string, labels ...Label) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) End(err error) {}
+
+// Or returns in, or Nop if in is nil.
+func Or(in Instrumentation) Instrumentation {
+	if in == nil {
+		return Nop{}
+	}
+	return in
+}
+
+// Multi returns an Instrumentation reporting to all the given ones, such as
+// a Prometheus one for the metrics and an OpenTelemetry one for the traces.
+func Multi(ins ...Instrumentation) Instrumentation {
+	return multi(ins)
+}
+
+type multi []Instrumentation
+
+func (m multi) Count(name string, delta float64, labels ...Label) {
+	for _, in := range m {
+		in.Count(name, delta, labels...)
+	}
+}
+
+func (m multi) Observe(name string, value float64, labels ...Label) {
+	for _, in := range m {
+		in.Observe(name, value, labels...)
+	}
+}
+
+func (m multi) StartSpan(ctx context.Context, name string, labels ...Label) (context.Context, Span) {
+	spans := make(multiSpan, len(m))
+	for i, in := range m {
+		ctx, spans[i] = in.StartSpan(ctx, name, labels...)
+	}
+	return ctx, spans
+}
+
+type multiSpan []Span
+
+func (spans multiSpan) End(err error) {
+	for i := len(spans) - 1; i >= 0; i-- {
+		spans[i].End(err)
+	}
+}
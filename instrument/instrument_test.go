@@ -0,0 +1,47 @@
+package instrument
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type spanLog []string
+
+func (l *spanLog) Count(name string, delta float64, labels ...Label) {
+	*l = append(*l, "count "+name)
+}
+
+func (l *spanLog) Observe(name string, value float64, labels ...Label) {
+	*l = append(*l, "observe "+name)
+}
+
+func (l *spanLog) StartSpan(ctx context.Context, name string, labels ...Label) (context.Context, Span) {
+	*l = append(*l, "start "+name)
+	return ctx, logSpan{l, name}
+}
+
+type logSpan struct {
+	l    *spanLog
+	name string
+}
+
+func (s logSpan) End(err error) {
+	*s.l = append(*s.l, "end "+s.name+" "+Result(err).Value)
+}
+
+func TestMulti(t *testing.T) {
+	var a, b spanLog
+	in := Multi(&a, Or(nil), &b)
+
+	in.Count("c", 1)
+	in.Observe("h", 1)
+	_, span := in.StartSpan(context.Background(), "s")
+	span.End(errors.New("failed"))
+
+	expected := spanLog{"count c", "observe h", "start s", "end s failure"}
+	assert.Equal(t, expected, a)
+	assert.Equal(t, expected, b)
+}
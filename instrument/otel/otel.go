@@ -0,0 +1,56 @@
+// Package otel reports the traces of the saml package to OpenTelemetry.
+// Metrics are not reported, see the prometheus package. It is a module of its
+// own, so that the saml module does not depend on OpenTelemetry.
+//
+//	sp.Instrumentation = otel.New(tracerProvider.Tracer("github.com/pressly/saml"))
+package otel
+
+import (
+	"context"
+
+	"github.com/pressly/saml/instrument"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Instrumentation is an instrument.Instrumentation starting OpenTelemetry
+// spans, with the labels as attributes.
+type Instrumentation struct {
+	tracer trace.Tracer
+}
+
+var _ instrument.Instrumentation = (*Instrumentation)(nil)
+
+// New returns an Instrumentation starting its spans with the given tracer.
+func New(tracer trace.Tracer) *Instrumentation {
+	return &Instrumentation{tracer: tracer}
+}
+
+// Count implements instrument.Instrumentation, metrics are not reported.
+func (in *Instrumentation) Count(name string, delta float64, labels ...instrument.Label) {}
+
+// Observe implements instrument.Instrumentation, metrics are not reported.
+func (in *Instrumentation) Observe(name string, value float64, labels ...instrument.Label) {}
+
+// StartSpan implements instrument.Instrumentation.
+func (in *Instrumentation) StartSpan(ctx context.Context, name string, labels ...instrument.Label) (context.Context, instrument.Span) {
+	attrs := make([]attribute.KeyValue, len(labels))
+	for i, label := range labels {
+		attrs[i] = attribute.String(label.Key, label.Value)
+	}
+	ctx, span := in.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, endSpan{span}
+}
+
+type endSpan struct {
+	span trace.Span
+}
+
+func (s endSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,37 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pressly/saml/instrument"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstrumentation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	in := New(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"))
+
+	ctx, parent := in.StartSpan(context.Background(), "saml.AssertResponse")
+	_, child := in.StartSpan(ctx, "saml.AssertResponse/verify", instrument.L(instrument.LabelStage, "verify"))
+	child.End(errors.New("bad signature"))
+	parent.End(nil)
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	assert.Equal(t, "saml.AssertResponse/verify", spans[0].Name())
+	assert.Equal(t, []attribute.KeyValue{attribute.String("stage", "verify")}, spans[0].Attributes())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "bad signature", spans[0].Status().Description)
+	assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+
+	assert.Equal(t, "saml.AssertResponse", spans[1].Name())
+	assert.Equal(t, codes.Unset, spans[1].Status().Code)
+}
@@ -0,0 +1,146 @@
+// Package prometheus reports the metrics of the saml and xmlsec packages to
+// Prometheus. Traces are not reported, see the otel package. It is a module
+// of its own, so that the saml module does not depend on the Prometheus
+// client.
+//
+//	in := prometheus.New(nil)
+//	sp.Instrumentation = in
+package prometheus
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pressly/saml/instrument"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// help holds the help texts of the metrics.
+var help = map[string]string{
+	instrument.XMLSecDuration:         "Duration of the xmlsec1 invocations.",
+	instrument.XMLSecFailures:         "Number of failed xmlsec1 invocations.",
+	instrument.AssertResponseDuration: "Duration of the stages of the validation of the SAML responses.",
+	instrument.AssertResponseTotal:    "Number of SAML responses validated by the service provider.",
+	instrument.MetadataFetchDuration:  "Duration of the metadata fetches.",
+	instrument.IdPResponseDuration:    "Duration of the making of the responses of the identity provider.",
+}
+
+// Instrumentation is an instrument.Instrumentation creating a Prometheus
+// counter or histogram for each metric it is given, on first use. The label
+// keys of a metric are the ones of its first measurement; measurements with
+// other keys are dropped.
+type Instrumentation struct {
+	registerer prom.Registerer
+	buckets    []float64
+
+	mu         sync.Mutex
+	counters   map[string]*prom.CounterVec
+	histograms map[string]*prom.HistogramVec
+}
+
+var _ instrument.Instrumentation = (*Instrumentation)(nil)
+
+// New returns an Instrumentation registering its collectors to the given
+// registerer, prometheus.DefaultRegisterer if nil. The histograms have the
+// given buckets, prometheus.DefBuckets if none.
+func New(registerer prom.Registerer, buckets ...float64) *Instrumentation {
+	if registerer == nil {
+		registerer = prom.DefaultRegisterer
+	}
+	if len(buckets) == 0 {
+		buckets = prom.DefBuckets
+	}
+	return &Instrumentation{
+		registerer: registerer,
+		buckets:    buckets,
+		counters:   map[string]*prom.CounterVec{},
+		histograms: map[string]*prom.HistogramVec{},
+	}
+}
+
+// Count implements instrument.Instrumentation.
+func (in *Instrumentation) Count(name string, delta float64, labels ...instrument.Label) {
+	in.mu.Lock()
+	vec, ok := in.counters[name]
+	if !ok {
+		vec = prom.NewCounterVec(prom.CounterOpts{Name: name, Help: helpText(name)}, keys(labels))
+		if collector, err := register(in.registerer, vec); err == nil {
+			vec, _ = collector.(*prom.CounterVec)
+		} else {
+			vec = nil
+		}
+		in.counters[name] = vec
+	}
+	in.mu.Unlock()
+
+	if vec == nil {
+		return
+	}
+	if counter, err := vec.GetMetricWith(values(labels)); err == nil {
+		counter.Add(delta)
+	}
+}
+
+// Observe implements instrument.Instrumentation.
+func (in *Instrumentation) Observe(name string, value float64, labels ...instrument.Label) {
+	in.mu.Lock()
+	vec, ok := in.histograms[name]
+	if !ok {
+		vec = prom.NewHistogramVec(prom.HistogramOpts{Name: name, Help: helpText(name), Buckets: in.buckets}, keys(labels))
+		if collector, err := register(in.registerer, vec); err == nil {
+			vec, _ = collector.(*prom.HistogramVec)
+		} else {
+			vec = nil
+		}
+		in.histograms[name] = vec
+	}
+	in.mu.Unlock()
+
+	if vec == nil {
+		return
+	}
+	if histogram, err := vec.GetMetricWith(values(labels)); err == nil {
+		histogram.Observe(value)
+	}
+}
+
+// StartSpan implements instrument.Instrumentation, spans are not reported.
+func (in *Instrumentation) StartSpan(ctx context.Context, name string, labels ...instrument.Label) (context.Context, instrument.Span) {
+	return instrument.Nop{}.StartSpan(ctx, name, labels...)
+}
+
+// register registers the given collector, and returns it or the identical
+// one that was already registered.
+func register(registerer prom.Registerer, collector prom.Collector) (prom.Collector, error) {
+	err := registerer.Register(collector)
+	if err, ok := err.(prom.AlreadyRegisteredError); ok {
+		return err.ExistingCollector, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return collector, nil
+}
+
+func helpText(name string) string {
+	if text, ok := help[name]; ok {
+		return text
+	}
+	return name
+}
+
+func keys(labels []instrument.Label) []string {
+	keys := make([]string, len(labels))
+	for i, label := range labels {
+		keys[i] = label.Key
+	}
+	return keys
+}
+
+func values(labels []instrument.Label) prom.Labels {
+	values := make(prom.Labels, len(labels))
+	for _, label := range labels {
+		values[label.Key] = label.Value
+	}
+	return values
+}
@@ -0,0 +1,42 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pressly/saml/instrument"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentation(t *testing.T) {
+	registry := prom.NewRegistry()
+	in := New(registry, 0.1, 1)
+
+	in.Count(instrument.AssertResponseTotal, 1, instrument.L(instrument.LabelResult, "verify"))
+	in.Count(instrument.AssertResponseTotal, 2, instrument.L(instrument.LabelResult, "verify"))
+	in.Count(instrument.AssertResponseTotal, 1, instrument.L(instrument.LabelResult, instrument.ResultSuccess))
+	// Dropped, the keys differ.
+	in.Count(instrument.AssertResponseTotal, 1, instrument.L(instrument.LabelStage, "parse"))
+	in.Observe(instrument.IdPResponseDuration, 0.5, instrument.L(instrument.LabelStatus, "Success"))
+
+	err := testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP saml_idp_response_duration_seconds Duration of the making of the responses of the identity provider.
+# TYPE saml_idp_response_duration_seconds histogram
+saml_idp_response_duration_seconds_bucket{status="Success",le="0.1"} 0
+saml_idp_response_duration_seconds_bucket{status="Success",le="1"} 1
+saml_idp_response_duration_seconds_bucket{status="Success",le="+Inf"} 1
+saml_idp_response_duration_seconds_sum{status="Success"} 0.5
+saml_idp_response_duration_seconds_count{status="Success"} 1
+# HELP saml_sp_responses_total Number of SAML responses validated by the service provider.
+# TYPE saml_sp_responses_total counter
+saml_sp_responses_total{result="success"} 1
+saml_sp_responses_total{result="verify"} 3
+`))
+	assert.NoError(t, err)
+
+	// A second Instrumentation shares the registered collectors.
+	New(registry).Count(instrument.AssertResponseTotal, 1, instrument.L(instrument.LabelResult, "verify"))
+	assert.Equal(t, float64(4), testutil.ToFloat64(in.counters[instrument.AssertResponseTotal].WithLabelValues("verify")))
+}
@@ -0,0 +1,73 @@
+package saml
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pressly/saml/instrument"
+	"github.com/pressly/saml/xmlsec"
+)
+
+// stage is a measured step of a SAML flow, see startStage.
+type stage struct {
+	in     instrument.Instrumentation
+	metric string
+	labels []instrument.Label
+	start  time.Time
+	span   instrument.Span
+}
+
+// startStage starts a span with the given name, and measures the duration of
+// the step until end is called, reported to the histogram with the given
+// metric name and labels along with the result.
+func startStage(ctx context.Context, in instrument.Instrumentation, spanName string, metric string, labels ...instrument.Label) (context.Context, *stage) {
+	ctx, span := in.StartSpan(ctx, spanName, labels...)
+	return ctx, &stage{
+		in:     in,
+		metric: metric,
+		labels: labels,
+		start:  time.Now(),
+		span:   span,
+	}
+}
+
+// end ends the stage, which failed with err if not nil.
+func (s *stage) end(err error) {
+	labels := append(append([]instrument.Label(nil), s.labels...), instrument.Result(err))
+	s.in.Observe(s.metric, time.Since(s.start).Seconds(), labels...)
+	s.span.End(err)
+}
+
+// statusName returns the last part of the most specific code of the given
+// status, such as Success or AuthnFailed.
+func statusName(status *Status) string {
+	if status == nil {
+		return ""
+	}
+	code := status.StatusCode.Value
+	if status.StatusCode.StatusCode != nil {
+		code = status.StatusCode.StatusCode.Value
+	}
+	return code[strings.LastIndex(code, ":")+1:]
+}
+
+func (idp *IdentityProvider) instrumentation() instrument.Instrumentation {
+	return instrument.Or(idp.Instrumentation)
+}
+
+func (sp *ServiceProvider) instrumentation() instrument.Instrumentation {
+	return instrument.Or(sp.Instrumentation)
+}
+
+// xmlsecCommand returns the xmlsec1 command reporting to the IdP's Logger and
+// Instrumentation.
+func (idp *IdentityProvider) xmlsecCommand() *xmlsec.Command {
+	return &xmlsec.Command{Logger: idp.logger(), Instrumentation: idp.Instrumentation}
+}
+
+// xmlsecCommand returns the xmlsec1 command reporting to the SP's Logger and
+// Instrumentation.
+func (sp *ServiceProvider) xmlsecCommand() *xmlsec.Command {
+	return &xmlsec.Command{Logger: sp.logger(), Instrumentation: sp.Instrumentation}
+}
@@ -0,0 +1,107 @@
+package saml
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/pressly/saml/instrument"
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder is an instrument.Instrumentation recording the measurements and
+// the spans it receives, formatted as "name{key=value,...}".
+type recorder struct {
+	mu     sync.Mutex
+	counts []string
+	values []string
+	spans  []string
+}
+
+func (r *recorder) Count(name string, delta float64, labels ...instrument.Label) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts = append(r.counts, measurement(name, labels))
+}
+
+func (r *recorder) Observe(name string, value float64, labels ...instrument.Label) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values = append(r.values, measurement(name, labels))
+}
+
+func (r *recorder) StartSpan(ctx context.Context, name string, labels ...instrument.Label) (context.Context, instrument.Span) {
+	return ctx, recordedSpan{r, name}
+}
+
+type recordedSpan struct {
+	r    *recorder
+	name string
+}
+
+func (s recordedSpan) End(err error) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.r.spans = append(s.r.spans, measurement(s.name, []instrument.Label{instrument.Result(err)}))
+}
+
+func measurement(name string, labels []instrument.Label) string {
+	s := name + "{"
+	for i, label := range labels {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprintf("%s=%s", label.Key, label.Value)
+	}
+	return s + "}"
+}
+
+func TestInstrumentation(t *testing.T) {
+	tearUp()
+
+	idpRecorder := &recorder{}
+	idp := newTestIdPForSP(t, testSP)
+	idp.Instrumentation = idpRecorder
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+	req := &IdpAuthnRequest{
+		IDP:                     idp,
+		Request:                 *authnRequest,
+		ServiceProviderMetadata: spMetadata,
+	}
+	_, err = req.GenerateResponse(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"saml_idp_response_duration_seconds{status=AuthnFailed}"}, idpRecorder.values)
+	assert.Equal(t, []string{"saml.GenerateResponse{result=success}"}, idpRecorder.spans)
+
+	spRecorder := &recorder{}
+	sp := *testSP
+	sp.Instrumentation = spRecorder
+	_, err = sp.AssertResponse(base64.StdEncoding.EncodeToString(req.ResponseBuffer))
+	assert.Error(t, err)
+	assert.Equal(t, []string{"saml_sp_responses_total{result=parse}"}, spRecorder.counts)
+	assert.Equal(t, []string{"saml_sp_assert_response_duration_seconds{stage=parse,result=failure}"}, spRecorder.values)
+	assert.Equal(t, []string{
+		"saml.AssertResponse/parse{result=failure}",
+		"saml.AssertResponse{result=failure}",
+	}, spRecorder.spans)
+
+	// Instrumentations are optional.
+	sp.Instrumentation = nil
+	_, err = sp.AssertResponse(base64.StdEncoding.EncodeToString(req.ResponseBuffer))
+	assert.Error(t, err)
+}
+
+func TestStatusName(t *testing.T) {
+	assert.Equal(t, "", statusName(nil))
+	assert.Equal(t, "Success", statusName(&Status{StatusCode: StatusCode{Value: StatusSuccess}}))
+	assert.Equal(t, "AuthnFailed", statusName(&Status{StatusCode: StatusCode{
+		Value:      StatusResponder,
+		StatusCode: &StatusCode{Value: StatusAuthnFailed},
+	}}))
+}
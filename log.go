@@ -0,0 +1,69 @@
+package saml
+
+import (
+	"log/slog"
+)
+
+// SPs and IdPs log the steps of the SAML flows at debug level to their
+// Logger: the IDs of the messages, the entity IDs and the timings. Keys are
+// never logged. The subjects, the attributes, the client addresses and the
+// XML of the messages are redacted unless LogSensitive is set.
+
+// redacted is logged in place of the sensitive values.
+const redacted = "[redacted]"
+
+// sensitiveAttr returns a log attribute with the given key and value if
+// enabled is set, and a redacted one otherwise.
+func sensitiveAttr(enabled bool, key string, value interface{}) slog.Attr {
+	if !enabled {
+		return slog.String(key, redacted)
+	}
+	if buf, ok := value.([]byte); ok {
+		return slog.String(key, string(buf))
+	}
+	return slog.Any(key, value)
+}
+
+// errorAttr returns the log attribute of the given error, an empty one, which
+// is left out, if nil. The message is logged without the stack trace
+// pkg/errors would print.
+func errorAttr(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+	return slog.String("error", err.Error())
+}
+
+// nameIDValue returns the value of the given NameID, if any.
+func nameIDValue(nameID *NameID) string {
+	if nameID == nil {
+		return ""
+	}
+	return nameID.Value
+}
+
+func (idp *IdentityProvider) logger() *slog.Logger {
+	if idp.Logger != nil {
+		return idp.Logger
+	}
+	return slog.Default()
+}
+
+// sensitive returns a log attribute with the given value, redacted unless
+// the IdP's LogSensitive is set.
+func (idp *IdentityProvider) sensitive(key string, value interface{}) slog.Attr {
+	return sensitiveAttr(idp.LogSensitive, key, value)
+}
+
+func (sp *ServiceProvider) logger() *slog.Logger {
+	if sp.Logger != nil {
+		return sp.Logger
+	}
+	return slog.Default()
+}
+
+// sensitive returns a log attribute with the given value, redacted unless
+// the SP's LogSensitive is set.
+func (sp *ServiceProvider) sensitive(key string, value interface{}) slog.Attr {
+	return sensitiveAttr(sp.LogSensitive, key, value)
+}
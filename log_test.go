@@ -0,0 +1,59 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogRedaction(t *testing.T) {
+	tearUp()
+
+	for _, logSensitive := range []bool{false, true} {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+		idp := newTestIdPForSP(t, testSP)
+		idp.Logger = logger
+		idp.LogSensitive = logSensitive
+		spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+		assert.NoError(t, err)
+
+		authnRequest, err := testSP.NewAuthnRequest()
+		assert.NoError(t, err)
+		req := &IdpAuthnRequest{
+			IDP:                     idp,
+			Address:                 "10.0.0.1",
+			Request:                 *authnRequest,
+			ServiceProviderMetadata: spMetadata,
+		}
+		_, err = req.GenerateResponse(nil)
+		assert.NoError(t, err)
+
+		sp := *testSP
+		sp.Logger = logger
+		sp.LogSensitive = logSensitive
+		_, err = sp.AssertResponse(base64.StdEncoding.EncodeToString(req.ResponseBuffer))
+		assert.Error(t, err)
+
+		logs := buf.String()
+		assert.Contains(t, logs, `msg="looked up service provider"`)
+		assert.Contains(t, logs, `msg="made response" request_id=`+authnRequest.ID)
+		assert.Contains(t, logs, `msg="saml response rejected"`)
+		assert.Contains(t, logs, "in_response_to="+authnRequest.ID)
+		if logSensitive {
+			assert.Contains(t, logs, "client_ip=10.0.0.1")
+			assert.Contains(t, logs, "response=\"<Response")
+			assert.NotContains(t, logs, redacted)
+		} else {
+			assert.Contains(t, logs, "client_ip="+redacted)
+			assert.Contains(t, logs, "response="+redacted)
+			assert.NotContains(t, logs, "10.0.0.1")
+			assert.NotContains(t, logs, "<Response")
+		}
+	}
+}
@@ -33,14 +33,17 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/pressly/saml/xmlsec"
 )
 
 // EntitiesDescriptor represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.3.1
 type EntitiesDescriptor struct {
-	XMLName          xml.Name    `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
-	EntityDescriptor []*Metadata `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	XMLName          xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+	ID               string            `xml:",attr,omitempty"`
+	Signature        *xmlsec.Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature,omitempty"`
+	EntityDescriptor []*Metadata       `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
 }
 
 // Metadata represents the SAML EntityDescriptor object.
@@ -53,6 +56,8 @@ type Metadata struct {
 	EntityID         string            `xml:"entityID,attr"`
 	SPSSODescriptor  *SPSSODescriptor  `xml:"SPSSODescriptor"`
 	IDPSSODescriptor *IDPSSODescriptor `xml:"IDPSSODescriptor"`
+
+	AttributeAuthorityDescriptor *AttributeAuthorityDescriptor `xml:"AttributeAuthorityDescriptor"`
 }
 
 func (metadata *Metadata) Cert() string {
@@ -83,6 +88,51 @@ func (metadata *Metadata) SSOService(binding string) *Endpoint {
 	return nil
 }
 
+// AttributeService returns the attribute service of the attribute authority
+// using the given binding, or nil if there is none.
+func (metadata *Metadata) AttributeService(binding string) *Endpoint {
+	if metadata.AttributeAuthorityDescriptor == nil {
+		return nil
+	}
+
+	for i, endpoint := range metadata.AttributeAuthorityDescriptor.AttributeService {
+		if binding == endpoint.Binding {
+			return &metadata.AttributeAuthorityDescriptor.AttributeService[i]
+		}
+	}
+	return nil
+}
+
+// AttributeConsumingService returns the SP's attribute consuming service with
+// the given index. If index is nil the default service is returned, that is,
+// the first one marked with isDefault or, if none is marked, the first one
+// listed. Returns nil if there is no matching service.
+func (metadata *Metadata) AttributeConsumingService(index *int) *AttributeConsumingService {
+	if metadata.SPSSODescriptor == nil {
+		return nil
+	}
+
+	services := metadata.SPSSODescriptor.AttributeConsumingService
+	if index != nil {
+		for i := range services {
+			if services[i].Index == *index {
+				return &services[i]
+			}
+		}
+		return nil
+	}
+
+	for i := range services {
+		if services[i].IsDefault {
+			return &services[i]
+		}
+	}
+	if len(services) > 0 {
+		return &services[0]
+	}
+	return nil
+}
+
 // KeyDescriptor represents the XMLSEC object of the same name
 type KeyDescriptor struct {
 	Use               string             `xml:"use,attr"`
@@ -90,9 +140,28 @@ type KeyDescriptor struct {
 	EncryptionMethods []EncryptionMethod `xml:"EncryptionMethod"`
 }
 
-// EncryptionMethod represents the XMLSEC object of the same name
+// signingCertificates returns the certificates of the key descriptors that
+// can be used for signing, that is, those with use="signing" or no use at all.
+// Several certificates may be listed during a key rollover.
+func signingCertificates(descriptors []KeyDescriptor) []string {
+	var certs []string
+	for _, keyDescriptor := range descriptors {
+		if keyDescriptor.Use != "" && keyDescriptor.Use != "signing" {
+			continue
+		}
+		if keyDescriptor.KeyInfo.Certificate != "" {
+			certs = append(certs, keyDescriptor.KeyInfo.Certificate)
+		}
+	}
+	return certs
+}
+
+// EncryptionMethod represents the XMLSEC object of the same name. RSA-OAEP
+// methods may set the digest and mask generation function they use.
 type EncryptionMethod struct {
-	Algorithm string `xml:"Algorithm,attr"`
+	Algorithm    string         `xml:"Algorithm,attr"`
+	DigestMethod *xmlsec.Method `xml:"http://www.w3.org/2000/09/xmldsig# DigestMethod,omitempty"`
+	MGF          *xmlsec.Method `xml:"http://www.w3.org/2009/xmlenc11# MGF,omitempty"`
 }
 
 // KeyInfo represents the XMLSEC object of the same name
@@ -110,13 +179,44 @@ type Endpoint struct {
 	ResponseLocation string `xml:"ResponseLocation,attr,omitempty"`
 }
 
+// LocalizedName represents the SAML localizedNameType object.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.2.4
+type LocalizedName struct {
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Value string `xml:",chardata"`
+}
+
 // IndexedEndpoint represents the SAML IndexedEndpointType object.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.2.3
 type IndexedEndpoint struct {
-	Binding  string `xml:"Binding,attr"`
-	Location string `xml:"Location,attr"`
-	Index    int    `xml:"index,attr"`
+	Binding   string `xml:"Binding,attr"`
+	Location  string `xml:"Location,attr"`
+	Index     int    `xml:"index,attr"`
+	IsDefault bool   `xml:"isDefault,attr,omitempty"`
+}
+
+// defaultIndexedEndpoint returns the default endpoint of the list, that is,
+// the first one marked with isDefault or the first one listed if none is
+// marked. Only endpoints with the given binding are considered, unless
+// binding is empty.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.2.3
+func defaultIndexedEndpoint(endpoints []IndexedEndpoint, binding string) *IndexedEndpoint {
+	var first *IndexedEndpoint
+	for i := range endpoints {
+		if binding != "" && endpoints[i].Binding != binding {
+			continue
+		}
+		if endpoints[i].IsDefault {
+			return &endpoints[i]
+		}
+		if first == nil {
+			first = &endpoints[i]
+		}
+	}
+	return first
 }
 
 // SPSSODescriptor represents the SAML SPSSODescriptorType object.
@@ -131,9 +231,31 @@ type SPSSODescriptor struct {
 	ArtifactResolutionService  []IndexedEndpoint `xml:"ArtifactResolutionService"`
 	SingleLogoutService        []Endpoint        `xml:"SingleLogoutService"`
 	ManageNameIDService        []Endpoint
-	NameIDFormat               []string          `xml:"NameIDFormat"`
-	AssertionConsumerService   []IndexedEndpoint `xml:"AssertionConsumerService"`
-	AttributeConsumingService  []interface{}
+	NameIDFormat               []string                    `xml:"NameIDFormat"`
+	AssertionConsumerService   []IndexedEndpoint           `xml:"AssertionConsumerService"`
+	AttributeConsumingService  []AttributeConsumingService `xml:"AttributeConsumingService"`
+}
+
+// AttributeConsumingService represents the SAML object of the same name.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.4.1
+type AttributeConsumingService struct {
+	Index              int                  `xml:"index,attr"`
+	IsDefault          bool                 `xml:"isDefault,attr,omitempty"`
+	ServiceName        []LocalizedName      `xml:"ServiceName"`
+	ServiceDescription []LocalizedName      `xml:"ServiceDescription"`
+	RequestedAttribute []RequestedAttribute `xml:"RequestedAttribute"`
+}
+
+// RequestedAttribute represents the SAML object of the same name.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.4.2
+type RequestedAttribute struct {
+	Name         string           `xml:"Name,attr"`
+	NameFormat   string           `xml:"NameFormat,attr,omitempty"`
+	FriendlyName string           `xml:"FriendlyName,attr,omitempty"`
+	IsRequired   bool             `xml:"isRequired,attr,omitempty"`
+	Values       []AttributeValue `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
 }
 
 // IDPSSODescriptor represents the SAML IDPSSODescriptorType object.
@@ -141,12 +263,30 @@ type SPSSODescriptor struct {
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.3
 type IDPSSODescriptor struct {
 	XMLName                    xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+	WantAuthnRequestsSigned    bool            `xml:",attr,omitempty"`
 	ProtocolSupportEnumeration string          `xml:"protocolSupportEnumeration,attr"`
 	KeyDescriptor              []KeyDescriptor `xml:"KeyDescriptor"`
+	SingleLogoutService        []Endpoint      `xml:"SingleLogoutService"`
 	NameIDFormat               []string        `xml:"NameIDFormat"`
 	SingleSignOnService        []Endpoint      `xml:"SingleSignOnService"`
 }
 
+// AttributeAuthorityDescriptor represents the SAML
+// AttributeAuthorityDescriptorType object, the role of an entity answering
+// AttributeQuery messages.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.7
+type AttributeAuthorityDescriptor struct {
+	XMLName                    xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata AttributeAuthorityDescriptor"`
+	ProtocolSupportEnumeration string          `xml:"protocolSupportEnumeration,attr"`
+	KeyDescriptor              []KeyDescriptor `xml:"KeyDescriptor"`
+	AttributeService           []Endpoint      `xml:"AttributeService"`
+	NameIDFormat               []string        `xml:"NameIDFormat"`
+
+	// Attributes the authority supports, optionally with their values
+	Attribute []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+}
+
 type CacheDuration struct {
 	raw    string
 	attr   xml.Attr
@@ -0,0 +1,203 @@
+package saml
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoPersistentNameID is returned by a PersistentNameIDSource when no
+// persistent identifier exists for the subject and none may be created.
+var ErrNoPersistentNameID = errors.New("no persistent name id")
+
+// PersistentNameIDSource provides persistent NameIDs: opaque identifiers of a
+// subject that are stable over time and differ for every SP (or affiliation of
+// SPs), so SPs cannot correlate users between them.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 8.3.7
+type PersistentNameIDSource interface {
+	// PersistentNameID returns the identifier of the subject for the given
+	// SPNameQualifier. If none exists yet a new one is created when allowCreate
+	// is set, otherwise ErrNoPersistentNameID is returned.
+	PersistentNameID(ctx context.Context, subjectID string, spNameQualifier string, allowCreate bool) (string, error)
+}
+
+// HMACPersistentNameIDs derives persistent NameIDs from the subject and the
+// SPNameQualifier with HMAC-SHA256, so nothing needs to be stored. Since
+// identifiers can always be derived AllowCreate has no effect. Changing the
+// secret changes every identifier.
+type HMACPersistentNameIDs struct {
+	Secret []byte
+}
+
+// PersistentNameID implements PersistentNameIDSource.
+func (source *HMACPersistentNameIDs) PersistentNameID(ctx context.Context, subjectID string, spNameQualifier string, allowCreate bool) (string, error) {
+	if len(source.Secret) == 0 {
+		return "", errors.New("missing persistent name id secret")
+	}
+	mac := hmac.New(sha256.New, source.Secret)
+	fmt.Fprintf(mac, "%d:%s!%s", len(spNameQualifier), spNameQualifier, subjectID)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// MemoryPersistentNameIDs keeps randomly generated persistent NameIDs in
+// memory. It is mostly useful for tests and as a reference for implementations
+// backed by a database. It is safe for concurrent use.
+type MemoryPersistentNameIDs struct {
+	// Returns new identifiers, NewID is used if nil
+	NewID func() string
+
+	mu  sync.Mutex
+	ids map[[2]string]string
+}
+
+// PersistentNameID implements PersistentNameIDSource.
+func (source *MemoryPersistentNameIDs) PersistentNameID(ctx context.Context, subjectID string, spNameQualifier string, allowCreate bool) (string, error) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	key := [2]string{spNameQualifier, subjectID}
+	if id, ok := source.ids[key]; ok {
+		return id, nil
+	}
+	if !allowCreate {
+		return "", ErrNoPersistentNameID
+	}
+
+	newID := source.NewID
+	if newID == nil {
+		newID = NewID
+	}
+	if source.ids == nil {
+		source.ids = make(map[[2]string]string)
+	}
+	id := newID()
+	source.ids[key] = id
+	return id, nil
+}
+
+// nameIDFormats returns the NameID formats the IdP can issue.
+func (idp *IdentityProvider) nameIDFormats() []string {
+	formats := []string{NameIDTransientFormat}
+	if idp.PersistentNameIDs != nil {
+		formats = append(formats, NameIDPersistentFormat)
+	}
+	return append(formats, NameIDEmailAddressFormat, NameIDUnspecifiedFormat)
+}
+
+// invalidNameIDPolicy returns the error reported when the NameIDPolicy of the
+// request cannot be satisfied.
+func invalidNameIDPolicy(format string, args ...interface{}) *StatusError {
+	return &StatusError{
+		Code:    StatusRequester,
+		SubCode: StatusInvalidNameIDPolicy,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// makeNameID builds the NameID of the session's subject, honoring the
+// NameIDPolicy of the request. Requests that cannot be satisfied yield a
+// *StatusError with the InvalidNameIDPolicy status.
+//
+// Sessions setting NameID keep getting it, in the unspecified format, when
+// the SP lets the IdP pick the format or asks for an email address the
+// session does not have, as SPs did by default.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.4.1.1
+func (req *IdpAuthnRequest) makeNameID(session *Session) (*NameID, error) {
+	var entityID string
+	if req.ServiceProviderMetadata != nil {
+		entityID = req.ServiceProviderMetadata.EntityID
+	}
+	policy := req.spPolicy()
+	nameIDPolicy := req.Request.NameIDPolicy
+
+	spNameQualifier := entityID
+	if q := nameIDPolicy.SPNameQualifier; q != "" && q != entityID {
+		allowed := false
+		for _, affiliation := range policy.SPNameQualifiers {
+			if affiliation == q {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, invalidNameIDPolicy("sp %q may not request SPNameQualifier %q", entityID, q)
+		}
+		spNameQualifier = q
+	}
+
+	format := nameIDPolicy.Format
+	if format == "" || (format == NameIDUnspecifiedFormat && policy.NameIDFormat != "") {
+		// The IdP is free to pick the format.
+		format = policy.NameIDFormat
+		if format == "" {
+			format = NameIDTransientFormat
+			if session.NameID != "" {
+				format = NameIDUnspecifiedFormat
+			}
+		}
+	}
+
+	var value string
+	switch format {
+	case NameIDTransientFormat:
+		value = req.IDP.newID()
+	case NameIDPersistentFormat:
+		if req.IDP.PersistentNameIDs == nil {
+			return nil, invalidNameIDPolicy("persistent name ids are not supported")
+		}
+		subjectID := session.subjectID()
+		if subjectID == "" {
+			return nil, invalidNameIDPolicy("missing subject id")
+		}
+		var err error
+		value, err = req.IDP.PersistentNameIDs.PersistentNameID(req.context(), subjectID, spNameQualifier, nameIDPolicy.AllowCreate)
+		if err == ErrNoPersistentNameID {
+			return nil, invalidNameIDPolicy("no persistent name id exists for the subject and AllowCreate is false")
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get persistent name id")
+		}
+	case NameIDEmailAddressFormat:
+		if values := session.AttributeValues(SessionUserEmail); len(values) > 0 {
+			value = values[0]
+		}
+		if value == "" && session.NameID != "" {
+			format, value = NameIDUnspecifiedFormat, session.NameID
+		}
+		if value == "" {
+			return nil, invalidNameIDPolicy("the subject has no email address")
+		}
+	case NameIDUnspecifiedFormat:
+		value = session.NameID
+		if value == "" {
+			value = session.subjectID()
+		}
+		if value == "" {
+			return nil, invalidNameIDPolicy("missing name id")
+		}
+	default:
+		return nil, invalidNameIDPolicy("unsupported name id format %q", format)
+	}
+
+	return &NameID{
+		Format:          format,
+		NameQualifier:   req.IDP.MetadataURL,
+		SPNameQualifier: spNameQualifier,
+		Value:           value,
+	}, nil
+}
+
+// subjectID returns the stable identifier of the session's subject.
+func (session *Session) subjectID() string {
+	if session.SubjectID != "" {
+		return session.SubjectID
+	}
+	return session.UserID
+}
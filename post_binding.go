@@ -0,0 +1,64 @@
+package saml
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/pkg/errors"
+)
+
+// PostBindingForm is an HTML page posting a SAML message to its destination
+// through the browser, as described by the HTTP-POST binding.
+//
+// http://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf section 3.5
+type PostBindingForm struct {
+	// URL the message is posted to
+	Action string
+
+	RelayState string
+
+	// Base64 encoded XML of the message, either a request or a response
+	SAMLRequest  string
+	SAMLResponse string
+
+	// Nonce of the script submitting the form, which a Content-Security-Policy
+	// such as "script-src 'nonce-{Nonce}'" allows to run. Without scripts, the
+	// form is submitted by a button.
+	Nonce string
+}
+
+// DefaultPostBindingTemplate is the template of the PostBindingForm pages,
+// unless the SP or the IdP sets its PostBindingTemplate. Custom templates are
+// executed with a *PostBindingForm and must post its fields as hidden inputs
+// named RelayState and SAMLRequest or SAMLResponse.
+var DefaultPostBindingTemplate = template.Must(template.New("post-binding").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="utf-8" />
+	</head>
+	<body>
+		<form id="saml-post-binding" method="POST" action="{{.Action}}">
+			<input type="hidden" name="RelayState" value="{{.RelayState}}" />
+			{{if .SAMLRequest}}<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}" />{{else}}<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}" />{{end}}
+			<noscript>
+				<input type="submit" value="Continue" />
+			</noscript>
+		</form>
+		<script{{with .Nonce}} nonce="{{.}}"{{end}}>
+			document.getElementById("saml-post-binding").submit();
+		</script>
+	</body>
+</html>`))
+
+// Render returns the HTML page of the form, executing the given template, or
+// DefaultPostBindingTemplate if nil.
+func (form *PostBindingForm) Render(tpl *template.Template) ([]byte, error) {
+	if tpl == nil {
+		tpl = DefaultPostBindingTemplate
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, form); err != nil {
+		return nil, errors.Wrap(err, "failed to build form")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package saml
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostBindingForm(t *testing.T) {
+	form := PostBindingForm{
+		Action:      "https://idp.example.org/sso?a=1&b=2",
+		RelayState:  `"><script>alert(1)</script>`,
+		SAMLRequest: "PD94bWw+",
+	}
+	page, err := form.Render(nil)
+	assert.NoError(t, err)
+	body := string(page)
+	assert.Contains(t, body, `action="https://idp.example.org/sso?a=1&amp;b=2"`)
+	assert.Contains(t, body, `name="RelayState" value="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;"`)
+	assert.Contains(t, body, `name="SAMLRequest" value="PD94bWw&#43;"`)
+	assert.NotContains(t, body, "SAMLResponse")
+	assert.Contains(t, body, "<noscript>")
+	assert.Contains(t, body, "<script>")
+
+	form.Nonce = "r4nd0m"
+	page, err = form.Render(nil)
+	assert.NoError(t, err)
+	assert.Contains(t, string(page), `<script nonce="r4nd0m">`)
+
+	// Scripts cannot be injected through the action either.
+	form.Action = "javascript:alert(1)"
+	page, err = form.Render(nil)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(page), "javascript:")
+
+	tpl := template.Must(template.New("").Parse(`<form action="{{.Action}}">{{.RelayState}}</form>`))
+	page, err = form.Render(tpl)
+	assert.NoError(t, err)
+	assert.Equal(t, `<form action="#ZgotmplZ">&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;</form>`, string(page))
+
+	tpl = template.Must(template.New("").Parse(`{{.Missing}}`))
+	_, err = form.Render(tpl)
+	assert.Error(t, err)
+}
+
+func TestSAMLRequestForm(t *testing.T) {
+	tearUp()
+
+	sp := *testSP
+	sp.IdPSSOServiceBinding = HTTPPostBinding
+	sp.IdPSignSAMLRequest = false
+
+	page, err := sp.SAMLRequestWithOptions(`/next?a="b"`, AuthnRequestOptions{Nonce: "n0nce"})
+	assert.NoError(t, err)
+	assert.Contains(t, page, `action="`+sp.IdPSSOServiceURL+`"`)
+	assert.Contains(t, page, `name="RelayState" value="/next?a=&#34;b&#34;"`)
+	assert.Contains(t, page, `name="SAMLRequest"`)
+	assert.Contains(t, page, `<script nonce="n0nce">`)
+
+	sp.PostBindingTemplate = template.Must(template.New("").Parse(`custom {{.RelayState}}`))
+	page, err = sp.SAMLRequestForm([]byte("<AuthnRequest/>"), "state")
+	assert.NoError(t, err)
+	assert.Equal(t, "custom state", page)
+}
+
+func TestIdPPostBindingNonce(t *testing.T) {
+	tearUp()
+
+	idp := newTestIdPForSP(t, testSP)
+	idp.PostBindingNonce = func(r *http.Request) string {
+		return r.Header.Get("X-Nonce")
+	}
+	spMetadata, err := idp.GetServiceProvider(context.Background(), testSP.MetadataURL)
+	assert.NoError(t, err)
+
+	authnRequest, err := testSP.NewAuthnRequest()
+	assert.NoError(t, err)
+	r := httptest.NewRequest("GET", "/sso", nil)
+	r.Header.Set("X-Nonce", "idp-nonce")
+	req := &IdpAuthnRequest{
+		IDP:                     idp,
+		HTTPRequest:             r,
+		Request:                 *authnRequest,
+		ServiceProviderMetadata: spMetadata,
+		RelayState:              `"onload="alert(1)`,
+	}
+	form, err := req.GenerateErrorResponse(NewRequestDeniedError(""))
+	assert.NoError(t, err)
+	assert.Contains(t, string(form), `<script nonce="idp-nonce">`)
+	assert.Contains(t, string(form), `name="RelayState" value="&#34;onload=&#34;alert(1)"`)
+}
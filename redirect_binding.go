@@ -0,0 +1,284 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Signature algorithms supported by the HTTP-Redirect binding.
+const (
+	SigAlgRSASHA1     = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	SigAlgRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	SigAlgRSASHA512   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	SigAlgECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+)
+
+var redirectSigAlgs = map[string]x509.SignatureAlgorithm{
+	SigAlgRSASHA1:     x509.SHA1WithRSA,
+	SigAlgRSASHA256:   x509.SHA256WithRSA,
+	SigAlgRSASHA512:   x509.SHA512WithRSA,
+	SigAlgECDSASHA256: x509.ECDSAWithSHA256,
+}
+
+// encodeRedirectQuery builds the query of a HTTP-Redirect message: the DEFLATE
+// compressed and base64 encoded message in the messageParam parameter,
+// followed by the RelayState if any. The order of the parameters matters when
+// the query is signed.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf section 3.4.4.1
+func encodeRedirectQuery(messageParam string, message []byte, relayState string) (string, error) {
+	flateBuf := bytes.NewBuffer(nil)
+	flateWriter, err := flate.NewWriter(flateBuf, flate.DefaultCompression)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create flate writer")
+	}
+	if _, err = flateWriter.Write(message); err != nil {
+		return "", errors.Wrap(err, "failed to write to flate writer")
+	}
+	flateWriter.Close()
+
+	query := messageParam + "=" + url.QueryEscape(base64.StdEncoding.EncodeToString(flateBuf.Bytes()))
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	return query, nil
+}
+
+// decodeRedirectMessage inflates the base64 encoded message of a HTTP-Redirect
+// query, refusing messages larger than maxRequestSize.
+func decodeRedirectMessage(value string) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to base64-decode saml message")
+	}
+	flateReader := flate.NewReader(bytes.NewReader(compressed))
+	defer flateReader.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(flateReader, maxRequestSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to inflate saml message")
+	}
+	if len(buf) > maxRequestSize {
+		return nil, errors.New("saml message is too large")
+	}
+	return buf, nil
+}
+
+// rawQueryValue returns the first value of the given parameter, exactly as it
+// was URL-encoded by the sender.
+func rawQueryValue(rawQuery string, name string) (string, bool) {
+	for _, param := range strings.Split(rawQuery, "&") {
+		if strings.HasPrefix(param, name+"=") {
+			return param[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// redirectSignedOctets builds the string covered by the signature of a
+// HTTP-Redirect message, using the URL-encoded values of the original query.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf section 3.4.4.1
+func redirectSignedOctets(rawQuery string, messageParam string) (string, error) {
+	message, ok := rawQueryValue(rawQuery, messageParam)
+	if !ok {
+		return "", errors.Errorf("missing %s", messageParam)
+	}
+	signed := messageParam + "=" + message
+	if relayState, ok := rawQueryValue(rawQuery, "RelayState"); ok {
+		signed += "&RelayState=" + relayState
+	}
+	sigAlg, ok := rawQueryValue(rawQuery, "SigAlg")
+	if !ok {
+		return "", errors.New("missing SigAlg")
+	}
+	return signed + "&SigAlg=" + sigAlg, nil
+}
+
+// isRedirectSigned reports whether the query of a HTTP-Redirect message
+// carries a signature.
+func isRedirectSigned(rawQuery string) bool {
+	_, ok := rawQueryValue(rawQuery, "Signature")
+	return ok
+}
+
+// verifyRedirectSignature checks the signature of a HTTP-Redirect message
+// against any of the given base64 encoded certificates. messageParam is either
+// SAMLRequest or SAMLResponse.
+func verifyRedirectSignature(rawQuery string, messageParam string, certs []string) error {
+	signed, err := redirectSignedOctets(rawQuery, messageParam)
+	if err != nil {
+		return err
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse query")
+	}
+	algorithm, ok := redirectSigAlgs[query.Get("SigAlg")]
+	if !ok {
+		return errors.Errorf("unsupported SigAlg %q", query.Get("SigAlg"))
+	}
+	signature, err := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	if err != nil {
+		return errors.Wrap(err, "failed to base64-decode signature")
+	}
+
+	if len(certs) == 0 {
+		return errors.New("missing signing certificate")
+	}
+	for _, certStr := range certs {
+		cert, err := parseCertificate(certStr)
+		if err != nil {
+			return err
+		}
+		certSignature := signature
+		if algorithm == x509.ECDSAWithSHA256 {
+			if certSignature, err = ecdsaSignatureToASN1(cert.PublicKey, signature); err != nil {
+				continue
+			}
+		}
+		if err := cert.CheckSignature(algorithm, []byte(signed), certSignature); err == nil {
+			return nil
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// signRedirectQuery appends the SigAlg and Signature parameters to the query
+// of a HTTP-Redirect message, signing it with the private key at keyFile.
+func signRedirectQuery(rawQuery string, messageParam string, keyFile string) (string, error) {
+	key, err := loadPrivateKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	var sigAlg string
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		sigAlg = SigAlgRSASHA256
+	case *ecdsa.PrivateKey:
+		sigAlg = SigAlgECDSASHA256
+	default:
+		return "", errors.Errorf("unsupported key type %T", key)
+	}
+
+	rawQuery += "&SigAlg=" + url.QueryEscape(sigAlg)
+	signed, err := redirectSignedOctets(rawQuery, messageParam)
+	if err != nil {
+		return "", err
+	}
+
+	hash := crypto.SHA256.New()
+	hash.Write([]byte(signed))
+	signature, err := key.Sign(rand.Reader, hash.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to sign query")
+	}
+	if key, ok := key.(*ecdsa.PrivateKey); ok {
+		if signature, err = ecdsaSignatureFromASN1(&key.PublicKey, signature); err != nil {
+			return "", err
+		}
+	}
+
+	return rawQuery + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// ecdsaSignature is the ASN.1 structure of the ECDSA signatures produced and
+// checked by the crypto packages.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// ecdsaSignatureFromASN1 converts an ASN.1 DER encoded ECDSA signature to the
+// concatenation of r and s, each left-padded to the size of the curve, used
+// by XML Signature.
+//
+// See https://tools.ietf.org/html/rfc4050#section-3.3
+func ecdsaSignatureFromASN1(key *ecdsa.PublicKey, der []byte) ([]byte, error) {
+	var sig ecdsaSignature
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, errors.Wrap(err, "failed to parse ecdsa signature")
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	r, s := sig.R.Bytes(), sig.S.Bytes()
+	if len(r) > size || len(s) > size {
+		return nil, errors.New("invalid ecdsa signature")
+	}
+	out := make([]byte, 2*size)
+	copy(out[size-len(r):size], r)
+	copy(out[2*size-len(s):], s)
+	return out, nil
+}
+
+// ecdsaSignatureToASN1 converts an XML Signature ECDSA signature, r and s
+// concatenated, to the ASN.1 DER encoding checked by x509.Certificate.
+func ecdsaSignatureToASN1(publicKey interface{}, signature []byte) ([]byte, error) {
+	key, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("unexpected key type %T", publicKey)
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return nil, errors.Errorf("invalid ecdsa signature length %d", len(signature))
+	}
+	return asn1.Marshal(ecdsaSignature{
+		R: new(big.Int).SetBytes(signature[:size]),
+		S: new(big.Int).SetBytes(signature[size:]),
+	})
+}
+
+// parseCertificate parses a base64 encoded DER certificate, as found in
+// metadata.
+func parseCertificate(certStr string) (*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(certStr), ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to base64-decode certificate")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+	return cert, nil
+}
+
+// loadPrivateKey reads a PEM encoded PKCS#1, PKCS#8 or EC private key.
+func loadPrivateKey(keyFile string) (crypto.Signer, error) {
+	buf, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read private key")
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("failed to decode private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse private key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,77 @@
+package saml
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectECDSASignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sp.example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sp.example.org"},
+	}, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert := base64.StdEncoding.EncodeToString(der)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	keyFile, err := ioutil.TempFile("", "saml")
+	assert.NoError(t, err)
+	defer os.Remove(keyFile.Name())
+	assert.NoError(t, pem.Encode(keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	assert.NoError(t, keyFile.Close())
+
+	query, err := encodeRedirectQuery("SAMLRequest", []byte("<AuthnRequest/>"), "xyz")
+	assert.NoError(t, err)
+	query, err = signRedirectQuery(query, "SAMLRequest", keyFile.Name())
+	assert.NoError(t, err)
+
+	// The signature is r and s, 32 bytes each, and not ASN.1.
+	values, err := url.ParseQuery(query)
+	assert.NoError(t, err)
+	assert.Equal(t, SigAlgECDSASHA256, values.Get("SigAlg"))
+	signature, err := base64.StdEncoding.DecodeString(values.Get("Signature"))
+	assert.NoError(t, err)
+	assert.Len(t, signature, 64)
+
+	assert.NoError(t, verifyRedirectSignature(query, "SAMLRequest", []string{cert}))
+	tampered := strings.Replace(query, "RelayState=xyz", "RelayState=abc", 1)
+	assert.Error(t, verifyRedirectSignature(tampered, "SAMLRequest", []string{cert}))
+
+	// r and s are left-padded to the size of the curve.
+	der, err = asn1.Marshal(ecdsaSignature{R: big.NewInt(1), S: big.NewInt(2)})
+	assert.NoError(t, err)
+	signature, err = ecdsaSignatureFromASN1(&key.PublicKey, der)
+	assert.NoError(t, err)
+	assert.Len(t, signature, 64)
+	assert.Equal(t, byte(1), signature[31])
+	assert.Equal(t, byte(2), signature[63])
+	converted, err := ecdsaSignatureToASN1(&key.PublicKey, signature)
+	assert.NoError(t, err)
+	assert.Equal(t, der, converted)
+
+	_, err = ecdsaSignatureToASN1(&key.PublicKey, der)
+	assert.Error(t, err)
+}
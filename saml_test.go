@@ -1,6 +1,9 @@
 package saml
 
 import (
+	"fmt"
+	"os/exec"
+	"testing"
 	"time"
 )
 
@@ -15,3 +18,24 @@ func tearUp() {
 		return "id-MOCKID"
 	}
 }
+
+// xmlsec1AtLeast reports whether the installed xmlsec1 command is at least
+// the given version.
+func xmlsec1AtLeast(major int, minor int) bool {
+	out, err := exec.Command("xmlsec1", "--version").Output()
+	if err != nil {
+		return false
+	}
+	var gotMajor, gotMinor int
+	if _, err := fmt.Sscanf(string(out), "xmlsec1 %d.%d", &gotMajor, &gotMinor); err != nil {
+		return false
+	}
+	return gotMajor > major || gotMajor == major && gotMinor >= minor
+}
+
+// requireXMLSec1 skips the test if the xmlsec1 command is not installed.
+func requireXMLSec1(t *testing.T) {
+	if _, err := exec.LookPath("xmlsec1"); err != nil {
+		t.Skip("xmlsec1 is not installed")
+	}
+}
@@ -38,6 +38,13 @@ const (
 
 	// HTTPRedirectBinding is the official URN for the HTTP-Redirect binding (transport)
 	HTTPRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+
+	// SOAPBinding is the official URN for the SOAP binding (transport)
+	SOAPBinding = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+
+	// PAOSBinding is the official URN for the reverse SOAP (PAOS) binding
+	// (transport), used by ECPs
+	PAOSBinding = "urn:oasis:names:tc:SAML:2.0:bindings:PAOS"
 )
 
 const (
@@ -46,6 +53,14 @@ const (
 	NameIDEntityFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:entity"
 
 	NameIDEmailAddressFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+
+	NameIDUnspecifiedFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+	NameIDPersistentFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+
+	NameIDTransientFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+
+	NameIDEncryptedFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:encrypted"
 )
 
 const (
@@ -106,18 +121,171 @@ type AuthnRequest struct {
 	// with the requester. [SAMLMeta] provides one possible mechanism; signing the enclosing
 	// <AuthnRequest> message is another. This attribute is mutually exclusive with the
 	// AssertionConsumerServiceIndex attribute and is typically accompanied by the ProtocolBinding attribute.
-	AssertionConsumerServiceURL string `xml:",attr"`
+	AssertionConsumerServiceURL string `xml:",attr,omitempty"`
 
 	// A URI reference that identifies a SAML protocol binding to be used when returning the <Response>
 	// message. See [SAMLBind] for more information about protocol bindings and URI references defined
 	// for them. This attribute is mutually exclusive with the AssertionConsumerServiceIndex attribute
 	// and is typically accompanied by the AssertionConsumerServiceURL attribute.
-	ProtocolBinding string `xml:",attr"`
+	ProtocolBinding string `xml:",attr,omitempty"`
+
+	// Indirectly identifies the location to which the <Response> message should be returned to the
+	// requester. It applies only to profiles in which the requester is different from the presenter, such as
+	// the Web Browser SSO profile in [SAMLProf]. The identity provider MUST have a trusted means to map
+	// the index value in the attribute to a location associated with the requester. [SAMLMeta] provides one
+	// possible mechanism. If omitted, then the identity provider MUST return the <Response> message to
+	// the default location associated with the requester for the profile of use. If the index specified is invalid,
+	// then the identity provider MAY return an error <Response> or it MAY use the default location. This
+	// attribute is mutually exclusive with the AssertionConsumerServiceURL and ProtocolBinding attributes.
+	AssertionConsumerServiceIndex *int `xml:",attr,omitempty"`
+
+	// Indirectly identifies information associated with the requester describing the SAML attributes the
+	// requester desires or requires to be supplied by the identity provider in the <Response> message. The
+	// identity provider MUST have a trusted means to map the index value in the attribute to information
+	// associated with the requester. [SAMLMeta] provides a possible mechanism.
+	AttributeConsumingServiceIndex *int `xml:",attr,omitempty"`
+
+	// A Boolean value. If "true", the identity provider MUST authenticate the presenter directly rather than
+	// rely on a previous security context. If a value is not provided, the default is "false".
+	ForceAuthn bool `xml:",attr,omitempty"`
+
+	// A Boolean value. If "true", the identity provider and the user agent itself MUST NOT visibly take control
+	// of the user interface from the requester and interact with the presenter in a noticeable fashion. If a
+	// value is not provided, the default is "false".
+	IsPassive bool `xml:",attr,omitempty"`
 
 	// Specifies constraints on the name identifier to be used to represent the requested subject.
 	// If omitted, then any type of identifier supported by the identity provider for the requested
 	// subject can be used, constrained by any relevant deployment-specific policies, with respect to privacy.
 	NameIDPolicy NameIDPolicy
+
+	// Specifies the requirements, if any, that the requester places on the authentication context that applies
+	// to the responding provider's authentication of the presenter.
+	RequestedAuthnContext *RequestedAuthnContext
+}
+
+// RequestedAuthnContext represents the SAML object of the same name, the
+// authentication contexts a SP accepts. Either AuthnContextClassRef or
+// AuthnContextDeclRef is set.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.3.2.2.1
+type RequestedAuthnContext struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequestedAuthnContext"`
+
+	// How the authentication context of the assertion must compare to the
+	// ones listed, such as AuthnContextComparisonMinimum. Exact if empty.
+	Comparison string `xml:",attr,omitempty"`
+
+	AuthnContextClassRef []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+	AuthnContextDeclRef  []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextDeclRef"`
+}
+
+// Comparison methods of a RequestedAuthnContext.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.3.2.2.1
+const (
+	AuthnContextComparisonExact   = "exact"
+	AuthnContextComparisonMinimum = "minimum"
+	AuthnContextComparisonBetter  = "better"
+	AuthnContextComparisonMaximum = "maximum"
+)
+
+// LogoutRequest represents the SAML object of the same name, a request to end
+// the sessions of a principal.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.7.1
+type LogoutRequest struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+
+	// Required attributes
+	//
+
+	// An identifier for the request.
+	ID string `xml:",attr"`
+
+	// The version of this request.
+	Version string `xml:",attr"`
+
+	// The time instant of issue of the request.
+	IssueInstant time.Time `xml:",attr"`
+
+	// Optional attributes
+	//
+
+	// A URI reference indicating the address to which this request has been sent.
+	Destination string `xml:",attr,omitempty"`
+
+	// The time at which the request expires, after which the recipient may discard the message.
+	NotOnOrAfter *time.Time `xml:",attr,omitempty"`
+
+	// An indication of the reason for the logout, such as LogoutReasonUser.
+	Reason string `xml:",attr,omitempty"`
+
+	// Identifies the entity that generated the request message
+	Issuer *Issuer
+
+	// An XML Signature that authenticates the requester and provides message integrity
+	Signature *xmlsec.Signature
+
+	// The identifier of the principal to log out
+	NameID *NameID `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+
+	// The indexes of the sessions to end, all the sessions of the principal if
+	// empty
+	SessionIndex []string `xml:"urn:oasis:names:tc:SAML:2.0:protocol SessionIndex"`
+}
+
+// Reasons of a LogoutRequest.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.7.3
+const (
+	LogoutReasonUser  = "urn:oasis:names:tc:SAML:2.0:logout:user"
+	LogoutReasonAdmin = "urn:oasis:names:tc:SAML:2.0:logout:admin"
+)
+
+// LogoutResponse represents the SAML object of the same name, the answer to a
+// LogoutRequest.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.7.2
+type LogoutResponse struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutResponse"`
+
+	ID           string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Destination  string    `xml:",attr,omitempty"`
+
+	// The ID of the LogoutRequest this response answers
+	InResponseTo string `xml:",attr"`
+
+	Issuer    *Issuer
+	Signature *xmlsec.Signature
+
+	// Success, or PartialLogout when some of the sessions could not be ended
+	Status *Status
+}
+
+// AttributeQuery represents the SAML object of the same name, a request for
+// attributes of a principal, answered with a Response.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.3.2.3
+type AttributeQuery struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
+
+	ID           string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Destination  string    `xml:",attr,omitempty"`
+
+	Issuer    *Issuer
+	Signature *xmlsec.Signature
+
+	// The principal whose attributes are requested
+	Subject *Subject
+
+	// The attributes requested, all of those the requester may obtain if
+	// empty. Values, if any, restrict the values returned.
+	Attributes []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
 }
 
 // Issuer represents the SAML object of the same name.
@@ -152,6 +320,11 @@ type NameIDPolicy struct {
 	// urn:oasis:names:tc:SAML:2.0:nameid-format:encrypted is defined specifically for use
 	// within this attribute to indicate a request that the resulting identifier be encrypted
 	Format string `xml:",attr"`
+
+	// Optionally specifies that the assertion subject's identifier be returned (or created) in the namespace of
+	// a service provider other than the requester, or in the namespace of an affiliation group of service
+	// providers
+	SPNameQualifier string `xml:",attr,omitempty"`
 }
 
 // Response represents the SAML object of the same name.
@@ -175,9 +348,6 @@ type Response struct {
 	// The time instant of issue of the request. The time value is encoded in UTC
 	IssueInstant time.Time `xml:",attr"`
 
-	// A code representing the status of the corresponding reques
-	Status *Status
-
 	// Optional attributes
 	//
 
@@ -188,15 +358,12 @@ type Response struct {
 	// protocol bindings may require the use of this attribute
 	Destination string `xml:",attr"`
 
-	// An XML Signature that authenticates the requester and provides message integrity
-	Signature *xmlsec.Signature
-
 	// A reference to the identifier of the request to which the response corresponds, if any. If the response
 	// is not generated in response to a request, or if the ID attribute value of a request cannot be
 	// determined (for example, the request is malformed), then this attribute MUST NOT be present.
 	// Otherwise, it MUST be present and its value MUST match the value of the corresponding request's
 	// ID attribute.
-	InResponseTo string `xml:",attr"`
+	InResponseTo string `xml:",attr,omitempty"`
 
 	// Identifies the entity that generated the request message
 	// By default, the value of the <Issuer> element is a URI of no more than 1024 characters.
@@ -204,6 +371,12 @@ type Response struct {
 	// An <Issuer> element can now be present on requests and responses (in addition to appearing on assertions).
 	Issuer *Issuer
 
+	// An XML Signature that authenticates the requester and provides message integrity
+	Signature *xmlsec.Signature
+
+	// A code representing the status of the corresponding reques
+	Status *Status
+
 	EncryptedAssertion *EncryptedAssertion
 
 	Assertion *Assertion
@@ -215,6 +388,9 @@ type Response struct {
 type Status struct {
 	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
 	StatusCode StatusCode
+
+	// Optional message the responder may return to an operator
+	StatusMessage string `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage,omitempty"`
 }
 
 // StatusCode represents the SAML object of the same name.
@@ -223,6 +399,9 @@ type Status struct {
 type StatusCode struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
 	Value   string   `xml:",attr"`
+
+	// Optional subordinate status code providing more specific information
+	StatusCode *StatusCode
 }
 
 // StatusSuccess is the value of a StatusCode element when the authentication succeeds.
@@ -286,7 +465,7 @@ type SubjectConfirmation struct {
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type SubjectConfirmationData struct {
 	Address      string    `xml:",attr"`
-	InResponseTo string    `xml:",attr"`
+	InResponseTo string    `xml:",attr,omitempty"`
 	NotOnOrAfter time.Time `xml:",attr"`
 	Recipient    string    `xml:",attr"`
 }
@@ -318,8 +497,13 @@ type Audience struct {
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type AuthnStatement struct {
-	AuthnInstant    time.Time `xml:",attr"`
-	SessionIndex    string    `xml:",attr"`
+	AuthnInstant time.Time `xml:",attr"`
+	SessionIndex string    `xml:",attr"`
+
+	// Time at which the SP must end the session it establishes from the
+	// assertion
+	SessionNotOnOrAfter *time.Time `xml:",attr,omitempty"`
+
 	SubjectLocality SubjectLocality
 	AuthnContext    AuthnContext
 }
@@ -336,6 +520,7 @@ type SubjectLocality struct {
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type AuthnContext struct {
 	AuthnContextClassRef *AuthnContextClassRef
+	AuthnContextDeclRef  *AuthnContextDeclRef
 }
 
 // AuthnContextClassRef represents the SAML object of the same name.
@@ -345,6 +530,13 @@ type AuthnContextClassRef struct {
 	Value string `xml:",chardata"`
 }
 
+// AuthnContextDeclRef represents the SAML object of the same name.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 2.7.2.2
+type AuthnContextDeclRef struct {
+	Value string `xml:",chardata"`
+}
+
 // AttributeStatement represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
@@ -0,0 +1,101 @@
+package soap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Client sends SAML messages with the SOAP binding.
+type Client struct {
+	// HTTP client of the requests, http.DefaultClient if nil and
+	// TLSClientConfig is not set
+	HTTPClient *http.Client
+
+	// TLS configuration of the connections when HTTPClient is nil, such as
+	// the client certificate presented to peers requiring mutual TLS
+	TLSClientConfig *tls.Config
+
+	// Signs the SAML messages before they are sent, if set
+	Sign func(message []byte) ([]byte, error)
+
+	// Size limit of the answers, DefaultMaxMessageSize if zero
+	MaxMessageSize int64
+
+	once       sync.Once
+	httpClient *http.Client
+}
+
+// NewRequest returns the HTTP request posting the given SOAP envelope to the
+// given location.
+func NewRequest(ctx context.Context, location string, envelope []byte) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, location, bytes.NewReader(envelope))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("SOAPAction", Action)
+	return req, nil
+}
+
+// Send sends the given SAML message to the given location, with the given
+// header blocks if any, and returns the envelope answered. The message is
+// signed first if the client has a Sign function. A fault is returned as a
+// *Fault error.
+func (c *Client) Send(ctx context.Context, location string, message []byte, headers ...[]byte) (*Envelope, error) {
+	if c.Sign != nil {
+		var err error
+		if message, err = c.Sign(message); err != nil {
+			return nil, errors.Wrap(err, "failed to sign message")
+		}
+	}
+
+	req, err := NewRequest(ctx, location, Marshal(message, headers...))
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends the given HTTP request, such as one returned by NewRequest, and
+// reads the envelope answered. A fault is returned as a *Fault error.
+func (c *Client) Do(req *http.Request) (*Envelope, error) {
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Faults are sent with the 500 status code.
+	envelope, err := ReadEnvelope(resp.Body, c.MaxMessageSize)
+	if _, ok := err.(*Fault); ok {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("soap request failed with status %d", resp.StatusCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+func (c *Client) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	if c.TLSClientConfig == nil {
+		return http.DefaultClient
+	}
+	c.once.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c.TLSClientConfig
+		c.httpClient = &http.Client{Transport: transport}
+	})
+	return c.httpClient
+}
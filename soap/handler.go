@@ -0,0 +1,66 @@
+package soap
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// HandlerFunc answers the SAML message of a SOAP request with the message
+// returned. An error is answered with a fault: a *Fault as is, any other
+// error with a Server fault that does not disclose it.
+type HandlerFunc func(r *http.Request, envelope *Envelope) ([]byte, error)
+
+// Handler serves the SAML messages received with the SOAP binding,
+// dispatching them to the function registered for their type. Messages of
+// other types are answered with a Client fault.
+type Handler struct {
+	// Size limit of the requests, DefaultMaxMessageSize if zero
+	MaxMessageSize int64
+
+	handlers map[xml.Name]HandlerFunc
+}
+
+// HandleFunc registers the function answering the messages whose root
+// element has the given name, such as ProtocolMessage("AttributeQuery").
+func (h *Handler) HandleFunc(name xml.Name, fn HandlerFunc) {
+	if h.handlers == nil {
+		h.handlers = make(map[xml.Name]HandlerFunc)
+	}
+	h.handlers[name] = fn
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	envelope, err := ReadEnvelope(r.Body, h.MaxMessageSize)
+	if err != nil {
+		WriteFault(w, &Fault{Code: FaultClient, String: err.Error()})
+		return
+	}
+
+	fn, ok := h.handlers[envelope.Body.Name]
+	if !ok {
+		WriteFault(w, &Fault{
+			Code:   FaultClient,
+			String: "unsupported message " + envelope.Body.Name.Space + " " + envelope.Body.Name.Local,
+		})
+		return
+	}
+
+	message, err := fn(r, envelope)
+	if err != nil {
+		if fault, ok := errors.Cause(err).(*Fault); ok {
+			WriteFault(w, fault)
+			return
+		}
+		WriteFault(w, &Fault{Code: FaultServer, String: "internal error"})
+		return
+	}
+	WriteMessage(w, message)
+}
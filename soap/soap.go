@@ -0,0 +1,293 @@
+// Package soap implements the SOAP binding of SAML 2.0: SAML messages sent in
+// SOAP 1.1 envelopes over HTTP, as used by attribute queries, artifact
+// resolution, back-channel logout and ECP.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf section 3.2
+package soap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EnvelopeNamespace is the namespace of the SOAP 1.1 envelope.
+	EnvelopeNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+
+	// Action is the SOAPAction HTTP header of the requests of the SAML SOAP
+	// binding.
+	Action = "http://www.oasis-open.org/committees/security"
+
+	// ContentType is the HTTP content type of SOAP 1.1 messages.
+	ContentType = "text/xml; charset=utf-8"
+
+	// ActorNext is the actor of the header blocks addressed to the next node
+	// processing the envelope.
+	ActorNext = "http://schemas.xmlsoap.org/soap/actor/next"
+
+	// DefaultMaxMessageSize is the size limit of the envelopes read when none
+	// is set.
+	DefaultMaxMessageSize = 1 << 20
+)
+
+// ProtocolNamespace is the namespace of the SAML protocol messages.
+const ProtocolNamespace = "urn:oasis:names:tc:SAML:2.0:protocol"
+
+// ProtocolMessage returns the name of the SAML protocol message of the given
+// type, such as AttributeQuery.
+func ProtocolMessage(local string) xml.Name {
+	return xml.Name{Space: ProtocolNamespace, Local: local}
+}
+
+// Fault codes.
+//
+// See https://www.w3.org/TR/2000/NOTE-SOAP-20000508/ section 4.4.1
+const (
+	FaultVersionMismatch = "VersionMismatch"
+	FaultMustUnderstand  = "MustUnderstand"
+	FaultClient          = "Client"
+	FaultServer          = "Server"
+)
+
+// Fault is a SOAP 1.1 fault, the answer to a message that cannot be
+// processed. It is returned as an error by the functions reading envelopes.
+type Fault struct {
+	// Fault code, such as FaultClient, without namespace prefix
+	Code string
+
+	// Human readable explanation of the fault
+	String string
+
+	// Optional URI of the node that caused the fault
+	Actor string
+}
+
+func (f *Fault) Error() string {
+	return "soap fault " + f.Code + ": " + f.String
+}
+
+// Element is an XML element of an envelope, either a header block or the
+// SAML message of the body.
+type Element struct {
+	// Name of the element, such as ProtocolMessage("AttributeQuery")
+	Name xml.Name
+
+	// XML of the element, carrying the namespace declarations it inherits
+	// from the envelope so it stands on its own
+	XML []byte
+}
+
+// Envelope is a SOAP 1.1 envelope that was read.
+type Envelope struct {
+	Headers []Element
+	Body    Element
+}
+
+// Header returns the XML of the header block with the given name, or nil if
+// the envelope has none.
+func (e *Envelope) Header(name xml.Name) []byte {
+	for _, header := range e.Headers {
+		if header.Name == name {
+			return header.XML
+		}
+	}
+	return nil
+}
+
+// Marshal returns the XML of a SOAP envelope whose body holds the given XML
+// message, with the given header blocks if any.
+func Marshal(message []byte, headers ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<soap:Envelope xmlns:soap="` + EnvelopeNamespace + `">`)
+	if len(headers) > 0 {
+		buf.WriteString(`<soap:Header>`)
+		for _, header := range headers {
+			buf.Write(trimDeclaration(header))
+		}
+		buf.WriteString(`</soap:Header>`)
+	}
+	buf.WriteString(`<soap:Body>`)
+	buf.Write(trimDeclaration(message))
+	buf.WriteString(`</soap:Body></soap:Envelope>`)
+	return buf.Bytes()
+}
+
+// MarshalFault returns the XML of a SOAP envelope whose body holds the given
+// fault.
+func MarshalFault(fault *Fault) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<soap:Fault><faultcode>soap:`)
+	xml.EscapeText(&buf, []byte(fault.Code))
+	buf.WriteString(`</faultcode><faultstring>`)
+	xml.EscapeText(&buf, []byte(fault.String))
+	buf.WriteString(`</faultstring>`)
+	if fault.Actor != "" {
+		buf.WriteString(`<faultactor>`)
+		xml.EscapeText(&buf, []byte(fault.Actor))
+		buf.WriteString(`</faultactor>`)
+	}
+	buf.WriteString(`</soap:Fault>`)
+
+	// The fault uses the prefix declared by the envelope.
+	return Marshal(buf.Bytes())
+}
+
+// trimDeclaration removes the XML declaration the message may start with,
+// which may not appear inside an envelope.
+func trimDeclaration(message []byte) []byte {
+	message = bytes.TrimSpace(message)
+	if bytes.HasPrefix(message, []byte("<?xml")) {
+		if end := bytes.Index(message, []byte("?>")); end >= 0 {
+			message = bytes.TrimSpace(message[end+2:])
+		}
+	}
+	return message
+}
+
+// Unmarshal reads a SOAP envelope. If its body holds a fault, the *Fault is
+// returned as the error.
+func Unmarshal(data []byte) (*Envelope, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, errors.Wrap(err, "failed to parse soap envelope")
+	}
+	root := doc.Root()
+	if root == nil || root.Tag != "Envelope" || root.NamespaceURI() != EnvelopeNamespace {
+		return nil, errors.New("missing soap envelope")
+	}
+
+	envelope := &Envelope{}
+	var body *etree.Element
+	for _, child := range root.ChildElements() {
+		if child.NamespaceURI() != EnvelopeNamespace {
+			continue
+		}
+		switch child.Tag {
+		case "Header":
+			for _, block := range child.ChildElements() {
+				header, err := detach(block)
+				if err != nil {
+					return nil, err
+				}
+				envelope.Headers = append(envelope.Headers, header)
+			}
+		case "Body":
+			body = child
+		}
+	}
+	if body == nil {
+		return nil, errors.New("missing soap body")
+	}
+
+	children := body.ChildElements()
+	if len(children) == 0 {
+		return nil, errors.New("empty soap body")
+	}
+	if children[0].Tag == "Fault" && children[0].NamespaceURI() == EnvelopeNamespace {
+		return nil, parseFault(children[0])
+	}
+
+	var err error
+	if envelope.Body, err = detach(children[0]); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// ReadEnvelope reads a SOAP envelope of at most maxSize bytes,
+// DefaultMaxMessageSize if zero, see Unmarshal.
+func ReadEnvelope(r io.Reader, maxSize int64) (*Envelope, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read soap envelope")
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errors.New("soap envelope is too large")
+	}
+	return Unmarshal(data)
+}
+
+// detach returns the given element of an envelope as a standalone element,
+// declaring the namespaces it inherits.
+func detach(e *etree.Element) (Element, error) {
+	element := Element{
+		Name: xml.Name{Space: e.NamespaceURI(), Local: e.Tag},
+	}
+
+	detached := e.Copy()
+	declared := make(map[string]bool)
+	for ancestor := e; ancestor != nil; ancestor = ancestor.Parent() {
+		for _, attr := range ancestor.Attr {
+			prefix, ok := namespaceDeclaration(attr)
+			if !ok || declared[prefix] {
+				continue
+			}
+			declared[prefix] = true
+			if ancestor != e {
+				detached.CreateAttr(attr.FullKey(), attr.Value)
+			}
+		}
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(detached)
+	var err error
+	if element.XML, err = doc.WriteToBytes(); err != nil {
+		return Element{}, errors.Wrap(err, "failed to write xml element")
+	}
+	return element, nil
+}
+
+// namespaceDeclaration returns the prefix declared by the given attribute, ""
+// for the default namespace, if it is a namespace declaration.
+func namespaceDeclaration(attr etree.Attr) (string, bool) {
+	switch {
+	case attr.Space == "xmlns":
+		return attr.Key, true
+	case attr.Space == "" && attr.Key == "xmlns":
+		return "", true
+	}
+	return "", false
+}
+
+func parseFault(e *etree.Element) *Fault {
+	fault := &Fault{}
+	for _, child := range e.ChildElements() {
+		switch child.Tag {
+		case "faultcode":
+			fault.Code = strings.TrimSpace(child.Text())
+			if i := strings.Index(fault.Code, ":"); i >= 0 {
+				fault.Code = fault.Code[i+1:]
+			}
+		case "faultstring":
+			fault.String = child.Text()
+		case "faultactor":
+			fault.Actor = child.Text()
+		}
+	}
+	return fault
+}
+
+// WriteMessage answers a SOAP request with an envelope holding the given
+// message and header blocks.
+func WriteMessage(w http.ResponseWriter, message []byte, headers ...[]byte) {
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(Marshal(message, headers...))
+}
+
+// WriteFault answers a SOAP request with the given fault.
+func WriteFault(w http.ResponseWriter, fault *Fault) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(MarshalFault(fault))
+}
@@ -0,0 +1,130 @@
+package soap
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalUnmarshal(t *testing.T) {
+	data := Marshal(
+		[]byte(`<?xml version="1.0"?>`+"\n"+`<samlp:AttributeQuery xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="query"></samlp:AttributeQuery>`),
+		[]byte(`<ecp:Request xmlns:ecp="urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"></ecp:Request>`),
+	)
+	assert.Equal(t, `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">`+
+		`<soap:Header><ecp:Request xmlns:ecp="urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"></ecp:Request></soap:Header>`+
+		`<soap:Body><samlp:AttributeQuery xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="query"></samlp:AttributeQuery></soap:Body>`+
+		`</soap:Envelope>`, string(data))
+
+	envelope, err := Unmarshal(data)
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolMessage("AttributeQuery"), envelope.Body.Name)
+	ecpRequest := xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp", Local: "Request"}
+	assert.NotNil(t, envelope.Header(ecpRequest))
+	assert.Nil(t, envelope.Header(ProtocolMessage("AttributeQuery")))
+
+	var query struct {
+		XMLName xml.Name
+		ID      string `xml:",attr"`
+	}
+	assert.NoError(t, xml.Unmarshal(envelope.Body.XML, &query))
+	assert.Equal(t, ProtocolMessage("AttributeQuery"), query.XMLName)
+	assert.Equal(t, "query", query.ID)
+}
+
+func TestUnmarshalInheritedNamespaces(t *testing.T) {
+	envelope, err := Unmarshal([]byte(`<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/" xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">` +
+		`<S:Body><samlp:LogoutRequest ID="logout"><saml:NameID>anakin</saml:NameID></samlp:LogoutRequest></S:Body>` +
+		`</S:Envelope>`))
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolMessage("LogoutRequest"), envelope.Body.Name)
+
+	var request struct {
+		XMLName xml.Name
+		NameID  string `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	}
+	assert.NoError(t, xml.Unmarshal(envelope.Body.XML, &request))
+	assert.Equal(t, ProtocolMessage("LogoutRequest"), request.XMLName)
+	assert.Equal(t, "anakin", request.NameID)
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	_, err := Unmarshal([]byte(`<Envelope></Envelope>`))
+	assert.EqualError(t, err, "missing soap envelope")
+
+	_, err = Unmarshal(Marshal(nil))
+	assert.EqualError(t, err, "empty soap body")
+
+	_, err = ReadEnvelope(strings.NewReader(""), 0)
+	assert.Error(t, err)
+
+	data := Marshal([]byte(`<samlp:AttributeQuery xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"></samlp:AttributeQuery>`))
+	_, err = ReadEnvelope(bytes.NewReader(data), int64(len(data)-1))
+	assert.EqualError(t, err, "soap envelope is too large")
+}
+
+func TestFault(t *testing.T) {
+	fault := &Fault{Code: FaultClient, String: "unknown <issuer>", Actor: "https://idp.example.com/"}
+	_, err := Unmarshal(MarshalFault(fault))
+	assert.Equal(t, fault, err)
+	assert.EqualError(t, err, "soap fault Client: unknown <issuer>")
+}
+
+func TestClientHandler(t *testing.T) {
+	handler := &Handler{}
+	handler.HandleFunc(ProtocolMessage("AttributeQuery"), func(r *http.Request, envelope *Envelope) ([]byte, error) {
+		assert.Equal(t, Action, r.Header.Get("SOAPAction"))
+		assert.Equal(t, ContentType, r.Header.Get("Content-Type"))
+		return []byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"></samlp:Response>`), nil
+	})
+	handler.HandleFunc(ProtocolMessage("LogoutRequest"), func(r *http.Request, envelope *Envelope) ([]byte, error) {
+		return nil, errors.Wrap(&Fault{Code: FaultClient, String: "unknown session"}, "failed to log out")
+	})
+	handler.HandleFunc(ProtocolMessage("ArtifactResolve"), func(r *http.Request, envelope *Envelope) ([]byte, error) {
+		return nil, errors.New("database is down")
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var signed []byte
+	client := &Client{
+		Sign: func(message []byte) ([]byte, error) {
+			signed = message
+			return message, nil
+		},
+	}
+	query := []byte(`<samlp:AttributeQuery xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"></samlp:AttributeQuery>`)
+	envelope, err := client.Send(context.Background(), server.URL, query)
+	assert.NoError(t, err)
+	assert.Equal(t, query, signed)
+	if assert.NotNil(t, envelope) {
+		assert.Equal(t, ProtocolMessage("Response"), envelope.Body.Name)
+	}
+
+	_, err = client.Send(context.Background(), server.URL, []byte(`<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"></samlp:LogoutRequest>`))
+	assert.EqualError(t, err, "soap fault Client: unknown session")
+
+	_, err = client.Send(context.Background(), server.URL, []byte(`<samlp:ArtifactResolve xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"></samlp:ArtifactResolve>`))
+	assert.EqualError(t, err, "soap fault Server: internal error")
+
+	_, err = client.Send(context.Background(), server.URL, []byte(`<samlp:ManageNameIDRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"></samlp:ManageNameIDRequest>`))
+	assert.EqualError(t, err, "soap fault Client: unsupported message urn:oasis:names:tc:SAML:2.0:protocol ManageNameIDRequest")
+
+	client.Sign = func(message []byte) ([]byte, error) {
+		return nil, errors.New("no key")
+	}
+	_, err = client.Send(context.Background(), server.URL, query)
+	assert.EqualError(t, err, "failed to sign message: no key")
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
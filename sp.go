@@ -1,15 +1,20 @@
 package saml
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/pem"
 	"encoding/xml"
+	"html/template"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
 	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/pressly/saml/instrument"
 )
 
 // ServiceProvider represents a service provider.
@@ -27,8 +32,23 @@ type ServiceProvider struct {
 	// Supports only HTTP-POST binding
 	ACSBinding string
 
+	// Assertion consumer service endpoints advertised in the SP's metadata.
+	// Use this instead of ACSURL to serve the same SP from several locations,
+	// any of them can be selected per request with AuthnRequestOptions. If
+	// empty, a single HTTP-POST endpoint is derived from ACSURL.
+	AssertionConsumerServices []IndexedEndpoint
+
 	AllowIdpInitiated bool
 
+	// Human readable name of the service, advertised as the ServiceName of the
+	// AttributeConsumingService element. Defaults to the entity ID.
+	ServiceName string
+
+	// Attributes the SP wants the IdP to release. When set, the SP's metadata
+	// includes an AttributeConsumingService listing them and AuthnRequests
+	// reference it through AttributeConsumingServiceIndex.
+	RequestedAttributes []RequestedAttribute
+
 	SecurityOpts
 
 	// File system location of the private key file
@@ -71,6 +91,56 @@ type ServiceProvider struct {
 
 	// Whether to sign the SAML Request sent to the IdP to initiate the SSO workflow
 	IdPSignSAMLRequest bool
+
+	// Template of the page posting AuthnRequests to the IdP with the HTTP-POST
+	// binding, DefaultPostBindingTemplate if nil
+	PostBindingTemplate *template.Template
+
+	// URL of the IdP's attribute service, see QueryAttributes. Defaults to the
+	// SOAP attribute service listed in IdPMetadata.
+	IdPAttributeServiceURL string
+
+	// Client of the requests the SP sends to the IdP directly, such as
+	// AttributeQuery messages, http.DefaultClient if nil
+	HTTPClient *http.Client
+
+	// Receives the audit events of the logins, see EventSink
+	Events EventSink
+
+	// Receives the debug logs of the SAML flows and of the xmlsec1
+	// invocations, slog.Default() if nil
+	Logger *slog.Logger
+
+	// Whether the logs include the subjects, the attributes, the client
+	// addresses and the XML of the messages. It must not be set in
+	// production.
+	LogSensitive bool
+
+	// Receives the metrics and traces of AssertResponse and of the IdP
+	// metadata fetches, and the metrics of the xmlsec1 invocations, nothing
+	// is reported if nil
+	Instrumentation instrument.Instrumentation
+
+	// Returns the current time, the package level Now is used if nil
+	Now func() time.Time
+
+	// Returns unique identifiers for the messages the SP issues, the package
+	// level NewID is used if nil
+	NewID func() string
+}
+
+func (sp *ServiceProvider) now() time.Time {
+	if sp.Now != nil {
+		return sp.Now()
+	}
+	return Now()
+}
+
+func (sp *ServiceProvider) newID() string {
+	if sp.NewID != nil {
+		return sp.NewID()
+	}
+	return NewID()
 }
 
 // PrivkeyFile returns a physical path where the SP's key can be accessed.
@@ -79,7 +149,7 @@ func (sp *ServiceProvider) PrivkeyFile() (string, error) {
 		return sp.KeyFile, nil
 	}
 	if sp.PrivkeyPEM != "" {
-		return writeFile([]byte(sp.PrivkeyPEM))
+		return writeFile(WorkDir, []byte(sp.PrivkeyPEM))
 	}
 	return "", errors.New("missing sp private key")
 }
@@ -91,7 +161,7 @@ func (sp *ServiceProvider) PubkeyFile() (string, error) {
 		return validateKeyFile(sp.CertFile, nil)
 	}
 	if sp.PubkeyPEM != "" {
-		return validateKeyFile(writeFile([]byte(sp.PubkeyPEM)))
+		return validateKeyFile(writeFile(WorkDir, []byte(sp.PubkeyPEM)))
 	}
 	return "", errors.New("missing sp public key")
 }
@@ -110,7 +180,7 @@ func (sp *ServiceProvider) GetIdPCertFile() (string, error) {
 		Bytes: certBytes,
 	})
 
-	return writeFile(certBytes)
+	return writeFile(WorkDir, certBytes)
 }
 
 func (sp *ServiceProvider) ParseIdPMetadata() (*Metadata, error) {
@@ -121,15 +191,9 @@ func (sp *ServiceProvider) ParseIdPMetadata() (*Metadata, error) {
 			return nil, errors.Wrapf(err, "failed to unmarshal metadata: %v", string(sp.IdPMetadataXML))
 		}
 	case sp.IdPMetadataURL != "":
-		res, err := http.Get(sp.IdPMetadataURL)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to get %q", sp.IdPMetadataURL)
-		}
-		defer res.Body.Close()
-
-		buf, err := ioutil.ReadAll(res.Body)
+		buf, err := sp.fetchIdPMetadata()
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to read body from %q", sp.IdPMetadataURL)
+			return nil, err
 		}
 		if err := xml.Unmarshal(buf, &metadata); err != nil {
 			return nil, errors.Wrapf(err, "failed to unmarshal body: %+v", string(buf))
@@ -143,6 +207,32 @@ func (sp *ServiceProvider) ParseIdPMetadata() (*Metadata, error) {
 	return metadata, nil
 }
 
+// fetchIdPMetadata fetches the IdP metadata from IdPMetadataURL.
+func (sp *ServiceProvider) fetchIdPMetadata() (_ []byte, err error) {
+	start := time.Now()
+	_, stage := startStage(context.Background(), sp.instrumentation(), "saml.FetchMetadata",
+		instrument.MetadataFetchDuration, instrument.L(instrument.LabelSource, "idp"))
+	defer func() {
+		stage.end(err)
+		sp.logger().Debug("fetched idp metadata",
+			"url", sp.IdPMetadataURL,
+			"duration", time.Since(start),
+			errorAttr(err))
+	}()
+
+	res, err := http.Get(sp.IdPMetadataURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %q", sp.IdPMetadataURL)
+	}
+	defer res.Body.Close()
+
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read body from %q", sp.IdPMetadataURL)
+	}
+	return buf, nil
+}
+
 // Cert returns a *pem.Block value that corresponds to the SP's certificate.
 func (sp *ServiceProvider) Cert() (*pem.Block, error) {
 	if v := sp.pemCert.Load(); v != nil {
@@ -185,9 +275,9 @@ func (sp *ServiceProvider) Metadata() (*Metadata, error) {
 
 	metadata := &Metadata{
 		EntityID:   sp.MetadataURL,
-		ValidUntil: Now().Add(defaultValidDuration),
+		ValidUntil: sp.now().Add(defaultValidDuration),
 		SPSSODescriptor: &SPSSODescriptor{
-			AuthnRequestsSigned:        false,
+			AuthnRequestsSigned:        sp.IdPSignSAMLRequest,
 			WantAssertionsSigned:       true,
 			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
 			KeyDescriptor: []KeyDescriptor{
@@ -202,34 +292,102 @@ func (sp *ServiceProvider) Metadata() (*Metadata, error) {
 					KeyInfo: KeyInfo{
 						Certificate: certStr,
 					},
-					EncryptionMethods: []EncryptionMethod{
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
-					},
+					EncryptionMethods: supportedEncryptionMethods(),
 				},
 			},
-			AssertionConsumerService: []IndexedEndpoint{{
-				Binding:  HTTPPostBinding,
-				Location: sp.ACSURL,
-				Index:    1,
-			}},
+			AssertionConsumerService: sp.ACSEndpoints(),
 		},
 	}
 
+	if service := sp.attributeConsumingService(); service != nil {
+		metadata.SPSSODescriptor.AttributeConsumingService = []AttributeConsumingService{*service}
+	}
+
 	return metadata, nil
 }
 
+// ACSEndpoints returns the assertion consumer service endpoints of the SP.
+func (sp *ServiceProvider) ACSEndpoints() []IndexedEndpoint {
+	if len(sp.AssertionConsumerServices) > 0 {
+		return sp.AssertionConsumerServices
+	}
+	return []IndexedEndpoint{{
+		Binding:  HTTPPostBinding,
+		Location: sp.ACSURL,
+		Index:    1,
+	}}
+}
+
+// ACSEndpoint returns the assertion consumer service endpoint at the given
+// location, or nil if the location does not belong to the SP.
+func (sp *ServiceProvider) ACSEndpoint(location string) *IndexedEndpoint {
+	endpoints := sp.ACSEndpoints()
+	for i := range endpoints {
+		if endpoints[i].Location == location {
+			return &endpoints[i]
+		}
+	}
+	return nil
+}
+
+// defaultAttributeConsumingServiceIndex is the index of the only
+// AttributeConsumingService advertised by the SP.
+const defaultAttributeConsumingServiceIndex = 1
+
+// attributeConsumingService builds the AttributeConsumingService element
+// from the SP's requested attributes. Returns nil if the SP does not request
+// any attributes.
+func (sp *ServiceProvider) attributeConsumingService() *AttributeConsumingService {
+	if len(sp.RequestedAttributes) == 0 {
+		return nil
+	}
+
+	serviceName := sp.ServiceName
+	if serviceName == "" {
+		serviceName = sp.MetadataURL
+	}
+
+	return &AttributeConsumingService{
+		Index:     defaultAttributeConsumingServiceIndex,
+		IsDefault: true,
+		ServiceName: []LocalizedName{
+			{Lang: "en", Value: serviceName},
+		},
+		RequestedAttribute: sp.RequestedAttributes,
+	}
+}
+
+// AuthnRequestOptions allows to tweak the AuthnRequest created by
+// NewAuthnRequestWithOptions.
+type AuthnRequestOptions struct {
+	// Location of the assertion consumer service the IdP should send the
+	// response to, it must be one of the SP's ACS endpoints.
+	ACSURL string
+
+	// Index of the assertion consumer service the IdP should send the
+	// response to, it must be one of the SP's ACS endpoints. Takes precedence
+	// over ACSURL.
+	ACSIndex *int
+
+	// Nonce of the script of the page posting the AuthnRequest with the
+	// HTTP-POST binding, see PostBindingForm
+	Nonce string
+}
+
 // NewAuthnRequest creates a new AuthnRequest object for the given IdP URL.
 func (sp *ServiceProvider) NewAuthnRequest() (*AuthnRequest, error) {
+	return sp.NewAuthnRequestWithOptions(AuthnRequestOptions{})
+}
+
+// NewAuthnRequestWithOptions creates a new AuthnRequest object for the given
+// IdP URL, asking the IdP to send the response to the selected assertion
+// consumer service. The default ACS endpoint is used if none is selected.
+func (sp *ServiceProvider) NewAuthnRequestWithOptions(opts AuthnRequestOptions) (*AuthnRequest, error) {
 	req := AuthnRequest{
-		AssertionConsumerServiceURL: sp.ACSURL,
-		Destination:                 sp.IdPSSOServiceURL,
-		ID:                          NewID(),
-		IssueInstant:                NewSAMLTime(Now()),
-		Version:                     "2.0",
-		ProtocolBinding:             HTTPPostBinding,
+		Destination:  sp.IdPSSOServiceURL,
+		ID:           sp.newID(),
+		IssueInstant: NewSAMLTime(sp.now()),
+		Version:      "2.0",
 		Issuer: Issuer{
 			Format: NameIDEntityFormat,
 			Value:  sp.MetadataURL,
@@ -240,6 +398,40 @@ func (sp *ServiceProvider) NewAuthnRequest() (*AuthnRequest, error) {
 		},
 	}
 
+	// AssertionConsumerServiceIndex is mutually exclusive with the
+	// AssertionConsumerServiceURL and ProtocolBinding attributes.
+	switch {
+	case opts.ACSIndex != nil:
+		found := false
+		for _, endpoint := range sp.ACSEndpoints() {
+			if endpoint.Index == *opts.ACSIndex {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("unknown acs index %d", *opts.ACSIndex)
+		}
+		index := *opts.ACSIndex
+		req.AssertionConsumerServiceIndex = &index
+	case opts.ACSURL != "":
+		endpoint := sp.ACSEndpoint(opts.ACSURL)
+		if endpoint == nil {
+			return nil, errors.Errorf("unknown acs url %q", opts.ACSURL)
+		}
+		req.AssertionConsumerServiceURL = endpoint.Location
+		req.ProtocolBinding = endpoint.Binding
+	default:
+		endpoint := defaultIndexedEndpoint(sp.ACSEndpoints(), "")
+		req.AssertionConsumerServiceURL = endpoint.Location
+		req.ProtocolBinding = endpoint.Binding
+	}
+
+	if sp.attributeConsumingService() != nil {
+		index := defaultAttributeConsumingServiceIndex
+		req.AttributeConsumingServiceIndex = &index
+	}
+
 	// Spec lists that the xmlns also needs to be namespaced: https://docs.oasis-open.org/security/saml/v2.0/saml-schema-protocol-2.0.xsd
 	// TODO: create custom marshaler
 	req.XMLNamespace = ProtocolNamespace
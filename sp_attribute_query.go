@@ -0,0 +1,103 @@
+package saml
+
+import (
+	"context"
+	"encoding/xml"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/soap"
+)
+
+// QueryAttributes asks the IdP's attribute authority for the attributes of the
+// principal with the given NameID, using the SOAP binding, and returns the
+// assertion it answers with. The query is signed with the SP's key and the
+// assertion is validated like those of AssertResponse. The response must
+// answer the query and be issued by the IdP, IdPEntityID or else the entity
+// ID of IdPMetadata. All the attributes the SP may obtain are requested if
+// attributes is empty. A Response carrying an error status yields a
+// *StatusError.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.3.2.3
+func (sp *ServiceProvider) QueryAttributes(ctx context.Context, nameID *NameID, attributes []Attribute) (*Assertion, error) {
+	location := sp.IdPAttributeServiceURL
+	if location == "" && sp.IdPMetadata != nil {
+		if endpoint := sp.IdPMetadata.AttributeService(SOAPBinding); endpoint != nil {
+			location = endpoint.Location
+		}
+	}
+	if location == "" {
+		return nil, errors.New("missing idp attribute service url")
+	}
+	idpEntityID := sp.IdPEntityID
+	if idpEntityID == "" && sp.IdPMetadata != nil {
+		idpEntityID = sp.IdPMetadata.EntityID
+	}
+	if idpEntityID == "" {
+		return nil, errors.New("missing idp entity id")
+	}
+
+	query := &AttributeQuery{
+		ID:           sp.newID(),
+		Version:      "2.0",
+		IssueInstant: sp.now(),
+		Destination:  location,
+		Issuer: &Issuer{
+			Format: NameIDEntityFormat,
+			Value:  sp.MetadataURL,
+		},
+		Subject: &Subject{
+			NameID: nameID,
+		},
+		Attributes: attributes,
+	}
+	buf, err := xml.Marshal(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal attribute query")
+	}
+
+	client := &soap.Client{
+		HTTPClient: sp.HTTPClient,
+		Sign:       sp.signRequest,
+	}
+	start := time.Now()
+	envelope, err := client.Send(ctx, location, buf)
+	sp.logger().DebugContext(ctx, "sent attribute query",
+		"query_id", query.ID,
+		"location", location,
+		"duration", time.Since(start),
+		errorAttr(err))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send attribute query")
+	}
+	buf = envelope.Body.XML
+	var res *Response
+	if err := xml.Unmarshal(buf, &res); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal attribute query response")
+	}
+
+	if res.InResponseTo != query.ID {
+		return nil, errors.Errorf("response answers %q instead of %q", res.InResponseTo, query.ID)
+	}
+	if res.Issuer == nil || res.Issuer.Value != idpEntityID {
+		return nil, errors.New("response issued by another entity")
+	}
+	if res.Status == nil {
+		return nil, errors.New("missing response status")
+	}
+	if res.Status.StatusCode.Value != StatusSuccess {
+		return nil, statusError(res.Status)
+	}
+
+	assertion, err := sp.verifiedAssertion(res, buf)
+	if err != nil {
+		return nil, err
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value != nameID.Value {
+		return nil, errors.New("assertion is about another subject")
+	}
+	if err := checkAssertionConditions(assertion, sp.now()); err != nil {
+		return nil, err
+	}
+	return assertion, nil
+}
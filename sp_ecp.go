@@ -0,0 +1,135 @@
+package saml
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/soap"
+)
+
+// IsECPRequest reports whether the given request comes from an ECP, which
+// advertises PAOS support in its Accept and PAOS headers. Such a client should
+// be answered with ECPAuthnRequest instead of being redirected to the IdP.
+func IsECPRequest(r *http.Request) bool {
+	accept := strings.Join(r.Header["Accept"], ",")
+	paos := strings.Join(r.Header["Paos"], ",")
+	return strings.Contains(accept, PAOSContentType) && strings.Contains(paos, ECPNamespace)
+}
+
+// ECPAuthnRequest returns the SOAP envelope answering the request of an ECP,
+// see IsECPRequest: an AuthnRequest wrapped with the header blocks of the PAOS
+// binding, to be sent with the PAOSContentType content type. The ECP relays
+// the AuthnRequest to the IdP and posts the Response to the first PAOS
+// assertion consumer service of the SP, along with the given RelayState.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 4.2.4.2
+func (sp *ServiceProvider) ECPAuthnRequest(relayState string) ([]byte, error) {
+	endpoint := sp.ecpACSEndpoint()
+	if endpoint == nil {
+		return nil, errors.New("missing PAOS assertion consumer service")
+	}
+
+	authnRequest, err := sp.NewAuthnRequest()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create auth request")
+	}
+	authnRequest.AssertionConsumerServiceIndex = nil
+	authnRequest.AssertionConsumerServiceURL = endpoint.Location
+	authnRequest.ProtocolBinding = PAOSBinding
+	// The ECP picks the IdP, whose ECP endpoint is not IdPSSOServiceURL.
+	authnRequest.Destination = ""
+	sp.logger().Debug("created authn request",
+		"request_id", authnRequest.ID,
+		"binding", PAOSBinding)
+
+	buf, err := xml.Marshal(authnRequest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal auth request")
+	}
+	if sp.IdPSignSAMLRequest {
+		if buf, err = sp.signRequest(buf); err != nil {
+			return nil, errors.Wrap(err, "failed to sign authn request")
+		}
+	}
+
+	headers := []interface{}{
+		&PAOSRequest{
+			MustUnderstand:      "1",
+			Actor:               soap.ActorNext,
+			ResponseConsumerURL: endpoint.Location,
+			Service:             ECPNamespace,
+		},
+		&ECPRequest{
+			MustUnderstand: "1",
+			Actor:          soap.ActorNext,
+			ProviderName:   sp.ServiceName,
+			Issuer:         &authnRequest.Issuer,
+		},
+	}
+	if relayState != "" {
+		headers = append(headers, &ECPRelayState{
+			MustUnderstand: "1",
+			Actor:          soap.ActorNext,
+			Value:          relayState,
+		})
+	}
+	headerBufs := make([][]byte, len(headers))
+	for i, header := range headers {
+		if headerBufs[i], err = xml.Marshal(header); err != nil {
+			return nil, errors.Wrap(err, "failed to marshal header block")
+		}
+	}
+
+	return soap.Marshal(buf, headerBufs...), nil
+}
+
+// ecpACSEndpoint returns the PAOS assertion consumer service of the SP, or
+// nil if it has none.
+func (sp *ServiceProvider) ecpACSEndpoint() *IndexedEndpoint {
+	endpoints := sp.ACSEndpoints()
+	for i := range endpoints {
+		if endpoints[i].Binding == PAOSBinding {
+			return &endpoints[i]
+		}
+	}
+	return nil
+}
+
+// AssertECPResponse reads the Response an ECP posts to the PAOS assertion
+// consumer service of the SP, validates it like AssertResponseAt that
+// endpoint and returns its assertion along with the RelayState sent by
+// ECPAuthnRequest. An ECP that did not deliver the Response posts a SOAP
+// fault instead, returned as a *soap.Fault error.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf section 4.2.4.5
+func (sp *ServiceProvider) AssertECPResponse(r *http.Request) (*Assertion, string, error) {
+	if r.Method != http.MethodPost {
+		return nil, "", errors.Errorf("unsupported method %s", r.Method)
+	}
+	envelope, err := soap.ReadEnvelope(r.Body, maxRequestSize)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to read ecp response")
+	}
+	if envelope.Body.Name != soap.ProtocolMessage("Response") {
+		return nil, "", errors.Errorf("unexpected message %s", envelope.Body.Name.Local)
+	}
+
+	var relayState ECPRelayState
+	if header := envelope.Header(ecpRelayStateName); header != nil {
+		if err := xml.Unmarshal(header, &relayState); err != nil {
+			return nil, "", errors.Wrap(err, "failed to unmarshal relay state")
+		}
+	}
+
+	endpoint := sp.ecpACSEndpoint()
+	if endpoint == nil {
+		return nil, "", errors.New("missing PAOS assertion consumer service")
+	}
+	assertion, err := sp.assertResponse(r.Context(), remoteAddr(r), endpoint.Location, envelope.Body.XML)
+	if err != nil {
+		return nil, "", err
+	}
+	return assertion, relayState.Value, nil
+}
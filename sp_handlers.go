@@ -1,17 +1,17 @@
 package saml
 
 import (
-	"bytes"
-	"compress/flate"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/xml"
-	"fmt"
-	"net/url"
+	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/beevik/etree"
 	"github.com/pkg/errors"
+	"github.com/pressly/saml/instrument"
 	"github.com/pressly/saml/xmlsec"
 	dsig "github.com/russellhaering/goxmldsig"
 )
@@ -19,10 +19,20 @@ import (
 // SAMLRequest creates a new AuthnRequest object to be sent to the IdP
 // Depending on the selected binding a HTTP-POST form, or a HTTP-Redirect URL are returned
 func (sp *ServiceProvider) SAMLRequest(relayState string) (string, error) {
-	authnRequest, err := sp.NewAuthnRequest()
+	return sp.SAMLRequestWithOptions(relayState, AuthnRequestOptions{})
+}
+
+// SAMLRequestWithOptions works like SAMLRequest but allows to select the
+// assertion consumer service the IdP should send the response to.
+func (sp *ServiceProvider) SAMLRequestWithOptions(relayState string, opts AuthnRequestOptions) (string, error) {
+	authnRequest, err := sp.NewAuthnRequestWithOptions(opts)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to create auth request")
 	}
+	sp.logger().Debug("created authn request",
+		"request_id", authnRequest.ID,
+		"destination", authnRequest.Destination,
+		"binding", sp.IdPSSOServiceBinding)
 
 	buf, err := xml.Marshal(authnRequest)
 	if err != nil {
@@ -34,7 +44,7 @@ func (sp *ServiceProvider) SAMLRequest(relayState string) (string, error) {
 		return sp.SAMLRequestURL(buf, relayState)
 
 	case HTTPPostBinding:
-		return sp.SAMLRequestForm(buf, relayState)
+		return sp.samlRequestForm(buf, relayState, opts.Nonce)
 
 	default:
 		// default to HTTP-Redirect?
@@ -48,110 +58,125 @@ func (sp *ServiceProvider) SAMLRequest(relayState string) (string, error) {
 // the value is base64 encoded and deflate-compressed <AuthnRequest>
 // XML element. The final redirect destination that will be invoked
 // on successful login is passed using ?RelayState query parameter.
-//
-// TODO(diogo): HTTP-Redirect signed requests
+// When IdPSignSAMLRequest is set the query is signed, as described by the
+// HTTP-Redirect binding, using the SigAlg and Signature parameters.
 func (sp *ServiceProvider) SAMLRequestURL(authnRequest []byte, relayState string) (string, error) {
-	// Compress authnRequest
-	flateBuf := bytes.NewBuffer(nil)
-	flateWriter, err := flate.NewWriter(flateBuf, flate.DefaultCompression)
+	query, err := encodeRedirectQuery("SAMLRequest", authnRequest, relayState)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create flate writer")
-	}
-	if _, err = flateWriter.Write(authnRequest); err != nil {
-		return "", errors.Wrap(err, "failed to write to flate writer")
+		return "", err
 	}
-	flateWriter.Close()
-	authnReqCompressedBytes := flateBuf.Bytes()
-
-	// Base64 encode authnRequest
-	authnReqBase64Encoded := base64.StdEncoding.EncodeToString(authnReqCompressedBytes)
-
-	// Escape authnRequest
-	authnReqEscaped := url.QueryEscape(authnReqBase64Encoded)
-
-	// Escape relay state
-	relayStateEscaped := url.QueryEscape(relayState)
 
-	return fmt.Sprintf(`%s?RelayState=%s&SAMLRequest=%s`, sp.IdPSSOServiceURL, relayStateEscaped, authnReqEscaped), nil
-}
-
-// SAMLRequestForm creates a HTML form with an embedded SAML Request
-func (sp *ServiceProvider) SAMLRequestForm(authnRequest []byte, relayState string) (string, error) {
 	if sp.IdPSignSAMLRequest {
-		pubkeyFile, err := sp.PubkeyFile()
-		if err != nil {
-			return "", errors.Wrap(err, "failed to read service provider public key")
-		}
 		privkeyFile, err := sp.PrivkeyFile()
 		if err != nil {
 			return "", errors.Wrap(err, "failed to read service provider private key")
 		}
-
-		cert, err := tls.LoadX509KeyPair(pubkeyFile, privkeyFile)
+		query, err = signRedirectQuery(query, "SAMLRequest", privkeyFile)
 		if err != nil {
-			return "", errors.Wrap(err, "failed to load service provider key pair")
+			return "", errors.Wrap(err, "failed to sign authn request")
 		}
+	}
 
-		signingContext := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(cert))
-		// CA API Gateway IdP requires the exclusive canonicalization algorithm
-		//
-		// From the spec: http: //docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
-		// 5.4.3 Canonicalization Method
-		// SAML implementations SHOULD use Exclusive Canonicalization [Excl-C14N], with or without comments,
-		// both in the <ds:CanonicalizationMethod> element of <ds:SignedInfo>, and as a
-		// <ds:Transform> algorithm. Use of Exclusive Canonicalization ensures that signatures created over
-		// SAML messages embedded in an XML context can be verified independent of that context.
-		signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
-		signingContext.SetSignatureMethod(CryptoSHA256)
-
-		// Build an etree document from the AuthnRequest XML
-		doc := etree.NewDocument()
-		err = doc.ReadFromBytes(authnRequest)
-		if err != nil {
-			return "", errors.Wrap(err, "failed to deserialize authn request into xml document")
-		}
+	separator := "?"
+	if strings.Contains(sp.IdPSSOServiceURL, "?") {
+		separator = "&"
+	}
+	return sp.IdPSSOServiceURL + separator + query, nil
+}
 
-		if len(doc.Child) < 1 {
-			return "", errors.Errorf("expecting at least one child element for authn request")
-		}
+// SAMLRequestForm creates a HTML form with an embedded SAML Request, see
+// PostBindingForm. The page is built from the SP's PostBindingTemplate.
+func (sp *ServiceProvider) SAMLRequestForm(authnRequest []byte, relayState string) (string, error) {
+	return sp.samlRequestForm(authnRequest, relayState, "")
+}
 
-		// Signature requires an element, not document
-		element := doc.Child[0].(*etree.Element)
-		sig, err := signingContext.ConstructSignature(element, true)
-		if err != nil {
-			return "", errors.Wrap(err, "failed to build authn request signature")
+// samlRequestForm works like SAMLRequestForm, the script of the page has the
+// given nonce.
+func (sp *ServiceProvider) samlRequestForm(authnRequest []byte, relayState string, nonce string) (string, error) {
+	if sp.IdPSignSAMLRequest {
+		var err error
+		if authnRequest, err = sp.signRequest(authnRequest); err != nil {
+			return "", errors.Wrap(err, "failed to sign authn request")
 		}
+	}
 
-		// Build a new element with the signature included
-		elementWithSig := element.Copy()
-		// Following the flow defined in the gosaml2 lib: https://github.com/russellhaering/gosaml2/blob/master/build_request.go#L17
-		var children []etree.Token
-		children = append(children, elementWithSig.Child[0])     // issuer is always first
-		children = append(children, sig)                         // next is the signature
-		children = append(children, elementWithSig.Child[1:]...) // then all other children
-		elementWithSig.Child = children
-
-		// Convert the signed element to a document before marhsalling
-		doc = etree.NewDocument()
-		doc.SetRoot(elementWithSig)
-		if authnRequest, err = doc.WriteToBytes(); err != nil {
-			return "", errors.Wrap(err, "failed to write xml document to string")
-		}
+	form := PostBindingForm{
+		Action:      sp.IdPSSOServiceURL,
+		RelayState:  relayState,
+		SAMLRequest: base64.StdEncoding.EncodeToString(authnRequest),
+		Nonce:       nonce,
+	}
+	payload, err := form.Render(sp.PostBindingTemplate)
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// signRequest signs the XML of a request sent to the IdP with the SP's key.
+// The signature is inserted after the Issuer, the first child of the request.
+func (sp *ServiceProvider) signRequest(request []byte) ([]byte, error) {
+	pubkeyFile, err := sp.PubkeyFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read service provider public key")
+	}
+	privkeyFile, err := sp.PrivkeyFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read service provider private key")
 	}
 
-	payload := fmt.Sprintf(`
-<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en">
-<body onload="document.forms[0].submit()">
-	<form action="%s" method="post">
-		<div>
-			<input type="hidden" name="RelayState" value="%s" />
-			<input type="hidden" name="SAMLRequest" value="%s" />
-		</div>
-  </form>
-</body>
-</html>`, sp.IdPSSOServiceURL, relayState, base64.StdEncoding.EncodeToString(authnRequest))
+	cert, err := tls.LoadX509KeyPair(pubkeyFile, privkeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load service provider key pair")
+	}
 
-	return payload, nil
+	signingContext := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(cert))
+	// CA API Gateway IdP requires the exclusive canonicalization algorithm
+	//
+	// From the spec: http: //docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+	// 5.4.3 Canonicalization Method
+	// SAML implementations SHOULD use Exclusive Canonicalization [Excl-C14N], with or without comments,
+	// both in the <ds:CanonicalizationMethod> element of <ds:SignedInfo>, and as a
+	// <ds:Transform> algorithm. Use of Exclusive Canonicalization ensures that signatures created over
+	// SAML messages embedded in an XML context can be verified independent of that context.
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	signingContext.SetSignatureMethod(CryptoSHA256)
+
+	// Build an etree document from the request XML
+	doc := etree.NewDocument()
+	err = doc.ReadFromBytes(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to deserialize request into xml document")
+	}
+
+	if len(doc.Child) < 1 {
+		return nil, errors.Errorf("expecting at least one child element for request")
+	}
+
+	// Signature requires an element, not document
+	element := doc.Child[0].(*etree.Element)
+	sig, err := signingContext.ConstructSignature(element, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build request signature")
+	}
+
+	// Build a new element with the signature included
+	elementWithSig := element.Copy()
+	// Following the flow defined in the gosaml2 lib: https://github.com/russellhaering/gosaml2/blob/master/build_request.go#L17
+	var children []etree.Token
+	children = append(children, elementWithSig.Child[0])     // issuer is always first
+	children = append(children, sig)                         // next is the signature
+	children = append(children, elementWithSig.Child[1:]...) // then all other children
+	elementWithSig.Child = children
+
+	// Convert the signed element to a document before marhsalling
+	doc = etree.NewDocument()
+	doc.SetRoot(elementWithSig)
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write xml document to string")
+	}
+	return buf, nil
 }
 
 // MetadataXML returns SAML 2.0 Service Provider metadata XML.
@@ -177,14 +202,23 @@ func (sp *ServiceProvider) possibleResponseIDs() []string {
 	return responseIDs
 }
 
+func (sp *ServiceProvider) acsLocations() []string {
+	locations := []string{}
+	for _, endpoint := range sp.ACSEndpoints() {
+		locations = append(locations, endpoint.Location)
+	}
+	return locations
+}
+
 func (sp *ServiceProvider) verifySignature(plaintextMessage []byte) error {
 	idpCertFile, err := sp.GetIdPCertFile()
 	if err != nil {
 		return errors.Wrap(err, "failed to get idp cert file")
 	}
 
-	if err := xmlsec.Verify(plaintextMessage, idpCertFile, &xmlsec.ValidationOptions{
-		DTDFile: sp.DTDFile,
+	if err := sp.xmlsecCommand().Verify(plaintextMessage, idpCertFile, &xmlsec.ValidationOptions{
+		DTDFile:          sp.DTDFile,
+		EnableIDAttrHack: true,
 	}); err != nil {
 		if !IsSecurityException(err, &sp.SecurityOpts) {
 			// ...but it was not a security exception, so we ignore it and accept
@@ -196,31 +230,115 @@ func (sp *ServiceProvider) verifySignature(plaintextMessage []byte) error {
 	return nil
 }
 
-// AssertResponse parses and validates a SAML response and its assertion
+// AssertResponse parses and validates a SAML response and its assertion.
+// The Destination of the response and the Recipient of the assertion must
+// name the same assertion consumer service of the SP. SPs with several
+// assertion consumer services should use AssertResponseAt, which also checks
+// it is the one the response was received on.
 func (sp *ServiceProvider) AssertResponse(base64Res string) (*Assertion, error) {
+	return sp.AssertResponseAt("", base64Res)
+}
+
+// AssertResponseAt works like AssertResponse for a response received on the
+// assertion consumer service at acsURL. The Destination of the response and
+// the Recipient of the assertion must both be acsURL, so a response issued
+// for another endpoint of the SP cannot be replayed at this one.
+func (sp *ServiceProvider) AssertResponseAt(acsURL string, base64Res string) (*Assertion, error) {
 	// Parse SAML response from base64 encoded payload
 	//
 	samlResponseXML, err := base64.StdEncoding.DecodeString(base64Res)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to base64-decode SAML response")
+		err = errors.Wrapf(err, "failed to base64-decode SAML response")
+		sp.emitLogin(context.Background(), "", nil, nil, err)
+		return nil, err
 	}
-	var res *Response
-	if err := xml.Unmarshal(samlResponseXML, &res); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal XML document: %s", string(samlResponseXML))
+	return sp.assertResponse(context.Background(), "", acsURL, samlResponseXML)
+}
+
+// assertResponse parses and validates the XML of a SAML response received on
+// the assertion consumer service at acsURL, if known, and its assertion, see
+// AssertResponseAt, and reports the outcome to the SP's EventSink. clientIP
+// is the address of the user's client, if known.
+func (sp *ServiceProvider) assertResponse(ctx context.Context, clientIP string, acsURL string, samlResponseXML []byte) (*Assertion, error) {
+	start := time.Now()
+	res, assertion, err := sp.validateResponse(ctx, acsURL, samlResponseXML)
+	sp.emitLogin(ctx, clientIP, res, assertion, err)
+	sp.logResponse(ctx, time.Since(start), samlResponseXML, res, assertion, err)
+	if err != nil {
+		return nil, err
 	}
+	return assertion, nil
+}
 
-	// Validate response
-	//
-	// Validate destination
-	// Note: OneLogin triggers this error when the Recipient field
-	// is left blank (or when not set to the correct ACS endpoint)
-	// in the OneLogin SAML configuration page. OneLogin returns
-	// Destination="{recipient}" in the SAML reponse in this case.
-	if res.Destination != sp.ACSURL {
-		return nil, errors.Errorf("Wrong ACS destination, expected %q, got %q", sp.ACSURL, res.Destination)
+// emitLogin reports the validation of the given response, and of its
+// assertion, as an EventSPLogin event. Without clientIP, the address the IdP
+// saw the user's client at is used.
+func (sp *ServiceProvider) emitLogin(ctx context.Context, clientIP string, res *Response, assertion *Assertion, err error) {
+	if sp.Events == nil {
+		return
 	}
-	if res.Status.StatusCode.Value != "urn:oasis:names:tc:SAML:2.0:status:Success" {
-		return nil, errors.Errorf("Unexpected status code: %v", res.Status.StatusCode.Value)
+	event := &Event{
+		Type:     EventSPLogin,
+		Audience: sp.MetadataURL,
+		ClientIP: clientIP,
+	}
+	if res != nil {
+		if res.Issuer != nil {
+			event.Issuer = res.Issuer.Value
+		}
+		event.RequestID = res.InResponseTo
+	}
+	event.setAssertion(assertion)
+	if event.ClientIP == "" && assertion != nil && assertion.Subject != nil && assertion.Subject.SubjectConfirmation != nil {
+		event.ClientIP = assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Address
+	}
+	event.setError(err)
+	sp.emit(ctx, event)
+}
+
+// logResponse logs the validation of the given response, and of its
+// assertion, which took the given duration.
+func (sp *ServiceProvider) logResponse(ctx context.Context, duration time.Duration, samlResponseXML []byte, res *Response, assertion *Assertion, err error) {
+	logger := sp.logger()
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.Duration("duration", duration),
+		sp.sensitive("response", samlResponseXML),
+	}
+	if res != nil {
+		attrs = append(attrs, slog.String("response_id", res.ID), slog.String("in_response_to", res.InResponseTo))
+		if res.Issuer != nil {
+			attrs = append(attrs, slog.String("issuer", res.Issuer.Value))
+		}
+	}
+	if assertion != nil {
+		attrs = append(attrs, slog.String("assertion_id", assertion.ID))
+		if assertion.Subject != nil {
+			attrs = append(attrs, sp.sensitive("name_id", nameIDValue(assertion.Subject.NameID)))
+		}
+	}
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelDebug, "saml response rejected", append(attrs, errorAttr(err))...)
+		return
+	}
+	logger.LogAttrs(ctx, slog.LevelDebug, "saml response accepted", attrs...)
+}
+
+// validateResponse parses and validates the XML of a SAML response received
+// on the assertion consumer service at acsURL, if known, and its assertion.
+// The response, and the assertion once its signature is checked,
+// are returned along with the error that rejects them, if any. Each stage,
+// parse, verify and validate, is reported to the SP's Instrumentation.
+func (sp *ServiceProvider) validateResponse(ctx context.Context, acsURL string, samlResponseXML []byte) (*Response, *Assertion, error) {
+	ctx, span := sp.instrumentation().StartSpan(ctx, "saml.AssertResponse")
+
+	_, parse := sp.startStage(ctx, "parse")
+	res, err := sp.parseResponse(samlResponseXML, acsURL)
+	parse.end(err)
+	if err != nil {
+		return res, nil, sp.rejectResponse(span, "parse", err)
 	}
 
 	// Validates if the assertion matches the ID set in the original SAML AuthnRequest
@@ -243,8 +361,130 @@ func (sp *ServiceProvider) AssertResponse(base64Res string) (*Assertion, error)
 	// 	return nil, errors.New("Unexpected assertion InResponseTo value")
 	// }
 
+	_, verify := sp.startStage(ctx, "verify")
+	assertion, err := sp.verifiedAssertion(res, samlResponseXML)
+	verify.end(err)
+	if err != nil {
+		return res, nil, sp.rejectResponse(span, "verify", err)
+	}
+
+	_, validate := sp.startStage(ctx, "validate")
+	err = sp.validateAssertion(assertion, res.Destination)
+	validate.end(err)
+	if err != nil {
+		return res, assertion, sp.rejectResponse(span, "validate", err)
+	}
+
+	sp.instrumentation().Count(instrument.AssertResponseTotal, 1, instrument.L(instrument.LabelResult, instrument.ResultSuccess))
+	span.End(nil)
+	return res, assertion, nil
+}
+
+// startStage starts measuring the given stage of AssertResponse.
+func (sp *ServiceProvider) startStage(ctx context.Context, name string) (context.Context, *stage) {
+	return startStage(ctx, sp.instrumentation(), "saml.AssertResponse/"+name,
+		instrument.AssertResponseDuration, instrument.L(instrument.LabelStage, name))
+}
+
+// rejectResponse reports a response rejected at the given stage of
+// AssertResponse, ends the span of AssertResponse and returns err.
+func (sp *ServiceProvider) rejectResponse(span instrument.Span, stage string, err error) error {
+	sp.instrumentation().Count(instrument.AssertResponseTotal, 1, instrument.L(instrument.LabelResult, stage))
+	span.End(err)
+	return err
+}
+
+// parseResponse unmarshals the XML of a SAML response, and checks its
+// destination and status. The destination must be acsURL if set, and any
+// assertion consumer service of the SP otherwise.
+func (sp *ServiceProvider) parseResponse(samlResponseXML []byte, acsURL string) (*Response, error) {
+	var res *Response
+	if err := xml.Unmarshal(samlResponseXML, &res); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal XML document")
+	}
+
+	// Validate response
+	//
+	// Validate destination
+	// Note: OneLogin triggers this error when the Recipient field
+	// is left blank (or when not set to the correct ACS endpoint)
+	// in the OneLogin SAML configuration page. OneLogin returns
+	// Destination="{recipient}" in the SAML reponse in this case.
+	if acsURL != "" {
+		if sp.ACSEndpoint(acsURL) == nil {
+			return res, errors.Errorf("Unknown ACS %q, expected one of %q", acsURL, sp.acsLocations())
+		}
+		if res.Destination != acsURL {
+			return res, errors.Errorf("Wrong ACS destination, expected %q, got %q", acsURL, res.Destination)
+		}
+	}
+	if sp.ACSEndpoint(res.Destination) == nil {
+		return res, errors.Errorf("Wrong ACS destination, expected one of %q, got %q", sp.acsLocations(), res.Destination)
+	}
+	if res.Status == nil {
+		return res, errors.New("missing response status")
+	}
+	if res.Status.StatusCode.Value != "urn:oasis:names:tc:SAML:2.0:status:Success" {
+		return res, errors.Errorf("Unexpected status code: %v", res.Status.StatusCode.Value)
+	}
+	return res, nil
+}
+
+// validateAssertion checks the recipient, the conditions and the expiry of a
+// verified assertion. The recipient must be the assertion consumer service at
+// acsURL, the destination of the response.
+func (sp *ServiceProvider) validateAssertion(assertion *Assertion, acsURL string) error {
+	// Validate recipient
+	var err error
+	switch {
+	case assertion.Subject == nil:
+		err = errors.New(`missing Assertion > Subject`)
+	case assertion.Subject.SubjectConfirmation == nil:
+		err = errors.New(`missing Assertion > Subject > SubjectConfirmation`)
+	case sp.ACSEndpoint(assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient) == nil:
+		err = errors.Errorf("failed to validate assertion recipient: expected one of %q but got %q", sp.acsLocations(), assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient)
+	case assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient != acsURL:
+		err = errors.Errorf("failed to validate assertion recipient: expected %q but got %q", acsURL, assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "invalid assertion recipient")
+	}
+
+	if err := checkAssertionConditions(assertion, sp.now()); err != nil {
+		return err
+	}
+
+	// A time instant at which the subject can no longer be confirmed. The time
+	// value is encoded in UTC, as described in Section 1.3.3.
+	//
+	// Note that the time period specified by the optional NotBefore and
+	// NotOnOrAfter attributes, if present, SHOULD fall within the overall
+	// assertion validity period as specified by the element's NotBefore and
+	// NotOnOrAfter attributes. If both attributes are present, the value for
+	// NotBefore MUST be less than (earlier than) the value for NotOnOrAfter.
+	now := sp.now()
+	if validUntil := assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter; validUntil.Before(now.Add(-ClockDriftTolerance)) {
+		err := errors.Errorf("Assertion conditions already expired, got %v current time is %v", validUntil, now)
+		return errors.Wrap(err, "Assertion conditions already expired")
+	}
+
+	// TODO: reenable?
+	// if assertion.Conditions != nil && assertion.Conditions.AudienceRestriction != nil {
+	//   if assertion.Conditions.AudienceRestriction.Audience.Value != sp.MetadataURL {
+	//     returnt.Errorf("Audience restriction mismatch, got %q, expected %q", assertion.Conditions.AudienceRestriction.Audience.Value, sp.MetadataURL), errors.New("Audience restriction mismatch")
+	//   }
+	// }
+
+	return nil
+}
+
+// verifiedAssertion returns the assertion of the given response, decrypted if
+// need be, after checking the response or the assertion is signed by the IdP
+// and the assertion is issued by the IdP. responseXML is the XML of the
+// response, as received.
+func (sp *ServiceProvider) verifiedAssertion(res *Response, responseXML []byte) (*Assertion, error) {
 	// Save XML raw bytes so later we can reuse it to verify the signature
-	plainText := samlResponseXML
+	plainText := responseXML
 
 	// All SAML Responses are required to have a signature
 	validSignature := false
@@ -257,7 +497,7 @@ func (sp *ServiceProvider) AssertResponse(base64Res string) (*Assertion, error)
 			return nil, errors.Wrap(err, "failed to validate response signature reference")
 		}
 		if err := sp.verifySignature(plainText); err != nil {
-			return nil, errors.Wrapf(err, "failed to verify message signature: %v", string(plainText))
+			return nil, errors.Wrap(err, "failed to verify message signature")
 		}
 		validSignature = true
 	}
@@ -271,7 +511,11 @@ func (sp *ServiceProvider) AssertResponse(base64Res string) (*Assertion, error)
 			return nil, errors.Wrapf(err, "failed to get private key file")
 		}
 
-		plainTextAssertion, err := xmlsec.Decrypt(res.EncryptedAssertion.EncryptedData, keyFile)
+		if err := checkEncryptionMethods(res.EncryptedAssertion.EncryptedData); err != nil {
+			return nil, errors.Wrap(err, "failed to decrypt assertion")
+		}
+
+		plainTextAssertion, err := sp.xmlsecCommand().Decrypt(res.EncryptedAssertion.EncryptedData, keyFile)
 		if err != nil {
 			if IsSecurityException(err, &sp.SecurityOpts) {
 				return nil, errors.Wrap(err, "failed to decrypt assertion")
@@ -280,7 +524,7 @@ func (sp *ServiceProvider) AssertResponse(base64Res string) (*Assertion, error)
 
 		assertion = &Assertion{}
 		if err := xml.Unmarshal(plainTextAssertion, assertion); err != nil {
-			return nil, errors.Wrapf(err, "failed to unmarshal encrypted assertion: %v", plainTextAssertion)
+			return nil, errors.Wrap(err, "failed to unmarshal encrypted assertion")
 		}
 
 		// Track plain text so later we can verify the signature with xmlsec
@@ -300,7 +544,7 @@ func (sp *ServiceProvider) AssertResponse(base64Res string) (*Assertion, error)
 			return nil, errors.Wrap(err, "failed to validate assertion signature reference")
 		}
 		if err := sp.verifySignature(plainText); err != nil {
-			return nil, errors.Wrapf(err, "failed to verify message signature: %v", string(plainText))
+			return nil, errors.Wrap(err, "failed to verify message signature")
 		}
 		validSignature = true
 	}
@@ -322,22 +566,14 @@ func (sp *ServiceProvider) AssertResponse(base64Res string) (*Assertion, error)
 		return nil, errors.Errorf("failed to validate assertion issuer: expected %q but got %q", sp.IdPEntityID, assertion.Issuer.Value)
 	}
 
-	// Validate recipient
-	switch {
-	case assertion.Subject == nil:
-		err = errors.New(`missing Assertion > Subject`)
-	case assertion.Subject.SubjectConfirmation == nil:
-		err = errors.New(`missing Assertion > Subject > SubjectConfirmation`)
-	case assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient != sp.ACSURL:
-		err = errors.Errorf("failed to validate assertion recipient: expected %q but got %q", sp.ACSURL, assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient)
-	}
-	if err != nil {
-		return nil, errors.Wrapf(err, "invalid assertion recipient")
-	}
+	return assertion, nil
+}
 
+// checkAssertionConditions checks the assertion is valid at the given time.
+func checkAssertionConditions(assertion *Assertion, now time.Time) error {
 	// Make sure we have Conditions
 	if assertion.Conditions == nil {
-		return nil, errors.New(`missing Assertion > Conditions`)
+		return errors.New(`missing Assertion > Conditions`)
 	}
 
 	// The NotBefore and NotOnOrAfter attributes specify time limits on the
@@ -348,37 +584,15 @@ func (sp *ServiceProvider) AssertResponse(base64Res string) (*Assertion, error)
 	// begins. The NotOnOrAfter attribute specifies the time instant at which
 	// the validity interval has ended. If the value for either NotBefore or
 	// NotOnOrAfter is omitted, then it is considered unspecified.
-	now := Now()
 	validFrom := assertion.Conditions.NotBefore
 	if !validFrom.IsZero() && validFrom.After(now.Add(ClockDriftTolerance)) {
-		return nil, errors.Errorf("Assertion conditions are not valid yet, got %v, current time is %v", validFrom, now)
+		return errors.Errorf("Assertion conditions are not valid yet, got %v, current time is %v", validFrom, now)
 	}
 	validUntil := assertion.Conditions.NotOnOrAfter
 	if !validUntil.IsZero() && validUntil.Before(now.Add(-ClockDriftTolerance)) {
-		return nil, errors.Errorf("Assertion conditions already expired, got %v current time is %v, extra time is %v", validUntil, now, now.Add(-ClockDriftTolerance))
+		return errors.Errorf("Assertion conditions already expired, got %v current time is %v, extra time is %v", validUntil, now, now.Add(-ClockDriftTolerance))
 	}
-
-	// A time instant at which the subject can no longer be confirmed. The time
-	// value is encoded in UTC, as described in Section 1.3.3.
-	//
-	// Note that the time period specified by the optional NotBefore and
-	// NotOnOrAfter attributes, if present, SHOULD fall within the overall
-	// assertion validity period as specified by the element's NotBefore and
-	// NotOnOrAfter attributes. If both attributes are present, the value for
-	// NotBefore MUST be less than (earlier than) the value for NotOnOrAfter.
-	if validUntil := assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter; validUntil.Before(now.Add(-ClockDriftTolerance)) {
-		err := errors.Errorf("Assertion conditions already expired, got %v current time is %v", validUntil, now)
-		return nil, errors.Wrap(err, "Assertion conditions already expired")
-	}
-
-	// TODO: reenable?
-	// if assertion.Conditions != nil && assertion.Conditions.AudienceRestriction != nil {
-	//   if assertion.Conditions.AudienceRestriction.Audience.Value != sp.MetadataURL {
-	//     returnt.Errorf("Audience restriction mismatch, got %q, expected %q", assertion.Conditions.AudienceRestriction.Audience.Value, sp.MetadataURL), errors.New("Audience restriction mismatch")
-	//   }
-	// }
-
-	return assertion, nil
+	return nil
 }
 
 // Check if signature reference URI matches root element ID
@@ -0,0 +1,389 @@
+package saml
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pressly/saml/instrument"
+	"github.com/pressly/saml/xmlsec"
+)
+
+// ErrUnknownServiceProvider is returned by a ServiceProviderRegistry when it
+// has no metadata for the requested entity ID.
+var ErrUnknownServiceProvider = errors.New("unknown service provider")
+
+// ServiceProviderRegistry looks up the metadata of the service providers the
+// IdP trusts.
+type ServiceProviderRegistry interface {
+	// GetServiceProvider returns the metadata of the SP with the given entity
+	// ID, or ErrUnknownServiceProvider. The returned value is shared and must
+	// not be modified.
+	GetServiceProvider(ctx context.Context, entityID string) (*Metadata, error)
+}
+
+// MemoryServiceProviderRegistry is a ServiceProviderRegistry that keeps the
+// metadata of the SPs in memory. It is safe for concurrent use.
+type MemoryServiceProviderRegistry struct {
+	mu  sync.RWMutex
+	sps map[string]*Metadata
+}
+
+// NewMemoryServiceProviderRegistry returns a registry that holds the given
+// metadata.
+func NewMemoryServiceProviderRegistry(metadata ...*Metadata) *MemoryServiceProviderRegistry {
+	registry := &MemoryServiceProviderRegistry{}
+	for _, m := range metadata {
+		registry.Add(m)
+	}
+	return registry
+}
+
+// Add adds the metadata of a SP to the registry, replacing any metadata with
+// the same entity ID.
+func (registry *MemoryServiceProviderRegistry) Add(metadata *Metadata) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.sps == nil {
+		registry.sps = make(map[string]*Metadata)
+	}
+	registry.sps[metadata.EntityID] = metadata
+}
+
+// Remove removes the SP with the given entity ID from the registry.
+func (registry *MemoryServiceProviderRegistry) Remove(entityID string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.sps, entityID)
+}
+
+// GetServiceProvider implements ServiceProviderRegistry.
+func (registry *MemoryServiceProviderRegistry) GetServiceProvider(ctx context.Context, entityID string) (*Metadata, error) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	metadata, ok := registry.sps[entityID]
+	if !ok {
+		return nil, ErrUnknownServiceProvider
+	}
+	return metadata, nil
+}
+
+// replace swaps the content of the registry with the given metadata.
+func (registry *MemoryServiceProviderRegistry) replace(metadata []*Metadata) {
+	sps := make(map[string]*Metadata, len(metadata))
+	for _, m := range metadata {
+		sps[m.EntityID] = m
+	}
+	registry.mu.Lock()
+	registry.sps = sps
+	registry.mu.Unlock()
+}
+
+// DirectoryServiceProviderRegistry is a ServiceProviderRegistry that reads the
+// metadata of the SPs from the *.xml files of a directory. Each file holds
+// either an EntityDescriptor or an EntitiesDescriptor. It is safe for
+// concurrent use.
+type DirectoryServiceProviderRegistry struct {
+	// Directory holding the metadata files
+	Dir string
+
+	// Returns the current time, the package level Now is used if nil
+	Now func() time.Time
+
+	registry MemoryServiceProviderRegistry
+}
+
+// NewDirectoryServiceProviderRegistry returns a registry holding the metadata
+// found in dir.
+func NewDirectoryServiceProviderRegistry(dir string) (*DirectoryServiceProviderRegistry, error) {
+	registry := &DirectoryServiceProviderRegistry{Dir: dir}
+	if err := registry.Reload(); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// Reload reads the metadata files again. The registry is left untouched if any
+// of them cannot be read.
+func (registry *DirectoryServiceProviderRegistry) Reload() error {
+	files, err := filepath.Glob(filepath.Join(registry.Dir, "*.xml"))
+	if err != nil {
+		return errors.Wrap(err, "failed to list metadata files")
+	}
+
+	var metadata []*Metadata
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", file)
+		}
+		entities, err := parseServiceProviders(buf, registry.now())
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", file)
+		}
+		metadata = append(metadata, entities...)
+	}
+
+	registry.registry.replace(metadata)
+	return nil
+}
+
+// GetServiceProvider implements ServiceProviderRegistry.
+func (registry *DirectoryServiceProviderRegistry) GetServiceProvider(ctx context.Context, entityID string) (*Metadata, error) {
+	return registry.registry.GetServiceProvider(ctx, entityID)
+}
+
+func (registry *DirectoryServiceProviderRegistry) now() time.Time {
+	if registry.Now != nil {
+		return registry.Now()
+	}
+	return Now()
+}
+
+// defaultRefreshInterval is how long a metadata aggregate is cached when no
+// RefreshInterval is set.
+const defaultRefreshInterval = time.Hour
+
+// defaultAggregateClient fetches the metadata aggregates when no Client is
+// set. A slow server must not hold up the logins waiting for the aggregate.
+var defaultAggregateClient = &http.Client{Timeout: 30 * time.Second}
+
+// AggregateServiceProviderRegistry is a ServiceProviderRegistry that fetches
+// the metadata of the SPs from a URL serving an EntitiesDescriptor, as
+// published by federations, or a single EntityDescriptor. The aggregate must
+// be signed, its signature is checked against the certificate given by
+// CertFile or CertPEM before any of its metadata is trusted.
+//
+// The metadata is fetched on first use and refreshed once RefreshInterval has
+// elapsed. A single fetch runs at a time, lookups keep using the previous
+// metadata meanwhile and if the refresh fails. It is safe for concurrent use.
+type AggregateServiceProviderRegistry struct {
+	// URL of the metadata aggregate
+	URL string
+
+	// File system location of the certificate the aggregate is signed with
+	CertFile string
+
+	// Certificate the aggregate is signed with can also be provided as a param
+	CertPEM string
+
+	SecurityOpts
+
+	// HTTP client used to fetch the aggregate, a client giving up after 30
+	// seconds if nil
+	Client *http.Client
+
+	// How long the aggregate is cached, one hour if zero
+	RefreshInterval time.Duration
+
+	// Returns the current time, the package level Now is used if nil
+	Now func() time.Time
+
+	// Receives the metrics and traces of the fetches, and the metrics of the
+	// signature checks of xmlsec1, nothing is reported if nil
+	Instrumentation instrument.Instrumentation
+
+	mu        sync.Mutex
+	fetchedAt time.Time
+	fetching  chan struct{}
+	fetchErr  error
+	registry  MemoryServiceProviderRegistry
+}
+
+// GetServiceProvider implements ServiceProviderRegistry.
+func (registry *AggregateServiceProviderRegistry) GetServiceProvider(ctx context.Context, entityID string) (*Metadata, error) {
+	if err := registry.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return registry.registry.GetServiceProvider(ctx, entityID)
+}
+
+func (registry *AggregateServiceProviderRegistry) now() time.Time {
+	if registry.Now != nil {
+		return registry.Now()
+	}
+	return Now()
+}
+
+// refresh fetches the aggregate if it was never fetched or is stale. Only the
+// first caller fetches it, outside of the lock; the others use the previous
+// metadata or, if there is none yet, wait for the fetch to complete.
+func (registry *AggregateServiceProviderRegistry) refresh(ctx context.Context) error {
+	registry.mu.Lock()
+	interval := registry.RefreshInterval
+	if interval == 0 {
+		interval = defaultRefreshInterval
+	}
+	loaded := !registry.fetchedAt.IsZero()
+	if loaded && registry.now().Before(registry.fetchedAt.Add(interval)) {
+		registry.mu.Unlock()
+		return nil
+	}
+	if fetching := registry.fetching; fetching != nil {
+		registry.mu.Unlock()
+		if loaded {
+			return nil
+		}
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		if registry.fetchedAt.IsZero() {
+			return registry.fetchErr
+		}
+		return nil
+	}
+	fetching := make(chan struct{})
+	registry.fetching = fetching
+	registry.mu.Unlock()
+
+	// The fetch is shared with the lookups waiting for it, so it is not
+	// canceled along with the context of this one.
+	_, stage := startStage(ctx, instrument.Or(registry.Instrumentation), "saml.FetchMetadata",
+		instrument.MetadataFetchDuration, instrument.L(instrument.LabelSource, "sp_aggregate"))
+	metadata, err := registry.fetch(context.Background())
+	stage.end(err)
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.fetching = nil
+	registry.fetchErr = err
+	close(fetching)
+	if err != nil {
+		if !loaded {
+			return err
+		}
+		// Keep the stale metadata, the next refresh is due after interval.
+		registry.fetchedAt = registry.now()
+		return nil
+	}
+
+	registry.registry.replace(metadata)
+	registry.fetchedAt = registry.now()
+	return nil
+}
+
+func (registry *AggregateServiceProviderRegistry) fetch(ctx context.Context) ([]*Metadata, error) {
+	certFile, err := registry.certFile()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, registry.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build metadata request")
+	}
+
+	client := registry.Client
+	if client == nil {
+		client = defaultAggregateClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get url: %v", registry.URL)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to get url: %v: %s", registry.URL, res.Status)
+	}
+
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read body from url: %v", registry.URL)
+	}
+
+	cmd := &xmlsec.Command{Instrumentation: registry.Instrumentation}
+	if err := verifyMetadataSignature(cmd, buf, certFile, &registry.SecurityOpts); err != nil {
+		return nil, errors.Wrapf(err, "failed to verify metadata from url: %v", registry.URL)
+	}
+
+	return parseServiceProviders(buf, registry.now())
+}
+
+// certFile returns a physical path where the certificate the aggregate is
+// signed with can be accessed.
+func (registry *AggregateServiceProviderRegistry) certFile() (string, error) {
+	if registry.CertFile != "" {
+		return registry.CertFile, nil
+	}
+	if registry.CertPEM != "" {
+		return writeFile(WorkDir, []byte(registry.CertPEM))
+	}
+	return "", errors.New("missing metadata signing certificate")
+}
+
+// signedMetadata holds the signature of the root element of a metadata
+// document, whether an EntitiesDescriptor or an EntityDescriptor.
+type signedMetadata struct {
+	ID        string            `xml:"ID,attr"`
+	Signature *xmlsec.Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+}
+
+// verifyMetadataSignature checks, with the given xmlsec1 command, the
+// metadata document in buf carries a signature covering its root element,
+// made with the key of the certificate at certFile.
+func verifyMetadataSignature(cmd *xmlsec.Command, buf []byte, certFile string, opts *SecurityOpts) error {
+	var signed signedMetadata
+	if err := xml.Unmarshal(buf, &signed); err != nil {
+		return errors.Wrap(err, "failed to unmarshal metadata")
+	}
+	if signed.Signature == nil {
+		return errors.New("missing metadata signature")
+	}
+	// The signature must cover the whole document and not some other
+	// element of it.
+	if signed.ID == "" || signed.Signature.Reference.URI != "#"+signed.ID {
+		return errors.Errorf("signature references %q instead of the metadata", signed.Signature.Reference.URI)
+	}
+
+	err := cmd.Verify(buf, certFile, &xmlsec.ValidationOptions{
+		EnableIDAttrHack: true,
+		IDAttrs: []string{
+			"urn:oasis:names:tc:SAML:2.0:metadata:EntitiesDescriptor",
+			"urn:oasis:names:tc:SAML:2.0:metadata:EntityDescriptor",
+		},
+	})
+	if err != nil && IsSecurityException(err, opts) {
+		return err
+	}
+	return nil
+}
+
+// parseServiceProviders returns the SPs described by an EntitiesDescriptor
+// or an EntityDescriptor. Entities without a SPSSODescriptor or whose
+// validUntil has passed at now are left out.
+func parseServiceProviders(buf []byte, now time.Time) ([]*Metadata, error) {
+	var entities []*Metadata
+
+	var entitiesDescriptor EntitiesDescriptor
+	if err := xml.Unmarshal(buf, &entitiesDescriptor); err == nil {
+		entities = entitiesDescriptor.EntityDescriptor
+	} else {
+		var metadata Metadata
+		if err := xml.Unmarshal(buf, &metadata); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal metadata")
+		}
+		entities = []*Metadata{&metadata}
+	}
+
+	var sps []*Metadata
+	for _, metadata := range entities {
+		if metadata.SPSSODescriptor == nil {
+			continue
+		}
+		if !metadata.ValidUntil.IsZero() && now.After(metadata.ValidUntil) {
+			continue
+		}
+		sps = append(sps, metadata)
+	}
+	return sps, nil
+}
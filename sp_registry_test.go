@@ -0,0 +1,235 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pressly/saml/xmlsec"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSPMetadata(t *testing.T, entityID string) *Metadata {
+	sp := *testSP
+	sp.MetadataURL = entityID
+	metadata, err := sp.Metadata()
+	assert.NoError(t, err)
+	return metadata
+}
+
+func TestMemoryServiceProviderRegistry(t *testing.T) {
+	tearUp()
+
+	ctx := context.Background()
+	registry := NewMemoryServiceProviderRegistry(testSPMetadata(t, "https://sp1.example.org"))
+	registry.Add(testSPMetadata(t, "https://sp2.example.org"))
+
+	metadata, err := registry.GetServiceProvider(ctx, "https://sp2.example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp2.example.org", metadata.EntityID)
+
+	registry.Remove("https://sp1.example.org")
+	_, err = registry.GetServiceProvider(ctx, "https://sp1.example.org")
+	assert.Equal(t, ErrUnknownServiceProvider, err)
+}
+
+func TestDirectoryServiceProviderRegistry(t *testing.T) {
+	tearUp()
+
+	dir, err := ioutil.TempDir("", "saml-sp-registry")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	buf, err := xml.Marshal(testSPMetadata(t, "https://sp1.example.org"))
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sp1.xml"), buf, 0600))
+
+	buf, err = xml.Marshal(&EntitiesDescriptor{
+		EntityDescriptor: []*Metadata{
+			testSPMetadata(t, "https://sp2.example.org"),
+			testSPMetadata(t, "https://sp3.example.org"),
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "federation.xml"), buf, 0600))
+
+	registry, err := NewDirectoryServiceProviderRegistry(dir)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	for _, entityID := range []string{"https://sp1.example.org", "https://sp2.example.org", "https://sp3.example.org"} {
+		metadata, err := registry.GetServiceProvider(ctx, entityID)
+		assert.NoError(t, err)
+		if assert.NotNil(t, metadata) {
+			assert.Equal(t, entityID, metadata.EntityID)
+		}
+	}
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, "sp1.xml")))
+	assert.NoError(t, registry.Reload())
+	_, err = registry.GetServiceProvider(ctx, "https://sp1.example.org")
+	assert.Equal(t, ErrUnknownServiceProvider, err)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "broken.xml"), []byte("<nope"), 0600))
+	assert.Error(t, registry.Reload())
+	_, err = registry.GetServiceProvider(ctx, "https://sp2.example.org")
+	assert.NoError(t, err)
+
+	// Metadata past its validUntil is dropped on reload.
+	assert.NoError(t, os.Remove(filepath.Join(dir, "broken.xml")))
+	registry.Now = func() time.Time {
+		return Now().Add(defaultValidDuration + time.Minute)
+	}
+	assert.NoError(t, registry.Reload())
+	_, err = registry.GetServiceProvider(ctx, "https://sp2.example.org")
+	assert.Equal(t, ErrUnknownServiceProvider, err)
+}
+
+// signedAggregate returns an EntitiesDescriptor holding the given metadata,
+// signed with the key of testSP.
+func signedAggregate(t *testing.T, metadata ...*Metadata) []byte {
+	signature := xmlsec.NewSignature([]byte(testSP.PubkeyPEM), xmlsec.SignatureRSASHA256, xmlsec.DigestSHA256)
+	signature.Reference.URI = "#federation"
+	buf, err := xml.Marshal(&EntitiesDescriptor{
+		ID:               "federation",
+		Signature:        &signature,
+		EntityDescriptor: metadata,
+	})
+	assert.NoError(t, err)
+
+	keyFile, err := testSP.PrivkeyFile()
+	assert.NoError(t, err)
+	buf, err = xmlsec.Sign(buf, keyFile, &xmlsec.ValidationOptions{
+		EnableIDAttrHack: true,
+		IDAttrs:          []string{"urn:oasis:names:tc:SAML:2.0:metadata:EntitiesDescriptor"},
+	})
+	if _, ok := err.(xmlsec.ErrSelfSignedCertificate); !ok {
+		assert.NoError(t, err)
+	}
+	return buf
+}
+
+func TestAggregateServiceProviderRegistry(t *testing.T) {
+	requireXMLSec1(t)
+	tearUp()
+
+	expired := testSPMetadata(t, "https://expired.example.org")
+	expired.ValidUntil = Now().Add(-time.Minute)
+	buf := signedAggregate(t, testSPMetadata(t, "https://sp1.example.org"), expired)
+
+	var mu sync.Mutex
+	fetches := 0
+	available := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(buf)
+	}))
+	defer server.Close()
+
+	now := Now()
+	registry := &AggregateServiceProviderRegistry{
+		URL:             server.URL,
+		CertPEM:         testSP.PubkeyPEM,
+		RefreshInterval: time.Minute,
+		Now: func() time.Time {
+			return now
+		},
+		SecurityOpts: SecurityOpts{AllowSelfSignedCert: true},
+	}
+
+	ctx := context.Background()
+	metadata, err := registry.GetServiceProvider(ctx, "https://sp1.example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp1.example.org", metadata.EntityID)
+
+	_, err = registry.GetServiceProvider(ctx, "https://expired.example.org")
+	assert.Equal(t, ErrUnknownServiceProvider, err)
+	assert.Equal(t, 1, fetches)
+
+	// Once stale the aggregate is fetched again, failures keep the previous
+	// metadata around.
+	now = now.Add(2 * time.Minute)
+	mu.Lock()
+	available = false
+	mu.Unlock()
+	_, err = registry.GetServiceProvider(ctx, "https://sp1.example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+
+	// A tampered aggregate is rejected.
+	tampered := &AggregateServiceProviderRegistry{
+		URL:          server.URL,
+		CertPEM:      testSP.PubkeyPEM,
+		SecurityOpts: SecurityOpts{AllowSelfSignedCert: true},
+	}
+	mu.Lock()
+	available = true
+	buf = bytes.Replace(buf, []byte("https://sp1.example.org"), []byte("https://evil.example.org"), -1)
+	mu.Unlock()
+	_, err = tampered.GetServiceProvider(ctx, "https://evil.example.org")
+	assert.Error(t, err)
+}
+
+func TestAggregateServiceProviderRegistryUnsigned(t *testing.T) {
+	tearUp()
+
+	buf, err := xml.Marshal(&EntitiesDescriptor{
+		EntityDescriptor: []*Metadata{testSPMetadata(t, "https://sp1.example.org")},
+	})
+	assert.NoError(t, err)
+
+	fetched := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched <- struct{}{}
+		<-release
+		w.Write(buf)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	// The aggregate is the trust root of the SPs, it is never used unless
+	// signed.
+	unverifiable := &AggregateServiceProviderRegistry{URL: server.URL}
+	_, err = unverifiable.GetServiceProvider(ctx, "https://sp1.example.org")
+	assert.Error(t, err)
+
+	registry := &AggregateServiceProviderRegistry{
+		URL:     server.URL,
+		CertPEM: testSP.PubkeyPEM,
+	}
+	errs := make(chan error)
+	go func() {
+		_, err := registry.GetServiceProvider(ctx, "https://sp1.example.org")
+		errs <- err
+	}()
+	<-fetched
+
+	// Lookups do not start another fetch while one is running, and give up
+	// along with their context.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = registry.GetServiceProvider(timeoutCtx, "https://sp1.example.org")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(release)
+	err = <-errs
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing metadata signature")
+	}
+}
@@ -0,0 +1,127 @@
+package saml
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Top-level status codes of a Response.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.2.2.2
+const (
+	StatusRequester       = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	StatusResponder       = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+	StatusVersionMismatch = "urn:oasis:names:tc:SAML:2.0:status:VersionMismatch"
+)
+
+// Second-level status codes of a Response.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf section 3.2.2.2
+const (
+	StatusAuthnFailed              = "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"
+	StatusInvalidAttrNameOrValue   = "urn:oasis:names:tc:SAML:2.0:status:InvalidAttrNameOrValue"
+	StatusInvalidNameIDPolicy      = "urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy"
+	StatusNoAuthnContext           = "urn:oasis:names:tc:SAML:2.0:status:NoAuthnContext"
+	StatusNoAvailableIDP           = "urn:oasis:names:tc:SAML:2.0:status:NoAvailableIDP"
+	StatusNoPassive                = "urn:oasis:names:tc:SAML:2.0:status:NoPassive"
+	StatusNoSupportedIDP           = "urn:oasis:names:tc:SAML:2.0:status:NoSupportedIDP"
+	StatusPartialLogout            = "urn:oasis:names:tc:SAML:2.0:status:PartialLogout"
+	StatusProxyCountExceeded       = "urn:oasis:names:tc:SAML:2.0:status:ProxyCountExceeded"
+	StatusRequestDenied            = "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"
+	StatusRequestUnsupported       = "urn:oasis:names:tc:SAML:2.0:status:RequestUnsupported"
+	StatusRequestVersionDeprecated = "urn:oasis:names:tc:SAML:2.0:status:RequestVersionDeprecated"
+	StatusRequestVersionTooHigh    = "urn:oasis:names:tc:SAML:2.0:status:RequestVersionTooHigh"
+	StatusRequestVersionTooLow     = "urn:oasis:names:tc:SAML:2.0:status:RequestVersionTooLow"
+	StatusResourceNotRecognized    = "urn:oasis:names:tc:SAML:2.0:status:ResourceNotRecognized"
+	StatusTooManyResponses         = "urn:oasis:names:tc:SAML:2.0:status:TooManyResponses"
+	StatusUnknownAttrProfile       = "urn:oasis:names:tc:SAML:2.0:status:UnknownAttrProfile"
+	StatusUnknownPrincipal         = "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal"
+	StatusUnsupportedBinding       = "urn:oasis:names:tc:SAML:2.0:status:UnsupportedBinding"
+)
+
+// StatusError is an error the IdP reports to the SP with a Response carrying a
+// non-success status instead of an assertion.
+type StatusError struct {
+	// Top-level status code, such as StatusRequester
+	Code string
+
+	// Optional second-level status code, such as StatusUnsupportedBinding
+	SubCode string
+
+	// Optional message, sent to the SP as the StatusMessage
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	code := e.Code
+	if e.SubCode != "" {
+		code += " " + e.SubCode
+	}
+	if e.Message == "" {
+		return code
+	}
+	return fmt.Sprintf("%s: %s", code, e.Message)
+}
+
+// Status returns the Status element describing the error.
+func (e *StatusError) Status() *Status {
+	status := &Status{
+		StatusCode: StatusCode{
+			Value: e.Code,
+		},
+		StatusMessage: e.Message,
+	}
+	if e.SubCode != "" {
+		status.StatusCode.StatusCode = &StatusCode{
+			Value: e.SubCode,
+		}
+	}
+	return status
+}
+
+// statusError returns the *StatusError described by a Status element.
+func statusError(status *Status) *StatusError {
+	err := &StatusError{
+		Code:    status.StatusCode.Value,
+		Message: status.StatusMessage,
+	}
+	if status.StatusCode.StatusCode != nil {
+		err.SubCode = status.StatusCode.StatusCode.Value
+	}
+	return err
+}
+
+// NewAuthnFailedError returns the error reported when the IdP could not
+// authenticate the principal.
+func NewAuthnFailedError(message string) *StatusError {
+	return &StatusError{Code: StatusResponder, SubCode: StatusAuthnFailed, Message: message}
+}
+
+// NewNoPassiveError returns the error reported when the principal cannot be
+// authenticated without interacting with them while the request is passive.
+func NewNoPassiveError(message string) *StatusError {
+	return &StatusError{Code: StatusResponder, SubCode: StatusNoPassive, Message: message}
+}
+
+// NewRequestDeniedError returns the error reported when the IdP chooses not to
+// respond to a request, for instance because the principal may not access the
+// SP.
+func NewRequestDeniedError(message string) *StatusError {
+	return &StatusError{Code: StatusResponder, SubCode: StatusRequestDenied, Message: message}
+}
+
+// NewRequestUnsupportedError returns the error reported when the IdP does not
+// support the request.
+func NewRequestUnsupportedError(message string) *StatusError {
+	return &StatusError{Code: StatusResponder, SubCode: StatusRequestUnsupported, Message: message}
+}
+
+// authnStatusError returns the *StatusError that caused err or, if there is
+// none, an AuthnFailed error that does not leak the details of err to the SP.
+func authnStatusError(err error) *StatusError {
+	if statusErr, ok := errors.Cause(err).(*StatusError); ok {
+		return statusErr
+	}
+	return NewAuthnFailedError("")
+}
@@ -1,5 +1,9 @@
 package xmlsec
 
+import (
+	"fmt"
+)
+
 // EncryptedData represents the <EncryptedData> XML tag. See
 // https://www.w3.org/TR/2002/REC-xmlenc-core-20021210/Overview.html#sec-Usage
 type EncryptedData struct {
@@ -23,20 +27,69 @@ type KeyInfo struct {
 // EncryptedKey represents the <EncryptedKey> XML element. See
 // https://www.w3.org/TR/2002/REC-xmlenc-core-20021210/Overview.html#sec-EncryptedKey
 type EncryptedKey struct {
-	EncryptionMethod Method `xml:"EncryptionMethod"`
+	EncryptionMethod KeyEncryptionMethod `xml:"EncryptionMethod"`
 	KeyInfo          struct {
 		X509Data string
 	} `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
 	CipherData CipherData `xml:"http://www.w3.org/2001/04/xmlenc# CipherData"`
 }
 
+// KeyEncryptionMethod represents the <EncryptionMethod> tag of an
+// <EncryptedKey>, which may carry the digest and mask generation function used
+// by RSA-OAEP. See https://www.w3.org/TR/xmlenc-core1/#sec-RSA-OAEP
+type KeyEncryptionMethod struct {
+	Algorithm    string  `xml:",attr"`
+	DigestMethod *Method `xml:"http://www.w3.org/2000/09/xmldsig# DigestMethod,omitempty"`
+	MGF          *Method `xml:"http://www.w3.org/2009/xmlenc11# MGF,omitempty"`
+}
+
+// Block encryption algorithms.
+const (
+	AES128CBC = "http://www.w3.org/2001/04/xmlenc#aes128-cbc"
+	AES192CBC = "http://www.w3.org/2001/04/xmlenc#aes192-cbc"
+	AES256CBC = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	AES128GCM = "http://www.w3.org/2009/xmlenc11#aes128-gcm"
+	AES256GCM = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+)
+
+// Key transport algorithms. RSAOAEP, and digests other than SHA-1, need
+// xmlsec1 1.3 or later.
+const (
+	RSAOAEPMGF1P = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+	RSAOAEP      = "http://www.w3.org/2009/xmlenc11#rsa-oaep"
+)
+
+// Mask generation functions of RSAOAEP. MGF1SHA1 is used unless another one
+// is given.
+const (
+	MGF1SHA1   = "http://www.w3.org/2009/xmlenc11#mgf1sha1"
+	MGF1SHA256 = "http://www.w3.org/2009/xmlenc11#mgf1sha256"
+	MGF1SHA512 = "http://www.w3.org/2009/xmlenc11#mgf1sha512"
+)
+
 const (
-	defaultDataEncryptionMethodAlgorithm = "http://www.w3.org/2001/04/xmlenc#aes128-cbc"
-	defaultKeyEncryptionMethodAlgorithm  = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+	defaultDataEncryptionMethodAlgorithm = AES128CBC
+	defaultKeyEncryptionMethodAlgorithm  = RSAOAEPMGF1P
 )
 
+// SessionKey returns the session key parameter xmlsec1 needs to encrypt data
+// with the given block encryption algorithm.
+func SessionKey(dataEncryptionMethodAlgorithm string) (string, error) {
+	switch dataEncryptionMethodAlgorithm {
+	case AES128CBC, AES128GCM:
+		return "aes-128", nil
+	case AES192CBC:
+		return "aes-192", nil
+	case AES256CBC, AES256GCM:
+		return "aes-256", nil
+	}
+	return "", fmt.Errorf("unsupported encryption algorithm %q", dataEncryptionMethodAlgorithm)
+}
+
 // NewEncryptedDataTemplate returns an EncryptedData object that uses the given
-// data and key encryption algorithms.
+// data and key encryption algorithms. RSA-OAEP uses the default SHA-1 digest
+// and mask generation function; set the DigestMethod and MGF of the
+// EncryptionMethod of the EncryptedKey to use others.
 func NewEncryptedDataTemplate(dataEncryptionMethodAlgorithm string, keyEncryptionMethodAlgorithm string) *EncryptedData {
 	return &EncryptedData{
 		Type: "http://www.w3.org/2001/04/xmlenc#Element",
@@ -45,7 +98,7 @@ func NewEncryptedDataTemplate(dataEncryptionMethodAlgorithm string, keyEncryptio
 		},
 		KeyInfo: KeyInfo{
 			EncryptedKey: EncryptedKey{
-				EncryptionMethod: Method{
+				EncryptionMethod: KeyEncryptionMethod{
 					Algorithm: keyEncryptionMethodAlgorithm,
 				},
 			},
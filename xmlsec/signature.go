@@ -72,8 +72,30 @@ type SignatureX509Data struct {
 	X509Certificate string `xml:"X509Certificate,omitempty"`
 }
 
-// DefaultSignature returns a Signature struct that uses the default c14n and SHA1 settings.
+// Signature algorithms.
+const (
+	SignatureRSASHA1     = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	SignatureRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	SignatureRSASHA512   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	SignatureECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+)
+
+// Digest algorithms.
+const (
+	DigestSHA1   = "http://www.w3.org/2000/09/xmldsig#sha1"
+	DigestSHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+	DigestSHA512 = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+// DefaultSignature returns a Signature struct that uses the default c14n and
+// RSA-SHA256 settings.
 func DefaultSignature(pemEncodedPublicKey []byte) Signature {
+	return NewSignature(pemEncodedPublicKey, SignatureRSASHA256, DigestSHA256)
+}
+
+// NewSignature returns a Signature struct that uses the default c14n and the
+// given signature and digest algorithms.
+func NewSignature(pemEncodedPublicKey []byte, signatureMethodAlgorithm, digestMethodAlgorithm string) Signature {
 	// xmlsec wants the key to be base64-encoded but *not* wrapped with the
 	// PEM flags
 	pemBlock, _ := pem.Decode(pemEncodedPublicKey)
@@ -84,14 +106,14 @@ func DefaultSignature(pemEncodedPublicKey []byte) Signature {
 			Algorithm: "http://www.w3.org/TR/2001/REC-xml-c14n-20010315",
 		},
 		SignatureMethod: Method{
-			Algorithm: "http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+			Algorithm: signatureMethodAlgorithm,
 		},
 		Reference: Reference{
 			Transforms: []Method{
 				{Algorithm: "http://www.w3.org/2000/09/xmldsig#enveloped-signature"},
 			},
 			DigestMethod: Method{
-				Algorithm: "http://www.w3.org/2000/09/xmldsig#sha1",
+				Algorithm: digestMethodAlgorithm,
 			},
 		},
 		X509Certificate: &SignatureX509Data{
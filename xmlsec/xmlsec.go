@@ -5,12 +5,17 @@ package xmlsec
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
+
+	"github.com/pressly/saml/instrument"
 )
 
 const (
@@ -19,6 +24,69 @@ const (
 	attrNameAuthnRequest = `urn:oasis:names:tc:SAML:2.0:protocol:AuthnRequest`
 )
 
+// Command runs the xmlsec1 command and reports its invocations. The zero
+// value is ready to use. The package level functions use a zero Command.
+type Command struct {
+	// Receives the debug logs of the invocations: the operation, the size of
+	// its input, its duration and its outcome. Documents and keys are never
+	// logged. slog.Default() is used if nil.
+	Logger *slog.Logger
+
+	// Receives the metrics of the invocations, see instrument.XMLSecDuration
+	// and instrument.XMLSecFailures. Nothing is reported if nil.
+	Instrumentation instrument.Instrumentation
+}
+
+// report logs the outcome of the xmlsec1 operation started at start, and
+// records its metrics.
+func (c *Command) report(op string, start time.Time, size int, err error) {
+	duration := time.Since(start)
+
+	in := instrument.Or(c.Instrumentation)
+	in.Observe(instrument.XMLSecDuration, duration.Seconds(),
+		instrument.L(instrument.LabelOperation, op),
+		instrument.Result(err))
+	if err != nil {
+		in.Count(instrument.XMLSecFailures, 1,
+			instrument.L(instrument.LabelOperation, op),
+			instrument.L(instrument.LabelReason, failureReason(err)))
+	}
+
+	logger := c.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	attrs := []slog.Attr{
+		slog.Int("size", size),
+		slog.Duration("duration", duration),
+	}
+	if err != nil {
+		attrs = append(attrs,
+			slog.String("reason", failureReason(err)),
+			slog.String("error", err.Error()))
+	}
+	logger.LogAttrs(context.Background(), slog.LevelDebug, "xmlsec1 "+op, attrs...)
+}
+
+// failureReason classifies the error of a failed xmlsec1 invocation for the
+// instrument.XMLSecFailures metric.
+func failureReason(err error) string {
+	switch err.(type) {
+	case ErrValidityError:
+		return "validity"
+	case ErrSelfSignedCertificate:
+		return "self_signed_certificate"
+	case ErrUnknownIssuer:
+		return "unknown_issuer"
+	case *exec.Error:
+		return "exec"
+	}
+	if strings.Contains(err.Error(), "signature failed") {
+		return "signature"
+	}
+	return "other"
+}
+
 type ValidationOptions struct {
 	DTDFile          string
 	EnableIDAttrHack bool
@@ -61,6 +129,15 @@ func (e ErrValidityError) Error() string {
 // Encrypt encrypts a byte sequence into an EncryptedData template using the
 // given certificate and encryption method.
 func Encrypt(template *EncryptedData, in []byte, publicCertPath string, method string) ([]byte, error) {
+	var c Command
+	return c.Encrypt(template, in, publicCertPath, method)
+}
+
+// Encrypt encrypts a byte sequence into an EncryptedData template using the
+// given certificate and encryption method.
+func (c *Command) Encrypt(template *EncryptedData, in []byte, publicCertPath string, method string) (_ []byte, err error) {
+	defer func(start time.Time) { c.report("encrypt", start, len(in), err) }(time.Now())
+
 	// Writing template.
 	fp, err := ioutil.TempFile("/tmp", "xmlsec")
 	if err != nil {
@@ -142,6 +219,15 @@ func Encrypt(template *EncryptedData, in []byte, publicCertPath string, method s
 // Decrypt takes an encrypted XML document and decrypts it using the given
 // private key.
 func Decrypt(in []byte, privateKeyPath string) ([]byte, error) {
+	var c Command
+	return c.Decrypt(in, privateKeyPath)
+}
+
+// Decrypt takes an encrypted XML document and decrypts it using the given
+// private key.
+func (c *Command) Decrypt(in []byte, privateKeyPath string) (_ []byte, err error) {
+	defer func(start time.Time) { c.report("decrypt", start, len(in), err) }(time.Now())
+
 	// Executing command.
 	cmd := exec.Command("xmlsec1", "--decrypt",
 		"--privkey-pem", privateKeyPath,
@@ -201,6 +287,13 @@ func Decrypt(in []byte, privateKeyPath string) ([]byte, error) {
 
 // Verify takes a signed XML document and validates its signature.
 func Verify(in []byte, publicCertPath string, opts *ValidationOptions) error {
+	var c Command
+	return c.Verify(in, publicCertPath, opts)
+}
+
+// Verify takes a signed XML document and validates its signature.
+func (c *Command) Verify(in []byte, publicCertPath string, opts *ValidationOptions) (err error) {
+	defer func(start time.Time) { c.report("verify", start, len(in), err) }(time.Now())
 
 	args := []string{
 		"xmlsec1", "--verify",
@@ -247,8 +340,8 @@ func Verify(in []byte, publicCertPath string, opts *ValidationOptions) error {
 		return err
 	}
 
-	res, err := ioutil.ReadAll(outbr)
-	if err != nil {
+	// The outcome of the verification is reported on stderr.
+	if _, err := ioutil.ReadAll(outbr); err != nil {
 		return err
 	}
 
@@ -259,7 +352,7 @@ func Verify(in []byte, publicCertPath string, opts *ValidationOptions) error {
 
 	if err := cmd.Wait(); err != nil || isValidityError(resErr) {
 		if len(resErr) > 0 {
-			return xmlsecErr(string(res) + "\n" + string(resErr))
+			return xmlsecErr(string(resErr))
 		}
 		return err
 	}
@@ -268,7 +361,14 @@ func Verify(in []byte, publicCertPath string, opts *ValidationOptions) error {
 }
 
 // Sign takes a XML document and produces a signature.
-func Sign(in []byte, privateKeyPath string, opts *ValidationOptions) (out []byte, err error) {
+func Sign(in []byte, privateKeyPath string, opts *ValidationOptions) ([]byte, error) {
+	var c Command
+	return c.Sign(in, privateKeyPath, opts)
+}
+
+// Sign takes a XML document and produces a signature.
+func (c *Command) Sign(in []byte, privateKeyPath string, opts *ValidationOptions) (out []byte, err error) {
+	defer func(start time.Time) { c.report("sign", start, len(in), err) }(time.Now())
 
 	args := []string{
 		"xmlsec1", "--sign",
@@ -327,7 +427,7 @@ func Sign(in []byte, privateKeyPath string, opts *ValidationOptions) (out []byte
 
 	if err := cmd.Wait(); err != nil || isValidityError(resErr) {
 		if len(resErr) > 0 {
-			return res, xmlsecErr(string(res) + "\n" + string(resErr))
+			return res, xmlsecErr(string(resErr))
 		}
 		return nil, err
 	}
@@ -335,8 +435,11 @@ func Sign(in []byte, privateKeyPath string, opts *ValidationOptions) (out []byte
 	return res, nil
 }
 
+// xmlsecErr returns the error reported by xmlsec1 on stderr, nil if it
+// succeeded. The excerpts of the document libxml2 prints along with its
+// errors are left out, so that the error can be logged.
 func xmlsecErr(s string) error {
-	err := fmt.Errorf("xmlsec: %s", strings.TrimSpace(s))
+	err := fmt.Errorf("xmlsec: %s", strings.TrimSpace(stripExcerpts(s)))
 	if strings.HasPrefix(s, "OK") {
 		return nil
 	}
@@ -355,6 +458,22 @@ func xmlsecErr(s string) error {
 	return err
 }
 
+// stripExcerpts removes from the output of xmlsec1 the excerpts of the
+// document libxml2 prints under its errors: each is a line followed by a
+// line pointing at the error with a caret.
+func stripExcerpts(s string) string {
+	lines := strings.Split(s, "\n")
+	kept := lines[:0]
+	for i := 0; i < len(lines); i++ {
+		if i+1 < len(lines) && strings.TrimSpace(lines[i+1]) == "^" {
+			i++
+			continue
+		}
+		kept = append(kept, lines[i])
+	}
+	return strings.Join(kept, "\n")
+}
+
 func isValidityError(output []byte) bool {
 	return bytes.Contains(output, []byte("validity error"))
 }
@@ -1,10 +1,13 @@
 package xmlsec
 
 import (
+	"bytes"
 	"encoding/xml"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -178,7 +181,7 @@ func TestSignAndVerifyNode(t *testing.T) {
 		Signature Signature
 	}
 
-	e := Envelope{Person: *person, Signature: DefaultSignature(crt)}
+	e := Envelope{Person: *person, Signature: NewSignature(crt, SignatureRSASHA1, DigestSHA1)}
 
 	xmlDoc, err := xml.Marshal(e)
 
@@ -207,3 +210,20 @@ h5BC02ePIIwd58lPjdsQUrgetVnDh3DyuKtMqufVmNw=</SignatureValue><KeyInfo><X509Data>
 
 	assert.Equal(t, string(expectedOut), string(out))
 }
+
+func TestErrorLeavesDocumentOut(t *testing.T) {
+	stderr := `/dev/stdin:1: validity error : ID _123 already defined
+<samlp:Response ID="_123"><saml:AttributeValue>anakin@example.org</saml:AttributeValue>
+                          ^
+`
+	err := xmlsecErr(stderr)
+	assert.IsType(t, ErrValidityError{}, err)
+	assert.Contains(t, err.Error(), "ID _123 already defined")
+	assert.NotContains(t, err.Error(), "anakin")
+
+	var logs bytes.Buffer
+	c := &Command{Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	c.report("verify", time.Now(), 42, err)
+	assert.Contains(t, logs.String(), "reason=validity")
+	assert.NotContains(t, logs.String(), "anakin")
+}